@@ -7,6 +7,7 @@
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"expvar"
@@ -19,9 +20,11 @@
 	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"go4.org/mem"
@@ -29,6 +32,7 @@
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	_ "tailscale.com/derp/derpzstd" // for --zstd-threshold
 	"tailscale.com/metrics"
 	"tailscale.com/net/stun"
 	"tailscale.com/tsweb"
@@ -48,14 +52,52 @@
 	runSTUN    = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
 	runDERP    = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
 
-	meshPSKFile    = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
+	meshPSKFile    = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed. To rotate the key, it may list several whitespace-separated keys, primary first, all of which are accepted; it's reread on SIGHUP.")
 	meshWith       = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshDiscover   = flag.String("mesh-discover", "", "optional DNS name to periodically resolve for hosts to mesh with, in addition to --mesh-with. Its SRV records are used if it has any, otherwise its A/AAAA records, connecting to each address on port 443 using the name for TLS. The server's own address can be in the set.")
+	meshGossip     = flag.Int("mesh-gossip-fanout", 0, "if non-zero, instead of watching the connections of every --mesh-with server, subscribe to the peer maps of this many of them, which relay the maps of the rest; for large meshes. All servers in the mesh must use it.")
+	meshDiscoverIv = flag.Duration("mesh-discover-interval", time.Minute, "how often to resolve --mesh-discover for changes to the mesh")
+	meshBackoff    = flag.Duration("mesh-reconnect-backoff", 0, "if non-zero, how long to wait before reconnecting to a mesh peer after a failure, doubling with each consecutive failure up to --mesh-reconnect-backoff-max, instead of retrying every 5s")
+	meshBackoffMax = flag.Duration("mesh-reconnect-backoff-max", time.Minute, "the longest wait before reconnecting to a mesh peer, with --mesh-reconnect-backoff")
+	meshSnapshotIv = flag.Duration("mesh-snapshot-interval", 0, "if non-zero, how often to send mesh peers watching this server's connections a snapshot of all of them, so they can correct any missed updates")
+	adminTokenFile = flag.String("admin-token-file", "", "if non-empty, path to file containing a secret token granting access to the DERP admin API (in addition to the mesh key); whitespace is trimmed.")
 	bootstrapDNS   = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	unpublishedDNS = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list")
 	verifyClients  = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientPacketRate = flag.Float64("client-packet-rate-limit", 0, "if non-zero, per-client rate limit of packets per second relayed from each non-mesh client")
+	clientByteRate   = flag.Float64("client-byte-rate-limit", 0, "if non-zero, per-client rate limit of bytes per second relayed from each non-mesh client")
+	flapDampening    = flag.Duration("flap-dampening", 0, "if non-zero, how long to delay and coalesce mesh presence notifications for clients that are rapidly reconnecting")
+	clientQueueDepth = flag.Int("client-send-queue-depth", 0, "if non-zero, number of packets buffered for sending to each client before dropping")
+	drainGrace       = flag.Duration("drain-grace-period", 0, "if non-zero, on SIGTERM tell clients the server is restarting and keep relaying for up to this long before exiting")
+	zstdThreshold    = flag.Int("zstd-threshold", 0, "if non-zero, minimum size in bytes of relayed packets to zstd-compress for clients that support it")
+	idleTimeout      = flag.Duration("idle-timeout", 0, "if non-zero, disconnect clients that send nothing for this long")
+	proxyProtoCIDRs  = flag.String("proxy-protocol-trusted", "", "if non-empty, comma-separated CIDRs of L4 load balancers whose connections may start with a PROXY protocol v2 header giving the real client address")
+	topPairs         = flag.Int("top-pairs", 0, "if non-zero, track relayed bytes for about this many of the busiest client key pairs, shown at /debug/toppairs")
+	pairAuditDir     = flag.String("pair-audit-dir", "", "if non-empty, directory to write hourly snapshots of the busiest client key pairs to, kept for a day and shown at /debug/pairaudit")
+	meshBWFile       = flag.String("mesh-bandwidth-file", "", "if non-empty, file to keep daily and monthly counts of the traffic forwarded to and from each mesh peer in, shown at /debug/meshbandwidth")
+	keepAliveIval    = flag.Duration("keepalive-interval", 0, "if non-zero, interval between keep-alive frames sent to each client, instead of the default of 60s")
+	writeTimeout     = flag.Duration("write-timeout", 0, "if non-zero, how long a write to a client may block before it's disconnected, instead of the default of 2s")
+	slowClientPolicy = flag.String("slow-client-policy", "drop-oldest", `what to do when a client's send queue is full: "drop-oldest" queued packets, or "disconnect" the client`)
+	derpALPN         = flag.Bool("derp-alpn", false, `with TLS, also accept connections negotiating the "derp" ALPN protocol, which skip the HTTP upgrade; this turns off HTTP/2, and with it HTTP/2 CONNECT tunnels`)
+	tcpAddr          = flag.String("tcp-addr", "", "if non-empty, also serve DERP directly over plain TCP, without TLS or HTTP, on this address, e.g. behind a TLS-terminating load balancer")
+	perIPMaxConns    = flag.Int("per-ip-max-conns", 0, "if non-zero, most connections open at once from one source IP")
+	perIPConnRate    = flag.Float64("per-ip-conn-rate", 0, "if non-zero, per-source-IP rate limit of new connections per second")
+	perIPConnBurst   = flag.Int("per-ip-conn-burst", 10, "burst limit of new connections per source IP, with --per-ip-conn-rate")
+	perIPBlockFor    = flag.Duration("per-ip-block", time.Minute, "how long to refuse all connections from a source IP that exceeds --per-ip-conn-rate")
+	perIPHandshakes  = flag.Int("per-ip-handshakes-per-min", 0, "if non-zero, most DERP connections one source IP may start per minute over HTTP; over it, upgrades are refused with status 429")
+	perIPExempt      = flag.String("per-ip-exempt", "", "comma-separated CIDRs exempt from the --per-ip-* limits and --ban-threshold")
+	banThreshold     = flag.Int("ban-threshold", 0, "if non-zero, temporarily ban source IPs with this many failed handshakes, malformed frames or rate limit violations within a minute")
+	banDuration      = flag.Duration("ban-duration", time.Minute, "how long a source IP's first ban lasts, with --ban-threshold; repeat bans last twice as long each time, up to --ban-max-duration")
+	banMaxDuration   = flag.Duration("ban-max-duration", time.Hour, "the longest a source IP ban lasts, with --ban-threshold")
+	priorityPktSize  = flag.Int("priority-packet-size", 0, "if non-zero, packets of at most this many bytes are sent to clients ahead of bulk traffic, like disco packets are")
+	maxPacketSize    = flag.Int("max-packet-size", 0, "if greater than 65536, the largest packet relayed between clients and mesh peers that support it, up to 524288")
+	connCapacity     = flag.Int("conn-capacity", 0, "if non-zero, the number of connections at which /readyz reports the server not ready for more")
+	clientCAFile     = flag.String("client-ca-file", "", "if non-empty, path to a PEM file of CAs that must have issued TLS client certificates presented by clients; clients without one are rejected, except mesh peers")
+	verbosity        = flag.Int("verbosity", 0, "initial log verbosity: 1 adds per-connection and mesh events, 2 adds per-packet events; changeable at runtime by POSTing v=N to /debug/verbosity")
 )
 
 var (
@@ -152,35 +194,119 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	s.SetClientRateLimit(derp.ClientRateLimit{
+		PacketsPerSecond: *clientPacketRate,
+		BytesPerSecond:   *clientByteRate,
+	})
+	s.SetFlapDampening(*flapDampening)
+	s.SetClientSendQueueDepth(*clientQueueDepth)
+	s.SetPriorityPacketSize(*priorityPktSize)
+	s.SetMaxPacketSize(*maxPacketSize)
+	s.SetConnCapacity(*connCapacity)
+	s.SetWatcherSnapshotInterval(*meshSnapshotIv)
+	s.SetZstdThreshold(*zstdThreshold)
+	s.SetPairAccounting(*topPairs)
+	if *pairAuditDir != "" {
+		s.SetPairAudit(derp.PairAuditConfig{Dir: *pairAuditDir})
+		go func() {
+			log.Fatalf("derper: pair audit: %v", s.RunPairAudit(context.Background()))
+		}()
+	}
+	if *meshBWFile != "" {
+		s.SetMeshBandwidth(derp.MeshBandwidthConfig{File: *meshBWFile})
+		go func() {
+			log.Fatalf("derper: mesh bandwidth: %v", s.RunMeshBandwidth(context.Background()))
+		}()
+	}
+	s.SetIdleTimeout(*idleTimeout)
+	s.SetKeepAliveInterval(*keepAliveIval)
+	s.SetWriteTimeout(*writeTimeout)
+	switch *slowClientPolicy {
+	case "drop-oldest":
+		s.SetSlowClientPolicy(derp.SlowClientDropOldest)
+	case "disconnect":
+		s.SetSlowClientPolicy(derp.SlowClientDisconnect)
+	default:
+		log.Fatalf("derper: invalid -slow-client-policy %q", *slowClientPolicy)
+	}
+	if *banThreshold > 0 {
+		exempt, err := parseCIDRs(*perIPExempt)
+		if err != nil {
+			log.Fatalf("derper: invalid -per-ip-exempt: %v", err)
+		}
+		s.SetBanPolicy(derp.BanPolicy{
+			Threshold: *banThreshold,
+			BanFor:    *banDuration,
+			MaxBan:    *banMaxDuration,
+			Exempt:    exempt,
+		})
+	}
+	if *verbosity > 0 {
+		s.SetVerbosity(*verbosity)
+	}
+	var clientCAs *x509.CertPool
+	if *clientCAFile != "" {
+		b, err := os.ReadFile(*clientCAFile)
+		if err != nil {
+			log.Fatalf("derper: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(b) {
+			log.Fatalf("derper: no certificates in -client-ca-file %s", *clientCAFile)
+		}
+		s.SetClientCAs(clientCAs)
+	}
 
 	if *meshPSKFile != "" {
-		b, err := os.ReadFile(*meshPSKFile)
+		keys, err := readMeshKeys(*meshPSKFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		key := strings.TrimSpace(string(b))
-		if matched, _ := regexp.MatchString(`(?i)^[0-9a-f]{64,}$`, key); !matched {
-			log.Fatalf("key in %s must contain 64+ hex digits", *meshPSKFile)
-		}
-		s.SetMeshKey(key)
+		s.SetMeshKeys(keys)
 		log.Printf("DERP mesh key configured")
+		go reloadMeshKeysOnSignal(s, *meshPSKFile)
+	}
+	if *adminTokenFile != "" {
+		b, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tok := strings.TrimSpace(string(b))
+		if tok == "" {
+			log.Fatalf("admin token in %s is empty", *adminTokenFile)
+		}
+		s.SetAdminToken(tok)
+		log.Printf("DERP admin token configured")
 	}
 	if err := startMesh(s); err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
+	if *drainGrace > 0 {
+		go drainOnSignal(s, *drainGrace)
+	}
 
 	mux := http.NewServeMux()
+	// handler is mux, except that it serves HTTP/2 CONNECT requests
+	// to tunnel DERP (see derphttp.Client.H2Connect), which have no
+	// path for mux to route by.
+	var handler http.Handler = mux
 	if *runDERP {
 		derpHandler := derphttp.Handler(s)
-		derpHandler = addWebSocketSupport(s, derpHandler)
 		mux.Handle("/derp", derpHandler)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				derpHandler.ServeHTTP(w, r)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
 	} else {
 		mux.Handle("/derp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "derp server disabled", http.StatusNotFound)
 		}))
 	}
-	mux.HandleFunc("/derp/probe", probeHandler)
+	mux.HandleFunc("/derp/probe", derphttp.ProbeHandler)
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", tsweb.BrowserHeaderHandlerFunc(handleBootstrapDNS))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -208,6 +334,8 @@ func main() {
 		io.WriteString(w, "User-agent: *\nDisallow: /\n")
 	}))
 	mux.Handle("/generate_204", http.HandlerFunc(serveNoContent))
+	mux.Handle("/healthz", derphttp.HealthzHandler())
+	mux.Handle("/readyz", derphttp.ReadyzHandler(s))
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
@@ -220,15 +348,37 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("flapping", "Flapping clients", http.HandlerFunc(s.ServeDebugFlapping))
+	debug.Handle("verbosity", "Log verbosity", http.HandlerFunc(s.ServeDebugVerbosity))
+	if *topPairs > 0 {
+		debug.Handle("toppairs", "Top relayed key pairs by bytes", http.HandlerFunc(s.ServeDebugTopPairs))
+	}
+	if *pairAuditDir != "" {
+		debug.Handle("pairaudit", "Top relayed key pairs by bytes over the last day", http.HandlerFunc(s.ServeDebugPairAudit))
+	}
+	if *meshBWFile != "" {
+		debug.Handle("meshbandwidth", "Traffic forwarded to and from each mesh peer by day and month", http.HandlerFunc(s.ServeDebugMeshBandwidth))
+	}
 
 	if *runSTUN {
 		go serveSTUN(listenHost, *stunPort)
 	}
 
+	if *tcpAddr != "" {
+		ln, _, err := listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatalf("derper: %v", err)
+		}
+		log.Printf("derper: serving DERP over plain TCP on %s", *tcpAddr)
+		go func() {
+			log.Fatalf("derper: serving plain TCP: %v", derphttp.ServeTCP(s, ln))
+		}()
+	}
+
 	quietLogger := log.New(logFilter{}, "", 0)
 	httpsrv := &http.Server{
 		Addr:     *addr,
-		Handler:  mux,
+		Handler:  handler,
 		ErrorLog: quietLogger,
 
 		// Set read/write timeout. For derper, this basically
@@ -261,6 +411,28 @@ func main() {
 		}
 		// Disable TLS 1.0 and 1.1, which are obsolete and have security issues.
 		httpsrv.TLSConfig.MinVersion = tls.VersionTLS12
+		if clientCAs != nil {
+			// Requiring a cert is up to the DERP server, which
+			// exempts mesh peers.
+			httpsrv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			httpsrv.TLSConfig.ClientCAs = clientCAs
+		}
+		if *derpALPN {
+			// Let clients that know to ask skip the HTTP upgrade
+			// by negotiating DERP with ALPN. Setting TLSNextProto
+			// turns off net/http's HTTP/2 support, so stop
+			// offering h2 too; nothing on a DERP server needs it.
+			protos := []string{derphttp.ALPNProto}
+			for _, p := range httpsrv.TLSConfig.NextProtos {
+				if p != "h2" {
+					protos = append(protos, p)
+				}
+			}
+			httpsrv.TLSConfig.NextProtos = protos
+			httpsrv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+				derphttp.ALPNProto: derphttp.TLSNextProto(s),
+			}
+		}
 		httpsrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.TLS != nil {
 				label := "unknown"
@@ -279,7 +451,7 @@ func main() {
 				defer tlsActiveVersion.Add(label, -1)
 			}
 
-			mux.ServeHTTP(w, r)
+			handler.ServeHTTP(w, r)
 		})
 		if *httpPort > -1 {
 			go func() {
@@ -308,7 +480,13 @@ func main() {
 		err = rateLimitedListenAndServeTLS(httpsrv)
 	} else {
 		log.Printf("derper: serving on %s", *addr)
-		err = httpsrv.ListenAndServe()
+		var ln net.Listener
+		var ipLimits *derphttp.SourceIPLimitListener
+		ln, ipLimits, err = listen("http", cmpx.Or(httpsrv.Addr, ":http"))
+		if err == nil {
+			limitHandshakes(httpsrv, ipLimits)
+			err = httpsrv.Serve(ln)
+		}
 	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("derper: %v", err)
@@ -340,17 +518,6 @@ func isChallengeChar(c rune) bool {
 		c == '.' || c == '-' || c == '_'
 }
 
-// probeHandler is the endpoint that js/wasm clients hit to measure
-// DERP latency, since they can't do UDP STUN queries.
-func probeHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "HEAD", "GET":
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-	default:
-		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
-	}
-}
-
 func serveSTUN(host string, port int) {
 	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(port)))
 	if err != nil {
@@ -426,11 +593,112 @@ func defaultMeshPSKFile() string {
 	return ""
 }
 
+// readMeshKeys returns the whitespace-separated mesh keys in the file
+// at path, primary first.
+func readMeshKeys(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := strings.Fields(string(b))
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key in %s", path)
+	}
+	for _, key := range keys {
+		if matched, _ := regexp.MatchString(`(?i)^[0-9a-f]{64,}$`, key); !matched {
+			return nil, fmt.Errorf("key in %s must contain 64+ hex digits", path)
+		}
+	}
+	return keys, nil
+}
+
+// reloadMeshKeysOnSignal rereads the mesh keys from path into s, and
+// into the clients meshing s with other servers, on each SIGHUP. A
+// file that fails to parse leaves the keys unchanged.
+func reloadMeshKeysOnSignal(s *derp.Server, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		keys, err := readMeshKeys(path)
+		if err != nil {
+			log.Printf("derper: reloading mesh keys: %v", err)
+			continue
+		}
+		s.SetMeshKeys(keys)
+		updateMeshClientKeys(s)
+		log.Printf("derper: reloaded %d mesh key(s)", len(keys))
+	}
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs, as in a flag.
+func parseCIDRs(v string) ([]netip.Prefix, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var ret []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// listen listens on TCP address addr, for the DERP server. If the
+// --proxy-protocol-trusted flag is set, the connections from those
+// addresses may start with a PROXY protocol header. If per-IP limits
+// are set, they're enforced, with metrics published under the given
+// name, and ipLimits is the listener enforcing them, whose
+// LimitHandshakes the HTTP server's handler should be wrapped with.
+func listen(name, addr string) (ln net.Listener, ipLimits *derphttp.SourceIPLimitListener, err error) {
+	trusted, err := parseCIDRs(*proxyProtoCIDRs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --proxy-protocol-trusted: %w", err)
+	}
+	exempt, err := parseCIDRs(*perIPExempt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --per-ip-exempt: %w", err)
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *perIPMaxConns > 0 || *perIPConnRate > 0 || *perIPHandshakes > 0 {
+		// Limit by the TCP peer address, exempting trusted
+		// proxies, which speak for many clients.
+		ipLimits = derphttp.NewSourceIPLimitListener(ln, derphttp.SourceIPLimits{
+			MaxConns:            *perIPMaxConns,
+			ConnsPerSecond:      *perIPConnRate,
+			ConnBurst:           *perIPConnBurst,
+			BlockFor:            *perIPBlockFor,
+			HandshakesPerMinute: *perIPHandshakes,
+			Exempt:              append(trusted[:len(trusted):len(trusted)], exempt...),
+		})
+		expvar.Publish(name+"_source_ip_limits", ipLimits.ExpVar())
+		ln = ipLimits
+	}
+	if len(trusted) == 0 {
+		return ln, ipLimits, nil
+	}
+	return derphttp.NewProxyProtocolListener(ln, trusted), ipLimits, nil
+}
+
+// limitHandshakes wraps srv's handler with ipLimits' LimitHandshakes,
+// if ipLimits is non-nil.
+func limitHandshakes(srv *http.Server, ipLimits *derphttp.SourceIPLimitListener) {
+	if ipLimits != nil {
+		srv.Handler = ipLimits.LimitHandshakes(srv.Handler)
+	}
+}
+
 func rateLimitedListenAndServeTLS(srv *http.Server) error {
-	ln, err := net.Listen("tcp", cmpx.Or(srv.Addr, ":https"))
+	ln, ipLimits, err := listen("https", cmpx.Or(srv.Addr, ":https"))
 	if err != nil {
 		return err
 	}
+	limitHandshakes(srv, ipLimits)
 	rln := newRateLimitedListener(ln, rate.Limit(*acceptConnLimit), *acceptConnBurst)
 	expvar.Publish("tls_listener", rln.ExpVar())
 	defer rln.Close()
@@ -500,3 +768,21 @@ func (logFilter) Write(p []byte) (int, error) {
 	log.Printf("%s", p)
 	return len(p), nil
 }
+
+// drainOnSignal waits for SIGTERM, then drains s for up to grace
+// before exiting, so clients can move to other servers ahead of a
+// restart rather than all at once when the process dies.
+func drainOnSignal(s *derp.Server, grace time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	<-ch
+	log.Printf("derper: got SIGTERM; draining for up to %v", grace)
+	if err := s.Drain(context.Background(), derp.DrainOptions{
+		ReconnectIn: grace,
+		TryFor:      5 * time.Second,
+		GracePeriod: grace,
+	}); err != nil {
+		log.Printf("derper: drain: %v", err)
+	}
+	os.Exit(0)
+}
@@ -8,9 +8,13 @@
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/net/stun"
 )
 
@@ -128,3 +132,124 @@ func TestNoContent(t *testing.T) {
 		})
 	}
 }
+
+// fakeDNSResolver returns a resolver that answers queries from a DNS
+// server on localhost serving records, and NXDOMAIN for other names.
+func fakeDNSResolver(t *testing.T, records map[dnsmessage.Question][]dnsmessage.ResourceBody) *net.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 60}
+			bodies := records[q]
+			rcode := dnsmessage.RCodeNameError
+			for other := range records {
+				if other.Name == q.Name {
+					rcode = dnsmessage.RCodeSuccess
+				}
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+				ID:            h.ID,
+				Response:      true,
+				Authoritative: true,
+				RCode:         rcode,
+			})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			for _, body := range bodies {
+				switch body := body.(type) {
+				case *dnsmessage.AResource:
+					b.AResource(rh, *body)
+				case *dnsmessage.AAAAResource:
+					b.AAAAResource(rh, *body)
+				case *dnsmessage.SRVResource:
+					b.SRVResource(rh, *body)
+				}
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pc.WriteTo(msg, addr)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
+
+func TestLookupMeshTargets(t *testing.T) {
+	q := func(name string, typ dnsmessage.Type) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+	}
+	r := fakeDNSResolver(t, map[dnsmessage.Question][]dnsmessage.ResourceBody{
+		q("srv.example.", dnsmessage.TypeSRV): {
+			&dnsmessage.SRVResource{Target: dnsmessage.MustNewName("derp1.example."), Port: 443},
+			&dnsmessage.SRVResource{Target: dnsmessage.MustNewName("derp2.example."), Port: 8443},
+		},
+		q("ips.example.", dnsmessage.TypeA): {
+			&dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		},
+		q("ips.example.", dnsmessage.TypeAAAA): {
+			&dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("fd00::1").As16()},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		want    []meshTarget
+		wantErr bool
+	}{
+		{
+			name: "srv.example.",
+			want: []meshTarget{{host: "derp1.example"}, {host: "derp2.example:8443"}},
+		},
+		{
+			name: "ips.example.",
+			want: []meshTarget{
+				{host: "ips.example", addr: "10.0.0.1:443"},
+				{host: "ips.example", addr: "[fd00::1]:443"},
+			},
+		},
+		{
+			name:    "missing.example.",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupMeshTargets(context.Background(), r, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			// Order of records isn't significant.
+			slices.SortFunc(got, func(a, b meshTarget) int { return strings.Compare(a.String(), b.String()) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
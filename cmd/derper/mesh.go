@@ -5,42 +5,274 @@
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
 	"net/netip"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 )
 
+// meshClients are the clients of the running meshes and the servers
+// they mesh with, so their mesh keys can be updated when the server's
+// are reloaded, and their forwarding stats exported.
+var meshClients struct {
+	sync.Mutex
+	targets  map[*derphttp.Client]meshTarget
+	watchers set.Set[*derphttp.Client] // those watching connections, not gossiping
+}
+
+// setMeshClientKeys sets c to present the mesh keys of s.
+func setMeshClientKeys(c *derphttp.Client, s *derp.Server) {
+	keys := s.MeshKeys()
+	if len(keys) == 0 {
+		return
+	}
+	var secondary string
+	if len(keys) > 1 {
+		secondary = keys[1]
+	}
+	c.SetMeshKeys(keys[0], secondary)
+}
+
+// updateMeshClientKeys sets all running mesh clients to present the
+// current mesh keys of s, for their next connection.
+func updateMeshClientKeys(s *derp.Server) {
+	meshClients.Lock()
+	defer meshClients.Unlock()
+	for c := range meshClients.targets {
+		setMeshClientKeys(c, s)
+	}
+}
+
+// meshForwardStats returns the forwarding stats of each running mesh
+// client, by the server it meshes with, for expvar.
+func meshForwardStats() any {
+	meshClients.Lock()
+	defer meshClients.Unlock()
+	ret := make(map[string]derphttp.ForwardStats, len(meshClients.targets))
+	for c, t := range meshClients.targets {
+		ret[t.String()] = c.ForwardStats()
+	}
+	return ret
+}
+
+// meshConnectStats returns the connection attempt counts of each
+// running mesh client, by the server it meshes with, for expvar.
+func meshConnectStats() any {
+	meshClients.Lock()
+	defer meshClients.Unlock()
+	ret := make(map[string]derphttp.ConnectStats, len(meshClients.targets))
+	for c, t := range meshClients.targets {
+		ret[t.String()] = c.ConnectStats()
+	}
+	return ret
+}
+
+// meshReady reports an error naming the servers whose connections
+// aren't being watched yet, for derp.Server.SetReadyCheck.
+func meshReady() error {
+	meshClients.Lock()
+	defer meshClients.Unlock()
+	var pending []string
+	for c := range meshClients.watchers {
+		if !c.IsWatching() {
+			pending = append(pending, meshClients.targets[c].String())
+		}
+	}
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		return fmt.Errorf("mesh not yet established with %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
 func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
+	if *meshWith == "" && *meshDiscover == "" {
 		return nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return errors.New("--mesh-with and --mesh-discover require --mesh-psk-file")
 	}
-	for _, host := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, host); err != nil {
-			return err
+	expvar.Publish("mesh_forwarding", expvar.Func(meshForwardStats))
+	expvar.Publish("mesh_connects", expvar.Func(meshConnectStats))
+	s.SetReadyCheck(meshReady)
+	if *meshGossip > 0 {
+		if *meshWith == "" || *meshDiscover != "" {
+			return errors.New("--mesh-gossip-fanout requires --mesh-with, and doesn't support --mesh-discover")
+		}
+		s.SetGossip(*hostname, 0)
+		return startGossipMesh(context.Background(), s, *hostname, strings.Split(*meshWith, ","), *meshGossip)
+	}
+	if *meshWith != "" {
+		for _, host := range strings.Split(*meshWith, ",") {
+			if err := startMeshWithHost(context.Background(), s, meshTarget{host: host}); err != nil {
+				return err
+			}
 		}
 	}
+	if *meshDiscover != "" {
+		go discoverMesh(context.Background(), s, *meshDiscover, *meshDiscoverIv)
+	}
 	return nil
 }
 
-func startMeshWithHost(s *derp.Server, host string) error {
-	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
+// meshTarget is a DERP server to mesh with.
+type meshTarget struct {
+	host string // hostname (with optional port) for the URL and TLS
+	addr string // if non-empty, the "ip:port" to dial instead of looking up host
+}
+
+func (t meshTarget) String() string {
+	if t.addr != "" {
+		return t.host + "@" + t.addr
+	}
+	return t.host
+}
+
+// discoverMesh meshes s with the servers that name resolves to,
+// resolving it again every interval to start meshing with new servers
+// and stop meshing with those no longer listed, until ctx is done.
+//
+// Failed lookups leave the mesh as it was, so that a DNS outage
+// doesn't partition the region.
+func discoverMesh(ctx context.Context, s *derp.Server, name string, interval time.Duration) {
+	running := map[meshTarget]context.CancelFunc{}
+	for {
+		targets, err := lookupMeshTargets(ctx, net.DefaultResolver, name)
+		if err != nil {
+			log.Printf("mesh-discover: looking up %q: %v", name, err)
+		} else {
+			want := map[meshTarget]bool{}
+			for _, t := range targets {
+				want[t] = true
+				if _, ok := running[t]; ok {
+					continue
+				}
+				tctx, cancel := context.WithCancel(ctx)
+				if err := startMeshWithHost(tctx, s, t); err != nil {
+					log.Printf("mesh-discover: starting mesh with %v: %v", t, err)
+					cancel()
+					continue
+				}
+				log.Printf("mesh-discover: added %v", t)
+				running[t] = cancel
+			}
+			for t, cancel := range running {
+				if !want[t] {
+					log.Printf("mesh-discover: removed %v", t)
+					cancel()
+					delete(running, t)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lookupMeshTargets returns the DERP servers that name resolves to:
+// the targets of its SRV records if it has any, otherwise each of
+// its A and AAAA records on port 443, to be reached using name for TLS.
+func lookupMeshTargets(ctx context.Context, r *net.Resolver, name string) ([]meshTarget, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, srvs, err := r.LookupSRV(ctx, "", "", name)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+	if len(srvs) > 0 {
+		var ret []meshTarget
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			if srv.Port != 443 {
+				host = net.JoinHostPort(host, fmt.Sprint(srv.Port))
+			}
+			ret = append(ret, meshTarget{host: host})
+		}
+		return ret, nil
+	}
+
+	ips, err := r.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]meshTarget, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, meshTarget{
+			host: strings.TrimSuffix(name, "."),
+			addr: netip.AddrPortFrom(ip.Unmap(), 443).String(),
+		})
+	}
+	return ret, nil
+}
+
+// startMeshWithHost starts meshing s with the DERP server at t, until
+// ctx is done.
+func startMeshWithHost(ctx context.Context, s *derp.Server, t meshTarget) error {
+	logf := meshLogf(t)
+	c, err := newMeshClient(ctx, s, t, logf)
 	if err != nil {
 		return err
 	}
-	c.MeshKey = s.MeshKey()
+	meshClients.Lock()
+	mak.Set(&meshClients.watchers, c, struct{}{})
+	meshClients.Unlock()
+	context.AfterFunc(ctx, func() {
+		meshClients.Lock()
+		meshClients.watchers.Delete(c)
+		meshClients.Unlock()
+	})
+	add := func(k key.NodePublic, _ netip.AddrPort) { s.AddPacketForwarder(k, c) }
+	remove := func(k key.NodePublic) { s.RemovePacketForwarder(k, c) }
+	go c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove)
+	return nil
+}
+
+// meshLogf returns the logger for meshing with t.
+func meshLogf(t meshTarget) logger.Logf {
+	return logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", t))
+}
+
+// newMeshClient returns a client, which connects lazily, for meshing s
+// with the DERP server at t. It's closed when ctx is done.
+func newMeshClient(ctx context.Context, s *derp.Server, t meshTarget, logf logger.Logf) (*derphttp.Client, error) {
+	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+t.host+"/derp", logf)
+	if err != nil {
+		return nil, err
+	}
+	// Register c before reading the keys, so a concurrent reload
+	// can't be missed.
+	meshClients.Lock()
+	mak.Set(&meshClients.targets, c, t)
+	meshClients.Unlock()
+	setMeshClientKeys(c, s)
+	c.ReconnectBackoff = derphttp.BackoffPolicy{
+		Initial:    *meshBackoff,
+		Max:        *meshBackoffMax,
+		Jitter:     0.2,
+		ResetAfter: 30 * time.Second, // a link that drops sooner is still flaky
+	}
+	c.SetCanForwardAck(true)
+	c.SetMaxPacketSize(*maxPacketSize)
 
 	// For meshed peers within a region, connect via VPC addresses.
 	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -50,6 +282,9 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		}
 		var d net.Dialer
 		var r net.Resolver
+		if t.addr != "" {
+			return d.DialContext(ctx, network, t.addr)
+		}
 		if base, ok := strings.CutSuffix(host, ".tailscale.com"); ok && port == "443" {
 			subCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
 			defer cancel()
@@ -68,8 +303,153 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		return d.DialContext(ctx, network, addr)
 	})
 
-	add := func(k key.NodePublic, _ netip.AddrPort) { s.AddPacketForwarder(k, c) }
-	remove := func(k key.NodePublic) { s.RemovePacketForwarder(k, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
+	context.AfterFunc(ctx, func() {
+		meshClients.Lock()
+		delete(meshClients.targets, c)
+		meshClients.Unlock()
+		c.Close()
+	})
+	return c, nil
+}
+
+// gossipMesh meshes a server with the others in gossip mode (see
+// derp.Server.SetGossip): it subscribes to the peer maps of a few of
+// them and forwards packets for the clients in those maps, and the
+// maps they relay, directly to the clients' servers.
+type gossipMesh struct {
+	ctx context.Context
+	s   *derp.Server
+
+	mu      sync.Mutex
+	clients map[string]*derphttp.Client // by host; created lazily for forwarding
+	origins map[key.NodePublic]*gossipOrigin
+}
+
+// gossipOrigin is what a gossipMesh knows about another server from
+// its latest peer map.
+type gossipOrigin struct {
+	host    string
+	fwd     *derphttp.Client
+	keys    set.Set[key.NodePublic]
+	expires time.Time
+}
+
+// startGossipMesh meshes s in gossip mode with the servers at hosts,
+// subscribing to the peer maps of fanout of them. The choice of which
+// is by rendezvous hashing, so that the subscriptions are spread evenly
+// over the mesh.
+func startGossipMesh(ctx context.Context, s *derp.Server, self string, hosts []string, fanout int) error {
+	g := &gossipMesh{ctx: ctx, s: s}
+	var peers []string
+	for _, h := range hosts {
+		if h != self {
+			peers = append(peers, h)
+		}
+	}
+	score := func(h string) string {
+		sum := sha256.Sum256([]byte(self + "|" + h))
+		return string(sum[:])
+	}
+	slices.SortFunc(peers, func(a, b string) int { return strings.Compare(score(a), score(b)) })
+	if len(peers) > fanout {
+		peers = peers[:fanout]
+	}
+	for _, h := range peers {
+		g.mu.Lock()
+		c, err := g.clientLocked(h)
+		g.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		go c.RunGossipLoop(ctx, s.PublicKey(), func(m derp.PeerMap) {
+			g.apply(m, c.ServerPublicKey())
+		})
+	}
+	go g.expireLoop()
 	return nil
 }
+
+// clientLocked returns the mesh client for host, creating it if
+// needed. g.mu must be held.
+func (g *gossipMesh) clientLocked(host string) (*derphttp.Client, error) {
+	if c, ok := g.clients[host]; ok {
+		return c, nil
+	}
+	t := meshTarget{host: host}
+	c, err := newMeshClient(g.ctx, g.s, t, meshLogf(t))
+	if err != nil {
+		return nil, err
+	}
+	mak.Set(&g.clients, host, c)
+	return c, nil
+}
+
+// apply relays m, received from the mesh peer with key via, and
+// updates the packet forwarders for its clients, if it's newer than
+// the last map from its origin.
+func (g *gossipMesh) apply(m derp.PeerMap, via key.NodePublic) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.s.RelayPeerMap(m, via) {
+		return
+	}
+	o := g.origins[m.Origin]
+	if o == nil || o.host != m.Host {
+		fwd, err := g.clientLocked(m.Host)
+		if err != nil {
+			log.Printf("gossip: map of %s: %v", m.Origin.ShortString(), err)
+			return
+		}
+		if o != nil {
+			g.removeOriginLocked(m.Origin)
+		}
+		o = &gossipOrigin{host: m.Host, fwd: fwd, keys: set.Set[key.NodePublic]{}}
+		mak.Set(&g.origins, m.Origin, o)
+	}
+
+	keys := set.SetOf(m.Keys)
+	for k := range keys {
+		if !o.keys.Contains(k) {
+			g.s.AddPacketForwarder(k, o.fwd)
+		}
+	}
+	for k := range o.keys {
+		if !keys.Contains(k) {
+			g.s.RemovePacketForwarder(k, o.fwd)
+		}
+	}
+	o.keys = keys
+	o.expires = time.Now().Add(m.TTL)
+}
+
+// removeOriginLocked stops forwarding packets to the clients of
+// origin. g.mu must be held.
+func (g *gossipMesh) removeOriginLocked(origin key.NodePublic) {
+	o := g.origins[origin]
+	for k := range o.keys {
+		g.s.RemovePacketForwarder(k, o.fwd)
+	}
+	delete(g.origins, origin)
+}
+
+// expireLoop forgets the clients of servers whose peer maps have
+// expired, until g.ctx is done.
+func (g *gossipMesh) expireLoop() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-t.C:
+			g.mu.Lock()
+			for origin, o := range g.origins {
+				if now.After(o.expires) {
+					log.Printf("gossip: map of %s expired", origin.ShortString())
+					g.removeOriginLocked(origin)
+				}
+			}
+			g.mu.Unlock()
+		}
+	}
+}
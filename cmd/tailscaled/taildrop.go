@@ -11,10 +11,17 @@
 	"path/filepath"
 
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/taildrop"
 	"tailscale.com/types/logger"
 	"tailscale.com/version/distro"
 )
 
+// openTaildropStore, if non-nil, opens the store named by the
+// --taildrop-store flag. It's only linked in when building with the
+// ts_include_taildrop_s3 tag, to keep the S3 client out of tailscaled
+// by default.
+var openTaildropStore func(spec string) (taildrop.Store, error)
+
 func configureTaildrop(logf logger.Logf, lb *ipnlocal.LocalBackend) {
 	dg := distro.Get()
 	switch dg {
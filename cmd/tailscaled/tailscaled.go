@@ -137,6 +137,7 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	taildropStore  string // if non-empty, where to stage received Taildrop files
 }
 
 var (
@@ -172,6 +173,7 @@ func main() {
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
+	flag.StringVar(&args.taildropStore, "taildrop-store", "", "if non-empty, where to stage incoming Taildrop files instead of --statedir, as 's3://bucket[/prefix]'; requires building with the ts_include_taildrop_s3 tag")
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
 		beCLI()
@@ -388,6 +390,9 @@ func run() error {
 	if args.statepath == "" && args.statedir == "" {
 		log.Fatalf("--statedir (or at least --state) is required")
 	}
+	if args.taildropStore != "" && openTaildropStore == nil {
+		log.Fatalf("--taildrop-store is not supported by this build of tailscaled")
+	}
 	if err := trySynologyMigration(statePathOrDefault()); err != nil {
 		log.Printf("error in synology migration: %v", err)
 	}
@@ -551,6 +556,13 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	if root := lb.TailscaleVarRoot(); root != "" {
 		dnsfallback.SetCachePath(filepath.Join(root, "derpmap.cached.json"), logf)
 	}
+	if args.taildropStore != "" {
+		st, err := openTaildropStore(args.taildropStore)
+		if err != nil {
+			return nil, fmt.Errorf("--taildrop-store: %w", err)
+		}
+		lb.SetTaildropStore(st)
+	}
 	configureTaildrop(logf, lb)
 	if err := ns.Start(lb); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
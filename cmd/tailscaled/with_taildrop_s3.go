@@ -0,0 +1,29 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_include_taildrop_s3
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"tailscale.com/taildrop"
+	"tailscale.com/taildrop/s3store"
+)
+
+func init() {
+	openTaildropStore = func(spec string) (taildrop.Store, error) {
+		rest, ok := strings.CutPrefix(spec, "s3://")
+		if !ok {
+			return nil, fmt.Errorf("unsupported store %q; want s3://bucket[/prefix]", spec)
+		}
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return s3store.New(context.Background(), bucket, prefix)
+	}
+}
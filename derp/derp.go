@@ -24,8 +24,16 @@
 // MaxPacketSize is the maximum size of a packet sent over DERP.
 // (This only includes the data bytes visible to magicsock, not
 // including its on-wire framing overhead)
+//
+// Clients and servers may negotiate a larger size, up to
+// MaxJumboPacketSize, in the handshake. See Server.SetMaxPacketSize
+// and JumboPacketSize.
 const MaxPacketSize = 64 << 10
 
+// MaxJumboPacketSize is the largest packet size that clients and
+// servers may negotiate.
+const MaxJumboPacketSize = 512 << 10
+
 // magic is the DERP magic number, sent in the frameServerKey frame
 // upon initial connection.
 const magic = "DERP🔑" // 8 bytes: 0x44 45 52 50 f0 9f 94 91
@@ -34,6 +42,7 @@
 	nonceLen       = 24
 	frameHeaderLen = 1 + 4 // frameType byte + 4 byte length
 	keyLen         = 32
+	peerPresentLen = keyLen + 16 + 2 // peer present entry: pub key, IP, port
 	maxInfoLen     = 1 << 20
 	keepAlive      = 60 * time.Second
 )
@@ -89,10 +98,17 @@
 
 	// frameWatchConns is how one DERP node in a regional mesh
 	// subscribes to the others in the region.
-	// There's no payload. If the sender doesn't have permission, the connection
+	// If the sender doesn't have permission, the connection
 	// is closed. Otherwise, the client is initially flooded with
 	// framePeerPresent for all connected nodes, and then a stream of
 	// framePeerPresent & framePeerGone has peers connect and disconnect.
+	//
+	// The payload is empty to watch all peers, or else a filter
+	// limiting which peers to send presence changes for: a 1 byte
+	// length N (at most 32), an N byte prefix of matching peers' raw
+	// keys, then zero or more 32B keys of other matching peers. A
+	// later frameWatchConns replaces the filter and resends the
+	// matching connected peers.
 	frameWatchConns = frameType(0x10)
 
 	// frameClosePeer is a privileged frame type (requires the
@@ -117,6 +133,72 @@
 	// and how long to try total. See ServerRestartingMessage docs for
 	// more details on how the client should interpret them.
 	frameRestarting = frameType(0x15)
+
+	// framePeerPresentBatch is like framePeerPresent, but for
+	// multiple peers at once, such as the initial snapshot of all
+	// connected peers sent to a new watcher. The payload is one or
+	// more 50 byte entries, each a 32B pub key, 16B IP, and 2B big
+	// endian port. It's only sent to clients that declare
+	// CanPeerPresentBatch in their client info.
+	framePeerPresentBatch = frameType(0x16)
+
+	// frameSendPacketZstd and frameRecvPacketZstd are like
+	// frameSendPacket and (v2) frameRecvPacket, respectively, but
+	// with the packet bytes after the key compressed with zstd.
+	// Clients only send frameSendPacketZstd to servers that declare
+	// a ZstdThreshold in their server info, and servers only send
+	// frameRecvPacketZstd to clients that declare CanZstd in their
+	// client info. Either side only compresses packets of at least
+	// ZstdThreshold bytes, and only when that makes them smaller.
+	frameSendPacketZstd = frameType(0x17) // 32B dest pub key + zstd-compressed packet bytes
+	frameRecvPacketZstd = frameType(0x18) // 32B src pub key + zstd-compressed packet bytes
+
+	// framePacketDropped is sent from server to client to say that
+	// a packet the client sent was dropped, and why. It's only sent
+	// to clients that declare CanDropNotify in their client info,
+	// and at a limited rate, so it describes some but not all drops.
+	framePacketDropped = frameType(0x19) // 32B dest pub key + 1 byte DropReasonType
+
+	// frameForwardAck is sent from server to mesh peer, every
+	// forwardAckInterval, to acknowledge the packets the peer
+	// forwarded in frameForwardPacket since the previous ack. It's
+	// only sent to mesh peers that declare CanForwardAck in their
+	// client info, and only when there's something to acknowledge.
+	// Comparing the acknowledged counts with what it sent lets a
+	// server measure the loss on its mesh links.
+	frameForwardAck = frameType(0x1a) // 8B packets + 8B bytes + 8B packets dropped on arrival, all BE
+
+	// frameGossipSubscribe is sent from mesh client to a server in
+	// gossip mode to subscribe to framePeerMap frames, instead of
+	// watching connections with frameWatchConns. See derp_gossip.go.
+	frameGossipSubscribe = frameType(0x1b) // no payload
+	// framePeerMap is sent from server to gossip subscriber with a
+	// part of the map of which clients are connected to the origin
+	// server, which is either the server itself or one whose map
+	// it's relaying.
+	framePeerMap = frameType(0x1c) // 32B origin key + 8B BE seq + 4B BE TTL secs + 2B BE part + 2B BE parts + 1B host len + host + 32B client keys
+
+	// framePeerSnapshot is sent from server to watcher, periodically,
+	// with a part of a snapshot of all the connected peers it
+	// watches, so that it can correct any drift in its view from
+	// missed framePeerPresent and framePeerGone frames. Each part
+	// has up to maxPeerSnapshotEntriesPerFrame entries, in the
+	// format of framePeerPresentBatch. It's only sent to watchers
+	// that declare CanPeerSnapshot in their client info.
+	framePeerSnapshot = frameType(0x1d) // 2B BE part + 2B BE parts + 50B entries (32B pub key + 16B IP + 2B BE port)
+)
+
+const (
+	// forwardAckInterval is how often a server acknowledges
+	// forwarded packets in frameForwardAck.
+	forwardAckInterval = 5 * time.Second
+
+	forwardAckLen = 24 // length of frameForwardAck's payload
+
+	// maxPeerSnapshotEntriesPerFrame is the most peers in one
+	// framePeerSnapshot, keeping frames well under the 1MB that
+	// clients accept.
+	maxPeerSnapshotEntriesPerFrame = 16384
 )
 
 // PeerGoneReasonType is a one byte reason code explaining why a
@@ -128,6 +210,17 @@
 	PeerGoneReasonNotHere      = PeerGoneReasonType(0x01) // server doesn't know about this peer, unexpected
 )
 
+// DropReasonType is a one byte reason code explaining why a server
+// dropped a packet, as reported to its sender.
+type DropReasonType byte
+
+const (
+	DropReasonUnknownDest = DropReasonType(0x00) // no client with the destination key is connected
+	DropReasonQueueFull   = DropReasonType(0x01) // the destination's send queue was full
+	DropReasonRateLimited = DropReasonType(0x02) // the sender exceeded its rate limit
+	DropReasonDupClient   = DropReasonType(0x03) // the destination key is connected more than once
+)
+
 var bin = binary.BigEndian
 
 func writeUint32(bw *bufio.Writer, v uint32) error {
@@ -160,14 +253,6 @@ func readUint32(br *bufio.Reader) (uint32, error) {
 	return bin.Uint32(b[:]), nil
 }
 
-func readFrameTypeHeader(br *bufio.Reader, wantType frameType) (frameLen uint32, err error) {
-	gotType, frameLen, err := readFrameHeader(br)
-	if err == nil && wantType != gotType {
-		err = fmt.Errorf("bad frame type 0x%X, want 0x%X", gotType, wantType)
-	}
-	return frameLen, err
-}
-
 func readFrameHeader(br *bufio.Reader) (t frameType, frameLen uint32, err error) {
 	tb, err := br.ReadByte()
 	if err != nil {
@@ -233,3 +318,71 @@ func writeFrame(bw *bufio.Writer, t frameType, b []byte) error {
 	}
 	return bw.Flush()
 }
+
+// ZstdCodec compresses and decompresses packets with zstd, for
+// frameSendPacketZstd and frameRecvPacketZstd. It's implemented by the
+// derp/derpzstd package, which registers it with RegisterZstd, so that
+// programs that don't need compression, such as the CLI, don't link
+// zstd. Its methods must be safe for concurrent use.
+type ZstdCodec interface {
+	// EncodeAll returns src compressed, appended to dst.
+	EncodeAll(src, dst []byte) []byte
+	// DecodeAll returns src decompressed, appended to dst.
+	DecodeAll(src, dst []byte) ([]byte, error)
+}
+
+var zstdCodec ZstdCodec // or nil
+
+// RegisterZstd lets the conditionally linked derp/derpzstd package
+// register itself. Without it, clients don't advertise CanZstd and
+// servers ignore SetZstdThreshold.
+func RegisterZstd(c ZstdCodec) {
+	zstdCodec = c
+}
+
+// zstdCompress returns pkt compressed with zstd if that's at least
+// threshold bytes and compressing it makes it smaller. Otherwise it
+// returns nil. A threshold of zero or less never compresses.
+func zstdCompress(pkt []byte, threshold int) []byte {
+	if zstdCodec == nil || threshold <= 0 || len(pkt) < threshold {
+		return nil
+	}
+	c := zstdCodec.EncodeAll(pkt, make([]byte, 0, len(pkt)))
+	if len(c) >= len(pkt) {
+		return nil
+	}
+	return c
+}
+
+// zstdDecompress returns the packet compressed in b, which must not
+// decompress to more than maxSize bytes.
+func zstdDecompress(b []byte, maxSize int) ([]byte, error) {
+	if zstdCodec == nil {
+		return nil, errors.New("zstd not supported")
+	}
+	pkt, err := zstdCodec.DecodeAll(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) > maxSize {
+		return nil, packetTooLargeError{len(pkt), maxSize}
+	}
+	return pkt, nil
+}
+
+// negotiatedMaxPacketSize returns the max packet size for a
+// connection on which one side supports packets of up to a bytes and
+// the other up to b, where zero means MaxPacketSize.
+func negotiatedMaxPacketSize(a, b int) int {
+	n := a
+	if b < n {
+		n = b
+	}
+	if n < MaxPacketSize {
+		return MaxPacketSize
+	}
+	if n > MaxJumboPacketSize {
+		return MaxJumboPacketSize
+	}
+	return n
+}
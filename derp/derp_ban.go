@@ -0,0 +1,282 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// BanPolicy is a policy for temporarily banning source IPs that abuse
+// a server: breaking the DERP handshake, being denied by the server's
+// checks of clients, sending malformed frames or exceeding rate
+// limits, or being reported with ReportAbuse. Connections that merely
+// fail or time out, and checks of clients that fail, don't count. The
+// zero value bans nothing.
+type BanPolicy struct {
+	// Threshold is how many offenses from one IP within Window get
+	// it banned. Zero disables bans.
+	Threshold int
+
+	// Window is the period over which offenses are counted. Zero
+	// means one minute.
+	Window time.Duration
+
+	// BanFor is how long an IP's first ban lasts. Each later ban of
+	// the same IP lasts twice as long as the one before, up to
+	// MaxBan. An IP that goes MaxBan after a ban without offending
+	// starts over. Zero means one minute.
+	BanFor time.Duration
+
+	// MaxBan is the longest a ban lasts. Zero means one hour.
+	MaxBan time.Duration
+
+	// Exempt are addresses that are never banned, such as mesh peers
+	// or load balancers.
+	Exempt []netip.Prefix
+
+	// OnBan, if non-nil, is called when an IP is banned, such as to
+	// log it or report it elsewhere. It's called synchronously, so
+	// shouldn't block for long.
+	OnBan func(Ban)
+}
+
+func (p BanPolicy) window() time.Duration {
+	if p.Window > 0 {
+		return p.Window
+	}
+	return time.Minute
+}
+
+func (p BanPolicy) maxBan() time.Duration {
+	if p.MaxBan > 0 {
+		return p.MaxBan
+	}
+	return time.Hour
+}
+
+// banDuration returns how long the n'th ban of an IP lasts.
+func (p BanPolicy) banDuration(n int) time.Duration {
+	d := p.BanFor
+	if d <= 0 {
+		d = time.Minute
+	}
+	max := p.maxBan()
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (p BanPolicy) isExempt(ip netip.Addr) bool {
+	for _, pfx := range p.Exempt {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban is a source IP that's temporarily banned from a server.
+type Ban struct {
+	IP     netip.Addr
+	Reason string    // the offense that got it banned
+	Bans   int       // how many times in a row it's been banned, including this one
+	Since  time.Time // when the ban started
+	Until  time.Time // when the ban ends
+}
+
+// abuseState is the offense history of a source IP.
+type abuseState struct {
+	offenses    int       // offenses in the current window
+	windowStart time.Time // when the current window started
+	lastOffense time.Time
+	ban         Ban // the current or last ban, if ban.Bans > 0
+}
+
+// SetBanPolicy sets the policy for temporarily banning abusive source
+// IPs. Connections from a banned IP get a health frame saying so and
+// are closed, and Handler refuses its HTTP upgrades with status 403
+// (Forbidden). Connections already open when an IP is banned aren't
+// closed.
+//
+// It must be called before serving begins.
+func (s *Server) SetBanPolicy(p BanPolicy) {
+	s.banPolicy = p
+}
+
+// ReportAbuse reports an offense by the source IP of remoteAddr, such
+// as a failed TLS handshake seen by the caller, counting towards its
+// being banned under the server's BanPolicy. reason says what it did.
+func (s *Server) ReportAbuse(remoteAddr, reason string) {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return
+	}
+	s.noteOffense(ap.Addr(), reason)
+}
+
+// noteOffense counts an offense by ip, banning it if that takes it
+// over the BanPolicy threshold.
+func (s *Server) noteOffense(ip netip.Addr, reason string) {
+	p := s.banPolicy
+	if p.Threshold <= 0 || !ip.IsValid() {
+		return
+	}
+	ip = ip.Unmap()
+	if p.isExempt(ip) {
+		return
+	}
+	s.abuseReports.Add(1)
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	s.sweepAbuseLocked(now)
+	st := s.abuse[ip]
+	if st == nil {
+		st = &abuseState{windowStart: now}
+		mak.Set(&s.abuse, ip, st)
+	}
+	if st.ban.Bans > 0 && now.Before(st.ban.Until) {
+		// Already banned; its connections are being refused.
+		s.mu.Unlock()
+		return
+	}
+	if st.ban.Bans > 0 && now.Sub(st.ban.Until) >= p.maxBan() && now.Sub(st.lastOffense) >= p.maxBan() {
+		st.ban = Ban{} // reformed; start over
+	}
+	if now.Sub(st.windowStart) >= p.window() {
+		st.offenses = 0
+		st.windowStart = now
+	}
+	st.offenses++
+	st.lastOffense = now
+	if st.offenses < p.Threshold {
+		s.mu.Unlock()
+		return
+	}
+	n := st.ban.Bans + 1
+	st.offenses = 0
+	st.ban = Ban{
+		IP:     ip,
+		Reason: reason,
+		Bans:   n,
+		Since:  now,
+		Until:  now.Add(p.banDuration(n)),
+	}
+	ban := st.ban
+	s.mu.Unlock()
+
+	s.bansTotal.Add(1)
+	s.logf("derp: banning %v until %v after %d offenses: %s", ip, ban.Until.Format(time.RFC3339), p.Threshold, reason)
+	if p.OnBan != nil {
+		p.OnBan(ban)
+	}
+}
+
+// sweepAbuseLocked forgets the history of IPs that are neither banned
+// nor have offended recently.
+//
+// s.mu must be held.
+func (s *Server) sweepAbuseLocked(now time.Time) {
+	if now.Sub(s.abuseSwept) < time.Minute {
+		return
+	}
+	s.abuseSwept = now
+	p := s.banPolicy
+	for ip, st := range s.abuse {
+		if now.Sub(st.lastOffense) < p.window() {
+			continue
+		}
+		if st.ban.Bans > 0 && now.Sub(st.ban.Until) < p.maxBan() {
+			continue
+		}
+		delete(s.abuse, ip)
+	}
+}
+
+// bannedLocked returns the ban of ip, if it's banned.
+//
+// s.mu must be held.
+func (s *Server) bannedLocked(ip netip.Addr, now time.Time) (ban Ban, ok bool) {
+	st := s.abuse[ip.Unmap()]
+	if st == nil || st.ban.Bans == 0 || !now.Before(st.ban.Until) {
+		return Ban{}, false
+	}
+	return st.ban, true
+}
+
+// Banned reports whether remoteAddr's IP is banned (see SetBanPolicy),
+// and if so, for how much longer.
+func (s *Server) Banned(remoteAddr string) (retryAfter time.Duration, banned bool) {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return 0, false
+	}
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ban, ok := s.bannedLocked(ap.Addr(), now)
+	if !ok {
+		return 0, false
+	}
+	return ban.Until.Sub(now), true
+}
+
+// Bans returns the current bans, ordered by IP.
+func (s *Server) Bans() []Ban {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Ban, 0)
+	for ip := range s.abuse {
+		if ban, ok := s.bannedLocked(ip, now); ok {
+			ret = append(ret, ban)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].IP.Less(ret[j].IP)
+	})
+	return ret
+}
+
+// Unban lifts the ban of ip, if any, and forgets its offenses,
+// reporting whether it was banned.
+func (s *Server) Unban(ip netip.Addr) bool {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.bannedLocked(ip, now)
+	delete(s.abuse, ip.Unmap())
+	return ok
+}
+
+// isConnError reports whether err, from reading a client's frames, is
+// due to the connection failing rather than to the client sending a
+// malformed frame.
+func isConnError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// protocolError is an error from a client breaking the DERP protocol,
+// which counts as an offense, as opposed to its connection failing,
+// which doesn't.
+type protocolError struct {
+	error
+}
+
+func (e protocolError) Unwrap() error { return e.error }
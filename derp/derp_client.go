@@ -12,10 +12,12 @@
 	"io"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go4.org/mem"
 	"golang.org/x/time/rate"
+	"tailscale.com/disco"
 	"tailscale.com/syncs"
 	"tailscale.com/tstime"
 	"tailscale.com/types/key"
@@ -34,9 +36,21 @@ type Client struct {
 	canAckPings bool
 	isProber    bool
 
+	canPeerPresentBatch bool
+	canZstd             bool
+	canDropNotify       bool
+	canForwardAck       bool
+	canPeerSnapshot     bool
+
 	wmu  sync.Mutex // hold while writing to bw
 	bw   *bufio.Writer
-	rate *rate.Limiter // if non-nil, rate limiter to use
+	rate atomic.Pointer[rate.Limiter] // if non-nil, rate limiter to use
+
+	sendQueue atomic.Int32 // sends waiting for or holding wmu; see SendQueueDepth
+
+	zstdThreshold atomic.Int64 // if non-zero, compress sent packets at least this big
+	maxPacketSize int          // largest packet this client supports; see JumboPacketSize
+	maxSendSize   atomic.Int64 // largest packet the server accepts; zero means MaxPacketSize
 
 	// Owned by Recv:
 	peeked  int                      // bytes to discard on next Recv
@@ -60,6 +74,13 @@ type clientOpt struct {
 	ServerPub   key.NodePublic
 	CanAckPings bool
 	IsProber    bool
+
+	CanPeerPresentBatch bool
+	CanZstd             bool
+	CanDropNotify       bool
+	CanForwardAck       bool
+	CanPeerSnapshot     bool
+	MaxPacketSize       int
 }
 
 // MeshKey returns a ClientOpt to pass to the DERP server during connect to get
@@ -84,6 +105,56 @@ func CanAckPings(v bool) ClientOpt {
 	return clientOptFunc(func(o *clientOpt) { o.CanAckPings = v })
 }
 
+// CanPeerPresentBatch returns a ClientOpt to set whether it advertises
+// to the server that it's capable of receiving PeerPresentBatchMessage
+// from Recv when watching connection changes. Otherwise the server
+// sends each present peer as a separate PeerPresentMessage.
+func CanPeerPresentBatch(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanPeerPresentBatch = v })
+}
+
+// CanPeerSnapshot returns a ClientOpt to set whether it asks the
+// server for periodic snapshots of all the peers it watches, as
+// PeerSnapshotMessage from Recv, when watching connection changes. The
+// server only sends them if configured to; see
+// Server.SetWatcherSnapshotInterval.
+func CanPeerSnapshot(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanPeerSnapshot = v })
+}
+
+// CanZstd returns a ClientOpt to set whether it advertises to the
+// server that it's capable of receiving zstd-compressed packets, and
+// whether it compresses the packets it sends if the server accepts
+// them. Either way, Recv returns packets decompressed. It has no effect
+// unless the derp/derpzstd package is linked in.
+func CanZstd(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanZstd = v })
+}
+
+// CanDropNotify returns a ClientOpt to set whether it asks the server
+// to report some of the packets it drops, as PacketDroppedMessage
+// from Recv.
+func CanDropNotify(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanDropNotify = v })
+}
+
+// CanForwardAck returns a ClientOpt to set whether a mesh client asks
+// the server to periodically acknowledge the packets it forwards, as
+// ForwardAckMessage from Recv.
+func CanForwardAck(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanForwardAck = v })
+}
+
+// JumboPacketSize returns a ClientOpt to set the largest packet the
+// client supports sending and receiving, up to MaxJumboPacketSize. If
+// the server supports larger packets than MaxPacketSize too (see
+// Server.SetMaxPacketSize), the smaller of the two sizes is used in
+// both directions, as reported by Client.MaxPacketSize once the
+// server's ServerInfoMessage is received. Zero means MaxPacketSize.
+func JumboPacketSize(n int) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.MaxPacketSize = n })
+}
+
 func NewClient(privateKey key.NodePrivate, nc Conn, brw *bufio.ReadWriter, logf logger.Logf, opts ...ClientOpt) (*Client, error) {
 	var opt clientOpt
 	for _, o := range opts {
@@ -107,6 +178,13 @@ func newClient(privateKey key.NodePrivate, nc Conn, brw *bufio.ReadWriter, logf
 		canAckPings: opt.CanAckPings,
 		isProber:    opt.IsProber,
 		clock:       tstime.StdClock{},
+
+		canPeerPresentBatch: opt.CanPeerPresentBatch,
+		canZstd:             opt.CanZstd && zstdCodec != nil,
+		canDropNotify:       opt.CanDropNotify,
+		canForwardAck:       opt.CanForwardAck,
+		canPeerSnapshot:     opt.CanPeerSnapshot,
+		maxPacketSize:       opt.MaxPacketSize,
 	}
 	if opt.ServerPub.IsZero() {
 		if err := c.recvServerKey(); err != nil {
@@ -175,6 +253,30 @@ type clientInfo struct {
 
 	// IsProber is whether this client is a prober.
 	IsProber bool `json:",omitempty"`
+
+	// CanPeerPresentBatch is whether the client can decode
+	// framePeerPresentBatch frames, if it watches connections.
+	CanPeerPresentBatch bool `json:",omitempty"`
+
+	// CanZstd is whether the client can decode frameRecvPacketZstd
+	// frames.
+	CanZstd bool `json:",omitempty"`
+
+	// CanDropNotify is whether the client wants framePacketDropped
+	// frames about packets of its that the server drops.
+	CanDropNotify bool `json:",omitempty"`
+
+	// CanForwardAck is whether the client, a mesh peer, wants
+	// frameForwardAck frames acknowledging the packets it forwards.
+	CanForwardAck bool `json:",omitempty"`
+
+	// CanPeerSnapshot is whether the client, a watcher, wants
+	// periodic framePeerSnapshot frames.
+	CanPeerSnapshot bool `json:",omitempty"`
+
+	// MaxPacketSize, if greater than MaxPacketSize, is the largest
+	// packet the client supports sending and receiving.
+	MaxPacketSize int `json:",omitempty"`
 }
 
 func (c *Client) sendClientKey() error {
@@ -183,6 +285,13 @@ func (c *Client) sendClientKey() error {
 		MeshKey:     c.meshKey,
 		CanAckPings: c.canAckPings,
 		IsProber:    c.isProber,
+
+		CanPeerPresentBatch: c.canPeerPresentBatch,
+		CanZstd:             c.canZstd,
+		CanDropNotify:       c.canDropNotify,
+		CanForwardAck:       c.canForwardAck,
+		CanPeerSnapshot:     c.canPeerSnapshot,
+		MaxPacketSize:       c.maxPacketSize,
 	})
 	if err != nil {
 		return err
@@ -201,31 +310,122 @@ func (c *Client) ServerPublicKey() key.NodePublic { return c.serverKey }
 // Send sends a packet to the Tailscale node identified by dstKey.
 //
 // It is an error if the packet is larger than 64KB.
-func (c *Client) Send(dstKey key.NodePublic, pkt []byte) error { return c.send(dstKey, pkt) }
+//
+// Send is safe for concurrent use. Each packet is written as a whole,
+// never interleaved with another. Packets are written in the order
+// their Send calls were made whenever those calls are ordered, such as
+// when made from one goroutine, so the packets one goroutine sends to
+// a given destination stay in FIFO order. Only the write of each
+// frame to the connection is serialized, as it must be on one stream:
+// compressing the packet, rate limiting and encoding the frame's
+// header happen beforehand, in the caller's goroutine, without any
+// lock held.
+func (c *Client) Send(dstKey key.NodePublic, pkt []byte) error { return c.send(dstKey, pkt, c.canZstd) }
+
+// SendCompressible is like Send, but compressible says whether to
+// compress pkt for this call, regardless of CanZstd, such as to
+// compress bulky payloads without also asking the server to send
+// compressed packets. Either way, pkt is only compressed if the server
+// accepts compressed packets of its size and compressing makes it
+// smaller.
+func (c *Client) SendCompressible(dstKey key.NodePublic, pkt []byte, compressible bool) error {
+	return c.send(dstKey, pkt, compressible)
+}
 
-func (c *Client) send(dstKey key.NodePublic, pkt []byte) (ret error) {
+// ErrSendWouldBlock is returned by TrySend when the packet can't be
+// written without waiting.
+var ErrSendWouldBlock = errors.New("derp: send would block")
+
+// TrySend is like Send, but rather than wait for other writes to the
+// connection to finish, such as bulk packets being sent by other
+// goroutines, it returns an error matching ErrSendWouldBlock, so that
+// latency-sensitive callers can do something else instead. Once the
+// packet is being written, it's written in full, which may still
+// block if the connection is slow.
+func (c *Client) TrySend(dstKey key.NodePublic, pkt []byte) (ret error) {
 	defer func() {
 		if ret != nil {
-			ret = fmt.Errorf("derp.Send: %w", ret)
+			ret = fmt.Errorf("derp.TrySend: %w", ret)
 		}
 	}()
 
-	if len(pkt) > MaxPacketSize {
-		return fmt.Errorf("packet too big: %d", len(pkt))
+	hdr, pkt, err := c.sendFrame(dstKey, pkt, c.canZstd)
+	if err != nil {
+		return err
 	}
+	if !c.wmu.TryLock() {
+		return ErrSendWouldBlock
+	}
+	defer c.wmu.Unlock()
+	if !c.allowSend(pkt) {
+		return nil // drop
+	}
+	c.sendQueue.Add(1)
+	defer c.sendQueue.Add(-1)
+	return c.writeSendLocked(hdr[:], pkt)
+}
 
+// SendQueueDepth returns the number of Send, SendCompressible and
+// TrySend calls that are waiting to write their packet or writing it.
+func (c *Client) SendQueueDepth() int { return int(c.sendQueue.Load()) }
+
+func (c *Client) send(dstKey key.NodePublic, pkt []byte, compress bool) (ret error) {
+	defer func() {
+		if ret != nil {
+			ret = fmt.Errorf("derp.Send: %w", ret)
+		}
+	}()
+
+	hdr, pkt, err := c.sendFrame(dstKey, pkt, compress)
+	if err != nil {
+		return err
+	}
+	if !c.allowSend(pkt) {
+		return nil // drop
+	}
+	c.sendQueue.Add(1)
+	defer c.sendQueue.Add(-1)
 	c.wmu.Lock()
 	defer c.wmu.Unlock()
-	if c.rate != nil {
-		pktLen := frameHeaderLen + key.NodePublicRawLen + len(pkt)
-		if !c.rate.AllowN(c.clock.Now(), pktLen) {
-			return nil // drop
-		}
+	return c.writeSendLocked(hdr[:], pkt)
+}
+
+// sendFrameHeaderLen is the length of the header of a frame sending a
+// packet: the frame header and the destination key.
+const sendFrameHeaderLen = frameHeaderLen + keyLen
+
+// sendFrame returns the header and payload of the frame that sends pkt
+// to dstKey, compressing pkt if compress is true and that makes it
+// smaller.
+func (c *Client) sendFrame(dstKey key.NodePublic, pkt []byte, compress bool) (hdr [sendFrameHeaderLen]byte, payload []byte, err error) {
+	if len(pkt) > c.MaxPacketSize() {
+		return hdr, nil, fmt.Errorf("packet too big: %d", len(pkt))
 	}
-	if err := writeFrameHeader(c.bw, frameSendPacket, uint32(key.NodePublicRawLen+len(pkt))); err != nil {
-		return err
+	ft := frameSendPacket
+	if compress && !disco.LooksLikeDiscoWrapper(pkt) {
+		if z := zstdCompress(pkt, int(c.zstdThreshold.Load())); z != nil {
+			ft, pkt = frameSendPacketZstd, z
+		}
 	}
-	if _, err := c.bw.Write(dstKey.AppendTo(nil)); err != nil {
+	hdr[0] = byte(ft)
+	binary.BigEndian.PutUint32(hdr[1:frameHeaderLen], uint32(keyLen+len(pkt)))
+	dstKey.AppendTo(hdr[frameHeaderLen:frameHeaderLen]) // fills hdr's remaining capacity
+	return hdr, pkt, nil
+}
+
+// allowSend reports whether a frame with payload pkt may be sent
+// within the server's rate limit, if any, or should be dropped.
+func (c *Client) allowSend(pkt []byte) bool {
+	rl := c.rate.Load()
+	return rl == nil || rl.AllowN(c.clock.Now(), sendFrameHeaderLen+len(pkt))
+}
+
+// writeSendLocked writes the frame with header hdr and payload pkt,
+// as returned by sendFrame.
+//
+// c.wmu must be held.
+func (c *Client) writeSendLocked(hdr, pkt []byte) error {
+	if _, err := c.bw.Write(hdr); err != nil {
 		return err
 	}
 	if _, err := c.bw.Write(pkt); err != nil {
@@ -241,9 +441,14 @@ func (c *Client) ForwardPacket(srcKey, dstKey key.NodePublic, pkt []byte) (err e
 		}
 	}()
 
-	if len(pkt) > MaxPacketSize {
+	if len(pkt) > c.MaxPacketSize() {
 		return fmt.Errorf("packet too big: %d", len(pkt))
 	}
+	hdr := make([]byte, 0, frameHeaderLen+keyLen*2)
+	hdr = append(hdr, byte(frameForwardPacket))
+	hdr = binary.BigEndian.AppendUint32(hdr, uint32(keyLen*2+len(pkt)))
+	hdr = srcKey.AppendTo(hdr)
+	hdr = dstKey.AppendTo(hdr)
 
 	c.wmu.Lock()
 	defer c.wmu.Unlock()
@@ -251,19 +456,7 @@ func (c *Client) ForwardPacket(srcKey, dstKey key.NodePublic, pkt []byte) (err e
 	timer := c.clock.AfterFunc(5*time.Second, c.writeTimeoutFired)
 	defer timer.Stop()
 
-	if err := writeFrameHeader(c.bw, frameForwardPacket, uint32(keyLen*2+len(pkt))); err != nil {
-		return err
-	}
-	if _, err := c.bw.Write(srcKey.AppendTo(nil)); err != nil {
-		return err
-	}
-	if _, err := c.bw.Write(dstKey.AppendTo(nil)); err != nil {
-		return err
-	}
-	if _, err := c.bw.Write(pkt); err != nil {
-		return err
-	}
-	return c.bw.Flush()
+	return c.writeSendLocked(hdr, pkt)
 }
 
 func (c *Client) writeTimeoutFired() { c.nc.Close() }
@@ -325,6 +518,46 @@ func (c *Client) WatchConnectionChanges() error {
 	return c.bw.Flush()
 }
 
+// WatchFilter limits which peers a watcher is told about the
+// connection changes of. A peer matches if its key is in Keys or if
+// its raw 32 byte form starts with KeyPrefix.
+type WatchFilter struct {
+	Keys      []key.NodePublic
+	KeyPrefix []byte // at most 32 bytes
+}
+
+// maxWatchFilterKeys is the most keys a WatchFilter may have, to keep
+// its frame no bigger than a packet.
+const maxWatchFilterKeys = (MaxPacketSize - 1 - keyLen) / keyLen
+
+// WatchConnectionChangesFiltered is like WatchConnectionChanges, but
+// subscribes only to changes for the peers matching f. Calling it (or
+// WatchConnectionChanges) again replaces the filter and resends the
+// matching peers that are connected.
+//
+// Servers that predate filters close the connection.
+// It's a fatal error if the client wasn't created using MeshKey.
+func (c *Client) WatchConnectionChangesFiltered(f WatchFilter) error {
+	if len(f.Keys) == 0 && len(f.KeyPrefix) == 0 {
+		return errors.New("empty WatchFilter")
+	}
+	if len(f.KeyPrefix) > keyLen {
+		return fmt.Errorf("WatchFilter key prefix of %d bytes; max %d", len(f.KeyPrefix), keyLen)
+	}
+	if len(f.Keys) > maxWatchFilterKeys {
+		return fmt.Errorf("WatchFilter of %d keys; max %d", len(f.Keys), maxWatchFilterKeys)
+	}
+	b := make([]byte, 0, 1+len(f.KeyPrefix)+len(f.Keys)*keyLen)
+	b = append(b, byte(len(f.KeyPrefix)))
+	b = append(b, f.KeyPrefix...)
+	for _, k := range f.Keys {
+		b = k.AppendTo(b)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.bw, frameWatchConns, b)
+}
+
 // ClosePeer asks the server to close target's TCP connection.
 // It's a fatal error if the client wasn't created using MeshKey.
 func (c *Client) ClosePeer(target key.NodePublic) error {
@@ -361,6 +594,32 @@ type PeerGoneMessage struct {
 
 func (PeerGoneMessage) msg() {}
 
+// PacketDroppedMessage is a ReceivedMessage that indicates that the
+// server dropped a packet the client sent to Dst. It's only returned
+// by clients created with CanDropNotify, and the server only reports
+// some drops, at a limited rate.
+type PacketDroppedMessage struct {
+	Dst    key.NodePublic
+	Reason DropReasonType
+}
+
+func (PacketDroppedMessage) msg() {}
+
+// ForwardAckMessage is a ReceivedMessage in which the server
+// acknowledges the packets the client forwarded with ForwardPacket
+// since the previous ForwardAckMessage. It's only returned by mesh
+// clients created with CanForwardAck.
+type ForwardAckMessage struct {
+	Packets uint64 // packets received
+	Bytes   uint64 // bytes of the packets received
+
+	// Dropped is how many of Packets the server dropped on arrival,
+	// such as for having no client with their destination key.
+	Dropped uint64
+}
+
+func (ForwardAckMessage) msg() {}
+
 // PeerPresentMessage is a ReceivedMessage that indicates that the client
 // is connected to the server. (Only used by trusted mesh clients)
 type PeerPresentMessage struct {
@@ -372,6 +631,30 @@ type PeerPresentMessage struct {
 
 func (PeerPresentMessage) msg() {}
 
+// PeerPresentBatchMessage is a ReceivedMessage that indicates that
+// several clients are connected to the server, such as the initial
+// set of connected clients after WatchConnectionChanges. It's only
+// returned by clients created with CanPeerPresentBatch. It doesn't
+// alias the buffer passed to Recv.
+type PeerPresentBatchMessage []PeerPresentMessage
+
+func (PeerPresentBatchMessage) msg() {}
+
+// PeerSnapshotMessage is a ReceivedMessage containing one part of a
+// snapshot of all the clients connected to the server that the
+// watcher watches. Clients missing from a complete snapshot are no
+// longer connected, whatever earlier messages said. Snapshots too
+// large for one frame are split into Parts parts, sent in order. It's
+// only returned by clients created with CanPeerSnapshot. It doesn't
+// alias the buffer passed to Recv.
+type PeerSnapshotMessage struct {
+	Peers []PeerPresentMessage
+	Part  int // in the range [0, Parts)
+	Parts int
+}
+
+func (PeerSnapshotMessage) msg() {}
+
 // ServerInfoMessage is sent by the server upon first connect.
 type ServerInfoMessage struct {
 	// TokenBucketBytesPerSecond is how many bytes per second the
@@ -388,6 +671,22 @@ type ServerInfoMessage struct {
 	// Zero means unspecified. There might be a limit, but the
 	// client need not try to respect it.
 	TokenBucketBytesBurst int
+
+	// MeshKeyRejected is whether the server didn't accept the
+	// client's mesh key. It's always false if the client didn't
+	// present one, and for servers that predate reporting it.
+	MeshKeyRejected bool
+
+	// ZstdThreshold, if non-zero, is the minimum size of packets
+	// the server accepts compressed. Clients with CanZstd set
+	// compress packets at least this big when that makes them
+	// smaller.
+	ZstdThreshold int
+
+	// MaxPacketSize, if non-zero, is the largest packet the server
+	// and client agreed on sending each other, if it's larger than
+	// MaxPacketSize.
+	MaxPacketSize int
 }
 
 func (ServerInfoMessage) msg() {}
@@ -523,6 +822,9 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			sm := ServerInfoMessage{
 				TokenBucketBytesPerSecond: si.TokenBucketBytesPerSecond,
 				TokenBucketBytesBurst:     si.TokenBucketBytesBurst,
+				MeshKeyRejected:           si.MeshKeyRejected,
+				ZstdThreshold:             si.ZstdThreshold,
+				MaxPacketSize:             si.MaxPacketSize,
 			}
 			c.setSendRateLimiter(sm)
 			return sm, nil
@@ -546,6 +848,35 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			}
 			return pg, nil
 
+		case framePacketDropped:
+			if n < keyLen+1 {
+				c.logf("[unexpected] dropping short packetDropped frame from DERP server")
+				continue
+			}
+			return PacketDroppedMessage{
+				Dst:    key.NodePublicFromRaw32(mem.B(b[:keyLen])),
+				Reason: DropReasonType(b[keyLen]),
+			}, nil
+
+		case framePeerMap:
+			pm, err := parsePeerMapFrame(b)
+			if err != nil {
+				c.logf("[unexpected] dropping peerMap frame from DERP server: %v", err)
+				continue
+			}
+			return pm, nil
+
+		case frameForwardAck:
+			if n < forwardAckLen {
+				c.logf("[unexpected] dropping short forwardAck frame from DERP server")
+				continue
+			}
+			return ForwardAckMessage{
+				Packets: binary.BigEndian.Uint64(b[0:]),
+				Bytes:   binary.BigEndian.Uint64(b[8:]),
+				Dropped: binary.BigEndian.Uint64(b[16:]),
+			}, nil
+
 		case framePeerPresent:
 			if n < keyLen {
 				c.logf("[unexpected] dropping short peerPresent frame from DERP server")
@@ -553,11 +884,30 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			}
 			var msg PeerPresentMessage
 			msg.Key = key.NodePublicFromRaw32(mem.B(b[:keyLen]))
-			if n >= keyLen+16+2 {
-				msg.IPPort = netip.AddrPortFrom(
-					netip.AddrFrom16([16]byte(b[keyLen:keyLen+16])).Unmap(),
-					binary.BigEndian.Uint16(b[keyLen+16:keyLen+16+2]),
-				)
+			if n >= peerPresentLen {
+				msg.IPPort = parsePeerPresentIPPort(b)
+			}
+			return msg, nil
+
+		case framePeerPresentBatch:
+			if n < peerPresentLen || n%peerPresentLen != 0 {
+				c.logf("[unexpected] dropping malformed peerPresentBatch frame of %d bytes from DERP server", n)
+				continue
+			}
+			msg := make(PeerPresentBatchMessage, 0, n/peerPresentLen)
+			for b := b[:n]; len(b) > 0; b = b[peerPresentLen:] {
+				msg = append(msg, PeerPresentMessage{
+					Key:    key.NodePublicFromRaw32(mem.B(b[:keyLen])),
+					IPPort: parsePeerPresentIPPort(b),
+				})
+			}
+			return msg, nil
+
+		case framePeerSnapshot:
+			msg, err := parsePeerSnapshotFrame(b[:n])
+			if err != nil {
+				c.logf("[unexpected] dropping peerSnapshot frame of %d bytes from DERP server: %v", n, err)
+				continue
 			}
 			return msg, nil
 
@@ -571,6 +921,21 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			rp.Data = b[keyLen:n]
 			return rp, nil
 
+		case frameRecvPacketZstd:
+			var rp ReceivedPacket
+			if n < keyLen {
+				c.logf("[unexpected] dropping short packet from DERP server")
+				continue
+			}
+			data, err := zstdDecompress(b[keyLen:n], negotiatedMaxPacketSize(c.maxPacketSize, MaxJumboPacketSize))
+			if err != nil {
+				c.logf("[unexpected] dropping undecodable compressed packet from DERP server: %v", err)
+				continue
+			}
+			rp.Source = key.NodePublicFromRaw32(mem.B(b[:keyLen]))
+			rp.Data = data
+			return rp, nil
+
 		case framePing:
 			var pm PingMessage
 			if n < 8 {
@@ -605,17 +970,58 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 	}
 }
 
-func (c *Client) setSendRateLimiter(sm ServerInfoMessage) {
-	c.wmu.Lock()
-	defer c.wmu.Unlock()
+// parsePeerSnapshotFrame parses a framePeerSnapshot payload.
+func parsePeerSnapshotFrame(b []byte) (m PeerSnapshotMessage, err error) {
+	if len(b) < 4 || (len(b)-4)%peerPresentLen != 0 {
+		return m, errors.New("malformed peer snapshot frame")
+	}
+	m.Part = int(binary.BigEndian.Uint16(b))
+	m.Parts = int(binary.BigEndian.Uint16(b[2:]))
+	if m.Part >= m.Parts {
+		return m, errors.New("malformed peer snapshot frame")
+	}
+	m.Peers = make([]PeerPresentMessage, 0, (len(b)-4)/peerPresentLen)
+	for b := b[4:]; len(b) > 0; b = b[peerPresentLen:] {
+		m.Peers = append(m.Peers, PeerPresentMessage{
+			Key:    key.NodePublicFromRaw32(mem.B(b[:keyLen])),
+			IPPort: parsePeerPresentIPPort(b),
+		})
+	}
+	return m, nil
+}
+
+// parsePeerPresentIPPort parses the ip:port of a peer present entry
+// (as in framePeerPresent and framePeerPresentBatch) in b, which must
+// be at least peerPresentLen bytes.
+func parsePeerPresentIPPort(b []byte) netip.AddrPort {
+	return netip.AddrPortFrom(
+		netip.AddrFrom16([16]byte(b[keyLen:keyLen+16])).Unmap(),
+		binary.BigEndian.Uint16(b[keyLen+16:peerPresentLen]),
+	)
+}
 
+func (c *Client) setSendRateLimiter(sm ServerInfoMessage) {
+	c.zstdThreshold.Store(int64(sm.ZstdThreshold))
+	if sm.MaxPacketSize > 0 {
+		c.maxSendSize.Store(int64(negotiatedMaxPacketSize(sm.MaxPacketSize, c.maxPacketSize)))
+	}
 	if sm.TokenBucketBytesPerSecond == 0 {
-		c.rate = nil
+		c.rate.Store(nil)
 	} else {
-		c.rate = rate.NewLimiter(
+		c.rate.Store(rate.NewLimiter(
 			rate.Limit(sm.TokenBucketBytesPerSecond),
-			sm.TokenBucketBytesBurst)
+			sm.TokenBucketBytesBurst))
+	}
+}
+
+// MaxPacketSize returns the largest packet c may send, as agreed with
+// the server. Until the server's ServerInfoMessage is received by
+// Recv, it's MaxPacketSize.
+func (c *Client) MaxPacketSize() int {
+	if n := c.maxSendSize.Load(); n > 0 {
+		return int(n)
 	}
+	return MaxPacketSize
 }
 
 // LocalAddr returns the TCP connection's local address.
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// tlsStateKey is the context key for the TLS connection state added by
+// ContextWithTLSState.
+type tlsStateKey struct{}
+
+// ContextWithTLSState returns a copy of ctx carrying cs, the state of
+// the TLS connection a DERP connection arrived on, for passing to
+// Server.Accept when the Conn isn't the *tls.Conn itself, such as for
+// WebSocket connections. It's used to verify client certificates; see
+// SetClientCAs.
+func ContextWithTLSState(ctx context.Context, cs *tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, tlsStateKey{}, cs)
+}
+
+// tlsState returns the state of the TLS connection nc arrived on, from
+// ctx (see ContextWithTLSState) or else nc itself, or nil if there's
+// none.
+func tlsState(ctx context.Context, nc Conn) *tls.ConnectionState {
+	if cs, ok := ctx.Value(tlsStateKey{}).(*tls.ConnectionState); ok && cs != nil {
+		return cs
+	}
+	if tc, ok := nc.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		cs := tc.ConnectionState()
+		return &cs
+	}
+	return nil
+}
+
+// SetClientCAs requires clients to present a TLS client certificate
+// issued by one of the CAs in pool, for private DERP servers that must
+// be fronted with mutual TLS. The certificate's identity, its first
+// URI SAN or else its subject common name, is reported as ClientCert
+// in ConnectedClients and ConnEvent. Mesh peers, which authenticate
+// with the mesh key, needn't present one.
+//
+// The certificate is taken from the TLS state passed to Accept with
+// ContextWithTLSState, as derphttp.Handler does, or else from the Conn
+// if it's a *tls.Conn. The TLS server must request client certificates
+// (see tls.Config.ClientAuth); clients connecting without TLS are
+// rejected.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientCAs(pool *x509.CertPool) {
+	s.clientCAs = pool
+}
+
+// verifyClientCert verifies the TLS client certificate of a new
+// connection against the CAs set by SetClientCAs, returning its
+// identity. It returns the empty string and no error if no certificate
+// is required, or if a mesh peer didn't present a valid one.
+func (s *Server) verifyClientCert(ctx context.Context, nc Conn, info *clientInfo) (identity string, err error) {
+	if s.clientCAs == nil {
+		return "", nil
+	}
+	identity, err = s.verifyClientCertState(tlsState(ctx, nc))
+	if err != nil {
+		if s.isMeshClientInfo(info) {
+			return "", nil
+		}
+		s.clientCertRejects.Add(1)
+		return "", err
+	}
+	return identity, nil
+}
+
+func (s *Server) verifyClientCertState(cs *tls.ConnectionState) (identity string, err error) {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return "", errors.New("no TLS client certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         s.clientCAs,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   s.clock.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return "", fmt.Errorf("TLS client certificate: %w", err)
+	}
+	if len(leaf.URIs) > 0 {
+		return leaf.URIs[0].String(), nil
+	}
+	return leaf.Subject.CommonName, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// Embedded mode links a Server and Clients directly over any
+// io.ReadWriteCloser, without HTTP or TLS, such as for in-process
+// relays in integration tests and tsnet, or for exotic transports.
+// DERP's own handshake still authenticates both ends.
+
+// embeddedAddr is the net.Addr of an embedded connection.
+type embeddedAddr struct{}
+
+func (embeddedAddr) Network() string { return "derp-embedded" }
+func (embeddedAddr) String() string  { return "embedded" }
+
+// rwcConn adapts an io.ReadWriteCloser to a Conn. Its deadline methods
+// are passed on to the io.ReadWriteCloser if it has them, and are
+// otherwise no-ops, so the server's handshake and write timeouts don't
+// apply.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func (rwcConn) LocalAddr() net.Addr { return embeddedAddr{} }
+
+func (c rwcConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c rwcConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c rwcConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// newRWCConn returns rwc as a Conn, wrapping it if needed.
+func newRWCConn(rwc io.ReadWriteCloser) Conn {
+	if nc, ok := rwc.(Conn); ok {
+		return nc
+	}
+	return rwcConn{rwc}
+}
+
+// ServeReadWriteCloser serves a DERP client connected over rwc, which
+// needn't be a network connection, until the connection ends, and then
+// closes rwc. remoteAddr identifies the client in logs and in
+// ConnectedClients. Unless rwc has deadline methods like net.Conn's,
+// the server can't time out a client that stops reading.
+func (s *Server) ServeReadWriteCloser(ctx context.Context, rwc io.ReadWriteCloser, remoteAddr string) {
+	if ctx.Value(transportKey{}) == nil {
+		ctx = ContextWithTransport(ctx, TransportEmbedded)
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(rwc), bufio.NewWriter(rwc))
+	s.Accept(ctx, newRWCConn(rwc), brw, remoteAddr)
+}
+
+// NewClientReadWriteCloser returns a new DERP client speaking to a
+// server over rwc, such as one served by Server.ServeReadWriteCloser.
+// Closing rwc ends the connection.
+func NewClientReadWriteCloser(privateKey key.NodePrivate, rwc io.ReadWriteCloser, logf logger.Logf, opts ...ClientOpt) (*Client, error) {
+	brw := bufio.NewReadWriter(bufio.NewReader(rwc), bufio.NewWriter(rwc))
+	return NewClient(privateKey, newRWCConn(rwc), brw, logf, opts...)
+}
+
+// EmbeddedConn returns one end of a synchronous, in-memory connection
+// to s, whose other end s serves until either end is closed or ctx is
+// done. It's for in-process clients; see NewClientReadWriteCloser.
+func (s *Server) EmbeddedConn(ctx context.Context) net.Conn {
+	cc, sc := net.Pipe()
+	go s.ServeReadWriteCloser(ctx, sc, "embedded")
+	return cc
+}
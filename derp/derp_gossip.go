@@ -0,0 +1,297 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// Gossip mode is an alternative to every server in a large mesh
+// watching the connections of every other (see WatchConnectionChanges),
+// which takes N^2 watcher connections. Instead, each server subscribes
+// to the peer maps of a few others (see SubscribeGossip), which pass on
+// the maps they receive from their own subscriptions (see
+// Server.RelayPeerMap), so that every server eventually learns which
+// server every client is connected to. Packets for a client are then
+// forwarded directly to its server.
+
+const (
+	// peerMapHeaderLen is the length of the fixed part of a
+	// framePeerMap payload: 32B origin key, 8B seq, 4B TTL in
+	// seconds, 2B part, 2B parts and 1B host length.
+	peerMapHeaderLen = keyLen + 8 + 4 + 2 + 2 + 1
+
+	// maxPeerMapKeysPerFrame is the most client keys in one
+	// framePeerMap, keeping frames well under the 1MB that
+	// clients accept.
+	maxPeerMapKeysPerFrame = 8192
+
+	// defaultGossipInterval is how often a server in gossip mode
+	// sends its own peer map to its subscribers by default.
+	defaultGossipInterval = 10 * time.Second
+)
+
+// PeerMap is a summary of the clients connected to a DERP server, its
+// origin, as exchanged between meshed servers in gossip mode.
+type PeerMap struct {
+	Origin key.NodePublic // DERP key of the server the clients are connected to
+	Host   string         // hostname at which mesh peers can reach Origin
+	Seq    uint64         // increases with each newer map from Origin
+	TTL    time.Duration  // how long the map is valid for, unless replaced by a newer one
+	Keys   []key.NodePublic
+}
+
+// PeerMapMessage is a ReceivedMessage containing one part of a
+// PeerMap, with only that part's Keys. Maps too large for one frame
+// are split into several parts with the same Origin and Seq. It's
+// only returned to mesh clients that called SubscribeGossip. It
+// doesn't alias the buffer passed to Recv.
+type PeerMapMessage struct {
+	PeerMap
+	Part  int // in the range [0, Parts)
+	Parts int
+}
+
+func (PeerMapMessage) msg() {}
+
+// appendPeerMapFrames returns the framePeerMap payloads for m.
+func appendPeerMapFrames(m PeerMap) ([][]byte, error) {
+	if len(m.Host) > 255 {
+		return nil, fmt.Errorf("peer map host %q too long", m.Host)
+	}
+	parts := (len(m.Keys) + maxPeerMapKeysPerFrame - 1) / maxPeerMapKeysPerFrame
+	if parts == 0 {
+		parts = 1
+	}
+	if parts > 1<<16-1 {
+		return nil, errors.New("peer map too large")
+	}
+	ret := make([][]byte, 0, parts)
+	keys := m.Keys
+	for part := 0; part < parts; part++ {
+		n := len(keys)
+		if n > maxPeerMapKeysPerFrame {
+			n = maxPeerMapKeysPerFrame
+		}
+		b := make([]byte, 0, peerMapHeaderLen+len(m.Host)+n*keyLen)
+		b = m.Origin.AppendTo(b)
+		b = binary.BigEndian.AppendUint64(b, m.Seq)
+		b = binary.BigEndian.AppendUint32(b, uint32(m.TTL/time.Second))
+		b = binary.BigEndian.AppendUint16(b, uint16(part))
+		b = binary.BigEndian.AppendUint16(b, uint16(parts))
+		b = append(b, byte(len(m.Host)))
+		b = append(b, m.Host...)
+		for _, k := range keys[:n] {
+			b = k.AppendTo(b)
+		}
+		keys = keys[n:]
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// parsePeerMapFrame parses a framePeerMap payload.
+func parsePeerMapFrame(b []byte) (m PeerMapMessage, err error) {
+	if len(b) < peerMapHeaderLen {
+		return m, errors.New("short peer map frame")
+	}
+	m.Origin = key.NodePublicFromRaw32(mem.B(b[:keyLen]))
+	b = b[keyLen:]
+	m.Seq = binary.BigEndian.Uint64(b)
+	m.TTL = time.Duration(binary.BigEndian.Uint32(b[8:])) * time.Second
+	m.Part = int(binary.BigEndian.Uint16(b[12:]))
+	m.Parts = int(binary.BigEndian.Uint16(b[14:]))
+	hostLen := int(b[16])
+	b = b[17:]
+	if len(b) < hostLen || (len(b)-hostLen)%keyLen != 0 || m.Part >= m.Parts {
+		return m, errors.New("malformed peer map frame")
+	}
+	m.Host = string(b[:hostLen])
+	b = b[hostLen:]
+	m.Keys = make([]key.NodePublic, 0, len(b)/keyLen)
+	for ; len(b) > 0; b = b[keyLen:] {
+		m.Keys = append(m.Keys, key.NodePublicFromRaw32(mem.B(b[:keyLen])))
+	}
+	return m, nil
+}
+
+// SubscribeGossip asks the server, which must be in gossip mode (see
+// Server.SetGossip), to send its own peer map and those it relays, as
+// PeerMapMessage from Recv. It requires a mesh key.
+func (c *Client) SubscribeGossip() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := writeFrameHeader(c.bw, frameGossipSubscribe, 0); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// relayedPeerMap is a peer map received from another server, to relay
+// to gossip subscribers.
+type relayedPeerMap struct {
+	frames  [][]byte // framePeerMap payloads
+	seq     uint64
+	via     key.NodePublic // key of the mesh peer it was received from
+	expires time.Time
+}
+
+// SetGossip enables gossip mode, in which mesh peers that subscribe
+// with SubscribeGossip are sent a PeerMap of this server's clients
+// every interval, and the maps of other servers passed to
+// RelayPeerMap. host is the hostname at which mesh peers can reach
+// this server, for forwarding packets to its clients. An interval of
+// zero means the default of 10s.
+//
+// It must be called before serving begins.
+func (s *Server) SetGossip(host string, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+	s.gossipHost = host
+	s.gossipInterval = interval
+	// Start the sequence at the current time so that it keeps
+	// increasing across restarts.
+	s.gossipSeq.Store(uint64(s.clock.Now().UnixNano()))
+}
+
+// ownPeerMapFrames returns the framePeerMap payloads of a new peer map
+// of this server's clients.
+func (s *Server) ownPeerMapFrames() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ownPeerMapFramesLocked()
+}
+
+func (s *Server) ownPeerMapFramesLocked() [][]byte {
+	m := PeerMap{
+		Origin: s.publicKey,
+		Host:   s.gossipHost,
+		Seq:    s.gossipSeq.Add(1),
+		TTL:    3 * s.gossipInterval,
+		Keys:   make([]key.NodePublic, 0, len(s.clients)),
+	}
+	for k, cs := range s.clients {
+		if cs.ActiveClient() != nil {
+			m.Keys = append(m.Keys, k)
+		}
+	}
+	frames, err := appendPeerMapFrames(m)
+	if err != nil {
+		s.logf("derp: gossip: %v", err)
+		return nil
+	}
+	return frames
+}
+
+// RelayPeerMap records m, a complete peer map received from the mesh
+// peer with key via, and sends it on to this server's gossip
+// subscribers other than via and m's origin. It reports whether m was
+// newer than the last map from its origin; older maps, and this
+// server's own, are ignored.
+func (s *Server) RelayPeerMap(m PeerMap, via key.NodePublic) bool {
+	if m.Origin == s.publicKey {
+		return false
+	}
+	frames, err := appendPeerMapFrames(m)
+	if err != nil {
+		s.logf("derp: gossip: relaying map of %s: %v", m.Origin.ShortString(), err)
+		return false
+	}
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.gossipMaps[m.Origin]; ok && prev.seq >= m.Seq && now.Before(prev.expires) {
+		return false
+	}
+	for origin, rm := range s.gossipMaps {
+		if !now.Before(rm.expires) {
+			delete(s.gossipMaps, origin)
+		}
+	}
+	mak.Set(&s.gossipMaps, m.Origin, relayedPeerMap{
+		frames:  frames,
+		seq:     m.Seq,
+		via:     via,
+		expires: now.Add(m.TTL),
+	})
+	for c := range s.gossipSubs {
+		if c.key != via && c.key != m.Origin {
+			c.queuePeerMap(frames)
+		}
+	}
+	s.peerMapsRelayed.Add(1)
+	return true
+}
+
+// addGossipSubscriber subscribes c, a mesh peer, to peer maps: this
+// server's own, now and every gossipInterval, and those it relays,
+// starting with the ones it already has.
+func (s *Server) addGossipSubscriber(c *sclient) {
+	if s.gossipInterval == 0 {
+		c.logf("gossip subscription ignored; gossip mode is off")
+		return
+	}
+	if c.key == s.publicKey {
+		// We're connecting to ourself. Do nothing.
+		return
+	}
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.vlogf(1, "adding gossip subscriber; %d relayed maps to send", len(s.gossipMaps))
+	c.queuePeerMap(s.ownPeerMapFramesLocked())
+	for origin, rm := range s.gossipMaps {
+		if origin != c.key && rm.via != c.key && now.Before(rm.expires) {
+			c.queuePeerMap(rm.frames)
+		}
+	}
+	s.gossipSubs.Add(c)
+	c.gossipSubscribed.Store(true)
+}
+
+func (c *sclient) handleFrameGossipSubscribe(ft frameType, fl uint32) error {
+	if fl != 0 {
+		return fmt.Errorf("handleFrameGossipSubscribe wrong size")
+	}
+	if !c.canMesh {
+		return fmt.Errorf("insufficient permissions")
+	}
+	c.s.addGossipSubscriber(c)
+	return nil
+}
+
+// queuePeerMap queues the framePeerMap payloads of a peer map to send
+// to c. If too many are already queued, it's dropped; a newer one will
+// follow within the map's TTL.
+func (c *sclient) queuePeerMap(frames [][]byte) {
+	if len(frames) == 0 {
+		return
+	}
+	select {
+	case c.peerMapCh <- frames:
+	default:
+		c.s.peerMapsDropped.Add(1)
+	}
+}
+
+// sendPeerMap writes the framePeerMap payloads of a peer map to c.
+func (c *sclient) sendPeerMap(frames [][]byte) error {
+	for _, b := range frames {
+		c.setWriteDeadline()
+		if err := writeFrame(c.bw.bw(), framePeerMap, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
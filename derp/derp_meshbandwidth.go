@@ -0,0 +1,327 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/key"
+)
+
+// Mesh bandwidth accounting counts the traffic forwarded to and from
+// each mesh peer, by the peer's server key, rolled up by UTC day and
+// month, for operators paying for egress between regions to attribute
+// its cost. The counts are kept in a file so they survive restarts.
+
+// MeshBandwidthConfig configures mesh bandwidth accounting. See
+// SetMeshBandwidth.
+type MeshBandwidthConfig struct {
+	// File is the path of the JSON file that the counts are loaded
+	// from and saved to. Its directory is created if needed.
+	File string
+
+	// SaveInterval is how often the counts are saved. Zero means
+	// five minutes.
+	SaveInterval time.Duration
+
+	// Days and Months are how many of the most recent days and
+	// months are kept. Zero means 35 days and 13 months.
+	Days, Months int
+}
+
+func (c MeshBandwidthConfig) saveInterval() time.Duration {
+	if c.SaveInterval > 0 {
+		return c.SaveInterval
+	}
+	return 5 * time.Minute
+}
+
+func (c MeshBandwidthConfig) days() int {
+	if c.Days > 0 {
+		return c.Days
+	}
+	return 35
+}
+
+func (c MeshBandwidthConfig) months() int {
+	if c.Months > 0 {
+		return c.Months
+	}
+	return 13
+}
+
+// MeshBandwidth is the traffic forwarded to and from a mesh peer.
+// Bytes are of packet payloads, not including framing.
+type MeshBandwidth struct {
+	PacketsIn  int64 `json:"packetsIn"`  // forwarded to this server by the peer
+	BytesIn    int64 `json:"bytesIn"`    // forwarded to this server by the peer
+	PacketsOut int64 `json:"packetsOut"` // forwarded by this server to the peer
+	BytesOut   int64 `json:"bytesOut"`   // forwarded by this server to the peer
+}
+
+func (b *MeshBandwidth) add(o MeshBandwidth) {
+	b.PacketsIn += o.PacketsIn
+	b.BytesIn += o.BytesIn
+	b.PacketsOut += o.PacketsOut
+	b.BytesOut += o.BytesOut
+}
+
+// MeshBandwidthReport is the traffic forwarded to and from each mesh
+// peer, by UTC day ("2006-01-02") and month ("2006-01"), and then by
+// the peer's server key. It's the format of the file the counts are
+// saved to.
+type MeshBandwidthReport struct {
+	Daily   map[string]map[key.NodePublic]MeshBandwidth `json:"daily,omitempty"`
+	Monthly map[string]map[key.NodePublic]MeshBandwidth `json:"monthly,omitempty"`
+}
+
+const (
+	meshBandwidthDayFormat   = "2006-01-02"
+	meshBandwidthMonthFormat = "2006-01"
+)
+
+// meshBandwidth is the state of mesh bandwidth accounting.
+type meshBandwidth struct {
+	cfg MeshBandwidthConfig
+
+	mu     sync.Mutex
+	report MeshBandwidthReport
+	day    time.Time // the UTC midnight starting the day being counted
+	today  map[key.NodePublic]MeshBandwidth
+	month  map[key.NodePublic]MeshBandwidth
+}
+
+// SetMeshBandwidth enables counting the traffic forwarded to and from
+// each mesh peer, which RunMeshBandwidth loads from and saves to disk.
+//
+// It must be called before serving begins.
+func (s *Server) SetMeshBandwidth(cfg MeshBandwidthConfig) {
+	s.meshBandwidth = &meshBandwidth{cfg: cfg}
+}
+
+// noteMeshBandwidth counts a packet of n bytes forwarded from (if in)
+// or to the mesh peer with server key peer, if mesh bandwidth
+// accounting is enabled.
+func (s *Server) noteMeshBandwidth(peer key.NodePublic, in bool, n int) {
+	b := s.meshBandwidth
+	if b == nil || peer.IsZero() {
+		return
+	}
+	now := s.clock.Now().UTC()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+	for _, m := range []map[key.NodePublic]MeshBandwidth{b.today, b.month} {
+		bw := m[peer]
+		if in {
+			bw.PacketsIn++
+			bw.BytesIn += int64(n)
+		} else {
+			bw.PacketsOut++
+			bw.BytesOut += int64(n)
+		}
+		m[peer] = bw
+	}
+}
+
+// rollLocked makes b count into the day and month of now, a UTC time,
+// dropping the oldest days and months beyond those kept.
+//
+// b.mu must be held.
+func (b *meshBandwidth) rollLocked(now time.Time) {
+	if !b.day.IsZero() && now.Sub(b.day) >= 0 && now.Sub(b.day) < 24*time.Hour {
+		return
+	}
+	y, m, d := now.Date()
+	b.day = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	dayKey := b.day.Format(meshBandwidthDayFormat)
+	monthKey := b.day.Format(meshBandwidthMonthFormat)
+	if b.report.Daily == nil {
+		b.report.Daily = map[string]map[key.NodePublic]MeshBandwidth{}
+		b.report.Monthly = map[string]map[key.NodePublic]MeshBandwidth{}
+	}
+	if b.report.Daily[dayKey] == nil {
+		b.report.Daily[dayKey] = map[key.NodePublic]MeshBandwidth{}
+	}
+	if b.report.Monthly[monthKey] == nil {
+		b.report.Monthly[monthKey] = map[key.NodePublic]MeshBandwidth{}
+	}
+	b.today = b.report.Daily[dayKey]
+	b.month = b.report.Monthly[monthKey]
+	pruneOldest(b.report.Daily, b.cfg.days())
+	pruneOldest(b.report.Monthly, b.cfg.months())
+}
+
+// pruneOldest deletes all but the keep latest periods from m, whose
+// keys sort in time order.
+func pruneOldest(m map[string]map[key.NodePublic]MeshBandwidth, keep int) {
+	if len(m) <= keep {
+		return
+	}
+	periods := make([]string, 0, len(m))
+	for p := range m {
+		periods = append(periods, p)
+	}
+	sort.Strings(periods)
+	for _, p := range periods[:len(periods)-keep] {
+		delete(m, p)
+	}
+}
+
+// MeshBandwidth returns the traffic forwarded to and from each mesh
+// peer in the days and months kept, or the zero report if mesh
+// bandwidth accounting isn't enabled.
+func (s *Server) MeshBandwidth() MeshBandwidthReport {
+	var ret MeshBandwidthReport
+	b := s.meshBandwidth
+	if b == nil {
+		return ret
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret.Daily = cloneMeshBandwidthPeriods(b.report.Daily)
+	ret.Monthly = cloneMeshBandwidthPeriods(b.report.Monthly)
+	return ret
+}
+
+func cloneMeshBandwidthPeriods(m map[string]map[key.NodePublic]MeshBandwidth) map[string]map[key.NodePublic]MeshBandwidth {
+	ret := make(map[string]map[key.NodePublic]MeshBandwidth, len(m))
+	for p, peers := range m {
+		c := make(map[key.NodePublic]MeshBandwidth, len(peers))
+		for k, v := range peers {
+			c[k] = v
+		}
+		ret[p] = c
+	}
+	return ret
+}
+
+// RunMeshBandwidth loads the mesh bandwidth counts saved in the
+// configured file, if it exists, adding them to those counted so far,
+// and then saves the counts to it each SaveInterval until ctx is done,
+// when it saves them a final time. SetMeshBandwidth must have been
+// called. Errors saving the counts are logged.
+func (s *Server) RunMeshBandwidth(ctx context.Context) error {
+	b := s.meshBandwidth
+	if b == nil {
+		return errors.New("mesh bandwidth accounting not enabled")
+	}
+	if err := b.load(); err != nil {
+		return err
+	}
+	t, tc := s.clock.NewTicker(b.cfg.saveInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-tc:
+		case <-ctx.Done():
+			if err := s.saveMeshBandwidth(); err != nil {
+				s.logf("derp: mesh bandwidth: %v", err)
+			}
+			return ctx.Err()
+		}
+		if err := s.saveMeshBandwidth(); err != nil {
+			s.logf("derp: mesh bandwidth: %v", err)
+		}
+	}
+}
+
+// load adds the counts saved in b's file, if it exists, to b's.
+func (b *meshBandwidth) load() error {
+	j, err := os.ReadFile(b.cfg.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved MeshBandwidthReport
+	if err := json.Unmarshal(j, &saved); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.report.Daily == nil {
+		b.report.Daily = map[string]map[key.NodePublic]MeshBandwidth{}
+		b.report.Monthly = map[string]map[key.NodePublic]MeshBandwidth{}
+	}
+	mergeMeshBandwidthPeriods(b.report.Daily, saved.Daily)
+	mergeMeshBandwidthPeriods(b.report.Monthly, saved.Monthly)
+	pruneOldest(b.report.Daily, b.cfg.days())
+	pruneOldest(b.report.Monthly, b.cfg.months())
+	return nil
+}
+
+// mergeMeshBandwidthPeriods adds the counts in src to dst.
+func mergeMeshBandwidthPeriods(dst, src map[string]map[key.NodePublic]MeshBandwidth) {
+	for p, peers := range src {
+		if dst[p] == nil {
+			dst[p] = map[key.NodePublic]MeshBandwidth{}
+		}
+		for k, v := range peers {
+			bw := dst[p][k]
+			bw.add(v)
+			dst[p][k] = bw
+		}
+	}
+}
+
+// saveMeshBandwidth writes the mesh bandwidth counts to their file.
+func (s *Server) saveMeshBandwidth() error {
+	b := s.meshBandwidth
+	j, err := json.Marshal(s.MeshBandwidth())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.cfg.File), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(b.cfg.File, j, 0600)
+}
+
+// forwarderPeer returns the server key of the mesh peer that fwd
+// forwards to, or the zero key if it's unknown.
+func forwarderPeer(fwd PacketForwarder) key.NodePublic {
+	if m, ok := fwd.(*multiForwarder); ok {
+		fwd = m.fwd.Load()
+	}
+	if k, ok := fwd.(interface{ ServerPublicKey() key.NodePublic }); ok {
+		return k.ServerPublicKey()
+	}
+	return key.NodePublic{}
+}
+
+// ServeDebugMeshBandwidth is an HTTP handler that writes the results of
+// MeshBandwidth as JSON. The "period" query parameter, if "daily" or
+// "monthly", limits the results to those rollups.
+func (s *Server) ServeDebugMeshBandwidth(w http.ResponseWriter, r *http.Request) {
+	if s.meshBandwidth == nil {
+		http.Error(w, "mesh bandwidth accounting not enabled", http.StatusNotFound)
+		return
+	}
+	rep := s.MeshBandwidth()
+	switch r.FormValue("period") {
+	case "":
+	case "daily":
+		rep.Monthly = nil
+	case "monthly":
+		rep.Daily = nil
+	default:
+		http.Error(w, `period must be "daily" or "monthly"`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(rep)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"errors"
+	"unsafe"
+
+	"tailscale.com/types/key"
+)
+
+// PacketMiddleware wraps the relaying of packets that clients send,
+// letting integrators apply policy such as per-tenant quotas, auditing
+// or experiments without changing the server. It returns a
+// PacketForwarder that's called with each packet and that passes the
+// packet on by calling next, possibly with a different destination,
+// or drops it by returning without doing so.
+//
+// A middleware is called once for each client connection, so the
+// PacketForwarder it returns may keep per-connection state. Its
+// ForwardPacket is only called from the connection's goroutine, with
+// src the connection's key, and must not retain payload after it
+// returns. The src passed to next is ignored, and next must be called
+// at most once per packet.
+type PacketMiddleware func(next PacketForwarder) PacketForwarder
+
+// SetPacketMiddleware sets the middleware through which packets sent
+// by clients are relayed, in order from outermost to innermost.
+// Packets forwarded from mesh peers, which went through the
+// middleware of the server they were sent to, don't go through it
+// again. Packets that middleware drops are counted as dropped, with
+// reason "middleware".
+//
+// It must be called before serving begins.
+func (s *Server) SetPacketMiddleware(mws ...PacketMiddleware) {
+	s.packetMiddleware = mws
+}
+
+// relayChain returns the middleware chain through which c's packets
+// are relayed, or nil if there's no middleware.
+func (s *Server) relayChain(c *sclient) PacketForwarder {
+	if len(s.packetMiddleware) == 0 {
+		return nil
+	}
+	var f PacketForwarder = clientRelay{c}
+	for i := len(s.packetMiddleware) - 1; i >= 0; i-- {
+		f = s.packetMiddleware[i](f)
+	}
+	return f
+}
+
+// clientRelay is the innermost PacketForwarder of a client's
+// middleware chain, which relays its packets as if there were no
+// middleware.
+type clientRelay struct {
+	c *sclient
+}
+
+func (r clientRelay) String() string { return "derp-relay" }
+
+func (r clientRelay) ForwardPacket(_, dst key.NodePublic, payload []byte) error {
+	c := r.c
+	if c.relayed {
+		// The payload's buffer now belongs to the relay.
+		return errors.New("packet already relayed")
+	}
+	c.relayed = true
+	if sameBuf(payload, c.relayBuf) {
+		c.relayTookBuf = true
+	} else {
+		// The middleware passed on a slice of its own, which
+		// relayPacket mustn't put in packetBufPools, so relay a
+		// copy of it instead.
+		b := getPacketBuf(len(payload))
+		copy(b, payload)
+		payload = b
+	}
+	c.relayErr = c.relayPacket(dst, payload)
+	return c.relayErr
+}
+
+// sameBuf reports whether a and b start at the same address and have
+// the same capacity, as when a is b or a prefix of it.
+func sameBuf(a, b []byte) bool {
+	return cap(a) == cap(b) && unsafe.SliceData(a) == unsafe.SliceData(b)
+}
+
+// relayViaMiddleware relays contents, a packet from c, to the client
+// dstKey through c's middleware chain, dropping it if the chain does.
+// It takes ownership of contents.
+func (c *sclient) relayViaMiddleware(dstKey key.NodePublic, contents []byte) error {
+	c.relayed, c.relayErr = false, nil
+	c.relayBuf, c.relayTookBuf = contents, false
+	err := c.relay.ForwardPacket(c.key, dstKey, contents)
+	c.relayBuf = nil
+	if !c.relayed {
+		c.vlogf(2, "SendPacket for %s, dropped by middleware: %v", dstKey.ShortString(), err)
+		c.s.recordDrop(contents, c.key, dstKey, dropReasonMiddleware)
+		putPacketBuf(contents)
+		return nil
+	}
+	if !c.relayTookBuf {
+		putPacketBuf(contents)
+	}
+	return c.relayErr
+}
@@ -0,0 +1,247 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"tailscale.com/atomicfile"
+)
+
+// The pair audit is a record on disk of which pairs of clients the
+// server relayed the most traffic between, for operators investigating
+// abuse reports after the fact. It's kept as one snapshot file per
+// interval, each counting about the busiest pairs of that interval the
+// same way as SetPairAccounting.
+
+// PairAuditConfig configures the pair audit. See SetPairAudit.
+type PairAuditConfig struct {
+	// Dir is the directory that snapshots are written to. It's
+	// created if needed.
+	Dir string
+
+	// Pairs is roughly how many of the busiest pairs each snapshot
+	// counts, bounding memory use and snapshot size. Zero means 1000.
+	Pairs int
+
+	// Interval is the period each snapshot covers. Zero means one
+	// hour.
+	Interval time.Duration
+
+	// Retain is how long snapshots are kept before being deleted.
+	// Zero means 24 hours.
+	Retain time.Duration
+}
+
+func (c PairAuditConfig) pairs() int {
+	if c.Pairs > 0 {
+		return c.Pairs
+	}
+	return 1000
+}
+
+func (c PairAuditConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return time.Hour
+}
+
+func (c PairAuditConfig) retain() time.Duration {
+	if c.Retain > 0 {
+		return c.Retain
+	}
+	return 24 * time.Hour
+}
+
+// PairAuditSnapshot is the traffic between pairs of clients during one
+// interval, as written to disk by RunPairAudit.
+type PairAuditSnapshot struct {
+	Start time.Time
+	End   time.Time
+	Pairs []PairBandwidth // highest Bytes first
+}
+
+const pairAuditPrefix, pairAuditSuffix = "pairs-", ".json"
+
+// pairAuditTimeFormat is the format of the end time in snapshot file
+// names, which sorts in time order.
+const pairAuditTimeFormat = "20060102T150405Z"
+
+// SetPairAudit enables counting the traffic relayed between pairs of
+// clients for the pair audit, which RunPairAudit writes to disk.
+//
+// It must be called before serving begins.
+func (s *Server) SetPairAudit(cfg PairAuditConfig) {
+	s.pairAudit = cfg
+	s.pairAuditCur.Store(newPairAccounting(cfg.pairs()))
+	s.pairAuditStart = s.clock.Now()
+}
+
+func newPairAccounting(n int) *pairAccounting {
+	return &pairAccounting{max: n, index: map[keyPair]*pairEntry{}}
+}
+
+// RunPairAudit writes a snapshot of the pair audit to its directory
+// each interval, deleting those older than its retention period, until
+// ctx is done, when it writes a final snapshot. SetPairAudit must have
+// been called. Errors writing snapshots are logged.
+func (s *Server) RunPairAudit(ctx context.Context) error {
+	if s.pairAuditCur.Load() == nil {
+		return errors.New("pair audit not enabled")
+	}
+	if err := os.MkdirAll(s.pairAudit.Dir, 0700); err != nil {
+		return err
+	}
+	t, tc := s.clock.NewTicker(s.pairAudit.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-tc:
+		case <-ctx.Done():
+			if err := s.writePairAuditSnapshot(); err != nil {
+				s.logf("derp: pair audit: %v", err)
+			}
+			return ctx.Err()
+		}
+		if err := s.writePairAuditSnapshot(); err != nil {
+			s.logf("derp: pair audit: %v", err)
+		}
+		if err := s.prunePairAudit(); err != nil {
+			s.logf("derp: pair audit: %v", err)
+		}
+	}
+}
+
+// writePairAuditSnapshot writes the counts since the last snapshot to
+// a new snapshot file and starts counting afresh. Packets counted while
+// the counts are being swapped may be missed.
+func (s *Server) writePairAuditSnapshot() error {
+	now := s.clock.Now()
+	cur := s.pairAuditCur.Swap(newPairAccounting(s.pairAudit.pairs()))
+	snap := PairAuditSnapshot{
+		Start: s.pairAuditStart,
+		End:   now,
+		Pairs: cur.top(),
+	}
+	s.pairAuditStart = now
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	name := pairAuditPrefix + now.UTC().Format(pairAuditTimeFormat) + pairAuditSuffix
+	return atomicfile.WriteFile(filepath.Join(s.pairAudit.Dir, name), b, 0600)
+}
+
+// prunePairAudit deletes snapshots older than the retention period.
+func (s *Server) prunePairAudit() error {
+	cutoff := s.clock.Now().Add(-s.pairAudit.retain())
+	des, err := os.ReadDir(s.pairAudit.Dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		end, ok := pairAuditFileTime(de.Name())
+		if ok && end.Before(cutoff) {
+			if err := os.Remove(filepath.Join(s.pairAudit.Dir, de.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pairAuditFileTime returns the end time of the snapshot in the file
+// with the given name, reporting whether it's a snapshot file.
+func pairAuditFileTime(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, pairAuditPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	ts, ok = strings.CutSuffix(ts, pairAuditSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(pairAuditTimeFormat, ts)
+	return t, err == nil
+}
+
+// ReadPairAudit returns the traffic between pairs of clients in the
+// pair audit snapshots in dir that ended after since, summed across
+// snapshots, highest Bytes first. Like the snapshots, the result is
+// approximate; see PairBandwidth.
+func ReadPairAudit(dir string, since time.Time) ([]PairBandwidth, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[keyPair]*PairBandwidth{}
+	for _, de := range des {
+		end, ok := pairAuditFileTime(de.Name())
+		if !ok || !end.After(since) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var snap PairAuditSnapshot
+		if err := json.Unmarshal(b, &snap); err != nil {
+			return nil, fmt.Errorf("%s: %w", de.Name(), err)
+		}
+		for _, p := range snap.Pairs {
+			k := keyPair{p.Src, p.Dst}
+			sum, ok := sums[k]
+			if !ok {
+				sum = &PairBandwidth{Src: p.Src, Dst: p.Dst}
+				sums[k] = sum
+			}
+			sum.Bytes += p.Bytes
+			sum.MaxOverCount += p.MaxOverCount
+		}
+	}
+	ret := make([]PairBandwidth, 0, len(sums))
+	for _, p := range sums {
+		ret = append(ret, *p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Bytes > ret[j].Bytes })
+	return ret, nil
+}
+
+// ServeDebugPairAudit is an HTTP handler that writes the results of
+// ReadPairAudit as JSON, for the snapshots within the retention
+// period, or the duration given by the "since" query parameter, such
+// as "6h".
+func (s *Server) ServeDebugPairAudit(w http.ResponseWriter, r *http.Request) {
+	if s.pairAuditCur.Load() == nil {
+		http.Error(w, "pair audit not enabled", http.StatusNotFound)
+		return
+	}
+	d := s.pairAudit.retain()
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	pairs, err := ReadPairAudit(s.pairAudit.Dir, s.clock.Now().Add(-d))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(pairs)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// PingClient sends a ping to the connected client with key k and
+// returns the round-trip time until its pong, as measured by the
+// server, to tell whether relay latency is due to the server or to the
+// client's network. The client must have declared that it replies to
+// pings (see CanAckPings). It returns an error if the client isn't
+// connected or doesn't reply before ctx is done.
+func (s *Server) PingClient(ctx context.Context, k key.NodePublic) (time.Duration, error) {
+	s.mu.Lock()
+	var c *sclient
+	if set, ok := s.clients[k]; ok {
+		c = set.ActiveClient()
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return 0, errors.New("client not connected")
+	}
+	if !c.info.CanAckPings {
+		return 0, errors.New("client doesn't reply to pings")
+	}
+
+	var data [8]byte
+	if _, err := crand.Read(data[:]); err != nil {
+		return 0, err
+	}
+	pong := make(chan struct{})
+	c.pingMu.Lock()
+	mak.Set(&c.pingsOut, data, pong)
+	c.pingMu.Unlock()
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pingsOut, data)
+		c.pingMu.Unlock()
+	}()
+
+	start := s.clock.Now()
+	select {
+	case c.sendPingCh <- data:
+	case <-c.done:
+		return 0, errors.New("client disconnected")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case <-pong:
+		s.clientPingsAcked.Add(1)
+		return s.clock.Since(start), nil
+	case <-c.done:
+		return 0, errors.New("client disconnected")
+	case <-ctx.Done():
+		return 0, fmt.Errorf("no pong: %w", ctx.Err())
+	}
+}
+
+// sendPing sends a ping to the client, without flushing.
+func (c *sclient) sendPing(data [8]byte) error {
+	c.s.clientPingsSent.Add(1)
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), framePing, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
+// handleFramePong handles a client's reply to a ping from PingClient.
+// Unexpected pongs are ignored.
+func (c *sclient) handleFramePong(ft frameType, fl uint32) error {
+	var data [8]byte
+	if fl != uint32(len(data)) {
+		return fmt.Errorf("handleFramePong wrong size %v", fl)
+	}
+	if _, err := io.ReadFull(c.br, data[:]); err != nil {
+		return err
+	}
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	if ch, ok := c.pingsOut[data]; ok {
+		delete(c.pingsOut, data)
+		close(ch)
+	}
+	return nil
+}
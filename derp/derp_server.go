@@ -7,9 +7,12 @@
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
 	"context"
 	"crypto/ed25519"
 	crand "crypto/rand"
+	"crypto/subtle"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/binary"
@@ -25,8 +28,10 @@
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,6 +40,7 @@
 
 	"go4.org/mem"
 	"golang.org/x/sync/errgroup"
+	xrate "golang.org/x/time/rate"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
@@ -44,6 +50,8 @@
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/lru"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 	"tailscale.com/version"
 )
@@ -74,6 +82,23 @@ func init() {
 const (
 	perClientSendQueueDepth = 32 // packets buffered for sending
 	writeTimeout            = 2 * time.Second
+	defaultRecentClients    = 1000 // see SetRecentClientsLimit
+)
+
+// SlowClientPolicy is what a Server does when a client isn't reading
+// packets as fast as they arrive for it and its send queue is full.
+type SlowClientPolicy int
+
+const (
+	// SlowClientDropOldest drops the oldest queued packets to make
+	// room for new ones. It's the default.
+	SlowClientDropOldest SlowClientPolicy = iota
+
+	// SlowClientDisconnect drops the new packet and disconnects the
+	// client, which can then reconnect (perhaps to a less loaded
+	// server) and start afresh. Mesh peers are never disconnected
+	// under this policy; their queues drop the oldest packets.
+	SlowClientDisconnect
 )
 
 // dupPolicy is a temporary (2021-08-30) mechanism to change the policy
@@ -103,11 +128,13 @@ type Server struct {
 	publicKey   key.NodePublic
 	logf        logger.Logf
 	memSys0     uint64 // runtime.MemStats.Sys at start (or early-ish)
-	meshKey     string
+	adminToken  string
 	limitedLogf logger.Logf
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 	dupPolicy   dupPolicy
-	debug       bool
+
+	// verbosity is the current log verbosity; see SetVerbosity.
+	verbosity atomic.Int32
 
 	// Counters:
 	packetsSent, bytesSent       expvar.Int
@@ -127,20 +154,39 @@ type Server struct {
 	packetsForwardedIn           expvar.Int
 	peerGoneDisconnectedFrames   expvar.Int // number of peer disconnected frames sent
 	peerGoneNotHereFrames        expvar.Int // number of peer not here frames sent
+	packetDroppedFrames          expvar.Int // number of packet dropped frames sent
 	gotPing                      expvar.Int // number of ping frames from client
 	sentPong                     expvar.Int // number of pong frames enqueued to client
+	clientPingsSent              expvar.Int // number of pings sent to clients by PingClient
+	clientPingsAcked             expvar.Int // number of pongs received for pings sent by PingClient
+	sendBatches                  expvar.Int // number of client send loop flushes that coalesced more than one packet
+	packetsSentZstd              expvar.Int // packets sent to clients compressed
+	packetsRecvZstd              expvar.Int // packets received from clients compressed
 	accepts                      expvar.Int
 	curClients                   expvar.Int
-	curHomeClients               expvar.Int // ones with preferred
-	dupClientKeys                expvar.Int // current number of public keys we have 2+ connections for
-	dupClientConns               expvar.Int // current number of connections sharing a public key
-	dupClientConnTotal           expvar.Int // total number of accepted connections when a dup key existed
+	curHomeClients               expvar.Int       // ones with preferred
+	curClientsByFamily           metrics.LabelMap // current clients by the address family of their remote address
+	curClientsByTransport        metrics.LabelMap // current clients by the transport they connected over
+	dupClientKeys                expvar.Int       // current number of public keys we have 2+ connections for
+	idleDisconnects              expvar.Int       // number of clients disconnected for being idle
+	slowClientDisconnects        expvar.Int       // number of clients disconnected for a full send queue
+	packetsSentPriority          expvar.Int       // number of packets sent to clients from their priority lane
+	peerMapsRelayed              expvar.Int       // number of other servers' peer maps relayed to gossip subscribers
+	peerMapsDropped              expvar.Int       // number of peer maps not sent to a gossip subscriber for a full queue
+	peerSnapshotsSent            expvar.Int       // number of peer snapshots sent to watchers
+	clientCertRejects            expvar.Int       // number of connections rejected for a missing or invalid TLS client certificate
+	abuseReports                 expvar.Int       // number of offenses counted towards banning source IPs
+	bansTotal                    expvar.Int       // number of times a source IP was banned
+	banRejects                   expvar.Int       // number of connections refused from banned source IPs
+	dupClientConns               expvar.Int       // current number of connections sharing a public key
+	dupClientConnTotal           expvar.Int       // total number of accepted connections when a dup key existed
 	unknownFrames                expvar.Int
 	homeMovesIn                  expvar.Int // established clients announce home server moves in
 	homeMovesOut                 expvar.Int // established clients announce home server moves out
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
+	peerStateChangesDampened     expvar.Int       // presence notifications withheld from watchers due to flapping
 	avgQueueDuration             *uint64          // In milliseconds; accessed atomically
 	tcpRtt                       metrics.LabelMap // histogram
 
@@ -148,11 +194,118 @@ type Server struct {
 	// known peer in the network, as specified by a running tailscaled's client's LocalAPI.
 	verifyClients bool
 
+	// verifyClientFunc, if non-nil, is called to authorize each
+	// non-mesh client connection. See SetVerifyClientFunc.
+	verifyClientFunc func(ctx context.Context, clientKey key.NodePublic, srcIP netip.Addr) error
+
+	// sendQueueDepth is the number of packets buffered for sending
+	// to each client. See SetClientSendQueueDepth.
+	sendQueueDepth int
+
+	// priorityPacketSize, if non-zero, is the size of the largest
+	// packets that go in each client's priority lane, along with
+	// disco packets. See SetPriorityPacketSize.
+	priorityPacketSize int
+
+	// rateLimit is the per-client rate limit policy applied to
+	// packets sent by clients. See ClientRateLimit.
+	rateLimit ClientRateLimit
+
+	// meshKeys are the pre-shared keys that mesh peers may present,
+	// primary first. It's nil if meshing is not configured.
+	meshKeys atomic.Pointer[[]string]
+
+	// packetTap, if non-nil, is the consumer of relayed packet
+	// metadata. See SetPacketTap.
+	packetTap atomic.Pointer[packetTap]
+
+	// connHooks are called as clients connect and disconnect. See
+	// SetConnHooks.
+	connHooks ConnHooks
+
+	// flapDampening, if non-zero, is how long presence
+	// notifications to watchers are delayed (and coalesced) for
+	// client keys that are flapping.
+	flapDampening time.Duration
+
+	// zstdThreshold, if non-zero, is the minimum size of packets
+	// that are compressed when relayed. See SetZstdThreshold.
+	zstdThreshold int
+
+	// maxPacketSize is the largest packet the server supports, if
+	// clients do too. See SetMaxPacketSize.
+	maxPacketSize int
+
+	// pairBytes, if non-nil, tracks the top pairs of keys by bytes
+	// relayed. See SetPairAccounting.
+	pairBytes *pairAccounting
+
+	// pairAudit configures the pair audit, and pairAuditCur, if
+	// non-nil, counts pairs' traffic since pairAuditStart, when the
+	// last snapshot was written. See SetPairAudit.
+	pairAudit      PairAuditConfig
+	pairAuditCur   atomic.Pointer[pairAccounting]
+	pairAuditStart time.Time
+
+	// meshBandwidth, if non-nil, counts the traffic forwarded to and
+	// from each mesh peer. See SetMeshBandwidth.
+	meshBandwidth *meshBandwidth
+
+	// idleTimeout, if non-zero, is how long a non-mesh client may go
+	// without sending any frames before it's disconnected. See
+	// SetIdleTimeout.
+	idleTimeout time.Duration
+
+	// keepAlive is the interval between keep-alive frames sent to
+	// each client. See SetKeepAliveInterval.
+	keepAlive time.Duration
+
+	// writeTimeout is how long a write to a client may block
+	// before the connection is considered dead. See
+	// SetWriteTimeout.
+	writeTimeout time.Duration
+
+	// slowClientPolicy is what to do when a client's send queue
+	// is full. See SetSlowClientPolicy.
+	slowClientPolicy SlowClientPolicy
+
+	// connCapacity, if non-zero, is the number of connections at
+	// which the server reports itself not ready, and readyCheck, if
+	// non-nil, is consulted by Ready too. See SetConnCapacity and
+	// SetReadyCheck.
+	connCapacity int
+	readyCheck   func() error
+
+	// watcherSnapshotInterval, if non-zero, is how often watchers
+	// that want them are sent snapshots of the peers they watch.
+	// See SetWatcherSnapshotInterval.
+	watcherSnapshotInterval time.Duration
+
+	// clientCAs, if non-nil, are the CAs that must have issued
+	// clients' TLS client certificates. See SetClientCAs.
+	clientCAs *x509.CertPool
+
+	// upgradeAuth, if non-nil, authorizes HTTP requests to connect.
+	// See SetUpgradeAuthorizer.
+	upgradeAuth func(*http.Request) error
+
 	mu       sync.Mutex
 	closed   bool
+	draining bool                   // new connections are rejected; see Drain
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
 	clients  map[key.NodePublic]clientSet
 	watchers set.Set[*sclient] // mesh peers
+
+	// gossipHost, gossipInterval and gossipSeq configure gossip
+	// mode. See SetGossip.
+	gossipHost     string
+	gossipInterval time.Duration
+	gossipSeq      atomic.Uint64 // seq of the last of this server's own peer maps
+	// gossipSubs are the mesh peers subscribed to peer maps.
+	gossipSubs set.Set[*sclient]
+	// gossipMaps are the latest peer maps relayed from other
+	// servers, by origin.
+	gossipMaps map[key.NodePublic]relayedPeerMap
 	// clientsMesh tracks all clients in the cluster, both locally
 	// and to mesh peers.  If the value is nil, that means the
 	// peer is only local (and thus in the clients Map, but not
@@ -168,6 +321,27 @@ type Server struct {
 	// maps from netip.AddrPort to a client's public key
 	keyOfAddr map[netip.AddrPort]key.NodePublic
 
+	// connHistory is the recent connect/disconnect history of
+	// client keys, used to detect flapping clients.
+	connHistory      map[key.NodePublic]*connHistory
+	connHistorySwept time.Time // last time connHistory was swept of old entries
+
+	// recentClients are the most recently disconnected clients.
+	// See SetRecentClientsLimit.
+	recentClients lru.Cache[key.NodePublic, RecentClient]
+
+	// banPolicy is the policy for banning abusive source IPs. See
+	// SetBanPolicy.
+	banPolicy BanPolicy
+	// abuse is the offense history of source IPs, when there's a
+	// banPolicy.
+	abuse      map[netip.Addr]*abuseState
+	abuseSwept time.Time // last time abuse was swept of old entries
+
+	// packetMiddleware wraps the relaying of packets from clients.
+	// See SetPacketMiddleware.
+	packetMiddleware []PacketMiddleware
+
 	clock tstime.Clock
 }
 
@@ -282,6 +456,10 @@ func (s *dupClientSet) removeClient(c *sclient) bool {
 // typical implementation is derphttp.Client. The other implementation
 // is a multiForwarder, which this package creates as needed if a
 // public key gets more than one PacketForwarder registered for it.
+//
+// ForwardPacket must not retain payload after it returns: the Server
+// reuses its buffer for other packets. Implementations that queue
+// packets must copy them.
 type PacketForwarder interface {
 	ForwardPacket(src, dst key.NodePublic, payload []byte) error
 	String() string
@@ -305,36 +483,51 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 	runtime.ReadMemStats(&ms)
 
 	s := &Server{
-		debug:                envknob.Bool("DERP_DEBUG_LOGS"),
-		privateKey:           privateKey,
-		publicKey:            privateKey.Public(),
-		logf:                 logf,
-		limitedLogf:          logger.RateLimitedFn(logf, 30*time.Second, 5, 100),
-		packetsRecvByKind:    metrics.LabelMap{Label: "kind"},
-		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
-		packetsDroppedType:   metrics.LabelMap{Label: "type"},
-		clients:              map[key.NodePublic]clientSet{},
-		clientsMesh:          map[key.NodePublic]PacketForwarder{},
-		netConns:             map[Conn]chan struct{}{},
-		memSys0:              ms.Sys,
-		watchers:             set.Set[*sclient]{},
-		sentTo:               map[key.NodePublic]map[key.NodePublic]int64{},
-		avgQueueDuration:     new(uint64),
-		tcpRtt:               metrics.LabelMap{Label: "le"},
-		keyOfAddr:            map[netip.AddrPort]key.NodePublic{},
-		clock:                tstime.StdClock{},
+		privateKey:            privateKey,
+		publicKey:             privateKey.Public(),
+		logf:                  logf,
+		limitedLogf:           logger.RateLimitedFn(logf, 30*time.Second, 5, 100),
+		packetsRecvByKind:     metrics.LabelMap{Label: "kind"},
+		packetsDroppedReason:  metrics.LabelMap{Label: "reason"},
+		packetsDroppedType:    metrics.LabelMap{Label: "type"},
+		curClientsByFamily:    metrics.LabelMap{Label: "family"},
+		curClientsByTransport: metrics.LabelMap{Label: "transport"},
+		clients:               map[key.NodePublic]clientSet{},
+		clientsMesh:           map[key.NodePublic]PacketForwarder{},
+		netConns:              map[Conn]chan struct{}{},
+		memSys0:               ms.Sys,
+		watchers:              set.Set[*sclient]{},
+		gossipSubs:            set.Set[*sclient]{},
+		sentTo:                map[key.NodePublic]map[key.NodePublic]int64{},
+		avgQueueDuration:      new(uint64),
+		tcpRtt:                metrics.LabelMap{Label: "le"},
+		keyOfAddr:             map[netip.AddrPort]key.NodePublic{},
+		connHistory:           map[key.NodePublic]*connHistory{},
+		recentClients:         lru.Cache[key.NodePublic, RecentClient]{MaxEntries: defaultRecentClients},
+		clock:                 tstime.StdClock{},
+		sendQueueDepth:        perClientSendQueueDepth,
+		keepAlive:             keepAlive,
+		writeTimeout:          writeTimeout,
 	}
 	s.initMetacert()
+	if envknob.Bool("DERP_DEBUG_LOGS") {
+		s.verbosity.Store(2)
+	}
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
 	s.packetsRecvOther = s.packetsRecvByKind.Get("other")
+	// Must be in dropReason order.
 	s.packetsDroppedReasonCounters = []*expvar.Int{
 		s.packetsDroppedReason.Get("unknown_dest"),
 		s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
 		s.packetsDroppedReason.Get("gone_disconnected"),
-		s.packetsDroppedReason.Get("gone_not_here"),
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
+		s.packetsDroppedReason.Get("write_timeout"),
+		s.packetsDroppedReason.Get("too_large"),
+		s.packetsDroppedReason.Get("middleware"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -344,9 +537,51 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 // SetMesh sets the pre-shared key that regional DERP servers used to mesh
 // amongst themselves.
 //
-// It must be called before serving begins.
+// It's equivalent to SetMeshKeys with v as the only key.
 func (s *Server) SetMeshKey(v string) {
-	s.meshKey = v
+	s.SetMeshKeys([]string{v})
+}
+
+// SetMeshKeys sets the pre-shared keys that regional DERP servers use
+// to mesh amongst themselves. A peer presenting any of them is
+// trusted. The first is the primary key, as returned by MeshKey, and
+// empty keys are ignored.
+//
+// Unlike most setters, it may be called at any time, such as to
+// rotate the key across a region without restarting: first add the
+// new key on every server, then switch peers over to it, then remove
+// the old one. Connections already established are unaffected, even if
+// the key they presented is removed.
+func (s *Server) SetMeshKeys(keys []string) {
+	var valid []string
+	for _, k := range keys {
+		if k != "" {
+			valid = append(valid, k)
+		}
+	}
+	if len(valid) == 0 {
+		s.meshKeys.Store(nil)
+		return
+	}
+	s.meshKeys.Store(&valid)
+}
+
+// isMeshKey reports whether k is one of the server's mesh keys.
+// The empty string never is.
+func (s *Server) isMeshKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	keys := s.meshKeys.Load()
+	if keys == nil {
+		return false
+	}
+	for _, want := range *keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(want)) == 1 {
+			return true
+		}
+	}
+	return false
 }
 
 // SetVerifyClients sets whether this DERP server verifies clients through tailscaled.
@@ -356,11 +591,796 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetClientSendQueueDepth sets the number of packets buffered for
+// sending to each client (and, separately, the number of disco
+// packets). Packets arriving for a client whose queue is full are
+// dropped. Values less than one mean the default of 32.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientSendQueueDepth(n int) {
+	if n < 1 {
+		n = perClientSendQueueDepth
+	}
+	s.sendQueueDepth = n
+}
+
+// SetPriorityPacketSize sets the size in bytes of the largest packets
+// that, like disco packets, are queued to each client in a separate
+// priority lane that's written ahead of the others. Small packets
+// (pings, WireGuard handshakes and keep-alives) then aren't delayed
+// behind bursts of bulk traffic, which speeds up path discovery and
+// direct connection upgrades for clients under relay load. Zero means
+// only disco packets are prioritized.
+//
+// It must be called before serving begins.
+func (s *Server) SetPriorityPacketSize(n int) {
+	s.priorityPacketSize = n
+}
+
+// isPriorityPacket reports whether the packet b goes in its
+// destination's priority lane.
+func (s *Server) isPriorityPacket(b []byte) bool {
+	return disco.LooksLikeDiscoWrapper(b) || len(b) <= s.priorityPacketSize
+}
+
+// SetVerifyClientFunc sets an optional func that's called on every
+// client handshake with the client's node key and source IP address
+// (which is invalid if the connection isn't over IP). If it returns an
+// error, the connection is rejected and closed. This allows a private
+// DERP server to restrict relaying to a set of nodes, such as those in
+// its own tailnet.
+//
+// To deny a client, as opposed to failing to check it (such as when
+// the service it asks is unreachable), the func should return an
+// error wrapping ErrClientDenied. Only denials count as offenses
+// under the server's BanPolicy.
+//
+// The func is not called for mesh peers presenting the server's mesh
+// key. If SetVerifyClient is also enabled, both checks must pass.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClientFunc(f func(ctx context.Context, clientKey key.NodePublic, srcIP netip.Addr) error) {
+	s.verifyClientFunc = f
+}
+
+// ErrClientDenied is returned, possibly wrapped, when a client is
+// denied by the server's checks of clients. See SetVerifyClientFunc.
+var ErrClientDenied = errors.New("client denied")
+
+// ClientRateLimit is a per-client rate limit policy for a Server.
+//
+// Limits are enforced with token buckets kept per connection and
+// apply to packets that a client sends (or forwards) through the
+// server. Packets over the limit are dropped.
+//
+// The zero value means no rate limiting.
+type ClientRateLimit struct {
+	// PacketsPerSecond is the sustained number of packets per
+	// second that a client may send. Zero means unlimited.
+	PacketsPerSecond float64
+
+	// PacketsBurst is the number of packets a client may send in
+	// excess of PacketsPerSecond in a burst. If zero, it defaults
+	// to PacketsPerSecond (but at least 1).
+	PacketsBurst int
+
+	// BytesPerSecond is the sustained number of bytes per second,
+	// including DERP framing, that a client may send. Zero means
+	// unlimited.
+	//
+	// It's also advertised to clients in the server info frame so
+	// well-behaved clients can limit themselves.
+	BytesPerSecond float64
+
+	// BytesBurst is the number of bytes a client may send in
+	// excess of BytesPerSecond in a burst. If zero, it defaults to
+	// BytesPerSecond, but at least the client's max packet size
+	// plus framing.
+	BytesBurst int
+
+	// Exempt, if non-nil, reports whether the client with the
+	// provided public key is exempt from rate limiting. isMesh is
+	// whether the client authenticated with the server's mesh key.
+	//
+	// If nil, mesh peers are exempt and all other clients are
+	// limited.
+	Exempt func(k key.NodePublic, isMesh bool) bool
+}
+
+// isZero reports whether l doesn't limit anything.
+func (l ClientRateLimit) isZero() bool {
+	return l.PacketsPerSecond <= 0 && l.BytesPerSecond <= 0
+}
+
+// isExempt reports whether the client c is exempt from l.
+func (l ClientRateLimit) isExempt(c *sclient) bool {
+	if l.Exempt == nil {
+		return c.canMesh
+	}
+	return l.Exempt(c.key, c.canMesh)
+}
+
+// packetsBurst returns the effective packet burst of l.
+func (l ClientRateLimit) packetsBurst() int {
+	if l.PacketsBurst > 0 {
+		return l.PacketsBurst
+	}
+	return max(int(math.Ceil(l.PacketsPerSecond)), 1)
+}
+
+// bytesBurst returns the effective byte burst of l, for a client that
+// may send packets of up to maxPacketSize bytes.
+func (l ClientRateLimit) bytesBurst(maxPacketSize int) int {
+	if l.BytesBurst > 0 {
+		return l.BytesBurst
+	}
+	return max(int(math.Ceil(l.BytesPerSecond)), frameHeaderLen+keyLen*2+maxPacketSize)
+}
+
+// SetClientRateLimit sets the per-client rate limit policy.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(l ClientRateLimit) {
+	s.rateLimit = l
+}
+
+// PacketTapEvent is metadata about a packet relayed by a Server, as
+// passed to the func registered with SetPacketTap. It never includes
+// the packet's contents.
+type PacketTapEvent struct {
+	Src, Dst key.NodePublic
+	Len      int       // length of the packet contents, excluding DERP framing
+	Time     time.Time // when the server relayed the packet
+	FromMesh bool      // whether the packet arrived from a mesh peer
+	ToMesh   bool      // whether the packet is being forwarded to a mesh peer
+}
+
+type packetTap struct {
+	f           func(PacketTapEvent)
+	sampleOneIn int
+}
+
+// SetPacketTap registers f to be called with metadata about each
+// packet the server relays, for debugging and flow-level
+// observability. If sampleOneIn is greater than one, f is instead
+// called for a random sample of about one in sampleOneIn packets.
+//
+// f is called synchronously on the sending client's receive path, so
+// it must not block. A nil f removes the tap.
+//
+// Unlike most Server setters, it may be called at any time.
+func (s *Server) SetPacketTap(f func(PacketTapEvent), sampleOneIn int) {
+	if f == nil {
+		s.packetTap.Store(nil)
+		return
+	}
+	s.packetTap.Store(&packetTap{f: f, sampleOneIn: sampleOneIn})
+}
+
+// tapPacket reports a relayed packet to the packet tap, if enabled.
+func (s *Server) tapPacket(src, dst key.NodePublic, n int, fromMesh, toMesh bool) {
+	t := s.packetTap.Load()
+	if t == nil {
+		return
+	}
+	if t.sampleOneIn > 1 && rand.Intn(t.sampleOneIn) != 0 {
+		return
+	}
+	t.f(PacketTapEvent{
+		Src:      src,
+		Dst:      dst,
+		Len:      n,
+		Time:     s.clock.Now(),
+		FromMesh: fromMesh,
+		ToMesh:   toMesh,
+	})
+}
+
+// ConnEvent describes a client connecting to or disconnecting from
+// the server, as passed to ConnHooks.
+type ConnEvent struct {
+	Key         key.NodePublic
+	RemoteAddr  string // usually ip:port
+	IsMesh      bool   // whether the client is a mesh peer
+	IsProber    bool   // whether the client declared itself a prober
+	ClientCert  string // identity of the client's TLS client certificate; see SetClientCAs
+	UserAgent   string // User-Agent of the client's HTTP request, if any; see ContextWithClientAgent
+	Metadata    string // client-declared metadata from its HTTP request, if any; see ContextWithClientAgent
+	ConnectedAt time.Time
+
+	// Reason is why the client disconnected. It's empty for
+	// OnConnect.
+	Reason string
+}
+
+// ConnHooks are funcs that integrators can register with SetConnHooks
+// to be called as clients connect and disconnect, for things such as
+// audit logging, IP reputation checks and custom metrics. Either may
+// be nil.
+//
+// They're called synchronously on the client's connection goroutine,
+// so shouldn't block for long. To reject clients, use
+// SetVerifyClientFunc instead.
+type ConnHooks struct {
+	// OnConnect is called when a client has completed its
+	// handshake and is registered with the server.
+	OnConnect func(ConnEvent)
+
+	// OnDisconnect is called when a client that OnConnect was
+	// called for disconnects.
+	OnDisconnect func(ConnEvent)
+}
+
+// SetConnHooks sets the funcs called as clients connect and disconnect.
+//
+// It must be called before serving begins.
+func (s *Server) SetConnHooks(h ConnHooks) {
+	s.connHooks = h
+}
+
+// connEvent returns the ConnEvent describing c, with reason.
+func (c *sclient) connEvent(reason string) ConnEvent {
+	return ConnEvent{
+		Key:         c.key,
+		RemoteAddr:  c.remoteAddr,
+		IsMesh:      c.canMesh,
+		IsProber:    c.info.IsProber,
+		ClientCert:  c.clientCert,
+		UserAgent:   c.agent.userAgent,
+		Metadata:    c.agent.metadata,
+		ConnectedAt: c.connectedAt,
+		Reason:      reason,
+	}
+}
+
+// maxClientAgentLen is the most bytes of a client's User-Agent and
+// metadata that are kept, to bound the memory used per connection.
+const maxClientAgentLen = 256
+
+// clientAgent is what a client declared about itself in the HTTP
+// request it connected with.
+type clientAgent struct {
+	userAgent string
+	metadata  string
+}
+
+// clientAgentKey is the context key for ContextWithClientAgent.
+type clientAgentKey struct{}
+
+// ContextWithClientAgent returns a copy of ctx carrying the User-Agent
+// and metadata a client declared in the HTTP request it connected with,
+// for passing to Accept. They're reported, truncated, as the UserAgent
+// and Metadata of ConnectedClients and ConnEvent, so that operators
+// can take inventory of the clients and versions using their server.
+// They're not authenticated.
+func ContextWithClientAgent(ctx context.Context, userAgent, metadata string) context.Context {
+	return context.WithValue(ctx, clientAgentKey{}, clientAgent{
+		userAgent: truncateClientAgent(userAgent),
+		metadata:  truncateClientAgent(metadata),
+	})
+}
+
+func clientAgentFromContext(ctx context.Context) clientAgent {
+	a, _ := ctx.Value(clientAgentKey{}).(clientAgent)
+	return a
+}
+
+// Transports over which clients connect, as given to Accept with
+// ContextWithTransport and reported in ConnectedClients and the
+// server's metrics.
+const (
+	TransportTLS       = "tls"       // HTTP upgrade over TLS
+	TransportHTTP      = "http"      // HTTP upgrade without TLS
+	TransportWebSocket = "websocket" // WebSocket, with or without TLS
+	TransportALPN      = "alpn"      // TLS with the DERP ALPN protocol, without HTTP
+	TransportH2Connect = "h2connect" // an HTTP/2 CONNECT tunnel over TLS
+	TransportTCP       = "tcp"       // plain TCP, without TLS or HTTP
+	TransportEmbedded  = "embedded"  // see ServeReadWriteCloser
+)
+
+// transportKey is the context key for ContextWithTransport.
+type transportKey struct{}
+
+// ContextWithTransport returns a copy of ctx saying which transport a
+// connection passed to Accept with it arrived over, such as
+// TransportTLS, for the server's per-transport metrics.
+func ContextWithTransport(ctx context.Context, transport string) context.Context {
+	return context.WithValue(ctx, transportKey{}, transport)
+}
+
+// transportFromContext returns the transport set by
+// ContextWithTransport, or "other" if none was.
+func transportFromContext(ctx context.Context) string {
+	if t, ok := ctx.Value(transportKey{}).(string); ok && t != "" {
+		return t
+	}
+	return "other"
+}
+
+// addrFamily returns the address family label of a client's remote
+// address: "ipv4", "ipv6", or "other" if it's not an IP address.
+func addrFamily(ap netip.AddrPort) string {
+	switch ip := ap.Addr(); {
+	case ip.Unmap().Is4():
+		return "ipv4"
+	case ip.Is6():
+		return "ipv6"
+	}
+	return "other"
+}
+
+func truncateClientAgent(s string) string {
+	if len(s) > maxClientAgentLen {
+		return s[:maxClientAgentLen]
+	}
+	return s
+}
+
+// SetRecentClientsLimit sets how many of the most recently
+// disconnected client keys the server remembers, with when and why
+// they were last seen. See RecentClients. The default is 1000.
+// Zero or less disables it.
+//
+// It must be called before serving begins.
+func (s *Server) SetRecentClientsLimit(n int) {
+	if n <= 0 {
+		n = 0
+	}
+	s.recentClients.MaxEntries = n
+}
+
+// RecentClient is a client key that was recently disconnected from
+// the server.
+type RecentClient struct {
+	Key         key.NodePublic
+	RemoteAddr  string    // of its last connection
+	ConnectedAt time.Time // when its last connection started
+	LastSeen    time.Time // when its last connection ended
+	Reason      string    // why its last connection ended
+}
+
+// RecentClients returns the recently disconnected client keys that
+// aren't connected anymore, most recently seen first. Their number is
+// bounded by SetRecentClientsLimit.
+func (s *Server) RecentClients() []RecentClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]RecentClient, 0, s.recentClients.Len())
+	s.recentClients.ForEach(func(k key.NodePublic, rc RecentClient) {
+		if _, ok := s.clients[k]; !ok {
+			ret = append(ret, rc)
+		}
+	})
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].LastSeen.After(ret[j].LastSeen)
+	})
+	return ret
+}
+
+// RecentClient returns when and why k was last disconnected, if it's
+// among the recently disconnected keys that aren't connected anymore.
+func (s *Server) RecentClient(k key.NodePublic) (rc RecentClient, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[k]; ok {
+		return rc, false
+	}
+	return s.recentClients.PeekOk(k)
+}
+
+// noteDisconnected records in s.recentClients, and tells the
+// OnDisconnect hook, that c disconnected because of err, the error (if
+// any) that ended its connection.
+func (s *Server) noteDisconnected(c *sclient, err error) {
+	if s.recentClients.MaxEntries == 0 && s.connHooks.OnDisconnect == nil {
+		return
+	}
+	reason := c.disconnectReason.Load()
+	switch {
+	case reason != "":
+	case s.isClosed():
+		reason = "server closed"
+	case err != nil:
+		reason = err.Error()
+	default:
+		reason = "closed by client"
+	}
+	if f := s.connHooks.OnDisconnect; f != nil {
+		f(c.connEvent(reason))
+	}
+	if s.recentClients.MaxEntries == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recentClients.Set(c.key, RecentClient{
+		Key:         c.key,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		LastSeen:    s.clock.Now(),
+		Reason:      reason,
+	})
+}
+
+// refuseConn tells the client on nc, with a health frame, why its
+// connection is being refused.
+func (s *Server) refuseConn(nc Conn, bw *bufio.Writer, problem string) {
+	nc.SetDeadline(time.Now().Add(s.writeTimeout))
+	lw := &lazyBufioWriter{w: nc, lbw: bw}
+	if err := s.sendServerKey(lw); err != nil {
+		return
+	}
+	writeFrame(lw.bw(), frameHealth, []byte(problem))
+	lw.Flush()
+}
+
+// SetPairAccounting enables tracking of the bytes relayed from one
+// client key to another, for roughly the top n such pairs by volume.
+// Memory use is bounded by n, regardless of the number of pairs. See
+// TopPairs.
+//
+// Zero, the default, disables it.
+//
+// It must be called before serving begins.
+func (s *Server) SetPairAccounting(n int) {
+	if n <= 0 {
+		s.pairBytes = nil
+		return
+	}
+	s.pairBytes = newPairAccounting(n)
+}
+
+// PairBandwidth is the number of packet bytes the server relayed from
+// Src to Dst, as reported by TopPairs.
+type PairBandwidth struct {
+	Src   key.NodePublic
+	Dst   key.NodePublic
+	Bytes int64
+
+	// MaxOverCount is how many of Bytes may have been sent by other
+	// pairs. To stay within its memory bound, the server counts a
+	// new pair's traffic on top of the pair with the least traffic
+	// it replaces, so pairs that started being tracked late may be
+	// overstated by up to that amount.
+	MaxOverCount int64 `json:",omitempty"`
+}
+
+// TopPairs returns the pairs of keys that the server has relayed the
+// most bytes between since SetPairAccounting was called, highest
+// first. It returns nil if pair accounting isn't enabled.
+//
+// The counts are approximate: any pair that has sent more than the
+// total bytes relayed divided by the tracked pair limit is
+// guaranteed to be included, but Bytes may be overstated by up to
+// MaxOverCount. Connected clients' traffic is only counted about once
+// a second, so the most recent traffic may be missing.
+func (s *Server) TopPairs() []PairBandwidth {
+	if s.pairBytes == nil {
+		return nil
+	}
+	return s.pairBytes.top()
+}
+
+// ServeDebugTopPairs is an HTTP handler that writes the results of
+// TopPairs as JSON.
+func (s *Server) ServeDebugTopPairs(w http.ResponseWriter, r *http.Request) {
+	if s.pairBytes == nil {
+		http.Error(w, "pair accounting not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(s.TopPairs())
+}
+
+// keyPair is a directed pair of client keys.
+type keyPair struct {
+	src, dst key.NodePublic
+}
+
+// pairAccounting counts bytes relayed per keyPair for at most max
+// pairs, using the Space-Saving algorithm: once full, a new pair
+// replaces the tracked pair with the fewest bytes, inheriting its
+// count. That keeps the heaviest pairs tracked with bounded memory
+// and bounded error.
+type pairAccounting struct {
+	max int
+
+	mu    sync.Mutex
+	index map[keyPair]*pairEntry
+	heap  pairHeap // min-heap of index's values by Bytes
+}
+
+type pairEntry struct {
+	PairBandwidth
+	heapIdx int
+}
+
+// pairFlushInterval is how often a client's pair counts are merged
+// into the server's, and maxPairPending how many pairs it may count
+// before they're merged sooner. See sclient.notePairBytes.
+const (
+	pairFlushInterval = time.Second
+	maxPairPending    = 256
+)
+
+// notePairBytes counts n bytes relayed from src to dst for the pair
+// accounting and the pair audit, if either is enabled.
+//
+// To keep a lock shared by all clients off the packet path, the counts
+// are accumulated by c, and only merged into the server's every
+// pairFlushInterval and when c disconnects. It must only be called
+// from c's run goroutine.
+func (c *sclient) notePairBytes(src, dst key.NodePublic, n int) {
+	s := c.s
+	if s.pairBytes == nil && s.pairAuditCur.Load() == nil {
+		return
+	}
+	if c.pairPending == nil {
+		c.pairPending = make(map[keyPair]int64)
+	}
+	c.pairPending[keyPair{src, dst}] += int64(n)
+	if len(c.pairPending) >= maxPairPending || s.clock.Since(c.pairFlushedAt) >= pairFlushInterval {
+		c.flushPairBytes()
+	}
+}
+
+// flushPairBytes merges the pair counts accumulated by c into the
+// server's.
+func (c *sclient) flushPairBytes() {
+	c.pairFlushedAt = c.s.clock.Now()
+	if len(c.pairPending) == 0 {
+		return
+	}
+	c.s.addPairBytes(c.pairPending)
+	clear(c.pairPending)
+}
+
+// addPairBytes adds the bytes relayed per pair to the pair accounting
+// and the pair audit, if either is enabled.
+func (s *Server) addPairBytes(pairs map[keyPair]int64) {
+	if s.pairBytes != nil {
+		s.pairBytes.add(pairs)
+	}
+	if a := s.pairAuditCur.Load(); a != nil {
+		a.add(pairs)
+	}
+}
+
+// add adds the bytes relayed per pair to a.
+func (a *pairAccounting) add(pairs map[keyPair]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, n := range pairs {
+		a.addLocked(k, n)
+	}
+}
+
+func (a *pairAccounting) addLocked(k keyPair, n int64) {
+	e, ok := a.index[k]
+	if !ok {
+		if len(a.heap) < a.max {
+			e = &pairEntry{PairBandwidth: PairBandwidth{Src: k.src, Dst: k.dst}}
+			heap.Push(&a.heap, e)
+		} else {
+			e = a.heap[0]
+			delete(a.index, keyPair{e.Src, e.Dst})
+			e.Src, e.Dst = k.src, k.dst
+			e.MaxOverCount = e.Bytes
+		}
+		a.index[k] = e
+	}
+	e.Bytes += n
+	heap.Fix(&a.heap, e.heapIdx)
+}
+
+func (a *pairAccounting) top() []PairBandwidth {
+	a.mu.Lock()
+	ret := make([]PairBandwidth, 0, len(a.heap))
+	for _, e := range a.heap {
+		ret = append(ret, e.PairBandwidth)
+	}
+	a.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Bytes > ret[j].Bytes })
+	return ret
+}
+
+// pairHeap implements heap.Interface for pairAccounting.
+type pairHeap []*pairEntry
+
+func (h pairHeap) Len() int           { return len(h) }
+func (h pairHeap) Less(i, j int) bool { return h[i].Bytes < h[j].Bytes }
+func (h pairHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+func (h *pairHeap) Push(x any) {
+	e := x.(*pairEntry)
+	e.heapIdx = len(*h)
+	*h = append(*h, e)
+}
+func (h *pairHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// SetFlapDampening sets how long presence notifications to mesh
+// watchers are delayed for client keys that are flapping (rapidly
+// connecting and disconnecting). While delayed, changes are coalesced
+// so watchers see at most one notification per key per period d.
+//
+// Zero, the default, disables dampening.
+//
+// It must be called before serving begins.
+func (s *Server) SetFlapDampening(d time.Duration) {
+	s.flapDampening = d
+}
+
+// SetMaxPacketSize sets the largest packet the server relays, for
+// clients that support packets that large too (see JumboPacketSize),
+// up to MaxJumboPacketSize. Each client is told the largest packet it
+// may send, the smaller of n and the size it supports, and packets
+// larger than their destination supports are dropped. Larger packets
+// improve throughput for bulk traffic relayed on high-MTU paths.
+// Values less than MaxPacketSize mean MaxPacketSize.
+//
+// It must be called before serving begins.
+func (s *Server) SetMaxPacketSize(n int) {
+	s.maxPacketSize = negotiatedMaxPacketSize(n, MaxJumboPacketSize)
+}
+
+// SetZstdThreshold enables zstd compression of relayed packets of
+// at least n bytes, sent to or received from clients that support
+// it. Packets are only compressed if that makes them smaller.
+// Compression is per hop: the packets are always decompressed for
+// forwarding to mesh peers and to clients that don't support it.
+//
+// Zero, the default, disables compression. The server then never
+// sends compressed packets, nor advertises that it accepts them.
+// Compression is also disabled unless the derp/derpzstd package is
+// linked in.
+//
+// It must be called before serving begins.
+func (s *Server) SetZstdThreshold(n int) {
+	if zstdCodec == nil {
+		n = 0
+	}
+	s.zstdThreshold = n
+}
+
+// SetIdleTimeout sets how long a client may go without sending the
+// server any frames before it's disconnected, with a goodbye health
+// message saying so. It frees the resources held by clients whose
+// connections silently died, such as behind NATs that dropped their
+// mappings, sooner than TCP would notice. Mesh peers are exempt.
+//
+// Clients don't otherwise need to send anything to stay connected, so
+// d should be comfortably longer than the clients' own keepalive or
+// ping interval, if they have one.
+//
+// Zero, the default, disables the timeout.
+//
+// It must be called before serving begins.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
+// SetVerbosity sets the server's log verbosity. At the default of 0,
+// only informational messages and warnings are logged. At 1, the
+// server also logs per-connection lifecycle events such as client
+// registration, disconnection and mesh peer forwarding changes. At 2,
+// it also logs per-frame and per-packet events.
+//
+// Unlike most setters, it may be called at any time, including while
+// serving. Setting the DERP_DEBUG_LOGS environment variable starts the
+// server at verbosity 2.
+func (s *Server) SetVerbosity(level int) {
+	s.verbosity.Store(int32(level))
+}
+
+// Verbosity returns the server's current log verbosity.
+// See SetVerbosity.
+func (s *Server) Verbosity() int {
+	return int(s.verbosity.Load())
+}
+
+// ServeDebugVerbosity is an HTTP handler that reports the server's log
+// verbosity and, for POST requests with a "v" form value, changes it.
+func (s *Server) ServeDebugVerbosity(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		v, err := strconv.Atoi(r.FormValue("v"))
+		if err != nil || v < 0 {
+			http.Error(w, "bad verbosity", http.StatusBadRequest)
+			return
+		}
+		if old := s.Verbosity(); old != v {
+			s.logf("log verbosity changed from %d to %d", old, v)
+		}
+		s.SetVerbosity(v)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d\n", s.Verbosity())
+}
+
+// SetKeepAliveInterval sets the approximate interval between the
+// keep-alive frames the server sends each client. Mobile-heavy
+// deployments behind aggressive NATs may want them more often than
+// the default of 60 seconds; datacenter deployments less often.
+// Values less than or equal to zero mean the default.
+//
+// It must be called before serving begins.
+func (s *Server) SetKeepAliveInterval(d time.Duration) {
+	if d <= 0 {
+		d = keepAlive
+	}
+	s.keepAlive = d
+}
+
+// SetWriteTimeout sets how long a write to a client may block before
+// the client is considered dead and disconnected. Values less than or
+// equal to zero mean the default of 2 seconds.
+//
+// It must be called before serving begins.
+func (s *Server) SetWriteTimeout(d time.Duration) {
+	if d <= 0 {
+		d = writeTimeout
+	}
+	s.writeTimeout = d
+}
+
+// SetSlowClientPolicy sets what the server does when packets arrive
+// for a client whose send queue is full. The default is
+// SlowClientDropOldest.
+//
+// It must be called before serving begins.
+func (s *Server) SetSlowClientPolicy(p SlowClientPolicy) {
+	s.slowClientPolicy = p
+}
+
+// SetAdminToken sets a secret bearer token that, in addition to the
+// mesh key, grants access to the server's administrative HTTP API
+// (see derphttp.Handler).
+//
+// It must be called before serving begins.
+func (s *Server) SetAdminToken(v string) {
+	s.adminToken = v
+}
+
+// IsAdminToken reports whether tok grants access to the server's
+// administrative API. It must match either the admin token or one of
+// the mesh keys. The empty string is never accepted.
+func (s *Server) IsAdminToken(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(s.adminToken)) == 1 {
+		return true
+	}
+	return s.isMeshKey(tok)
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
-func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
+func (s *Server) HasMeshKey() bool { return s.meshKeys.Load() != nil }
 
-// MeshKey returns the configured mesh key, if any.
-func (s *Server) MeshKey() string { return s.meshKey }
+// MeshKey returns the primary configured mesh key, if any.
+func (s *Server) MeshKey() string {
+	if keys := s.meshKeys.Load(); keys != nil {
+		return (*keys)[0]
+	}
+	return ""
+}
+
+// MeshKeys returns all configured mesh keys, primary first.
+func (s *Server) MeshKeys() []string {
+	if keys := s.meshKeys.Load(); keys != nil {
+		return append([]string(nil), *keys...)
+	}
+	return nil
+}
 
 // PrivateKey returns the server's private key.
 func (s *Server) PrivateKey() key.NodePrivate { return s.privateKey }
@@ -394,12 +1414,166 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// DrainOptions are the options for Server.Drain.
+type DrainOptions struct {
+	// ReconnectIn and TryFor are sent to clients in the restarting
+	// frame. See ServerRestartingMessage.
+	ReconnectIn time.Duration
+	TryFor      time.Duration
+
+	// GracePeriod is how long to wait after notifying clients for
+	// them to disconnect on their own before closing the remaining
+	// connections.
+	GracePeriod time.Duration
+}
+
+// Drain gracefully shuts down the server ahead of a restart.
+//
+// It stops accepting new connections, sends all connected clients a
+// restarting frame, then waits for the grace period (or until ctx is
+// done, or all clients other than mesh peers have disconnected) while
+// continuing to relay packets for the remaining clients. It then
+// closes the server as Close does.
+func (s *Server) Drain(ctx context.Context, opts DrainOptions) error {
+	s.mu.Lock()
+	if s.closed || s.draining {
+		s.mu.Unlock()
+		return errors.New("derp: server already closed or draining")
+	}
+	s.draining = true
+	m := ServerRestartingMessage{ReconnectIn: opts.ReconnectIn, TryFor: opts.TryFor}
+	var n int
+	meshConns := make(set.Set[Conn])
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				// Mesh peers don't act on the restarting frame and
+				// stay until closed, so don't wait for them to leave.
+				meshConns.Add(c.nc)
+			} else {
+				n++
+			}
+			select {
+			case c.restartingCh <- m:
+			default:
+			}
+		})
+	}
+	closedChs := make([]chan struct{}, 0, len(s.netConns))
+	for nc, closed := range s.netConns {
+		if !meshConns.Contains(nc) {
+			closedChs = append(closedChs, closed)
+		}
+	}
+	s.mu.Unlock()
+
+	s.logf("derp: draining %d clients; closing in %v", n, opts.GracePeriod)
+
+	allClosed := make(chan struct{})
+	go func() {
+		for _, closed := range closedChs {
+			<-closed
+		}
+		close(allClosed)
+	}()
+	timer, timerC := s.clock.NewTimer(opts.GracePeriod)
+	defer timer.Stop()
+	select {
+	case <-timerC:
+	case <-allClosed:
+	case <-ctx.Done():
+	}
+	return s.Close()
+}
+
+// SetConnCapacity sets the number of connections at which Ready
+// reports that the server isn't ready for more, so that load balancers
+// send new clients elsewhere. Connections are still accepted beyond it.
+// Zero, the default, means no limit.
+//
+// It must be called before serving begins.
+func (s *Server) SetConnCapacity(n int) {
+	s.connCapacity = n
+}
+
+// SetReadyCheck sets a func that Ready calls to check readiness
+// conditions outside of the server itself, such as whether its mesh
+// connections are established. A non-nil error means not ready.
+//
+// It must be called before serving begins.
+func (s *Server) SetReadyCheck(f func() error) {
+	s.readyCheck = f
+}
+
+// Ready returns an error saying why the server isn't ready to accept
+// new clients, or nil if it is. It isn't ready if it's closed or
+// draining (see Drain), if it's at its connection capacity (see
+// SetConnCapacity), or if the func set by SetReadyCheck fails.
+func (s *Server) Ready() error {
+	s.mu.Lock()
+	closed, draining, conns := s.closed, s.draining, len(s.netConns)
+	s.mu.Unlock()
+	switch {
+	case closed:
+		return errors.New("server closed")
+	case draining:
+		return errors.New("server draining")
+	case s.connCapacity > 0 && conns >= s.connCapacity:
+		return fmt.Errorf("at capacity with %d connections", conns)
+	}
+	if s.readyCheck != nil {
+		return s.readyCheck()
+	}
+	return nil
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
 func (s *Server) isClosed() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.closed
 }
 
+// DisconnectClient closes all connections from the client with public
+// key k. Each connection is first sent a health frame saying that it
+// was disconnected by the server, after which the client reconnects.
+//
+// It reports whether any connection for k was found.
+func (s *Server) DisconnectClient(k key.NodePublic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.clients[k]
+	if !ok {
+		return false
+	}
+	set.ForeachClient(func(c *sclient) {
+		c.requestDisconnect("connection closed by DERP server administrator")
+	})
+	return true
+}
+
+// requestDisconnect asks c's sender to send a goodbye health frame
+// with the given problem text and close the connection.
+func (c *sclient) requestDisconnect(problem string) {
+	c.disconnected.Store(true)
+	select {
+	case c.disconnectCh <- problem:
+		c.disconnectReason.Store(problem)
+	default:
+		// Already requested.
+		return
+	}
+	// The sender closes the connection after the goodbye. As a
+	// backstop in case it's stuck, close it regardless once it'd
+	// have timed out writing the goodbye.
+	c.s.clock.AfterFunc(2*c.s.writeTimeout, func() { c.nc.Close() })
+}
+
 // IsClientConnectedForTest reports whether the client with specified key is connected.
 // This is used in tests to verify that nodes are connected.
 func (s *Server) IsClientConnectedForTest(k key.NodePublic) bool {
@@ -412,6 +1586,73 @@ func (s *Server) IsClientConnectedForTest(k key.NodePublic) bool {
 	return x.ActiveClient() != nil
 }
 
+// ConnectedClient describes a client connection to a Server.
+type ConnectedClient struct {
+	Key         key.NodePublic
+	RemoteAddr  string
+	ConnectedAt time.Time
+	BytesRecv   int64  // packet bytes received from the client
+	BytesSent   int64  // packet bytes sent to the client
+	IsMesh      bool   // whether the client authenticated with the mesh key
+	IsWatcher   bool   // whether the client is watching connection changes
+	IsDup       bool   // whether the key has more than one connection
+	Family      string // address family of RemoteAddr: "ipv4", "ipv6" or "other"
+	Transport   string // what the client connected over, such as TransportTLS
+
+	// ClientCert is the identity of the client's verified TLS
+	// client certificate, if SetClientCAs is in use.
+	ClientCert string
+
+	// UserAgent and Metadata are what the client declared about
+	// itself in the HTTP request it connected with, if any. See
+	// ContextWithClientAgent.
+	UserAgent string
+	Metadata  string
+
+	// Counts of packets to this client that were dropped, by cause.
+	// Drops due to a full send queue or write timeouts usually mean
+	// the client is reading too slowly, rather than that the server
+	// is overloaded.
+	DropsQueueFull    int64 // the client's send queue was full
+	DropsWriteTimeout int64 // writing to the client timed out
+	DropsTooLarge     int64 // a packet exceeded the sender's or client's max packet size
+}
+
+// ConnectedClients returns all current client connections, ordered by
+// connection time (oldest first).
+func (s *Server) ConnectedClients() []ConnectedClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]ConnectedClient, 0, len(s.clients))
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			ret = append(ret, ConnectedClient{
+				Key:         c.key,
+				RemoteAddr:  c.remoteAddr,
+				ConnectedAt: c.connectedAt,
+				BytesRecv:   c.bytesRecv.Load(),
+				BytesSent:   c.bytesSent.Load(),
+				IsMesh:      c.canMesh,
+				IsWatcher:   s.watchers.Contains(c),
+				IsDup:       c.isDup.Load(),
+				Family:      addrFamily(c.remoteIPPort),
+				Transport:   c.transport,
+				ClientCert:  c.clientCert,
+				UserAgent:   c.agent.userAgent,
+				Metadata:    c.agent.metadata,
+
+				DropsQueueFull:    c.dropsQueueFull.Load(),
+				DropsWriteTimeout: c.dropsWriteTimeout.Load(),
+				DropsTooLarge:     c.dropsTooLarge.Load(),
+			})
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ConnectedAt.Before(ret[j].ConnectedAt)
+	})
+	return ret
+}
+
 // Accept adds a new connection to the server and serves it.
 //
 // The provided bufio ReadWriter must be already connected to nc.
@@ -420,6 +1661,11 @@ func (s *Server) IsClientConnectedForTest(k key.NodePublic) bool {
 //
 // Accept closes nc.
 func (s *Server) Accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, remoteAddr string) {
+	if s.isDraining() {
+		nc.Close()
+		return
+	}
+
 	closed := make(chan struct{})
 
 	s.mu.Lock()
@@ -437,6 +1683,12 @@ func (s *Server) Accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		s.mu.Unlock()
 	}()
 
+	if retryAfter, banned := s.Banned(remoteAddr); banned {
+		s.banRejects.Add(1)
+		s.refuseConn(nc, brw.Writer, fmt.Sprintf("your IP is temporarily banned from this DERP server for abuse; retry in %v", retryAfter.Round(time.Second)))
+		return
+	}
+
 	if err := s.accept(ctx, nc, brw, remoteAddr, connNum); err != nil && !s.isClosed() {
 		s.logf("derp: %s: %v", remoteAddr, err)
 	}
@@ -503,7 +1755,7 @@ func (s *Server) registerClient(c *sclient) {
 	switch curSet := curSet.(type) {
 	case nil:
 		s.clients[c.key] = singleClient{c}
-		c.debugLogf("register single client")
+		c.vlogf(1, "register single client")
 	case singleClient:
 		s.dupClientKeys.Add(1)
 		s.dupClientConns.Add(2) // both old and new count
@@ -519,7 +1771,7 @@ func (s *Server) registerClient(c *sclient) {
 			},
 			sendHistory: []*sclient{old},
 		}
-		c.debugLogf("register duplicate client")
+		c.vlogf(1, "register duplicate client")
 	case *dupClientSet:
 		s.dupClientConns.Add(1)     // the gauge
 		s.dupClientConnTotal.Add(1) // the counter
@@ -527,7 +1779,7 @@ func (s *Server) registerClient(c *sclient) {
 		curSet.set.Add(c)
 		curSet.last = c
 		curSet.sendHistory = append(curSet.sendHistory, c)
-		c.debugLogf("register another duplicate client")
+		c.vlogf(1, "register another duplicate client")
 	}
 
 	if _, ok := s.clientsMesh[c.key]; !ok {
@@ -535,7 +1787,206 @@ func (s *Server) registerClient(c *sclient) {
 	}
 	s.keyOfAddr[c.remoteIPPort] = c.key
 	s.curClients.Add(1)
-	s.broadcastPeerStateChangeLocked(c.key, c.remoteIPPort, true)
+	s.curClientsByFamily.Add(addrFamily(c.remoteIPPort), 1)
+	s.curClientsByTransport.Add(c.transport, 1)
+	s.notePeerStateChangeLocked(c.key, c.remoteIPPort, true)
+}
+
+const (
+	// flapWindow is the period over which a client key's connection
+	// history is considered when deciding whether it's flapping.
+	flapWindow = time.Minute
+
+	// flapConnects is the number of connects within flapWindow at
+	// or above which a client key is considered to be flapping.
+	flapConnects = 5
+
+	// maxConnHistory is the maximum number of connection events
+	// kept per client key.
+	maxConnHistory = 32
+)
+
+// connEvent is a connect or disconnect of a client key.
+type connEvent struct {
+	at        time.Time
+	connected bool
+}
+
+// connHistory is the recent connection history of a client key.
+//
+// All fields are guarded by Server.mu.
+type connHistory struct {
+	events []connEvent // oldest first; at most maxConnHistory
+
+	// pending, if non-nil, is the most recent presence change for
+	// the key that's being withheld from watchers because the key
+	// is flapping.
+	pending *peerConnState
+
+	// announced is the last presence state broadcast to watchers,
+	// if announcedValid.
+	announced      peerConnState
+	announcedValid bool
+}
+
+func (h *connHistory) add(now time.Time, connected bool) {
+	if len(h.events) == maxConnHistory {
+		n := copy(h.events, h.events[1:])
+		h.events = h.events[:n]
+	}
+	h.events = append(h.events, connEvent{at: now, connected: connected})
+}
+
+// counts returns the number of connects and disconnects since
+// now-flapWindow.
+func (h *connHistory) counts(now time.Time) (connects, disconnects int) {
+	for _, e := range h.events {
+		if now.Sub(e.at) > flapWindow {
+			continue
+		}
+		if e.connected {
+			connects++
+		} else {
+			disconnects++
+		}
+	}
+	return
+}
+
+func (h *connHistory) isFlapping(now time.Time) bool {
+	connects, _ := h.counts(now)
+	return connects >= flapConnects
+}
+
+// last returns the most recent event of the given kind, or the zero
+// time if none.
+func (h *connHistory) last(connected bool) time.Time {
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].connected == connected {
+			return h.events[i].at
+		}
+	}
+	return time.Time{}
+}
+
+// notePeerStateChangeLocked records that peer connected or
+// disconnected and notifies watchers, unless the peer is flapping and
+// flap dampening is enabled, in which case the notification is
+// delayed.
+//
+// s.mu must be held.
+func (s *Server) notePeerStateChangeLocked(peer key.NodePublic, ipPort netip.AddrPort, present bool) {
+	now := s.clock.Now()
+	s.sweepConnHistoryLocked(now)
+	h, ok := s.connHistory[peer]
+	if !ok {
+		h = new(connHistory)
+		s.connHistory[peer] = h
+	}
+	h.add(now, present)
+
+	pcs := peerConnState{peer: peer, present: present, ipPort: ipPort}
+	if h.pending != nil {
+		// Already withholding a change; just update it.
+		*h.pending = pcs
+		s.peerStateChangesDampened.Add(1)
+		return
+	}
+	if s.flapDampening > 0 && h.isFlapping(now) {
+		h.pending = &pcs
+		s.peerStateChangesDampened.Add(1)
+		s.clock.AfterFunc(s.flapDampening, func() { s.flushDampenedPeerState(peer) })
+		return
+	}
+	h.announced, h.announcedValid = pcs, true
+	s.broadcastPeerStateChangeLocked(peer, ipPort, present)
+}
+
+// flushDampenedPeerState broadcasts peer's withheld presence change,
+// if any, to watchers.
+func (s *Server) flushDampenedPeerState(peer key.NodePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.connHistory[peer]
+	if !ok || h.pending == nil {
+		return
+	}
+	pcs := *h.pending
+	h.pending = nil
+	if h.announcedValid && h.announced == pcs {
+		// Flapped back to the state watchers already know about.
+		return
+	}
+	h.announced, h.announcedValid = pcs, true
+	s.broadcastPeerStateChangeLocked(pcs.peer, pcs.ipPort, pcs.present)
+}
+
+// sweepConnHistoryLocked removes connection history for keys that
+// haven't had any events within flapWindow. To keep it cheap, it only
+// does work once per flapWindow.
+//
+// s.mu must be held.
+func (s *Server) sweepConnHistoryLocked(now time.Time) {
+	if now.Sub(s.connHistorySwept) < flapWindow {
+		return
+	}
+	s.connHistorySwept = now
+	for k, h := range s.connHistory {
+		if h.pending == nil && now.Sub(h.events[len(h.events)-1].at) > flapWindow {
+			delete(s.connHistory, k)
+		}
+	}
+}
+
+// FlappingClient describes a client key that's been rapidly
+// connecting and disconnecting.
+type FlappingClient struct {
+	Key            key.NodePublic
+	Connects       int       // connects within the flap window
+	Disconnects    int       // disconnects within the flap window
+	LastConnect    time.Time `json:",omitempty"`
+	LastDisconnect time.Time `json:",omitempty"`
+	Connected      bool      // whether the key is currently connected
+	Dampened       bool      // whether presence notifications are currently being withheld
+}
+
+// FlappingClients returns the client keys that are currently
+// considered to be flapping.
+func (s *Server) FlappingClients() []FlappingClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	var ret []FlappingClient
+	for k, h := range s.connHistory {
+		if !h.isFlapping(now) {
+			continue
+		}
+		connects, disconnects := h.counts(now)
+		_, connected := s.clients[k]
+		ret = append(ret, FlappingClient{
+			Key:            k,
+			Connects:       connects,
+			Disconnects:    disconnects,
+			LastConnect:    h.last(true),
+			LastDisconnect: h.last(false),
+			Connected:      connected,
+			Dampened:       h.pending != nil,
+		})
+	}
+	return ret
+}
+
+// ServeDebugFlapping is an HTTP handler that writes the currently
+// flapping clients as JSON.
+func (s *Server) ServeDebugFlapping(w http.ResponseWriter, r *http.Request) {
+	fc := s.FlappingClients()
+	if fc == nil {
+		fc = []FlappingClient{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(fc)
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
@@ -545,6 +1996,9 @@ func (s *Server) registerClient(c *sclient) {
 // s.mu must be held.
 func (s *Server) broadcastPeerStateChangeLocked(peer key.NodePublic, ipPort netip.AddrPort, present bool) {
 	for w := range s.watchers {
+		if !w.watchFilter.matches(peer) {
+			continue
+		}
 		w.peerStateChange = append(w.peerStateChange, peerConnState{
 			peer:    peer,
 			present: present,
@@ -564,15 +2018,15 @@ func (s *Server) unregisterClient(c *sclient) {
 	case nil:
 		c.logf("[unexpected]; clients map is empty")
 	case singleClient:
-		c.debugLogf("removed connection")
+		c.vlogf(1, "removed connection")
 		delete(s.clients, c.key)
 		if v, ok := s.clientsMesh[c.key]; ok && v == nil {
 			delete(s.clientsMesh, c.key)
 			s.notePeerGoneFromRegionLocked(c.key)
 		}
-		s.broadcastPeerStateChangeLocked(c.key, netip.AddrPort{}, false)
+		s.notePeerStateChangeLocked(c.key, netip.AddrPort{}, false)
 	case *dupClientSet:
-		c.debugLogf("removed duplicate client")
+		c.vlogf(1, "removed duplicate client")
 		if set.removeClient(c) {
 			s.dupClientConns.Add(-1)
 		} else {
@@ -596,11 +2050,14 @@ func (s *Server) unregisterClient(c *sclient) {
 
 	if c.canMesh {
 		delete(s.watchers, c)
+		delete(s.gossipSubs, c)
 	}
 
 	delete(s.keyOfAddr, c.remoteIPPort)
 
 	s.curClients.Add(-1)
+	s.curClientsByFamily.Add(addrFamily(c.remoteIPPort), -1)
+	s.curClientsByTransport.Add(c.transport, -1)
 	if c.preferred {
 		s.curHomeClients.Add(-1)
 	}
@@ -646,7 +2103,9 @@ func (c *sclient) requestPeerGoneWriteLimited(peer key.NodePublic, contents []by
 	}
 }
 
-func (s *Server) addWatcher(c *sclient) {
+// addWatcher adds c as a watcher of the peers matching f, which is nil
+// to watch all peers, replacing any previous filter.
+func (s *Server) addWatcher(c *sclient, f *watchFilter) {
 	if !c.canMesh {
 		panic("invariant: addWatcher called without permissions")
 	}
@@ -658,9 +2117,14 @@ func (s *Server) addWatcher(c *sclient) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	c.vlogf(1, "adding mesh watcher; %d clients to send", len(s.clients))
+	c.watchFilter = f
 
-	// Queue messages for each already-connected client.
+	// Queue messages for each already-connected matching client.
 	for peer, clientSet := range s.clients {
+		if !f.matches(peer) {
+			continue
+		}
 		ac := clientSet.ActiveClient()
 		if ac == nil {
 			continue
@@ -679,6 +2143,17 @@ func (s *Server) addWatcher(c *sclient) {
 	go c.requestMeshUpdate()
 }
 
+// SetWatcherSnapshotInterval sets how often watchers that declare
+// CanPeerSnapshot are sent a snapshot of all the connected peers they
+// watch, so that they can correct any drift in their view from missed
+// updates, such as after a bug or a dropped write, without having to
+// reconnect. Zero, the default, means never.
+//
+// It must be called before serving begins.
+func (s *Server) SetWatcherSnapshotInterval(d time.Duration) {
+	s.watcherSnapshotInterval = d
+}
+
 func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, remoteAddr string, connNum int64) error {
 	br := brw.Reader
 	nc.SetDeadline(time.Now().Add(10 * time.Second))
@@ -687,11 +2162,28 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		return fmt.Errorf("send server key: %v", err)
 	}
 	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
 	clientKey, clientInfo, err := s.recvClientKey(br)
 	if err != nil {
+		// Only count protocol violations, not a connection that
+		// failed or timed out, as a flaky link's may.
+		if errors.As(err, new(protocolError)) {
+			s.noteOffense(remoteIPPort.Addr(), "failed handshake")
+		}
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+	if err := s.verifyClient(ctx, clientKey, clientInfo, remoteIPPort.Addr()); err != nil {
+		// Only count explicit denials, not a verifier that failed,
+		// so that an outage of it doesn't get legitimate clients
+		// banned.
+		if errors.Is(err, ErrClientDenied) {
+			s.noteOffense(remoteIPPort.Addr(), "rejected client")
+		}
+		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	}
+	clientCert, err := s.verifyClientCert(ctx, nc, clientInfo)
+	if err != nil {
+		s.noteOffense(remoteIPPort.Addr(), "rejected client certificate")
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -701,8 +2193,6 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
-
 	c := &sclient{
 		connNum:        connNum,
 		s:              s,
@@ -714,17 +2204,26 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		done:           ctx.Done(),
 		remoteAddr:     remoteAddr,
 		remoteIPPort:   remoteIPPort,
+		clientCert:     clientCert,
+		agent:          clientAgentFromContext(ctx),
+		transport:      transportFromContext(ctx),
 		connectedAt:    s.clock.Now(),
-		sendQueue:      make(chan pkt, perClientSendQueueDepth),
-		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
+		sendQueue:      make(chan pkt, s.sendQueueDepth),
+		discoSendQueue: make(chan pkt, s.sendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
+		sendPingCh:     make(chan [8]byte),
+		disconnectCh:   make(chan string, 1),
+		restartingCh:   make(chan ServerRestartingMessage, 1),
 		peerGone:       make(chan peerGoneMsg),
-		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		dropNotify:     make(chan dropNotifyMsg, 1),
+		canMesh:        s.isMeshClientInfo(clientInfo),
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
+		dropNotifyLim:  rate.NewLimiter(rate.Every(time.Second), 3),
 	}
 
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+		c.peerMapCh = make(chan [][]byte, 64)
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -732,24 +2231,34 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 			c.debug = true
 		}
 	}
-	if s.debug {
-		c.debug = true
-	}
+	c.maxPacketSize = negotiatedMaxPacketSize(s.maxPacketSize, c.info.MaxPacketSize)
+	c.initRateLimiters()
+	c.relay = s.relayChain(c)
 
 	s.registerClient(c)
 	defer s.unregisterClient(c)
+	if f := s.connHooks.OnConnect; f != nil {
+		f(c.connEvent(""))
+	}
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c)
 	if err != nil {
-		return fmt.Errorf("send server info: %v", err)
+		err = fmt.Errorf("send server info: %v", err)
+		s.noteDisconnected(c, err)
+		return err
 	}
 
-	return c.run(ctx)
+	err = c.run(ctx)
+	s.noteDisconnected(c, err)
+	return err
 }
 
-func (s *Server) debugLogf(format string, v ...any) {
-	if s.debug {
-		s.logf(format, v...)
+// vlogf logs the provided message if the server's verbosity is at
+// least level, prefixed with "[v1] " or "[v2] " to match the
+// logtail verbosity convention.
+func (s *Server) vlogf(level int, format string, v ...any) {
+	if int(s.verbosity.Load()) >= level {
+		s.logf(fmt.Sprintf("[v%d] ", level)+format, v...)
 	}
 }
 
@@ -762,6 +2271,8 @@ func (s *Server) debugLogf(format string, v ...any) {
 // run serves the client until there's an error.
 // If the client hangs up or the server is closed, run returns nil, otherwise run returns an error.
 func (c *sclient) run(ctx context.Context) error {
+	defer c.flushPairBytes()
+
 	// Launch sender, but don't return from run until sender goroutine is done.
 	var grp errgroup.Group
 	sendCtx, cancelSender := context.WithCancel(ctx)
@@ -771,51 +2282,94 @@ func (c *sclient) run(ctx context.Context) error {
 		cancelSender()
 		if err := grp.Wait(); err != nil && !c.s.isClosed() {
 			if errors.Is(err, context.Canceled) {
-				c.debugLogf("sender canceled by reader exiting")
+				c.vlogf(1, "sender canceled by reader exiting")
 			} else {
 				c.logf("sender failed: %v", err)
 			}
 		}
 	}()
 
+	idleTimeout := c.s.idleTimeout
+	if c.canMesh {
+		idleTimeout = 0
+	}
 	for {
+		if idleTimeout > 0 {
+			// Only the wait for the next frame to start is bounded.
+			// Once its first byte is in, lift the deadline, so that
+			// a frame arriving slowly isn't cut off partway through,
+			// leaving the stream misaligned.
+			c.nc.SetReadDeadline(time.Now().Add(idleTimeout))
+			_, err := c.br.Peek(1)
+			c.nc.SetReadDeadline(time.Time{})
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// Nothing of a frame has been read, so it's safe to
+				// keep reading: ask the sender to say goodbye and
+				// close the connection, and read until it has.
+				c.s.idleDisconnects.Add(1)
+				c.logf("closing; idle for %v", idleTimeout)
+				c.requestDisconnect(fmt.Sprintf("disconnected by DERP server after %v without any frames from client", idleTimeout))
+				idleTimeout = 0
+				continue
+			}
+		}
 		ft, fl, err := readFrameHeader(c.br)
-		c.debugLogf("read frame type %d len %d err %v", ft, fl, err)
+		c.vlogf(2, "read frame type %d len %d err %v", ft, fl, err)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				c.debugLogf("read EOF")
+				c.vlogf(1, "read EOF")
 				return nil
 			}
 			if c.s.isClosed() {
 				c.logf("closing; server closed")
 				return nil
 			}
+			if c.disconnected.Load() {
+				c.logf("closing; disconnected by server")
+				return nil
+			}
 			return fmt.Errorf("client %s: readFrameHeader: %w", c.key.ShortString(), err)
 		}
 		c.s.noteClientActivity(c)
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
-		case frameSendPacket:
+		case frameSendPacket, frameSendPacketZstd:
 			err = c.handleFrameSendPacket(ft, fl)
 		case frameForwardPacket:
 			err = c.handleFrameForwardPacket(ft, fl)
 		case frameWatchConns:
 			err = c.handleFrameWatchConns(ft, fl)
+		case frameGossipSubscribe:
+			err = c.handleFrameGossipSubscribe(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
 		case framePing:
 			err = c.handleFramePing(ft, fl)
+		case framePong:
+			err = c.handleFramePong(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
 		if err != nil {
+			if !isConnError(err) && !c.s.isClosed() {
+				c.s.noteOffense(c.remoteIPPort.Addr(), "malformed frame")
+			}
 			return err
 		}
 	}
 }
 
+// maxUnknownFrameLen is the longest frame of an unknown type that a
+// client may send, such as one from a newer protocol version that's
+// ignored. It's room for the largest packet and two keys, the most that
+// any known frame carries.
+const maxUnknownFrameLen = MaxJumboPacketSize + 2*keyLen
+
 func (c *sclient) handleUnknownFrame(ft frameType, fl uint32) error {
+	if fl > maxUnknownFrameLen {
+		return fmt.Errorf("unknown frame type 0x%X too large: %v", ft, fl)
+	}
 	_, err := io.CopyN(io.Discard, c.br, int64(fl))
 	return err
 }
@@ -833,16 +2387,63 @@ func (c *sclient) handleFrameNotePreferred(ft frameType, fl uint32) error {
 }
 
 func (c *sclient) handleFrameWatchConns(ft frameType, fl uint32) error {
-	if fl != 0 {
+	if fl > 1+keyLen+maxWatchFilterKeys*keyLen {
 		return fmt.Errorf("handleFrameWatchConns wrong size")
 	}
 	if !c.canMesh {
 		return fmt.Errorf("insufficient permissions")
 	}
-	c.s.addWatcher(c)
+	var f *watchFilter
+	if fl > 0 {
+		b := make([]byte, fl)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			return err
+		}
+		var err error
+		if f, err = parseWatchFilter(b); err != nil {
+			return fmt.Errorf("handleFrameWatchConns: %w", err)
+		}
+	}
+	c.s.addWatcher(c, f)
 	return nil
 }
 
+// watchFilter is the parsed form of a WatchFilter from a
+// frameWatchConns payload.
+type watchFilter struct {
+	keys   set.Set[key.NodePublic]
+	prefix []byte
+}
+
+func parseWatchFilter(b []byte) (*watchFilter, error) {
+	n := int(b[0])
+	b = b[1:]
+	if n > keyLen || n > len(b) || (len(b)-n)%keyLen != 0 {
+		return nil, errors.New("malformed filter")
+	}
+	f := &watchFilter{prefix: b[:n]}
+	for b = b[n:]; len(b) > 0; b = b[keyLen:] {
+		mak.Set(&f.keys, key.NodePublicFromRaw32(mem.B(b[:keyLen])), struct{}{})
+	}
+	if len(f.prefix) == 0 && len(f.keys) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	return f, nil
+}
+
+// matches reports whether f, which may be nil to match everything,
+// matches k.
+func (f *watchFilter) matches(k key.NodePublic) bool {
+	if f == nil || f.keys.Contains(k) {
+		return true
+	}
+	if len(f.prefix) == 0 {
+		return false
+	}
+	raw := k.Raw32()
+	return bytes.HasPrefix(raw[:], f.prefix)
+}
+
 func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
 	c.s.gotPing.Add(1)
 	var m PingMessage
@@ -910,11 +2511,24 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	}
 	s := c.s
 
-	srcKey, dstKey, contents, err := s.recvForwardPacket(c.br, fl)
+	srcKey, dstKey, contents, err := s.recvForwardPacket(c.br, fl, c.maxPacketSize)
 	if err != nil {
+		s.recordTooLarge(err, srcKey, dstKey)
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
 	s.packetsForwardedIn.Add(1)
+	s.noteMeshBandwidth(c.key, true, len(contents))
+	c.bytesRecv.Add(int64(len(contents)))
+	if c.info.CanForwardAck {
+		c.fwdAckPackets.Add(1)
+		c.fwdAckBytes.Add(uint64(len(contents)))
+	}
+	if !c.allowSend(fl) {
+		s.recordDrop(contents, srcKey, dstKey, dropReasonRateLimited)
+		c.noteForwardDropped()
+		putPacketBuf(contents)
+		return nil
+	}
 
 	var dstLen int
 	var dst *sclient
@@ -937,10 +2551,14 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 			c.requestPeerGoneWriteLimited(dstKey, contents, PeerGoneReasonNotHere)
 		}
 		s.recordDrop(contents, srcKey, dstKey, reason)
+		c.noteForwardDropped()
+		putPacketBuf(contents)
 		return nil
 	}
 
-	dst.debugLogf("received forwarded packet from %s via %s", srcKey.ShortString(), c.key.ShortString())
+	dst.vlogf(2, "received forwarded packet from %s via %s", srcKey.ShortString(), c.key.ShortString())
+	c.notePairBytes(srcKey, dstKey, len(contents))
+	s.tapPacket(srcKey, dstKey, len(contents), true, false)
 
 	return c.sendPkt(dst, pkt{
 		bs:         contents,
@@ -949,6 +2567,14 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	})
 }
 
+// noteForwardDropped counts a packet forwarded by c, a mesh peer, that
+// was dropped on arrival, for its next frameForwardAck.
+func (c *sclient) noteForwardDropped() {
+	if c.info.CanForwardAck {
+		c.fwdAckDropped.Add(1)
+	}
+}
+
 // notePeerSendLocked records that src sent to dst.  We keep track of
 // that so when src disconnects, we can tell dst (if it's still
 // around) that src is gone (a peerGone frame).
@@ -965,10 +2591,29 @@ func (s *Server) notePeerSendLocked(src key.NodePublic, dst *sclient) {
 func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	s := c.s
 
-	dstKey, contents, err := s.recvPacket(c.br, fl)
+	dstKey, contents, err := s.recvPacket(c.br, fl, ft == frameSendPacketZstd, c.maxPacketSize)
 	if err != nil {
+		s.recordTooLarge(err, c.key, dstKey)
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.bytesRecv.Add(int64(len(contents)))
+	if !c.allowSend(fl) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		c.requestDropNotifyLimited(dstKey, DropReasonRateLimited)
+		putPacketBuf(contents)
+		return nil
+	}
+	if c.relay != nil {
+		return c.relayViaMiddleware(dstKey, contents)
+	}
+	return c.relayPacket(dstKey, contents)
+}
+
+// relayPacket sends contents, a packet from c, to the client dstKey,
+// either directly or via a mesh peer, or drops it. It takes ownership
+// of contents.
+func (c *sclient) relayPacket(dstKey key.NodePublic, contents []byte) error {
+	s := c.s
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -989,25 +2634,36 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if dst == nil {
 		if fwd != nil {
 			s.packetsForwardedOut.Add(1)
+			c.notePairBytes(c.key, dstKey, len(contents))
+			s.tapPacket(c.key, dstKey, len(contents), false, true)
+			n := len(contents)
 			err := fwd.ForwardPacket(c.key, dstKey, contents)
-			c.debugLogf("SendPacket for %s, forwarding via %s: %v", dstKey.ShortString(), fwd, err)
+			putPacketBuf(contents) // fwd doesn't retain it; see PacketForwarder
+			if err == nil {
+				s.noteMeshBandwidth(forwarderPeer(fwd), false, n)
+			}
+			c.vlogf(2, "SendPacket for %s, forwarding via %s: %v", dstKey.ShortString(), fwd, err)
 			if err != nil {
 				// TODO:
 				return nil
 			}
 			return nil
 		}
-		reason := dropReasonUnknownDest
+		reason, notifyReason := dropReasonUnknownDest, DropReasonUnknownDest
 		if dstLen > 1 {
-			reason = dropReasonDupClient
+			reason, notifyReason = dropReasonDupClient, DropReasonDupClient
 		} else {
 			c.requestPeerGoneWriteLimited(dstKey, contents, PeerGoneReasonNotHere)
 		}
 		s.recordDrop(contents, c.key, dstKey, reason)
-		c.debugLogf("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), reason)
+		c.requestDropNotifyLimited(dstKey, notifyReason)
+		c.vlogf(2, "SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), reason)
+		putPacketBuf(contents)
 		return nil
 	}
-	c.debugLogf("SendPacket for %s, sending directly", dstKey.ShortString())
+	c.vlogf(2, "SendPacket for %s, sending directly", dstKey.ShortString())
+	c.notePairBytes(c.key, dstKey, len(contents))
+	s.tapPacket(c.key, dstKey, len(contents), false, false)
 
 	p := pkt{
 		bs:         contents,
@@ -1017,9 +2673,44 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	return c.sendPkt(dst, p)
 }
 
-func (c *sclient) debugLogf(format string, v ...any) {
-	if c.debug {
-		c.logf(format, v...)
+// initRateLimiters sets up c's rate limiters according to the
+// server's ClientRateLimit policy, unless c is exempt.
+func (c *sclient) initRateLimiters() {
+	l := c.s.rateLimit
+	if l.isZero() || l.isExempt(c) {
+		return
+	}
+	if l.PacketsPerSecond > 0 {
+		c.pktLim = xrate.NewLimiter(xrate.Limit(l.PacketsPerSecond), l.packetsBurst())
+	}
+	if l.BytesPerSecond > 0 {
+		c.byteLim = xrate.NewLimiter(xrate.Limit(l.BytesPerSecond), l.bytesBurst(c.maxPacketSize))
+	}
+}
+
+// allowSend reports whether c's rate limits permit it to send a frame
+// whose payload is fl bytes long.
+func (c *sclient) allowSend(fl uint32) bool {
+	now := c.s.clock.Now()
+	if (c.pktLim != nil && !c.pktLim.AllowN(now, 1)) ||
+		(c.byteLim != nil && !c.byteLim.AllowN(now, frameHeaderLen+int(fl))) {
+		// Count at most one offense a second, so that a burst
+		// over the limit isn't enough to get banned.
+		if now.Sub(c.lastRateLimited) >= time.Second {
+			c.lastRateLimited = now
+			c.s.noteOffense(c.remoteIPPort.Addr(), "exceeded rate limit")
+		}
+		return false
+	}
+	return true
+}
+
+// vlogf logs the provided message with the client's connection
+// fields (remote address and short key) if the server's verbosity is
+// at least level, or if debug logging was forced on for this client.
+func (c *sclient) vlogf(level int, format string, v ...any) {
+	if c.debug || int(c.s.verbosity.Load()) >= level {
+		c.logf(fmt.Sprintf("[v%d] ", level)+format, v...)
 	}
 }
 
@@ -1036,6 +2727,10 @@ func (c *sclient) debugLogf(format string, v ...any) {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the sending client exceeded its rate limit
+	dropReasonWriteTimeout                       // write to a slow-reading destination timed out
+	dropReasonTooLarge                           // packet larger than the sender or receiver supports
+	dropReasonMiddleware                         // a packet middleware didn't pass the packet on; see SetPacketMiddleware
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1055,7 +2750,7 @@ func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, r
 		msg := fmt.Sprintf("drop (%s) %s -> %s", srcKey.ShortString(), reason, dstKey.ShortString())
 		s.limitedLogf(msg)
 	}
-	s.debugLogf("dropping packet reason=%s dst=%s disco=%v", reason, dstKey, looksDisco)
+	s.vlogf(2, "dropping packet reason=%s dst=%s disco=%v", reason, dstKey, looksDisco)
 }
 
 func (c *sclient) sendPkt(dst *sclient, p pkt) error {
@@ -1064,30 +2759,59 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 
 	// Attempt to queue for sending up to 3 times. On each attempt, if
 	// the queue is full, try to drop from queue head to prioritize
-	// fresher packets.
+	// fresher packets, unless the slow client policy says to
+	// disconnect dst instead.
+	if len(p.bs) > MaxPacketSize && len(p.bs) > dst.maxPacketSize {
+		// A jumbo packet for a client that doesn't support it.
+		s.recordDrop(p.bs, c.key, dstKey, dropReasonTooLarge)
+		dst.dropsTooLarge.Add(1)
+		putPacketBuf(p.bs)
+		return nil
+	}
 	sendQueue := dst.sendQueue
-	if disco.LooksLikeDiscoWrapper(p.bs) {
+	if s.isPriorityPacket(p.bs) {
 		sendQueue = dst.discoSendQueue
 	}
 	for attempt := 0; attempt < 3; attempt++ {
 		select {
 		case <-dst.done:
 			s.recordDrop(p.bs, c.key, dstKey, dropReasonGoneDisconnected)
-			dst.debugLogf("sendPkt attempt %d dropped, dst gone", attempt)
+			dst.vlogf(2, "sendPkt attempt %d dropped, dst gone", attempt)
+			putPacketBuf(p.bs)
 			return nil
 		default:
 		}
 		select {
 		case sendQueue <- p:
-			dst.debugLogf("sendPkt attempt %d enqueued", attempt)
+			dst.vlogf(2, "sendPkt attempt %d enqueued", attempt)
 			return nil
 		default:
 		}
 
+		if s.slowClientPolicy == SlowClientDisconnect && !dst.canMesh {
+			s.recordDrop(p.bs, c.key, dstKey, dropReasonQueueTail)
+			dst.dropsQueueFull.Add(1)
+			if p.src == c.key {
+				c.requestDropNotifyLimited(dstKey, DropReasonQueueFull)
+			}
+			if !dst.disconnected.Load() {
+				s.slowClientDisconnects.Add(1)
+				dst.logf("closing; send queue full")
+				dst.requestDisconnect("disconnected by DERP server for not reading packets fast enough")
+			}
+			putPacketBuf(p.bs)
+			return nil
+		}
+
 		select {
 		case pkt := <-sendQueue:
 			s.recordDrop(pkt.bs, c.key, dstKey, dropReasonQueueHead)
+			dst.dropsQueueFull.Add(1)
+			if pkt.src == c.key {
+				c.requestDropNotifyLimited(dstKey, DropReasonQueueFull)
+			}
 			c.recordQueueTime(pkt.enqueuedAt)
+			putPacketBuf(pkt.bs)
 		default:
 		}
 	}
@@ -1095,11 +2819,30 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	// contended queue with racing writers. Give up and tail-drop in
 	// this case to keep reader unblocked.
 	s.recordDrop(p.bs, c.key, dstKey, dropReasonQueueTail)
-	dst.debugLogf("sendPkt attempt %d dropped, queue full")
+	dst.dropsQueueFull.Add(1)
+	if p.src == c.key {
+		c.requestDropNotifyLimited(dstKey, DropReasonQueueFull)
+	}
+	dst.vlogf(2, "sendPkt dropped, queue full")
+	putPacketBuf(p.bs)
 
 	return nil
 }
 
+// requestDropNotifyLimited sends a request to write a "packet dropped"
+// frame telling c that a packet it sent to dst was dropped, if c asked
+// for them and hasn't been sent one recently. It doesn't block: if a
+// request is already pending, this one is discarded.
+func (c *sclient) requestDropNotifyLimited(dst key.NodePublic, reason DropReasonType) {
+	if !c.info.CanDropNotify || !c.dropNotifyLim.Allow() {
+		return
+	}
+	select {
+	case c.dropNotify <- dropNotifyMsg{dst: dst, reason: reason}:
+	default:
+	}
+}
+
 // requestPeerGoneWrite sends a request to write a "peer gone" frame
 // with an explanation of why it is gone. It blocks until either the
 // write request is scheduled, or the client has closed.
@@ -1123,7 +2866,14 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error {
+func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, info *clientInfo, srcIP netip.Addr) error {
+	if s.verifyClientFunc != nil && !s.isMeshClientInfo(info) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := s.verifyClientFunc(ctx, clientKey, srcIP); err != nil {
+			return err
+		}
+	}
 	if !s.verifyClients {
 		return nil
 	}
@@ -1135,12 +2885,17 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 		return nil
 	}
 	if _, exists := status.Peer[clientKey]; !exists {
-		return fmt.Errorf("client %v not in set of peers", clientKey)
+		return fmt.Errorf("%w: %v not in set of peers", ErrClientDenied, clientKey)
 	}
-	// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	return nil
 }
 
+// isMeshClientInfo reports whether info presents one of the server's
+// mesh keys.
+func (s *Server) isMeshClientInfo(info *clientInfo) bool {
+	return info != nil && s.isMeshKey(info.MeshKey)
+}
+
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
 	buf := make([]byte, 0, len(magic)+key.NodePublicRawLen)
 	buf = append(buf, magic...)
@@ -1206,15 +2961,39 @@ type serverInfo struct {
 
 	TokenBucketBytesPerSecond int `json:",omitempty"`
 	TokenBucketBytesBurst     int `json:",omitempty"`
+
+	// MeshKeyRejected is whether the client presented a mesh key
+	// that the server doesn't accept.
+	MeshKeyRejected bool `json:",omitempty"`
+
+	// ZstdThreshold, if non-zero, is the minimum size of packets
+	// the client may send compressed in frameSendPacketZstd.
+	ZstdThreshold int `json:",omitempty"`
+
+	// MaxPacketSize, if non-zero, is the largest packet the client
+	// and server may send each other, if it's larger than
+	// MaxPacketSize.
+	MaxPacketSize int `json:",omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+func (s *Server) sendServerInfo(c *sclient) error {
+	si := serverInfo{Version: ProtocolVersion}
+	if c.byteLim != nil {
+		si.TokenBucketBytesPerSecond = int(c.byteLim.Limit())
+		si.TokenBucketBytesBurst = c.byteLim.Burst()
+	}
+	si.MeshKeyRejected = c.info.MeshKey != "" && !c.canMesh
+	si.ZstdThreshold = s.zstdThreshold
+	if c.maxPacketSize > MaxPacketSize {
+		si.MaxPacketSize = c.maxPacketSize
+	}
+	msg, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
 
-	msgbox := s.privateKey.SealTo(clientKey, msg)
+	bw := c.bw
+	msgbox := s.privateKey.SealTo(c.key, msg)
 	if err := writeFrameHeader(bw.bw(), frameServerInfo, uint32(len(msgbox))); err != nil {
 		return err
 	}
@@ -1227,19 +3006,25 @@ func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) e
 // recvClientKey reads the frameClientInfo frame from the client (its
 // proof of identity) upon its initial connection. It should be
 // considered especially untrusted at this point.
+//
+// Errors where the client broke the protocol, rather than the
+// connection failing, are protocolErrors.
 func (s *Server) recvClientKey(br *bufio.Reader) (clientKey key.NodePublic, info *clientInfo, err error) {
-	fl, err := readFrameTypeHeader(br, frameClientInfo)
+	ft, fl, err := readFrameHeader(br)
 	if err != nil {
 		return zpub, nil, err
 	}
+	if ft != frameClientInfo {
+		return zpub, nil, protocolError{fmt.Errorf("bad frame type 0x%X, want 0x%X", ft, frameClientInfo)}
+	}
 	const minLen = keyLen + nonceLen
 	if fl < minLen {
-		return zpub, nil, errors.New("short client info")
+		return zpub, nil, protocolError{errors.New("short client info")}
 	}
 	// We don't trust the client at all yet, so limit its input size to limit
 	// things like JSON resource exhausting (http://github.com/golang/go/issues/31789).
 	if fl > 256<<10 {
-		return zpub, nil, errors.New("long client info")
+		return zpub, nil, protocolError{errors.New("long client info")}
 	}
 	if err := clientKey.ReadRawWithoutAllocating(br); err != nil {
 		return zpub, nil, err
@@ -1251,16 +3036,19 @@ func (s *Server) recvClientKey(br *bufio.Reader) (clientKey key.NodePublic, info
 	}
 	msg, ok := s.privateKey.OpenFrom(clientKey, msgbox)
 	if !ok {
-		return zpub, nil, fmt.Errorf("msgbox: cannot open len=%d with client key %s", msgLen, clientKey)
+		return zpub, nil, protocolError{fmt.Errorf("msgbox: cannot open len=%d with client key %s", msgLen, clientKey)}
 	}
 	info = new(clientInfo)
 	if err := json.Unmarshal(msg, info); err != nil {
-		return zpub, nil, fmt.Errorf("msg: %v", err)
+		return zpub, nil, protocolError{fmt.Errorf("msg: %v", err)}
 	}
 	return clientKey, info, nil
 }
 
-func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.NodePublic, contents []byte, err error) {
+// recvPacket reads the body of a frameSendPacket frame, or of a
+// frameSendPacketZstd frame if compressed is set, returning the
+// decompressed contents.
+func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32, compressed bool, maxSize int) (dstKey key.NodePublic, contents []byte, err error) {
 	if frameLen < keyLen {
 		return zpub, nil, errors.New("short send packet frame")
 	}
@@ -1268,13 +3056,27 @@ func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.NodeP
 		return zpub, nil, err
 	}
 	packetLen := frameLen - keyLen
-	if packetLen > MaxPacketSize {
-		return zpub, nil, fmt.Errorf("data packet longer (%d) than max of %v", packetLen, MaxPacketSize)
+	if packetLen > uint32(maxSize) {
+		return dstKey, nil, packetTooLargeError{int(packetLen), maxSize}
 	}
-	contents = make([]byte, packetLen)
+	contents = getPacketBuf(int(packetLen))
 	if _, err := io.ReadFull(br, contents); err != nil {
+		putPacketBuf(contents)
 		return zpub, nil, err
 	}
+	if compressed {
+		if s.zstdThreshold == 0 {
+			putPacketBuf(contents)
+			return zpub, nil, errors.New("unexpected compressed packet")
+		}
+		zpkt := contents
+		contents, err = zstdDecompress(zpkt, maxSize)
+		putPacketBuf(zpkt)
+		if err != nil {
+			return dstKey, nil, fmt.Errorf("decompressing packet: %w", err)
+		}
+		s.packetsRecvZstd.Add(1)
+	}
 	s.packetsRecv.Add(1)
 	s.bytesRecv.Add(int64(len(contents)))
 	if disco.LooksLikeDiscoWrapper(contents) {
@@ -1285,10 +3087,37 @@ func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.NodeP
 	return dstKey, contents, nil
 }
 
+// packetTooLargeError is returned by recvPacket and recvForwardPacket
+// when a packet is longer than the max packet size.
+type packetTooLargeError struct {
+	len, max int
+}
+
+func (e packetTooLargeError) Error() string {
+	return fmt.Sprintf("data packet longer (%d) than max of %v", e.len, e.max)
+}
+
+// recordTooLarge records that a packet from srcKey to dstKey was
+// dropped for being larger than the max packet size, if err says so.
+func (s *Server) recordTooLarge(err error, srcKey, dstKey key.NodePublic) {
+	var tle packetTooLargeError
+	if !errors.As(err, &tle) {
+		return
+	}
+	s.recordDrop(nil, srcKey, dstKey, dropReasonTooLarge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if set, ok := s.clients[dstKey]; ok {
+		if dst := set.ActiveClient(); dst != nil {
+			dst.dropsTooLarge.Add(1)
+		}
+	}
+}
+
 // zpub is the key.NodePublic zero value.
 var zpub key.NodePublic
 
-func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, dstKey key.NodePublic, contents []byte, err error) {
+func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32, maxSize int) (srcKey, dstKey key.NodePublic, contents []byte, err error) {
 	if frameLen < keyLen*2 {
 		return zpub, zpub, nil, errors.New("short send packet frame")
 	}
@@ -1299,11 +3128,12 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 		return zpub, zpub, nil, err
 	}
 	packetLen := frameLen - keyLen*2
-	if packetLen > MaxPacketSize {
-		return zpub, zpub, nil, fmt.Errorf("data packet longer (%d) than max of %v", packetLen, MaxPacketSize)
+	if packetLen > uint32(maxSize) {
+		return srcKey, dstKey, nil, packetTooLargeError{int(packetLen), maxSize}
 	}
-	contents = make([]byte, packetLen)
+	contents = getPacketBuf(int(packetLen))
 	if _, err := io.ReadFull(br, contents); err != nil {
+		putPacketBuf(contents)
 		return zpub, zpub, nil, err
 	}
 	// TODO: was s.packetsRecv.Add(1)
@@ -1316,32 +3146,57 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 // (The "s" prefix is to more explicitly distinguish it from Client in derp_client.go)
 type sclient struct {
 	// Static after construction.
-	connNum        int64 // process-wide unique counter, incremented each Accept
-	s              *Server
-	nc             Conn
-	key            key.NodePublic
-	info           clientInfo
-	logf           logger.Logf
-	done           <-chan struct{}  // closed when connection closes
-	remoteAddr     string           // usually ip:port from net.Conn.RemoteAddr().String()
-	remoteIPPort   netip.AddrPort   // zero if remoteAddr is not ip:port.
-	sendQueue      chan pkt         // packets queued to this client; never closed
-	discoSendQueue chan pkt         // important packets queued to this client; never closed
-	sendPongCh     chan [8]byte     // pong replies to send to the client; never closed
-	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
-	meshUpdate     chan struct{}    // write request to write peerStateChange
-	canMesh        bool             // clientInfo had correct mesh token for inter-region routing
-	isDup          atomic.Bool      // whether more than 1 sclient for key is connected
-	isDisabled     atomic.Bool      // whether sends to this peer are disabled due to active/active dups
-	debug          bool             // turn on for verbose logging
+	connNum          int64 // process-wide unique counter, incremented each Accept
+	s                *Server
+	nc               Conn
+	key              key.NodePublic
+	info             clientInfo
+	maxPacketSize    int // largest packet this client may send and receive
+	logf             logger.Logf
+	done             <-chan struct{}              // closed when connection closes
+	remoteAddr       string                       // usually ip:port from net.Conn.RemoteAddr().String()
+	remoteIPPort     netip.AddrPort               // zero if remoteAddr is not ip:port.
+	clientCert       string                       // identity of the verified TLS client certificate, if any; see SetClientCAs
+	agent            clientAgent                  // what the client declared about itself over HTTP; see ContextWithClientAgent
+	transport        string                       // what the client connected over; see ContextWithTransport
+	sendQueue        chan pkt                     // packets queued to this client; never closed
+	discoSendQueue   chan pkt                     // priority lane of disco and small packets queued to this client; never closed
+	sendPongCh       chan [8]byte                 // pong replies to send to the client; never closed
+	sendPingCh       chan [8]byte                 // pings from PingClient to send to the client; never closed
+	peerGone         chan peerGoneMsg             // write request that a peer is not at this server (not used by mesh peers)
+	dropNotify       chan dropNotifyMsg           // write request to report a dropped packet; never closed
+	disconnectCh     chan string                  // request to send a goodbye health frame with this text and close; never closed
+	disconnected     atomic.Bool                  // whether the server closed the connection on purpose
+	restartingCh     chan ServerRestartingMessage // request to send a restarting frame; never closed
+	meshUpdate       chan struct{}                // write request to write peerStateChange
+	peerMapCh        chan [][]byte                // framePeerMap payloads of peer maps to write; nil unless canMesh
+	gossipSubscribed atomic.Bool                  // whether the client subscribed to peer maps
+	canMesh          bool                         // clientInfo had correct mesh token for inter-region routing
+	isDup            atomic.Bool                  // whether more than 1 sclient for key is connected
+	isDisabled       atomic.Bool                  // whether sends to this peer are disabled due to active/active dups
+	debug            bool                         // turn on for verbose logging
+	bytesRecv        atomic.Int64                 // packet bytes received from this client
+	bytesSent        atomic.Int64                 // packet bytes sent to this client
+
+	// Counts of packets to this client that were dropped, by cause.
+	dropsQueueFull    atomic.Int64 // send queue was full
+	dropsWriteTimeout atomic.Int64 // write to the client timed out
+	dropsTooLarge     atomic.Int64 // larger than the sender or this client supports
+
+	// disconnectReason is the problem text with which the server
+	// asked the client to disconnect, if it did.
+	disconnectReason syncs.AtomicValue[string]
 
 	// Owned by run, not thread-safe.
-	br          *bufio.Reader
-	connectedAt time.Time
-	preferred   bool
+	br            *bufio.Reader
+	connectedAt   time.Time
+	preferred     bool
+	pairPending   map[keyPair]int64 // bytes relayed per pair not yet merged; see notePairBytes
+	pairFlushedAt time.Time         // when pairPending was last merged
 
 	// Owned by sender, not thread-safe.
-	bw *lazyBufioWriter
+	bw            *lazyBufioWriter
+	sendBatchPkts int // packets written to bw since it was last flushed
 
 	// Guarded by s.mu
 	//
@@ -1351,10 +3206,53 @@ type sclient struct {
 	// to this node.
 	peerStateChange []peerConnState
 
+	// watchFilter, if non-nil, limits which peers' state changes
+	// are sent to this watcher.
+	watchFilter *watchFilter
+
 	// peerGoneLimiter limits how often the server will inform a
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// dropNotifyLim limits how often the server will tell a client
+	// (that asked, with CanDropNotify) about its dropped packets.
+	dropNotifyLim *rate.Limiter
+
+	// fwdAckPackets, fwdAckBytes and fwdAckDropped count the packets
+	// this mesh peer forwarded since the last frameForwardAck, if it
+	// asked for them with CanForwardAck.
+	fwdAckPackets atomic.Uint64
+	fwdAckBytes   atomic.Uint64
+	fwdAckDropped atomic.Uint64
+
+	// pktLim and byteLim, if non-nil, limit the rate of packets
+	// and bytes the client may send. They're only used by run.
+	pktLim  *xrate.Limiter
+	byteLim *xrate.Limiter
+
+	// lastRateLimited is when the client last exceeded its rate
+	// limits and was reported for it (see BanPolicy). It's only used
+	// by run.
+	lastRateLimited time.Time
+
+	// pingsOut are the pings sent by PingClient awaiting pongs,
+	// keyed by their payload, with channels to close on the pong.
+	pingMu   sync.Mutex
+	pingsOut map[[8]byte]chan struct{}
+
+	// relay, if non-nil, is the middleware chain through which the
+	// client's packets are relayed (see SetPacketMiddleware), and
+	// relayed and relayErr are whether the packet being relayed
+	// reached the end of it, and with what error. relayBuf is the
+	// packet's buffer from getPacketBuf, and relayTookBuf whether
+	// it was passed on to relayPacket, which then owns it. They're
+	// only used by run.
+	relay        PacketForwarder
+	relayed      bool
+	relayErr     error
+	relayBuf     []byte
+	relayTookBuf bool
 }
 
 // peerConnState represents whether a peer is connected to the server
@@ -1375,7 +3273,8 @@ type pkt struct {
 	enqueuedAt time.Time
 
 	// bs is the data packet bytes.
-	// The memory is owned by pkt.
+	// The memory is owned by pkt, until it's returned to
+	// packetBufPools once the packet is sent or dropped.
 	bs []byte
 }
 
@@ -1385,6 +3284,12 @@ type peerGoneMsg struct {
 	reason PeerGoneReasonType
 }
 
+// dropNotifyMsg is a request to write a packetDropped frame to an sclient
+type dropNotifyMsg struct {
+	dst    key.NodePublic
+	reason DropReasonType
+}
+
 func (c *sclient) setPreferred(v bool) {
 	if c.preferred == v {
 		return
@@ -1440,51 +3345,111 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			select {
 			case pkt := <-c.sendQueue:
 				c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
+				putPacketBuf(pkt.bs)
 			case pkt := <-c.discoSendQueue:
 				c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
+				putPacketBuf(pkt.bs)
 			default:
 				return
 			}
 		}
 	}()
 
-	jitter := time.Duration(rand.Intn(5000)) * time.Millisecond
-	keepAliveTick, keepAliveTickChannel := c.s.clock.NewTicker(keepAlive + jitter)
+	// Up to 5 seconds of jitter at the default 60 second interval.
+	jitter := time.Duration(rand.Int63n(int64(c.s.keepAlive/12) + 1))
+	keepAliveTick, keepAliveTickChannel := c.s.clock.NewTicker(c.s.keepAlive + jitter)
 	defer keepAliveTick.Stop()
 
+	var gossipTickChannel <-chan time.Time // or nil if not in gossip mode
+	if c.canMesh && c.s.gossipInterval > 0 {
+		var gossipTick tstime.TickerController
+		gossipTick, gossipTickChannel = c.s.clock.NewTicker(c.s.gossipInterval)
+		defer gossipTick.Stop()
+	}
+
+	var snapshotTickChannel <-chan time.Time // or nil if c doesn't want peer snapshots
+	if c.canMesh && c.info.CanPeerSnapshot && c.s.watcherSnapshotInterval > 0 {
+		var snapshotTick tstime.TickerController
+		snapshotTick, snapshotTickChannel = c.s.clock.NewTicker(c.s.watcherSnapshotInterval)
+		defer snapshotTick.Stop()
+	}
+
+	var fwdAckTickChannel <-chan time.Time // or nil if c doesn't want forward acks
+	if c.canMesh && c.info.CanForwardAck {
+		var fwdAckTick tstime.TickerController
+		fwdAckTick, fwdAckTickChannel = c.s.clock.NewTicker(forwardAckInterval)
+		defer fwdAckTick.Stop()
+	}
+
 	var werr error // last write error
 	for {
 		if werr != nil {
 			return werr
 		}
-		// First, a non-blocking select (with a default) that
+		// Write a packet from the priority lane, if any, ahead of
+		// everything else. Only one, so that a flood of them
+		// can't starve the rest.
+		select {
+		case msg := <-c.discoSendQueue:
+			if werr = c.sendQueuedPacket(msg); werr != nil {
+				continue
+			}
+			c.s.packetsSentPriority.Add(1)
+		default:
+		}
+		// Then a non-blocking select (with a default) that
 		// does as many non-flushing writes as possible.
 		select {
 		case <-ctx.Done():
 			return nil
+		case problem := <-c.disconnectCh:
+			return c.sendGoodbye(problem)
+		case m := <-c.restartingCh:
+			werr = c.sendRestarting(m)
+			continue
 		case msg := <-c.peerGone:
 			werr = c.sendPeerGone(msg.peer, msg.reason)
 			continue
+		case msg := <-c.dropNotify:
+			werr = c.sendPacketDropped(msg.dst, msg.reason)
+			continue
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(msg)
 			continue
 		case msg := <-c.discoSendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(msg)
+			c.s.packetsSentPriority.Add(1)
 			continue
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 			continue
+		case msg := <-c.sendPingCh:
+			werr = c.sendPing(msg)
+			continue
 		case <-keepAliveTickChannel:
 			werr = c.sendKeepAlive()
 			continue
+		case <-fwdAckTickChannel:
+			werr = c.sendForwardAck()
+			continue
+		case <-snapshotTickChannel:
+			werr = c.sendPeerSnapshot()
+			continue
+		case frames := <-c.peerMapCh:
+			werr = c.sendPeerMap(frames)
+			continue
+		case <-gossipTickChannel:
+			if c.gossipSubscribed.Load() {
+				werr = c.sendPeerMap(c.s.ownPeerMapFrames())
+			}
+			continue
 		default:
 			// Flush any writes from the 3 sends above, or from
 			// the blocking loop below.
+			c.countSendBatch()
 			if werr = c.bw.Flush(); werr != nil {
 				return werr
 			}
@@ -1494,28 +3459,86 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return nil
+		case problem := <-c.disconnectCh:
+			return c.sendGoodbye(problem)
+		case m := <-c.restartingCh:
+			werr = c.sendRestarting(m)
 		case msg := <-c.peerGone:
 			werr = c.sendPeerGone(msg.peer, msg.reason)
+		case msg := <-c.dropNotify:
+			werr = c.sendPacketDropped(msg.dst, msg.reason)
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(msg)
 		case msg := <-c.discoSendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(msg)
+			c.s.packetsSentPriority.Add(1)
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 			continue
+		case msg := <-c.sendPingCh:
+			werr = c.sendPing(msg)
 		case <-keepAliveTickChannel:
 			werr = c.sendKeepAlive()
+		case <-fwdAckTickChannel:
+			werr = c.sendForwardAck()
+		case <-snapshotTickChannel:
+			werr = c.sendPeerSnapshot()
+		case frames := <-c.peerMapCh:
+			werr = c.sendPeerMap(frames)
+		case <-gossipTickChannel:
+			if c.gossipSubscribed.Load() {
+				werr = c.sendPeerMap(c.s.ownPeerMapFrames())
+			}
+		}
+	}
+}
+
+// sendQueuedPacket writes msg, from one of c's send queues, to c.
+func (c *sclient) sendQueuedPacket(msg pkt) error {
+	err := c.prepareSendBatch()
+	if err == nil {
+		err = c.sendPacket(msg.src, msg.bs)
+	}
+	c.recordQueueTime(msg.enqueuedAt)
+	putPacketBuf(msg.bs)
+	return err
+}
+
+// prepareSendBatch is called before writing a packet to c.
+//
+// The heuristic for batching is that a packet with more packets
+// already queued behind it is the start (or middle) of a burst. In
+// that case c.bw is switched to a large buffer so that the rest of the
+// burst is coalesced into a few large writes (and TLS records) rather
+// than the small buffer's one or so per packet. A burst often only
+// becomes visible after the first packet or two were written to the
+// small buffer; those are flushed first, as part of the switch.
+func (c *sclient) prepareSendBatch() error {
+	if len(c.sendQueue)+len(c.discoSendQueue) > 0 && !c.bw.batching() {
+		c.countSendBatch() // growForBatch flushes any buffered packets
+		if err := c.bw.growForBatch(); err != nil {
+			return err
 		}
 	}
+	c.sendBatchPkts++
+	return nil
+}
+
+// countSendBatch is called when c.bw is about to be flushed. It counts
+// the flush in the send_batches metric if it carries more than one
+// packet, i.e. if batching actually saved any writes.
+func (c *sclient) countSendBatch() {
+	if c.sendBatchPkts > 1 {
+		c.s.sendBatches.Add(1)
+	}
+	c.sendBatchPkts = 0
 }
 
 func (c *sclient) setWriteDeadline() {
-	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.nc.SetWriteDeadline(time.Now().Add(c.s.writeTimeout))
 }
 
 // sendKeepAlive sends a keep-alive frame, without flushing.
@@ -1524,6 +3547,35 @@ func (c *sclient) sendKeepAlive() error {
 	return writeFrameHeader(c.bw.bw(), frameKeepAlive, 0)
 }
 
+// sendGoodbye sends a health frame with the given problem text,
+// flushes it, and closes the connection, which unblocks the receive
+// loop to unregister c. The client clears the problem once it
+// reconnects.
+func (c *sclient) sendGoodbye(problem string) error {
+	defer c.nc.Close()
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameHealth, uint32(len(problem))); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write([]byte(problem)); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// sendRestarting sends a restarting frame, without flushing.
+func (c *sclient) sendRestarting(m ServerRestartingMessage) error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameRestarting, 8); err != nil {
+		return err
+	}
+	var payload [8]byte
+	binary.BigEndian.PutUint32(payload[:4], uint32(m.ReconnectIn.Milliseconds()))
+	binary.BigEndian.PutUint32(payload[4:], uint32(m.TryFor.Milliseconds()))
+	_, err := c.bw.Write(payload[:])
+	return err
+}
+
 // sendPong sends a pong reply, without flushing.
 func (c *sclient) sendPong(data [8]byte) error {
 	c.s.sentPong.Add(1)
@@ -1555,22 +3607,75 @@ func (c *sclient) sendPeerGone(peer key.NodePublic, reason PeerGoneReasonType) e
 	return err
 }
 
+// sendPacketDropped sends a packetDropped frame, without flushing.
+func (c *sclient) sendPacketDropped(dst key.NodePublic, reason DropReasonType) error {
+	c.s.packetDroppedFrames.Add(1)
+	c.setWriteDeadline()
+	data := make([]byte, 0, keyLen+1)
+	data = dst.AppendTo(data)
+	data = append(data, byte(reason))
+	if err := writeFrameHeader(c.bw.bw(), framePacketDropped, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data)
+	return err
+}
+
+// sendForwardAck sends a frameForwardAck acknowledging the packets c,
+// a mesh peer, forwarded since the last one, if there are any.
+func (c *sclient) sendForwardAck() error {
+	pkts := c.fwdAckPackets.Swap(0)
+	if pkts == 0 {
+		return nil
+	}
+	c.setWriteDeadline()
+	var data [forwardAckLen]byte
+	binary.BigEndian.PutUint64(data[0:], pkts)
+	binary.BigEndian.PutUint64(data[8:], c.fwdAckBytes.Swap(0))
+	binary.BigEndian.PutUint64(data[16:], c.fwdAckDropped.Swap(0))
+	return writeFrame(c.bw.bw(), frameForwardAck, data[:])
+}
+
+// appendPeerPresent appends a peer present entry (as in
+// framePeerPresent and framePeerPresentBatch) to b.
+func appendPeerPresent(b []byte, peer key.NodePublic, ipPort netip.AddrPort) []byte {
+	b = peer.AppendTo(b)
+	a16 := ipPort.Addr().As16()
+	b = append(b, a16[:]...)
+	return binary.BigEndian.AppendUint16(b, ipPort.Port())
+}
+
 // sendPeerPresent sends a peerPresent frame, without flushing.
 func (c *sclient) sendPeerPresent(peer key.NodePublic, ipPort netip.AddrPort) error {
 	c.setWriteDeadline()
-	const frameLen = keyLen + 16 + 2
-	if err := writeFrameHeader(c.bw.bw(), framePeerPresent, frameLen); err != nil {
+	if err := writeFrameHeader(c.bw.bw(), framePeerPresent, peerPresentLen); err != nil {
 		return err
 	}
-	payload := make([]byte, frameLen)
-	_ = peer.AppendTo(payload[:0])
-	a16 := ipPort.Addr().As16()
-	copy(payload[keyLen:], a16[:])
-	binary.BigEndian.PutUint16(payload[keyLen+16:], ipPort.Port())
-	_, err := c.bw.Write(payload)
+	_, err := c.bw.Write(appendPeerPresent(make([]byte, 0, peerPresentLen), peer, ipPort))
 	return err
 }
 
+// sendPeerPresentBatch sends a peerPresentBatch frame for as many of
+// the leading present entries of pcs as fit in the write buffer (but
+// at least one), without flushing. It returns the number of entries
+// sent.
+func (c *sclient) sendPeerPresentBatch(pcs []peerConnState) (n int, err error) {
+	limit := max((c.bw.Available()-frameHeaderLen)/peerPresentLen, 1)
+	for n < len(pcs) && n < limit && pcs[n].present {
+		n++
+	}
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), framePeerPresentBatch, uint32(n*peerPresentLen)); err != nil {
+		return 0, err
+	}
+	payload := make([]byte, 0, n*peerPresentLen)
+	for _, p := range pcs[:n] {
+		payload = appendPeerPresent(payload, p.peer, p.ipPort)
+	}
+	_, err = c.bw.Write(payload)
+	return n, err
+}
+
 // sendMeshUpdates drains as many mesh peerStateChange entries as
 // possible into the write buffer WITHOUT flushing or otherwise
 // blocking (as it holds c.s.mu while working). If it can't drain them
@@ -1580,14 +3685,19 @@ func (c *sclient) sendMeshUpdates() error {
 	defer c.s.mu.Unlock()
 
 	writes := 0
-	for _, pcs := range c.peerStateChange {
+	for writes < len(c.peerStateChange) {
 		if c.bw.Available() <= frameHeaderLen+keyLen {
 			break
 		}
+		pcs := c.peerStateChange[writes]
+		n := 1
 		var err error
-		if pcs.present {
+		switch {
+		case pcs.present && c.info.CanPeerPresentBatch:
+			n, err = c.sendPeerPresentBatch(c.peerStateChange[writes:])
+		case pcs.present:
 			err = c.sendPeerPresent(pcs.peer, pcs.ipPort)
-		} else {
+		default:
 			err = c.sendPeerGone(pcs.peer, PeerGoneReasonDisconnected)
 		}
 		if err != nil {
@@ -1596,7 +3706,7 @@ func (c *sclient) sendMeshUpdates() error {
 			// network.
 			return err
 		}
-		writes++
+		writes += n
 	}
 
 	remain := copy(c.peerStateChange, c.peerStateChange[writes:])
@@ -1614,6 +3724,73 @@ func (c *sclient) sendMeshUpdates() error {
 	return nil
 }
 
+// sendPeerSnapshot sends c, if it's watching connections, a snapshot
+// of the peers it watches in framePeerSnapshot frames.
+func (c *sclient) sendPeerSnapshot() error {
+	frames := c.peerSnapshotFrames()
+	for _, b := range frames {
+		c.setWriteDeadline()
+		if err := writeFrame(c.bw.bw(), framePeerSnapshot, b); err != nil {
+			return err
+		}
+	}
+	if len(frames) > 0 {
+		c.s.peerSnapshotsSent.Add(1)
+	}
+	return nil
+}
+
+// peerSnapshotFrames returns the framePeerSnapshot payloads of a
+// snapshot of the peers c watches, or nil if c isn't a watcher.
+//
+// As the snapshot reflects them, it discards the peer state changes
+// queued for c. Those made after it are queued as usual, and are sent
+// after the snapshot, as they're sent by c's sendLoop too.
+func (c *sclient) peerSnapshotFrames() [][]byte {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.watchers.Contains(c) {
+		return nil
+	}
+	c.peerStateChange = c.peerStateChange[:0]
+	var entries []byte
+	for peer, cs := range s.clients {
+		if !c.watchFilter.matches(peer) {
+			continue
+		}
+		if ac := cs.ActiveClient(); ac != nil {
+			entries = appendPeerPresent(entries, peer, ac.remoteIPPort)
+		}
+	}
+	return appendPeerSnapshotFrames(entries)
+}
+
+// appendPeerSnapshotFrames returns the framePeerSnapshot payloads
+// for entries, the concatenated peer present entries of a snapshot.
+// There's always at least one, even for an empty snapshot.
+func appendPeerSnapshotFrames(entries []byte) [][]byte {
+	const maxLen = maxPeerSnapshotEntriesPerFrame * peerPresentLen
+	parts := (len(entries) + maxLen - 1) / maxLen
+	if parts == 0 {
+		parts = 1
+	}
+	ret := make([][]byte, 0, parts)
+	for part := 0; part < parts; part++ {
+		n := len(entries)
+		if n > maxLen {
+			n = maxLen
+		}
+		b := make([]byte, 0, 4+n)
+		b = binary.BigEndian.AppendUint16(b, uint16(part))
+		b = binary.BigEndian.AppendUint16(b, uint16(parts))
+		b = append(b, entries[:n]...)
+		entries = entries[n:]
+		ret = append(ret, b)
+	}
+	return ret
+}
+
 // sendPacket writes contents to the client in a RecvPacket frame. If
 // srcKey.IsZero, uses the old DERPv1 framing format, otherwise uses
 // DERPv2. The bytes of contents are only valid until this function
@@ -1622,23 +3799,35 @@ func (c *sclient) sendMeshUpdates() error {
 func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error) {
 	defer func() {
 		// Stats update.
-		if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.s.recordDrop(contents, srcKey, c.key, dropReasonWriteTimeout)
+			c.dropsWriteTimeout.Add(1)
+		} else if err != nil {
 			c.s.recordDrop(contents, srcKey, c.key, dropReasonWriteError)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.bytesSent.Add(int64(len(contents)))
 		}
-		c.debugLogf("sendPacket from %s: %v", srcKey.ShortString(), err)
+		c.vlogf(2, "sendPacket from %s: %v", srcKey.ShortString(), err)
 	}()
 
 	c.setWriteDeadline()
 
 	withKey := !srcKey.IsZero()
-	pktLen := len(contents)
+	ft := frameRecvPacket
+	body := contents
+	if withKey && c.info.CanZstd {
+		if z := zstdCompress(contents, c.s.zstdThreshold); z != nil {
+			ft, body = frameRecvPacketZstd, z
+			c.s.packetsSentZstd.Add(1)
+		}
+	}
+	pktLen := len(body)
 	if withKey {
 		pktLen += key.NodePublicRawLen
 	}
-	if err = writeFrameHeader(c.bw.bw(), frameRecvPacket, uint32(pktLen)); err != nil {
+	if err = writeFrameHeader(c.bw.bw(), ft, uint32(pktLen)); err != nil {
 		return err
 	}
 	if withKey {
@@ -1646,7 +3835,7 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 			return err
 		}
 	}
-	_, err = c.bw.Write(contents)
+	_, err = c.bw.Write(body)
 	return err
 }
 
@@ -1677,6 +3866,7 @@ func (s *Server) AddPacketForwarder(dst key.NodePublic, fwd PacketForwarder) {
 			s.multiForwarderCreated.Add(1)
 		}
 	}
+	s.vlogf(1, "mesh: forwarding packets for %s via %s", dst.ShortString(), fwd)
 	s.clientsMesh[dst] = fwd
 }
 
@@ -1712,6 +3902,7 @@ func (s *Server) RemovePacketForwarder(dst key.NodePublic, fwd PacketForwarder)
 		return
 	}
 
+	s.vlogf(1, "mesh: stopped forwarding packets for %s via %s", dst.ShortString(), fwd)
 	if _, isLocal := s.clients[dst]; isLocal {
 		s.clientsMesh[dst] = nil
 	} else {
@@ -1809,6 +4000,8 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_current_file_descriptors", expvar.Func(func() any { return metrics.CurrentFDs() }))
 	m.Set("gauge_current_connections", &s.curClients)
 	m.Set("gauge_current_home_connections", &s.curHomeClients)
+	m.Set("gauge_current_connections_by_family", &s.curClientsByFamily)
+	m.Set("gauge_current_connections_by_transport", &s.curClientsByTransport)
 	m.Set("gauge_clients_total", expvar.Func(func() any { return len(s.clientsMesh) }))
 	m.Set("gauge_clients_local", expvar.Func(func() any { return len(s.clients) }))
 	m.Set("gauge_clients_remote", expvar.Func(func() any { return len(s.clientsMesh) - len(s.clients) }))
@@ -1816,6 +4009,16 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_current_dup_client_conns", &s.dupClientConns)
 	m.Set("counter_total_dup_client_conns", &s.dupClientConnTotal)
 	m.Set("accepts", &s.accepts)
+	m.Set("idle_disconnects", &s.idleDisconnects)
+	m.Set("slow_client_disconnects", &s.slowClientDisconnects)
+	m.Set("packets_sent_priority", &s.packetsSentPriority)
+	m.Set("gossip_peer_maps_relayed", &s.peerMapsRelayed)
+	m.Set("gossip_peer_maps_dropped", &s.peerMapsDropped)
+	m.Set("watcher_peer_snapshots_sent", &s.peerSnapshotsSent)
+	m.Set("client_cert_rejects", &s.clientCertRejects)
+	m.Set("abuse_reports", &s.abuseReports)
+	m.Set("bans", &s.bansTotal)
+	m.Set("ban_rejects", &s.banRejects)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("packets_dropped", &s.packetsDropped)
@@ -1829,13 +4032,30 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("home_moves_out", &s.homeMovesOut)
 	m.Set("got_ping", &s.gotPing)
 	m.Set("sent_pong", &s.sentPong)
+	m.Set("client_pings_sent", &s.clientPingsSent)
+	m.Set("client_pings_acked", &s.clientPingsAcked)
+	m.Set("send_batches", &s.sendBatches)
+	m.Set("packets_sent_zstd", &s.packetsSentZstd)
+	m.Set("packets_received_zstd", &s.packetsRecvZstd)
 	m.Set("peer_gone_disconnected_frames", &s.peerGoneDisconnectedFrames)
 	m.Set("peer_gone_not_here_frames", &s.peerGoneNotHereFrames)
+	m.Set("packet_dropped_frames", &s.packetDroppedFrames)
 	m.Set("packets_forwarded_out", &s.packetsForwardedOut)
 	m.Set("packets_forwarded_in", &s.packetsForwardedIn)
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("peer_state_changes_dampened", &s.peerStateChangesDampened)
+	m.Set("gauge_flapping_clients", s.expVarFunc(func() any {
+		now := s.clock.Now()
+		var n int
+		for _, h := range s.connHistory {
+			if h.isFlapping(now) {
+				n++
+			}
+		}
+		return n
+	}))
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -1972,6 +4192,56 @@ func (s *Server) ServeDebugTraffic(w http.ResponseWriter, r *http.Request) {
 	},
 }
 
+// sendBatchBufferSize is the size of the buffers in
+// batchBufioWriterPool: the maximum TLS record payload, so that a full
+// batch can go out as a single record.
+const sendBatchBufferSize = 16 << 10
+
+// batchBufioWriterPool is like bufioWriterPool, but for writers with
+// larger buffers, used by send loops with many frames to write.
+var batchBufioWriterPool = &sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(io.Discard, sendBatchBufferSize)
+	},
+}
+
+// packetBufSizes are the size classes of the buffers in
+// packetBufPools, ascending. Most relayed packets are no bigger than a
+// path MTU, so fit the smaller classes.
+var packetBufSizes = [...]int{256, 2 << 10, 16 << 10, MaxPacketSize, MaxJumboPacketSize}
+
+// packetBufPools hold *[]byte buffers, one pool per size in
+// packetBufSizes, for the packets clients and mesh peers send, so that
+// relaying a packet doesn't allocate one. A buffer is put back once
+// its packet has been written to its destination or dropped.
+var packetBufPools [len(packetBufSizes)]sync.Pool
+
+// getPacketBuf returns a buffer of length n from packetBufPools, to
+// release with putPacketBuf.
+func getPacketBuf(n int) []byte {
+	for i, size := range packetBufSizes {
+		if n <= size {
+			if bp, ok := packetBufPools[i].Get().(*[]byte); ok {
+				return (*bp)[:n]
+			}
+			return make([]byte, n, size)
+		}
+	}
+	return make([]byte, n)
+}
+
+// putPacketBuf puts b back in packetBufPools if its capacity is one of
+// packetBufSizes. b must not be used afterwards.
+func putPacketBuf(b []byte) {
+	for i, size := range packetBufSizes {
+		if cap(b) == size {
+			b = b[:size]
+			packetBufPools[i].Put(&b)
+			return
+		}
+	}
+}
+
 // lazyBufioWriter is a bufio.Writer-like wrapping writer that lazily
 // allocates its actual bufio.Writer from a sync.Pool, releasing it to
 // the pool upon flush.
@@ -1991,8 +4261,41 @@ func (w *lazyBufioWriter) bw() *bufio.Writer {
 	return w.lbw
 }
 
+// batching reports whether w is using a large buffer from
+// batchBufioWriterPool.
+func (w *lazyBufioWriter) batching() bool {
+	return w.lbw != nil && w.lbw.Size() == sendBatchBufferSize
+}
+
+// growForBatch has w use a large buffer from batchBufioWriterPool
+// until the next Flush. If w has data in a small buffer, that's
+// flushed first.
+func (w *lazyBufioWriter) growForBatch() error {
+	if w.batching() {
+		return nil
+	}
+	if w.lbw != nil {
+		err := w.lbw.Flush()
+		w.release()
+		if err != nil {
+			return err
+		}
+	}
+	w.lbw = batchBufioWriterPool.Get().(*bufio.Writer)
+	w.lbw.Reset(w.w)
+	return nil
+}
+
 func (w *lazyBufioWriter) Available() int { return w.bw().Available() }
 
+// Buffered returns the number of bytes written but not yet flushed.
+func (w *lazyBufioWriter) Buffered() int {
+	if w.lbw == nil {
+		return 0
+	}
+	return w.lbw.Buffered()
+}
+
 func (w *lazyBufioWriter) Write(p []byte) (int, error) { return w.bw().Write(p) }
 
 func (w *lazyBufioWriter) Flush() error {
@@ -2000,10 +4303,17 @@ func (w *lazyBufioWriter) Flush() error {
 		return nil
 	}
 	err := w.lbw.Flush()
+	w.release()
+	return err
+}
 
+// release returns w's buffer to its pool.
+func (w *lazyBufioWriter) release() {
 	w.lbw.Reset(io.Discard)
-	bufioWriterPool.Put(w.lbw)
+	if w.lbw.Size() == sendBatchBufferSize {
+		batchBufioWriterPool.Put(w.lbw)
+	} else {
+		bufioWriterPool.Put(w.lbw)
+	}
 	w.lbw = nil
-
-	return err
 }
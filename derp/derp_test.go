@@ -7,22 +7,35 @@
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"go4.org/mem"
 	"golang.org/x/time/rate"
 	"tailscale.com/disco"
@@ -30,8 +43,29 @@
 	"tailscale.com/tstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/set"
 )
 
+func init() {
+	// The derp/derpzstd package imports derp, so can't be imported
+	// here. Register the equivalent for tests instead.
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxJumboPacketSize))
+	if err != nil {
+		panic(err)
+	}
+	RegisterZstd(testZstdCodec{enc, dec})
+}
+
+type testZstdCodec struct {
+	*zstd.Encoder
+	*zstd.Decoder
+}
+
 func TestClientInfoUnmarshal(t *testing.T) {
 	for i, in := range []string{
 		`{"Version":5,"MeshKey":"abc"}`,
@@ -940,6 +974,17 @@ type dummyNetConn struct {
 func (dummyNetConn) SetReadDeadline(time.Time) error { return nil }
 
 func TestClientRecv(t *testing.T) {
+	k1 := key.NodePublicFromRaw32(mem.B(bytes.Repeat([]byte{1}, keyLen)))
+	k2 := key.NodePublicFromRaw32(mem.B(bytes.Repeat([]byte{2}, keyLen)))
+	ap1 := netip.MustParseAddrPort("1.2.3.4:5")
+	ap2 := netip.MustParseAddrPort("[fe80::1]:6")
+	zstdFrame := func(b []byte, body []byte) []byte {
+		b = append(b, byte(frameRecvPacketZstd))
+		b = binary.BigEndian.AppendUint32(b, uint32(keyLen+len(body)))
+		b = k1.AppendTo(b)
+		return append(b, body...)
+	}
+	zstdData := bytes.Repeat([]byte("zstd"), 100)
 	tests := []struct {
 		name  string
 		input []byte
@@ -988,6 +1033,23 @@ func TestClientRecv(t *testing.T) {
 				TryFor:      2 * time.Millisecond,
 			},
 		},
+		{
+			name: "peer_present_batch",
+			input: appendPeerPresent(appendPeerPresent(
+				[]byte{byte(framePeerPresentBatch), 0, 0, 0, 2 * peerPresentLen},
+				k1, ap1), k2, ap2),
+			want: PeerPresentBatchMessage{
+				{Key: k1, IPPort: ap1},
+				{Key: k2, IPPort: ap2},
+			},
+		},
+		{
+			// The malformed first frame is dropped.
+			name: "recv_packet_zstd",
+			input: zstdFrame(zstdFrame(nil, []byte("not zstd")),
+				zstdCodec.EncodeAll(zstdData, nil)),
+			want: ReceivedPacket{Source: k1, Data: zstdData},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1359,6 +1421,107 @@ func benchmarkSendRecvSize(b *testing.B, packetSize int) {
 	}
 }
 
+func TestPacketBufPools(t *testing.T) {
+	for _, n := range []int{0, 1, 256, 257, MaxPacketSize, MaxPacketSize + 1, MaxJumboPacketSize} {
+		b := getPacketBuf(n)
+		if len(b) != n {
+			t.Errorf("getPacketBuf(%d) has len %d", n, len(b))
+		}
+		i := 0
+		for packetBufSizes[i] < n {
+			i++
+		}
+		if cap(b) != packetBufSizes[i] {
+			t.Errorf("getPacketBuf(%d) has cap %d; want %d", n, cap(b), packetBufSizes[i])
+		}
+		putPacketBuf(b)
+	}
+	if b := getPacketBuf(MaxJumboPacketSize + 1); len(b) != MaxJumboPacketSize+1 {
+		t.Errorf("oversized buffer has len %d", len(b))
+	}
+}
+
+// BenchmarkServerRelay measures the server relaying packets from one
+// client to many, from reading each frame to dequeuing it for sending,
+// including the GC cycles the garbage causes.
+func BenchmarkServerRelay(b *testing.B) {
+	for _, size := range []int{100, 1400, 10000} {
+		b.Run(fmt.Sprintf("clients=10000/msgsize=%d", size), func(b *testing.B) {
+			benchmarkServerRelay(b, 10000, size)
+		})
+	}
+}
+
+func benchmarkServerRelay(b *testing.B, numClients, packetSize int) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+
+	// Frames sending one packet to each client in turn.
+	var frames bytes.Buffer
+	bw := bufio.NewWriter(&frames)
+	dsts := make([]*sclient, numClients)
+	for i := range dsts {
+		dst := &sclient{
+			s:              s,
+			key:            key.NewNode().Public(),
+			logf:           logger.Discard,
+			done:           make(chan struct{}),
+			sendQueue:      make(chan pkt, perClientSendQueueDepth),
+			discoSendQueue: make(chan pkt, perClientSendQueueDepth),
+			maxPacketSize:  MaxPacketSize,
+		}
+		s.clients[dst.key] = singleClient{dst}
+		dsts[i] = dst
+		writeFrameHeader(bw, frameSendPacket, uint32(keyLen+packetSize))
+		dst.key.WriteRawWithoutAllocating(bw)
+		bw.Write(make([]byte, packetSize))
+	}
+	bw.Flush()
+
+	src := &sclient{
+		s:             s,
+		key:           key.NewNode().Public(),
+		logf:          logger.Discard,
+		br:            bufio.NewReader(&repeatReader{b: frames.Bytes()}),
+		maxPacketSize: MaxPacketSize,
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gcs := ms.NumGC
+	b.SetBytes(int64(packetSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ft, fl, err := readFrameHeader(src.br)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := src.handleFrameSendPacket(ft, fl); err != nil {
+			b.Fatal(err)
+		}
+		// Stand in for dst's sendLoop.
+		dst := dsts[i%numClients]
+		p := <-dst.sendQueue
+		putPacketBuf(p.bs)
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&ms)
+	b.ReportMetric(float64(ms.NumGC-gcs)*1e6/float64(b.N), "gcs/1M-pkts")
+}
+
+// repeatReader is an io.Reader that reads b over and over.
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
+
 func BenchmarkWriteUint32(b *testing.B) {
 	w := bufio.NewWriter(io.Discard)
 	b.ReportAllocs()
@@ -1444,7 +1607,7 @@ func TestClientSendRateLimiting(t *testing.T) {
 	c.setSendRateLimiter(ServerInfoMessage{})
 
 	pkt := make([]byte, 1000)
-	if err := c.send(key.NodePublic{}, pkt); err != nil {
+	if err := c.send(key.NodePublic{}, pkt, false); err != nil {
 		t.Fatal(err)
 	}
 	writes1, bytes1 := cw.Stats()
@@ -1455,7 +1618,7 @@ func TestClientSendRateLimiting(t *testing.T) {
 	// Flood should all succeed.
 	cw.ResetStats()
 	for i := 0; i < 1000; i++ {
-		if err := c.send(key.NodePublic{}, pkt); err != nil {
+		if err := c.send(key.NodePublic{}, pkt, false); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -1474,7 +1637,7 @@ func TestClientSendRateLimiting(t *testing.T) {
 		TokenBucketBytesBurst:     int(bytes1 * 2),
 	})
 	for i := 0; i < 1000; i++ {
-		if err := c.send(key.NodePublic{}, pkt); err != nil {
+		if err := c.send(key.NodePublic{}, pkt, false); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -1487,7 +1650,212 @@ func TestClientSendRateLimiting(t *testing.T) {
 	}
 }
 
-func TestServerRepliesToPing(t *testing.T) {
+func TestClientTrySend(t *testing.T) {
+	cw := new(countWriter)
+	c := &Client{
+		bw:    bufio.NewWriter(cw),
+		clock: &tstest.Clock{},
+	}
+	pkt := make([]byte, 100)
+	if err := c.TrySend(key.NodePublic{}, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if writes, _ := cw.Stats(); writes != 1 {
+		t.Errorf("writes = %v; want 1", writes)
+	}
+
+	// Another write in progress makes TrySend fail, and a Send wait.
+	c.wmu.Lock()
+	if err := c.TrySend(key.NodePublic{}, pkt); !errors.Is(err, ErrSendWouldBlock) {
+		t.Fatalf("TrySend while busy = %v; want %v", err, ErrSendWouldBlock)
+	}
+	errc := make(chan error)
+	go func() { errc <- c.Send(key.NodePublic{}, pkt) }()
+	for c.SendQueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	c.wmu.Unlock()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := c.SendQueueDepth(); got != 0 {
+		t.Errorf("SendQueueDepth = %d after sends; want 0", got)
+	}
+	if writes, _ := cw.Stats(); writes != 2 {
+		t.Errorf("writes = %v; want 2", writes)
+	}
+}
+
+func TestServerClientRateLimit(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	s.SetClientRateLimit(ClientRateLimit{
+		PacketsPerSecond: 10,
+		PacketsBurst:     5,
+	})
+
+	newClient := func(canMesh bool) *sclient {
+		c := &sclient{s: s, key: key.NewNode().Public(), canMesh: canMesh}
+		c.initRateLimiters()
+		return c
+	}
+
+	c := newClient(false)
+	for i := 0; i < 5; i++ {
+		if !c.allowSend(100) {
+			t.Fatalf("packet %d rate limited; want allowed within burst", i)
+		}
+	}
+	if c.allowSend(100) {
+		t.Fatal("packet over burst allowed; want rate limited")
+	}
+	clock.Advance(time.Second)
+	if !c.allowSend(100) {
+		t.Fatal("packet rate limited after refill; want allowed")
+	}
+
+	mc := newClient(true)
+	if mc.pktLim != nil || mc.byteLim != nil {
+		t.Fatal("mesh client has rate limiters; want exempt")
+	}
+	for i := 0; i < 100; i++ {
+		if !mc.allowSend(100) {
+			t.Fatalf("mesh packet %d rate limited", i)
+		}
+	}
+
+	// A custom policy can limit mesh peers too.
+	s.SetClientRateLimit(ClientRateLimit{
+		BytesPerSecond: 1000,
+		BytesBurst:     1000,
+		Exempt:         func(key.NodePublic, bool) bool { return false },
+	})
+	mc = newClient(true)
+	if mc.pktLim != nil {
+		t.Fatal("unexpected packet limiter with no packet rate configured")
+	}
+	if !mc.allowSend(500) {
+		t.Fatal("first 500 bytes rate limited")
+	}
+	if mc.allowSend(500) {
+		t.Fatal("second 500 bytes (plus framing) allowed; want rate limited")
+	}
+}
+
+func TestServerFlapDampening(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	s.SetFlapDampening(10 * time.Second)
+
+	done := make(chan struct{})
+	close(done)
+	w := &sclient{key: key.NewNode().Public(), canMesh: true, done: done}
+	s.watchers.Add(w)
+
+	c := &sclient{key: key.NewNode().Public(), logf: t.Logf, done: done}
+	flap := func() {
+		s.registerClient(c)
+		s.unregisterClient(c)
+		clock.Advance(time.Second)
+	}
+	for i := 0; i < flapConnects-1; i++ {
+		flap()
+	}
+	if got, want := len(w.peerStateChange), 2*(flapConnects-1); got != want {
+		t.Fatalf("before flapping, watcher got %d changes; want %d", got, want)
+	}
+	if fc := s.FlappingClients(); len(fc) != 0 {
+		t.Fatalf("FlappingClients = %v; want none", fc)
+	}
+
+	// The next connect makes it flap; it and the following disconnect
+	// are withheld from the watcher.
+	w.peerStateChange = nil
+	flap()
+	if len(w.peerStateChange) != 0 {
+		t.Fatalf("while flapping, watcher got %d changes; want 0", len(w.peerStateChange))
+	}
+	fc := s.FlappingClients()
+	if len(fc) != 1 || fc[0].Key != c.key || !fc[0].Dampened || fc[0].Connected {
+		t.Fatalf("FlappingClients = %+v; want dampened, disconnected %v", fc, c.key)
+	}
+
+	// It flapped back to disconnected, which the watcher already
+	// knows, so nothing is sent after the dampening period.
+	clock.Advance(10 * time.Second)
+	if len(w.peerStateChange) != 0 {
+		t.Fatalf("after dampening, watcher got %d changes; want 0", len(w.peerStateChange))
+	}
+
+	// A connect while flapping is coalesced and delivered later.
+	s.registerClient(c)
+	defer s.unregisterClient(c)
+	if len(w.peerStateChange) != 0 {
+		t.Fatalf("watcher got %d changes; want 0", len(w.peerStateChange))
+	}
+	clock.Advance(10 * time.Second)
+	if len(w.peerStateChange) != 1 || !w.peerStateChange[0].present {
+		t.Fatalf("after dampening, watcher got %+v; want one present change", w.peerStateChange)
+	}
+}
+
+func TestServerVerifyClientFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	var mu sync.Mutex
+	allowed := map[key.NodePublic]bool{}
+	ts.s.SetVerifyClientFunc(func(_ context.Context, k key.NodePublic, srcIP netip.Addr) error {
+		if !srcIP.IsLoopback() {
+			t.Errorf("srcIP = %v; want loopback", srcIP)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !allowed[k] {
+			return errors.New("not allowed")
+		}
+		return nil
+	})
+
+	newClient := func(name string, wantOK bool) {
+		t.Helper()
+		newTestClient(t, ts, name, func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+			if wantOK {
+				mu.Lock()
+				allowed[priv.Public()] = true
+				mu.Unlock()
+			}
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf)
+			if err != nil {
+				return nil, err
+			}
+			m, err := c.recvTimeout(5 * time.Second)
+			if wantOK {
+				if _, ok := m.(ServerInfoMessage); !ok || err != nil {
+					t.Errorf("%s: first recv = %T, %v; want ServerInfoMessage", name, m, err)
+				}
+			} else if err == nil {
+				t.Errorf("%s: connected despite being rejected; got %T", name, m)
+			}
+			return c, nil
+		})
+	}
+	newClient("alice", true)
+	newClient("mallory", false)
+
+	// Mesh peers aren't subject to the func.
+	newTestWatcher(t, ts, "mesh")
+}
+
+func TestServerDrain(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -1495,24 +1863,1921 @@ func TestServerRepliesToPing(t *testing.T) {
 	defer ts.close(t)
 
 	tc := newRegularClient(t, ts, "alice")
+	newTestWatcher(t, ts, "mesh") // stays connected throughout
 
-	data := [8]byte{1, 2, 3, 4, 5, 6, 7, 42}
+	drainErr := make(chan error, 1)
+	go func() {
+		drainErr <- ts.s.Drain(ctx, DrainOptions{
+			ReconnectIn: time.Second,
+			TryFor:      2 * time.Second,
+			GracePeriod: time.Minute,
+		})
+	}()
 
-	if err := tc.c.SendPing(data); err != nil {
+	m, err := tc.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ServerRestartingMessage{ReconnectIn: time.Second, TryFor: 2 * time.Second}
+	if m != want {
+		t.Fatalf("got %#v; want %#v", m, want)
+	}
+
+	// New connections are refused while draining.
+	nc, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	if c, err := NewClient(key.NewNode(), nc, brw, t.Logf); err == nil {
+		if m, err := c.recvTimeout(5 * time.Second); err == nil {
+			t.Fatalf("new connection accepted while draining; got %T", m)
+		}
+	}
+
+	// Once the last client other than the mesh peer leaves, Drain
+	// finishes without waiting for the grace period.
+	tc.nc.Close()
+	select {
+	case err := <-drainErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Drain didn't return after all clients disconnected")
+	}
+	if !ts.s.isClosed() {
+		t.Error("server not closed after Drain")
+	}
+}
+
+func TestServerPacketTap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	events := make(chan PacketTapEvent, 10)
+	ts.s.SetPacketTap(func(ev PacketTapEvent) { events <- ev }, 1)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+	recvPacket := func() {
+		t.Helper()
+		for {
+			m, err := bob.c.recvTimeout(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := m.(ReceivedPacket); ok {
+				return
+			}
+		}
+	}
+
+	if err := alice.c.Send(bob.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	recvPacket()
+	select {
+	case ev := <-events:
+		if ev.Src != alice.pub || ev.Dst != bob.pub || ev.Len != len("hello") || ev.FromMesh || ev.ToMesh || ev.Time.IsZero() {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("no tap event for relayed packet")
+	}
+
+	ts.s.SetPacketTap(nil, 0)
+	if err := alice.c.Send(bob.pub, []byte("again")); err != nil {
 		t.Fatal(err)
 	}
+	recvPacket()
+	select {
+	case ev := <-events:
+		t.Errorf("got event %+v after removing tap", ev)
+	default:
+	}
+}
+
+func TestServerDropAccounting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	if got, want := len(ts.s.packetsDroppedReasonCounters), int(dropReasonMiddleware)+1; got != want {
+		t.Fatalf("%d drop reason counters; want one per dropReason (%d)", got, want)
+	}
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	// Send an oversized packet from alice to bob. The server drops
+	// it and hangs up on alice.
+	bw := bufio.NewWriter(alice.nc)
+	writeFrameHeader(bw, frameSendPacket, keyLen+MaxPacketSize+1)
+	bob.pub.WriteRawWithoutAllocating(bw)
+	bw.Write(make([]byte, MaxPacketSize+1))
+	bw.Flush()
 
+	deadline := time.Now().Add(5 * time.Second)
 	for {
-		m, err := tc.c.recvTimeout(time.Second)
+		var got ConnectedClient
+		for _, cc := range ts.s.ConnectedClients() {
+			if cc.Key == bob.pub {
+				got = cc
+			}
+		}
+		if got.Key != bob.pub {
+			t.Fatal("bob not connected")
+		}
+		if got.DropsTooLarge == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob's DropsTooLarge = %d; want 1", got.DropsTooLarge)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ts.s.packetsDroppedReasonCounters[dropReasonTooLarge].Value(); got != 1 {
+		t.Errorf("too_large drops = %d; want 1", got)
+	}
+}
+
+// TestDropReasonLabels checks that each dropReason is counted under the
+// expvar label for that reason.
+func TestDropReasonLabels(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	labels := map[dropReason]string{
+		dropReasonUnknownDest:      "unknown_dest",
+		dropReasonUnknownDestOnFwd: "unknown_dest_on_fwd",
+		dropReasonGoneDisconnected: "gone_disconnected",
+		dropReasonQueueHead:        "queue_head",
+		dropReasonQueueTail:        "queue_tail",
+		dropReasonWriteError:       "write_error",
+		dropReasonDupClient:        "dup_client",
+		dropReasonRateLimited:      "rate_limited",
+		dropReasonWriteTimeout:     "write_timeout",
+		dropReasonTooLarge:         "too_large",
+		dropReasonMiddleware:       "middleware",
+	}
+	if len(labels) != len(s.packetsDroppedReasonCounters) {
+		t.Fatalf("%d labels for %d drop reason counters", len(labels), len(s.packetsDroppedReasonCounters))
+	}
+	for reason, label := range labels {
+		s.recordDrop(nil, key.NodePublic{}, key.NodePublic{}, reason)
+		if got := s.packetsDroppedReason.Get(label).Value(); got != 1 {
+			t.Errorf("%v: %q = %d; want 1", reason, label, got)
+		}
+	}
+}
+
+func TestServerWatcherPeerPresentBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	want := map[key.NodePublic]bool{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		want[newRegularClient(t, ts, name).pub] = true
+	}
+
+	w := newTestClient(t, ts, "watcher", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"), CanPeerPresentBatch(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		if err := c.WatchConnectionChanges(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+
+	for len(want) > 0 {
+		m, err := w.c.recvTimeout(5 * time.Second)
 		if err != nil {
 			t.Fatal(err)
 		}
 		switch m := m.(type) {
-		case PongMessage:
-			if ([8]byte(m)) != data {
-				t.Fatalf("got pong %2x; want %2x", [8]byte(m), data)
+		case PeerPresentBatchMessage:
+			for _, p := range m {
+				delete(want, p.Key)
 			}
-			return
+		case PeerPresentMessage:
+			t.Fatalf("got unbatched PeerPresentMessage for %v", ts.keyName(m.Key))
+		}
+	}
+}
+
+func TestServerDisconnectClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	tc := newRegularClient(t, ts, "alice")
+	if ts.s.DisconnectClient(key.NewNode().Public()) {
+		t.Fatal("DisconnectClient of unknown key reported success")
+	}
+	if !ts.s.DisconnectClient(tc.pub) {
+		t.Fatal("DisconnectClient of connected key reported failure")
+	}
+
+	// The connection must be closed promptly after the goodbye,
+	// well before requestDisconnect's backstop timer.
+	var gotHealth bool
+	for {
+		m, err := tc.c.recvTimeout(writeTimeout / 2)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("connection not closed after goodbye")
+		}
+		if err != nil {
+			if !gotHealth {
+				t.Fatalf("connection closed without goodbye health message: %v", err)
+			}
+			break
+		}
+		if hm, ok := m.(HealthMessage); ok && hm.Problem != "" {
+			gotHealth = true
+		}
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetIdleTimeout(500 * time.Millisecond)
+
+	idle := newRegularClient(t, ts, "idle")
+	busy := newRegularClient(t, ts, "busy")
+
+	// busy keeps pinging for longer than the timeout.
+	for i := 0; i < 5; i++ {
+		if err := busy.c.SendPing([8]byte{byte(i)}); err != nil {
+			t.Fatal(err)
 		}
+		time.Sleep(200 * time.Millisecond)
 	}
+
+	var problem string
+	for {
+		m, err := idle.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			break
+		}
+		if hm, ok := m.(HealthMessage); ok {
+			problem = hm.Problem
+		}
+	}
+	if !strings.Contains(problem, "without any frames") {
+		t.Errorf("idle client's goodbye = %q; want idle timeout reason", problem)
+	}
+	if got := ts.s.idleDisconnects.Value(); got != 1 {
+		t.Errorf("idle_disconnects = %d; want 1", got)
+	}
+	if !ts.s.IsClientConnectedForTest(busy.pub) {
+		t.Error("busy client was disconnected")
+	}
+}
+
+func TestServerIdleTimeoutSlowFrame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetIdleTimeout(200 * time.Millisecond)
+
+	tc := newRegularClient(t, ts, "slow")
+
+	// Send a ping whose header and body straddle the idle timeout.
+	data := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tc.c.wmu.Lock()
+	writeFrameHeader(tc.c.bw, framePing, 8)
+	tc.c.bw.Write(data[:4])
+	tc.c.bw.Flush()
+	time.Sleep(500 * time.Millisecond)
+	tc.c.bw.Write(data[4:])
+	err := tc.c.bw.Flush()
+	tc.c.wmu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		m, err := tc.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatalf("no pong for slow ping: %v", err)
+		}
+		if pm, ok := m.(PongMessage); ok {
+			if pm != PongMessage(data) {
+				t.Fatalf("pong = %x; want %x", pm, data)
+			}
+			break
+		}
+	}
+	if got := ts.s.idleDisconnects.Value(); got != 0 {
+		t.Errorf("idle_disconnects = %d; want 0", got)
+	}
+}
+
+func TestServerRepliesToPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	tc := newRegularClient(t, ts, "alice")
+
+	data := [8]byte{1, 2, 3, 4, 5, 6, 7, 42}
+
+	if err := tc.c.SendPing(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		m, err := tc.c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m := m.(type) {
+		case PongMessage:
+			if ([8]byte(m)) != data {
+				t.Fatalf("got pong %2x; want %2x", [8]byte(m), data)
+			}
+			return
+		}
+	}
+}
+
+func TestServerSetMeshKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetMeshKeys([]string{"mesh-key", "new-key"})
+
+	w := newTestWatcher(t, ts, "w")
+	w.wantPresent(t, w.pub)
+
+	// meshKeyRejected connects with meshKey and reports whether the
+	// server said it rejected it.
+	meshKeyRejected := func(meshKey string) bool {
+		t.Helper()
+		nc, err := net.Dial("tcp", ts.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(key.NewNode(), nc, brw, t.Logf, MeshKey(meshKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		si, ok := m.(ServerInfoMessage)
+		if !ok {
+			t.Fatalf("first message = %T; want ServerInfoMessage", m)
+		}
+		return si.MeshKeyRejected
+	}
+	for _, k := range []string{"mesh-key", "new-key", ""} {
+		if meshKeyRejected(k) {
+			t.Errorf("mesh key %q rejected; want accepted", k)
+		}
+	}
+	if !meshKeyRejected("wrong-key") {
+		t.Error("wrong mesh key accepted")
+	}
+
+	// Rotate out the old key.
+	ts.s.SetMeshKeys([]string{"new-key"})
+	if got := ts.s.MeshKey(); got != "new-key" {
+		t.Errorf("MeshKey = %q; want %q", got, "new-key")
+	}
+	if !meshKeyRejected("mesh-key") {
+		t.Error("removed mesh key accepted")
+	}
+	if ts.s.IsAdminToken("mesh-key") || !ts.s.IsAdminToken("new-key") {
+		t.Error("IsAdminToken doesn't match the current mesh keys")
+	}
+
+	// The watcher that connected with the old key keeps watching,
+	// past the comings and goings of the clients above.
+	c1 := newRegularClient(t, ts, "c1")
+	for {
+		m, err := w.c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("watcher: %v", err)
+		}
+		if m, ok := m.(PeerPresentMessage); ok && m.Key == c1.pub {
+			break
+		}
+	}
+}
+
+// writeCounter is an io.Writer that counts calls to Write.
+func TestServerZstd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetZstdThreshold(100)
+
+	newZstdClient := func(name string) *testClient {
+		return newTestClient(t, ts, name, func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf, CanZstd(true))
+			if err != nil {
+				return nil, err
+			}
+			waitConnect(t, c)
+			return c, nil
+		})
+	}
+	alice := newZstdClient("alice")
+	bob := newZstdClient("bob")
+	carol := newRegularClient(t, ts, "carol") // doesn't support zstd
+
+	big := bytes.Repeat([]byte("compressible "), 50)
+	small := []byte("too small to compress")
+	random := make([]byte, 1000)
+	crand.Read(random)
+
+	tests := []struct {
+		name         string
+		from, to     *testClient
+		pkt          []byte
+		compress     opt.Bool // if set, sent with SendCompressible
+		wantSentZstd int64    // from the sender to the server
+		wantRecvZstd int64    // from the server to the recipient
+	}{
+		{"both_capable", alice, bob, big, "", 1, 1},
+		{"under_threshold", alice, bob, small, "", 0, 0},
+		{"incompressible", alice, bob, random, "", 0, 0},
+		{"recipient_not_capable", alice, carol, big, "", 1, 0},
+		{"sender_not_capable", carol, bob, big, "", 0, 1},
+		{"compressible", carol, bob, big, "true", 1, 1},
+		{"compressible_under_threshold", carol, bob, small, "true", 0, 0},
+		{"not_compressible", alice, carol, big, "false", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv0 := ts.s.packetsRecvZstd.Value()
+			sent0 := ts.s.packetsSentZstd.Value()
+			var err error
+			if compress, ok := tt.compress.Get(); ok {
+				err = tt.from.c.SendCompressible(tt.to.pub, tt.pkt, compress)
+			} else {
+				err = tt.from.c.Send(tt.to.pub, tt.pkt)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				m, err := tt.to.c.recvTimeout(5 * time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rp, ok := m.(ReceivedPacket); ok {
+					if rp.Source != tt.from.pub || !bytes.Equal(rp.Data, tt.pkt) {
+						t.Fatalf("got %d byte packet from %v; want %d bytes from %v", len(rp.Data), rp.Source, len(tt.pkt), tt.from.pub)
+					}
+					break
+				}
+			}
+			if got := ts.s.packetsRecvZstd.Value() - recv0; got != tt.wantSentZstd {
+				t.Errorf("server received %d compressed packets; want %d", got, tt.wantSentZstd)
+			}
+			if got := ts.s.packetsSentZstd.Value() - sent0; got != tt.wantRecvZstd {
+				t.Errorf("server sent %d compressed packets; want %d", got, tt.wantRecvZstd)
+			}
+		})
+	}
+
+	wantHangup := func(tc *testClient) {
+		t.Helper()
+		for {
+			_, err := tc.c.recvTimeout(5 * time.Second)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("%s: server didn't hang up", tc.name)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	sendRawZstd := func(from, to *testClient, body []byte) {
+		bw := bufio.NewWriter(from.nc)
+		writeFrameHeader(bw, frameSendPacketZstd, uint32(keyLen+len(body)))
+		to.pub.WriteRawWithoutAllocating(bw)
+		bw.Write(body)
+		bw.Flush()
+	}
+
+	// A malformed compressed packet gets the sender disconnected.
+	sendRawZstd(alice, bob, []byte("not zstd"))
+	wantHangup(alice)
+
+	// As does a compressed packet to a server that didn't offer to
+	// accept them.
+	ts2 := newTestServer(t, ctx)
+	defer ts2.close(t)
+	dave := newRegularClient(t, ts2, "dave")
+	erin := newRegularClient(t, ts2, "erin")
+	sendRawZstd(dave, erin, zstdCodec.EncodeAll(big, nil))
+	wantHangup(dave)
+}
+
+func TestServerDropNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	alice := newTestClient(t, ts, "alice", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, CanDropNotify(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, nil
+	})
+	carol := newRegularClient(t, ts, "carol") // didn't ask for drop notifications
+	nobody := key.NewNode().Public()
+
+	// recvDrops sends a ping from tc and returns the drop
+	// notifications it receives before the pong.
+	recvDrops := func(tc *testClient) (drops []PacketDroppedMessage) {
+		t.Helper()
+		if err := tc.c.SendPing([8]byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			m, err := tc.c.recvTimeout(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch m := m.(type) {
+			case PacketDroppedMessage:
+				drops = append(drops, m)
+			case PongMessage:
+				return drops
+			}
+		}
+	}
+
+	if err := alice.c.Send(nobody, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	drops := recvDrops(alice)
+	want := []PacketDroppedMessage{{Dst: nobody, Reason: DropReasonUnknownDest}}
+	if !reflect.DeepEqual(drops, want) {
+		t.Fatalf("drops = %+v; want %+v", drops, want)
+	}
+
+	// Notifications are rate limited.
+	for i := 0; i < 10; i++ {
+		if err := alice.c.Send(nobody, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(recvDrops(alice)); n < 1 || n > 3 {
+		t.Errorf("got %d drop notifications for 10 drops; want 1-3", n)
+	}
+
+	if err := carol.c.Send(nobody, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if drops := recvDrops(carol); len(drops) != 0 {
+		t.Errorf("client that didn't ask got drop notifications: %+v", drops)
+	}
+}
+
+type writeCounter struct {
+	writes int
+	bytes  int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	return len(p), nil
+}
+
+func TestLazyBufioWriterBatch(t *testing.T) {
+	pkt := make([]byte, 1000)
+	writePackets := func(lw *lazyBufioWriter) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			if _, err := lw.Write(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if lw.lbw != nil {
+			t.Fatal("buffer not released on Flush")
+		}
+	}
+
+	var small writeCounter
+	writePackets(&lazyBufioWriter{w: &small})
+	if small.writes < 5 {
+		t.Errorf("unbatched: %d writes; want at least 5", small.writes)
+	}
+
+	var batched writeCounter
+	lw := &lazyBufioWriter{w: &batched}
+	if err := lw.growForBatch(); err != nil {
+		t.Fatal(err)
+	}
+	writePackets(lw)
+	if batched.writes != 1 || batched.bytes != 10*len(pkt) {
+		t.Errorf("batched: %d writes of %d bytes; want 1 of %d", batched.writes, batched.bytes, 10*len(pkt))
+	}
+
+	// Growing with data in the small buffer flushes it, rather than
+	// discarding it or staying small.
+	var partial writeCounter
+	lw = &lazyBufioWriter{w: &partial}
+	lw.Write([]byte("hi"))
+	if err := lw.growForBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if partial.bytes != 2 {
+		t.Errorf("growForBatch with buffered data flushed %d bytes; want 2", partial.bytes)
+	}
+	if !lw.batching() {
+		t.Error("growForBatch with buffered data didn't switch to a large buffer")
+	}
+	writePackets(lw)
+	if partial.writes != 2 {
+		t.Errorf("after growForBatch with buffered data, %d writes; want 2", partial.writes)
+	}
+}
+
+func TestSendBatchCounting(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	var w writeCounter
+	c := &sclient{
+		s:              s,
+		bw:             &lazyBufioWriter{w: &w},
+		sendQueue:      make(chan pkt, 4),
+		discoSendQueue: make(chan pkt, 4),
+	}
+	send := func() {
+		t.Helper()
+		if err := c.prepareSendBatch(); err != nil {
+			t.Fatal(err)
+		}
+		c.bw.Write([]byte("pkt"))
+	}
+	flush := func() {
+		t.Helper()
+		c.countSendBatch()
+		if err := c.bw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A lone packet isn't a batch.
+	send()
+	flush()
+	if got := s.sendBatches.Value(); got != 0 {
+		t.Fatalf("after lone packet, send_batches = %d; want 0", got)
+	}
+
+	// A burst noticed after the first packet was buffered flushes
+	// that packet alone, then coalesces the rest.
+	send()
+	c.sendQueue <- pkt{}
+	c.sendQueue <- pkt{}
+	for len(c.sendQueue) > 0 {
+		<-c.sendQueue
+		send()
+	}
+	send()
+	flush()
+	if !(w.writes == 3 && s.sendBatches.Value() == 1) {
+		t.Fatalf("after burst, %d writes and send_batches = %d; want 3 and 1", w.writes, s.sendBatches.Value())
+	}
+}
+
+func TestPairAccounting(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if s.TopPairs() != nil {
+		t.Fatal("TopPairs non-nil without SetPairAccounting")
+	}
+	s.SetPairAccounting(2)
+
+	a, b, c := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	add := func(src, dst key.NodePublic, n int64) {
+		s.addPairBytes(map[keyPair]int64{{src, dst}: n})
+	}
+	add(a, b, 100)
+	add(a, c, 30)
+	add(a, c, 20)
+	add(b, a, 10) // replaces a->c, the smallest
+
+	want := []PairBandwidth{
+		{Src: a, Dst: b, Bytes: 100},
+		{Src: b, Dst: a, Bytes: 60, MaxOverCount: 50},
+	}
+	if got := s.TopPairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TopPairs = %+v; want %+v", got, want)
+	}
+
+	// A heavy new pair displaces the smallest and rises to the top.
+	add(c, a, 200)
+	want = []PairBandwidth{
+		{Src: c, Dst: a, Bytes: 260, MaxOverCount: 60},
+		{Src: a, Dst: b, Bytes: 100},
+	}
+	if got := s.TopPairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TopPairs = %+v; want %+v", got, want)
+	}
+}
+
+func TestPairAccountingPerClient(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	s.SetPairAccounting(10)
+
+	a, b := key.NewNode().Public(), key.NewNode().Public()
+	c := &sclient{s: s, key: a}
+	c.notePairBytes(a, b, 100) // first count is merged at once
+	c.notePairBytes(a, b, 20)
+	c.notePairBytes(a, b, 30)
+	want := []PairBandwidth{{Src: a, Dst: b, Bytes: 100}}
+	if got := s.TopPairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TopPairs before flush = %+v; want %+v", got, want)
+	}
+
+	// Counts are merged once pairFlushInterval has passed.
+	clock.Advance(pairFlushInterval)
+	c.notePairBytes(a, b, 1)
+	want = []PairBandwidth{{Src: a, Dst: b, Bytes: 151}}
+	if got := s.TopPairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TopPairs after interval = %+v; want %+v", got, want)
+	}
+
+	// And when the client disconnects.
+	c.notePairBytes(a, b, 9)
+	c.flushPairBytes()
+	want = []PairBandwidth{{Src: a, Dst: b, Bytes: 160}}
+	if got := s.TopPairs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TopPairs after flush = %+v; want %+v", got, want)
+	}
+}
+
+func TestPairAudit(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)})
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	dir := t.TempDir()
+	s.SetPairAudit(PairAuditConfig{Dir: dir, Pairs: 2, Retain: 2 * time.Hour})
+
+	a, b, c := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	snapshot := func() {
+		t.Helper()
+		clock.Advance(time.Hour)
+		if err := s.writePairAuditSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.prunePairAudit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(since time.Time) []PairBandwidth {
+		t.Helper()
+		got, err := ReadPairAudit(dir, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	add := func(src, dst key.NodePublic, n int64) {
+		s.addPairBytes(map[keyPair]int64{{src, dst}: n})
+	}
+	start := clock.Now()
+	add(a, b, 100)
+	add(b, c, 50)
+	snapshot()
+	add(b, c, 200)
+	snapshot()
+
+	want := []PairBandwidth{
+		{Src: b, Dst: c, Bytes: 250},
+		{Src: a, Dst: b, Bytes: 100},
+	}
+	if got := read(start); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadPairAudit = %+v; want %+v", got, want)
+	}
+	want = []PairBandwidth{{Src: b, Dst: c, Bytes: 200}}
+	if got := read(start.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadPairAudit of last hour = %+v; want %+v", got, want)
+	}
+
+	// Snapshots older than the retention period are deleted.
+	snapshot()
+	snapshot()
+	if got := read(start); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadPairAudit after retention period = %+v; want %+v", got, want)
+	}
+	if des, _ := os.ReadDir(dir); len(des) != 3 {
+		t.Errorf("%d files in audit dir; want 3", len(des))
+	}
+}
+
+func TestMeshBandwidth(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC)})
+	file := filepath.Join(t.TempDir(), "sub", "meshbw.json")
+	newServer := func() *Server {
+		s := NewServer(key.NewNode(), t.Logf)
+		t.Cleanup(func() { s.Close() })
+		s.clock = clock
+		s.SetMeshBandwidth(MeshBandwidthConfig{File: file, Days: 2})
+		return s
+	}
+	s := newServer()
+
+	p1, p2 := key.NewNode().Public(), key.NewNode().Public()
+	s.noteMeshBandwidth(p1, true, 100)
+	s.noteMeshBandwidth(p1, false, 10)
+	s.noteMeshBandwidth(p2, false, 20)
+	clock.Advance(2 * time.Hour)
+	s.noteMeshBandwidth(p1, true, 1000)
+
+	want := MeshBandwidthReport{
+		Daily: map[string]map[key.NodePublic]MeshBandwidth{
+			"2026-01-31": {
+				p1: {PacketsIn: 1, BytesIn: 100, PacketsOut: 1, BytesOut: 10},
+				p2: {PacketsOut: 1, BytesOut: 20},
+			},
+			"2026-02-01": {
+				p1: {PacketsIn: 1, BytesIn: 1000},
+			},
+		},
+		Monthly: map[string]map[key.NodePublic]MeshBandwidth{
+			"2026-01": {
+				p1: {PacketsIn: 1, BytesIn: 100, PacketsOut: 1, BytesOut: 10},
+				p2: {PacketsOut: 1, BytesOut: 20},
+			},
+			"2026-02": {
+				p1: {PacketsIn: 1, BytesIn: 1000},
+			},
+		},
+	}
+	if got := s.MeshBandwidth(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("MeshBandwidth = %+v; want %+v", got, want)
+	}
+
+	// The counts survive a restart, adding to those since.
+	if err := s.saveMeshBandwidth(); err != nil {
+		t.Fatal(err)
+	}
+	s = newServer()
+	s.noteMeshBandwidth(p1, true, 1000)
+	if err := s.meshBandwidth.load(); err != nil {
+		t.Fatal(err)
+	}
+	want.Daily["2026-02-01"][p1] = MeshBandwidth{PacketsIn: 2, BytesIn: 2000}
+	want.Monthly["2026-02"][p1] = MeshBandwidth{PacketsIn: 2, BytesIn: 2000}
+	if got := s.MeshBandwidth(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("MeshBandwidth after reload = %+v; want %+v", got, want)
+	}
+
+	// Only the configured number of days are kept.
+	clock.Advance(24 * time.Hour)
+	s.noteMeshBandwidth(p2, true, 5)
+	got := s.MeshBandwidth()
+	if _, ok := got.Daily["2026-01-31"]; ok || len(got.Daily) != 2 {
+		t.Errorf("days kept = %v; want 2026-02-01 and 2026-02-02", got.Daily)
+	}
+	if len(got.Monthly) != 2 {
+		t.Errorf("%d months kept; want 2", len(got.Monthly))
+	}
+}
+
+func TestServerVerbosity(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	s := NewServer(key.NewNode(), logf)
+	defer s.Close()
+	s.SetVerbosity(0)
+	c := &sclient{s: s, logf: logf}
+	logs = nil
+
+	c.vlogf(1, "lifecycle")
+	c.vlogf(2, "per-packet")
+	if len(logs) != 0 {
+		t.Fatalf("at verbosity 0, logged %q", logs)
+	}
+
+	s.SetVerbosity(1)
+	c.vlogf(1, "lifecycle")
+	c.vlogf(2, "per-packet")
+	if want := []string{"[v1] lifecycle"}; !reflect.DeepEqual(logs, want) {
+		t.Fatalf("at verbosity 1, logged %q; want %q", logs, want)
+	}
+
+	logs = nil
+	c.debug = true
+	s.SetVerbosity(0)
+	c.vlogf(2, "per-packet")
+	if want := []string{"[v2] per-packet"}; !reflect.DeepEqual(logs, want) {
+		t.Fatalf("with debug forced, logged %q; want %q", logs, want)
+	}
+}
+
+func TestSlowClientPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		policy         SlowClientPolicy
+		canMesh        bool
+		wantDisconnect bool
+	}{
+		{"drop_oldest", SlowClientDropOldest, false, false},
+		{"disconnect", SlowClientDisconnect, false, true},
+		{"disconnect_mesh", SlowClientDisconnect, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(key.NewNode(), t.Logf)
+			defer s.Close()
+			s.SetSlowClientPolicy(tt.policy)
+
+			nc, peer := net.Pipe()
+			defer nc.Close()
+			defer peer.Close()
+			src := &sclient{s: s, key: key.NewNode().Public(), logf: t.Logf}
+			dst := &sclient{
+				s:              s,
+				nc:             nc,
+				key:            key.NewNode().Public(),
+				logf:           t.Logf,
+				canMesh:        tt.canMesh,
+				done:           make(chan struct{}),
+				sendQueue:      make(chan pkt, 1),
+				discoSendQueue: make(chan pkt, 1),
+				disconnectCh:   make(chan string, 1),
+			}
+			for i := 0; i < 2; i++ {
+				if err := src.sendPkt(dst, pkt{bs: []byte{byte(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := dst.dropsQueueFull.Load(); got != 1 {
+				t.Errorf("dropsQueueFull = %d; want 1", got)
+			}
+			queued := (<-dst.sendQueue).bs[0]
+			if tt.wantDisconnect {
+				if queued != 0 {
+					t.Errorf("queued packet %d; want the oldest kept", queued)
+				}
+				select {
+				case <-dst.disconnectCh:
+				default:
+					t.Error("no disconnect requested")
+				}
+				if got := s.slowClientDisconnects.Value(); got != 1 {
+					t.Errorf("slowClientDisconnects = %d; want 1", got)
+				}
+			} else {
+				if queued != 1 {
+					t.Errorf("queued packet %d; want the newest kept", queued)
+				}
+				if len(dst.disconnectCh) != 0 {
+					t.Error("unexpected disconnect requested")
+				}
+			}
+		})
+	}
+}
+
+func TestServerWatcherFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	w := newTestClient(t, ts, "watcher", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		if err := c.WatchConnectionChangesFiltered(WatchFilter{Keys: []key.NodePublic{bob.pub}}); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+	w.wantPresent(t, bob.pub)
+
+	// Changes for alice aren't sent; those for bob are.
+	alice.close(t)
+	bob.close(t)
+	w.wantGone(t, bob.pub)
+
+	// A key prefix filter replaces the key filter and sends the
+	// matching connected peers.
+	carol := newRegularClient(t, ts, "carol")
+	raw := carol.pub.Raw32()
+	if err := w.c.WatchConnectionChangesFiltered(WatchFilter{KeyPrefix: raw[:4]}); err != nil {
+		t.Fatal(err)
+	}
+	w.wantPresent(t, carol.pub)
+}
+
+func TestParseWatchFilter(t *testing.T) {
+	k := key.NewNode().Public()
+	raw := k.Raw32()
+	for _, tt := range []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{"prefix", append([]byte{2}, raw[:2]...), false},
+		{"keys", append([]byte{0}, raw[:]...), false},
+		{"both", append(append([]byte{1}, raw[0]), raw[:]...), false},
+		{"empty", []byte{0}, true},
+		{"short_prefix", []byte{3, 1}, true},
+		{"long_prefix", append([]byte{33}, make([]byte, 33)...), true},
+		{"partial_key", append([]byte{0}, raw[:31]...), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseWatchFilter(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if err == nil && !f.matches(k) {
+				t.Errorf("filter doesn't match %v", k)
+			}
+		})
+	}
+	var all *watchFilter
+	if !all.matches(k) {
+		t.Error("nil filter doesn't match")
+	}
+}
+
+func TestPriorityPacketSize(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetPriorityPacketSize(100)
+
+	src := &sclient{s: s, key: key.NewNode().Public(), logf: t.Logf}
+	dst := &sclient{
+		s:              s,
+		key:            key.NewNode().Public(),
+		logf:           t.Logf,
+		done:           make(chan struct{}),
+		sendQueue:      make(chan pkt, 4),
+		discoSendQueue: make(chan pkt, 4),
+	}
+	discoPkt := append([]byte(disco.Magic), make([]byte, 200)...)
+	for _, b := range [][]byte{make([]byte, 100), make([]byte, 101), discoPkt} {
+		if err := src.sendPkt(dst, pkt{bs: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(dst.discoSendQueue); got != 2 {
+		t.Errorf("priority lane has %d packets; want 2", got)
+	}
+	if got := len(dst.sendQueue); got != 1 {
+		t.Errorf("bulk queue has %d packets; want 1", got)
+	} else if got := len((<-dst.sendQueue).bs); got != 101 {
+		t.Errorf("bulk queue has a %d byte packet; want 101", got)
+	}
+}
+
+func TestJumboPackets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	const maxSize = 256 << 10
+	ts.s.SetMaxPacketSize(maxSize)
+
+	newJumboClient := func(name string) *testClient {
+		return newTestClient(t, ts, name, func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf, JumboPacketSize(MaxJumboPacketSize))
+			if err != nil {
+				return nil, err
+			}
+			waitConnect(t, c)
+			return c, nil
+		})
+	}
+	alice := newJumboClient("alice")
+	bob := newJumboClient("bob")
+	carol := newRegularClient(t, ts, "carol")
+
+	if got := alice.c.MaxPacketSize(); got != maxSize {
+		t.Errorf("alice MaxPacketSize = %d; want %d", got, maxSize)
+	}
+	if got := carol.c.MaxPacketSize(); got != MaxPacketSize {
+		t.Errorf("carol MaxPacketSize = %d; want %d", got, MaxPacketSize)
+	}
+
+	jumbo := make([]byte, 100<<10)
+	if err := alice.c.Send(bob.pub, jumbo); err != nil {
+		t.Fatal(err)
+	}
+	m, err := bob.c.recvTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := m.(ReceivedPacket); !ok || len(m.Data) != len(jumbo) {
+		t.Fatalf("bob got %T, want a %d byte ReceivedPacket", m, len(jumbo))
+	}
+
+	if err := carol.c.Send(bob.pub, jumbo); err == nil {
+		t.Error("carol sent a jumbo packet; want error")
+	}
+
+	// Jumbo packets for clients that don't support them are dropped.
+	if err := alice.c.Send(carol.pub, jumbo); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got ConnectedClient
+		for _, cc := range ts.s.ConnectedClients() {
+			if cc.Key == carol.pub {
+				got = cc
+			}
+		}
+		if got.DropsTooLarge == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("carol's DropsTooLarge = %d; want 1", got.DropsTooLarge)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerForwardAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	mesh := newTestClient(t, ts, "mesh", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"), CanForwardAck(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, nil
+	})
+	bob := newRegularClient(t, ts, "bob")
+
+	src := key.NewNode().Public()
+	for _, dst := range []key.NodePublic{bob.pub, key.NewNode().Public()} {
+		if err := mesh.c.ForwardPacket(src, dst, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		m, err := mesh.c.recvTimeout(2 * forwardAckInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := m.(ForwardAckMessage); ok {
+			want := ForwardAckMessage{Packets: 2, Bytes: 10, Dropped: 1}
+			if m != want {
+				t.Errorf("ack = %+v; want %+v", m, want)
+			}
+			return
+		}
+	}
+}
+
+func TestPeerMapFrames(t *testing.T) {
+	m := PeerMap{
+		Origin: key.NewNode().Public(),
+		Host:   "derp1.example.com",
+		Seq:    42,
+		TTL:    30 * time.Second,
+	}
+	for i := 0; i < maxPeerMapKeysPerFrame+1; i++ {
+		m.Keys = append(m.Keys, key.NewNode().Public())
+	}
+	frames, err := appendPeerMapFrames(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames; want 2", len(frames))
+	}
+	var keys []key.NodePublic
+	for i, b := range frames {
+		pm, err := parsePeerMapFrame(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pm.Origin != m.Origin || pm.Host != m.Host || pm.Seq != m.Seq || pm.TTL != m.TTL || pm.Part != i || pm.Parts != 2 {
+			t.Errorf("frame %d = %+v", i, pm)
+		}
+		keys = append(keys, pm.Keys...)
+	}
+	if !reflect.DeepEqual(keys, m.Keys) {
+		t.Error("keys didn't round trip")
+	}
+
+	if _, err := parsePeerMapFrame(frames[0][:len(frames[0])-1]); err == nil {
+		t.Error("truncated frame parsed")
+	}
+}
+
+func TestPeerSnapshotFrames(t *testing.T) {
+	var entries []byte
+	var want []PeerPresentMessage
+	for i := 0; i < maxPeerSnapshotEntriesPerFrame+1; i++ {
+		p := PeerPresentMessage{
+			Key:    key.NewNode().Public(),
+			IPPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), uint16(i)),
+		}
+		entries = appendPeerPresent(entries, p.Key, p.IPPort)
+		want = append(want, p)
+	}
+	frames := appendPeerSnapshotFrames(entries)
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames; want 2", len(frames))
+	}
+	var got []PeerPresentMessage
+	for i, b := range frames {
+		m, err := parsePeerSnapshotFrame(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Part != i || m.Parts != 2 {
+			t.Errorf("frame %d is part %d of %d", i, m.Part, m.Parts)
+		}
+		got = append(got, m.Peers...)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("parsed snapshot differs from original")
+	}
+
+	empty := appendPeerSnapshotFrames(nil)
+	if len(empty) != 1 {
+		t.Fatalf("empty snapshot has %d frames; want 1", len(empty))
+	}
+	if m, err := parsePeerSnapshotFrame(empty[0]); err != nil || m.Parts != 1 || len(m.Peers) != 0 {
+		t.Errorf("empty snapshot parsed as %+v, %v", m, err)
+	}
+	if _, err := parsePeerSnapshotFrame([]byte{0, 1, 0, 1}); err == nil {
+		t.Error("part out of range parsed without error")
+	}
+}
+
+func TestWatcherSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetWatcherSnapshotInterval(50 * time.Millisecond)
+
+	alice := newRegularClient(t, ts, "alice")
+	w := newTestClient(t, ts, "watcher", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"), CanPeerSnapshot(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, c.WatchConnectionChanges()
+	})
+
+	for {
+		m, err := w.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm, ok := m.(PeerSnapshotMessage)
+		if !ok {
+			continue
+		}
+		if sm.Part != 0 || sm.Parts != 1 {
+			t.Fatalf("got part %d of %d; want a single part", sm.Part, sm.Parts)
+		}
+		got := set.Set[key.NodePublic]{}
+		for _, p := range sm.Peers {
+			got.Add(p.Key)
+		}
+		if want := set.SetOf([]key.NodePublic{alice.pub, w.pub}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("snapshot has %v; want alice and the watcher", got.Slice())
+		}
+		break
+	}
+	if got := ts.s.peerSnapshotsSent.Value(); got == 0 {
+		t.Error("watcher_peer_snapshots_sent = 0")
+	}
+}
+
+func TestServerGossip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetGossip("derp1.example.com", time.Minute)
+
+	alice := newRegularClient(t, ts, "alice")
+	sub := newTestClient(t, ts, "sub", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, c.SubscribeGossip()
+	})
+
+	recvMap := func() PeerMapMessage {
+		t.Helper()
+		for {
+			m, err := sub.c.recvTimeout(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, ok := m.(PeerMapMessage); ok {
+				return m
+			}
+		}
+	}
+
+	// On subscribing, it gets the server's own map.
+	own := recvMap()
+	if own.Origin != ts.s.PublicKey() || own.Host != "derp1.example.com" || own.TTL != 3*time.Minute {
+		t.Errorf("own map = %+v", own)
+	}
+	// Like watchers, subscribers are told about all clients,
+	// including mesh peers.
+	if got, want := set.SetOf(own.Keys), set.SetOf([]key.NodePublic{alice.pub, sub.pub}); !reflect.DeepEqual(got, want) {
+		t.Errorf("own map keys = %v; want %v", own.Keys, want.Slice())
+	}
+
+	// Maps from elsewhere are relayed, once.
+	other := PeerMap{
+		Origin: key.NewNode().Public(),
+		Host:   "derp2.example.com",
+		Seq:    1,
+		TTL:    time.Minute,
+		Keys:   []key.NodePublic{key.NewNode().Public()},
+	}
+	via := key.NewNode().Public()
+	if !ts.s.RelayPeerMap(other, via) {
+		t.Fatal("RelayPeerMap = false; want true")
+	}
+	if ts.s.RelayPeerMap(other, via) {
+		t.Error("RelayPeerMap of the same map again = true; want false")
+	}
+	if got := recvMap(); !reflect.DeepEqual(got.PeerMap, other) {
+		t.Errorf("relayed map = %+v; want %+v", got.PeerMap, other)
+	}
+}
+
+func TestVerifyClientCert(t *testing.T) {
+	newCert := func(tmpl, parent *x509.Certificate, parentPriv *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		t.Helper()
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentPriv = tmpl, priv
+		}
+		der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &priv.PublicKey, parentPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, priv
+	}
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca, caPriv := newCert(caTmpl, nil, nil)
+	otherCA, otherCAPriv := newCert(caTmpl, nil, nil)
+	leafTmpl := func(cn string, uris ...string) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, v := range uris {
+			u, err := url.Parse(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		}
+		return tmpl
+	}
+	byCN, _ := newCert(leafTmpl("node1"), ca, caPriv)
+	byURI, _ := newCert(leafTmpl("node2", "spiffe://example.com/node2"), ca, caPriv)
+	untrusted, _ := newCert(leafTmpl("node3"), otherCA, otherCAPriv)
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("abc")
+	tlsCtx := func(certs ...*x509.Certificate) context.Context {
+		return ContextWithTLSState(context.Background(), &tls.ConnectionState{PeerCertificates: certs})
+	}
+	ctx := context.Background()
+
+	if id, err := s.verifyClientCert(ctx, nil, &clientInfo{}); id != "" || err != nil {
+		t.Errorf("without CAs = %q, %v; want no identity or error", id, err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	s.SetClientCAs(pool)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		info    *clientInfo
+		want    string
+		wantErr bool
+	}{
+		{"common-name", tlsCtx(byCN), &clientInfo{}, "node1", false},
+		{"uri-san", tlsCtx(byURI), &clientInfo{}, "spiffe://example.com/node2", false},
+		{"untrusted", tlsCtx(untrusted), &clientInfo{}, "", true},
+		{"no-cert", tlsCtx(), &clientInfo{}, "", true},
+		{"no-tls", ctx, &clientInfo{}, "", true},
+		{"mesh-no-cert", ctx, &clientInfo{MeshKey: "abc"}, "", false},
+		{"mesh-with-cert", tlsCtx(byCN), &clientInfo{MeshKey: "abc"}, "node1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.verifyClientCert(tt.ctx, nil, tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("identity = %q; want %q", got, tt.want)
+			}
+		})
+	}
+	if got := s.clientCertRejects.Value(); got != 3 {
+		t.Errorf("clientCertRejects = %d; want 3", got)
+	}
+}
+
+func TestBanPolicy(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s.clock = clock
+	var banned []Ban
+	s.SetBanPolicy(BanPolicy{
+		Threshold: 3,
+		BanFor:    time.Minute,
+		MaxBan:    3 * time.Minute,
+		Exempt:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		OnBan:     func(b Ban) { banned = append(banned, b) },
+	})
+	const addr = "1.2.3.4:5678"
+	offend := func(n int) {
+		for i := 0; i < n; i++ {
+			s.ReportAbuse(addr, "test")
+		}
+	}
+	checkBanned := func(want time.Duration) {
+		t.Helper()
+		got, ok := s.Banned(addr)
+		if want == 0 && ok {
+			t.Fatalf("banned for %v; want not banned", got)
+		} else if want != 0 && (!ok || got != want) {
+			t.Fatalf("Banned = %v, %v; want %v, true", got, ok, want)
+		}
+	}
+
+	// Offenses spread over more than the window don't add up.
+	offend(2)
+	clock.Advance(time.Minute)
+	offend(2)
+	checkBanned(0)
+
+	// Each ban lasts twice as long as the last, up to MaxBan.
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		offend(1)
+		checkBanned(want)
+		clock.Advance(want)
+		checkBanned(0)
+		offend(2)
+	}
+	if len(banned) != 3 || banned[2].Bans != 3 {
+		t.Errorf("OnBan calls = %+v; want 3, the last the third ban", banned)
+	}
+
+	offend(1)
+	if bans := s.Bans(); len(bans) != 1 || bans[0].IP != netip.MustParseAddr("1.2.3.4") {
+		t.Errorf("Bans = %+v; want one of 1.2.3.4", bans)
+	}
+	if !s.Unban(netip.MustParseAddr("1.2.3.4")) {
+		t.Error("Unban = false; want true")
+	}
+	checkBanned(0)
+	if len(s.Bans()) != 0 {
+		t.Errorf("Bans = %+v after Unban; want none", s.Bans())
+	}
+
+	for i := 0; i < 10; i++ {
+		s.ReportAbuse("10.1.2.3:1", "test")
+	}
+	if _, ok := s.Banned("10.1.2.3:1"); ok {
+		t.Error("exempt IP banned")
+	}
+}
+
+func TestBanOnlyOffenses(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetBanPolicy(BanPolicy{Threshold: 1})
+	var verifyErr error
+	s.SetVerifyClientFunc(func(context.Context, key.NodePublic, netip.Addr) error {
+		return verifyErr
+	})
+	const addr = "1.2.3.4:5678"
+	accept := func(client func(net.Conn)) {
+		t.Helper()
+		sc, cc := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			brw := bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc))
+			s.Accept(context.Background(), sc, brw, addr)
+		}()
+		client(cc)
+		cc.Close()
+		<-done
+	}
+	handshake := func(cc net.Conn) {
+		brw := bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc))
+		NewClient(key.NewNode(), cc, brw, logger.Discard)
+	}
+
+	// A connection that fails midway through the handshake.
+	accept(func(cc net.Conn) {
+		io.ReadFull(cc, make([]byte, frameHeaderLen+len(magic)+keyLen))
+	})
+	verifyErr = errors.New("verifier unreachable")
+	accept(handshake)
+	if _, ok := s.Banned(addr); ok {
+		t.Fatal("banned for a failed connection or verifier")
+	}
+
+	verifyErr = fmt.Errorf("%w: not in tailnet", ErrClientDenied)
+	accept(handshake)
+	if _, ok := s.Banned(addr); !ok {
+		t.Fatal("not banned for a denied client")
+	}
+}
+
+// pipeRWC is one end of a pair of io.Pipes, an io.ReadWriteCloser
+// without deadlines.
+type pipeRWC struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeRWC) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func TestEmbedded(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nc := s.EmbeddedConn(ctx)
+	defer nc.Close()
+	k1 := key.NewNode()
+	c1, err := NewClientReadWriteCloser(k1, nc, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c1)
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	clientEnd, serverEnd := pipeRWC{r1, w2}, pipeRWC{r2, w1}
+	defer clientEnd.Close()
+	go s.ServeReadWriteCloser(ctx, serverEnd, "pipe")
+	k2 := key.NewNode()
+	c2, err := NewClientReadWriteCloser(k2, clientEnd, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c2)
+
+	if err := c1.Send(k2.Public(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c2.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.(ReceivedPacket); !ok || p.Source != k1.Public() || string(p.Data) != "hello" {
+		t.Errorf("got %#v; want packet %q from c1", m, "hello")
+	}
+}
+
+func TestPingClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	acker := newTestClient(t, ts, "acker", func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, CanAckPings(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, nil
+	})
+	defer acker.close(t)
+	other := newRegularClient(t, ts, "other")
+	defer other.close(t)
+
+	go func() {
+		for {
+			m, err := acker.c.Recv()
+			if err != nil {
+				return
+			}
+			if ping, ok := m.(PingMessage); ok {
+				acker.c.SendPong(ping)
+			}
+		}
+	}()
+
+	pctx, pcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer pcancel()
+	rtt, err := ts.s.PingClient(pctx, acker.pub)
+	if err != nil {
+		t.Fatalf("PingClient: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("rtt = %v; want positive", rtt)
+	}
+	if got := ts.s.clientPingsAcked.Value(); got != 1 {
+		t.Errorf("clientPingsAcked = %d; want 1", got)
+	}
+
+	if _, err := ts.s.PingClient(pctx, other.pub); err == nil {
+		t.Error("PingClient of client that can't ack pings succeeded")
+	}
+	if _, err := ts.s.PingClient(pctx, key.NewNode().Public()); err == nil {
+		t.Error("PingClient of unknown client succeeded")
+	}
+}
+
+// funcFwd is a PacketForwarder that calls a func.
+type funcFwd func(src, dst key.NodePublic, payload []byte) error
+
+func (f funcFwd) ForwardPacket(src, dst key.NodePublic, payload []byte) error {
+	return f(src, dst, payload)
+}
+
+func (funcFwd) String() string { return "funcFwd" }
+
+func TestPacketMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	var mu sync.Mutex
+	var order []string
+	var blocked key.NodePublic
+	record := func(name string) PacketMiddleware {
+		return func(next PacketForwarder) PacketForwarder {
+			return funcFwd(func(src, dst key.NodePublic, payload []byte) error {
+				mu.Lock()
+				order = append(order, name)
+				isBlocked := dst == blocked
+				mu.Unlock()
+				if isBlocked {
+					return errors.New("blocked")
+				}
+				return next.ForwardPacket(src, dst, payload)
+			})
+		}
+	}
+	ts.s.SetPacketMiddleware(record("outer"), record("inner"))
+
+	alice := newRegularClient(t, ts, "alice")
+	defer alice.close(t)
+	bob := newRegularClient(t, ts, "bob")
+	defer bob.close(t)
+	carol := newRegularClient(t, ts, "carol")
+	defer carol.close(t)
+	mu.Lock()
+	blocked = carol.pub
+	mu.Unlock()
+
+	if err := alice.c.Send(bob.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := bob.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.(ReceivedPacket); !ok || string(p.Data) != "hello" {
+		t.Fatalf("bob got %#v; want hello packet", m)
+	}
+
+	if err := alice.c.Send(carol.pub, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.s.packetsDroppedReasonCounters[dropReasonMiddleware].Value() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet to carol not dropped by middleware")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"outer", "inner", "outer"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("middleware calls = %q; want %q", order, want)
+	}
+}
+
+func TestPacketMiddlewareOwnBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	// own has the capacity of a packetBufPools size class, so it'd
+	// be used to receive the next packet if it were put in a pool.
+	var mu sync.Mutex
+	own := make([]byte, 0, packetBufSizes[0])
+	ts.s.SetPacketMiddleware(func(next PacketForwarder) PacketForwarder {
+		return funcFwd(func(src, dst key.NodePublic, payload []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(own) == 0 {
+				own = append(own, bytes.ToUpper(payload)...)
+				payload = own
+			}
+			return next.ForwardPacket(src, dst, payload)
+		})
+	})
+
+	alice := newRegularClient(t, ts, "alice")
+	defer alice.close(t)
+	bob := newRegularClient(t, ts, "bob")
+	defer bob.close(t)
+
+	for _, tt := range []struct{ send, want string }{{"hello", "HELLO"}, {"world", "world"}} {
+		if err := alice.c.Send(bob.pub, []byte(tt.send)); err != nil {
+			t.Fatal(err)
+		}
+		m, err := bob.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(ReceivedPacket); !ok || string(p.Data) != tt.want {
+			t.Fatalf("bob got %#v; want %s packet", m, tt.want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if string(own) != "HELLO" {
+		t.Errorf("middleware's buffer = %q; want %q", own, "HELLO")
+	}
+}
+
+func TestUnknownFrameTooLarge(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	b := make([]byte, 10)
+	c := &sclient{s: s, br: bufio.NewReader(bytes.NewReader(b))}
+	if err := c.handleUnknownFrame(0xFE, uint32(len(b))); err != nil {
+		t.Errorf("small unknown frame: %v", err)
+	}
+	if err := c.handleUnknownFrame(0xFE, maxUnknownFrameLen+1); err == nil {
+		t.Error("oversized unknown frame accepted")
+	}
+}
+
+// FuzzServerFrames feeds arbitrary frames from a connected client, or
+// from a mesh peer, to a server, which must reject or ignore them
+// without panicking or allocating without bound.
+func FuzzServerFrames(f *testing.F) {
+	frame := func(ft frameType, payload ...[]byte) []byte {
+		b := []byte{byte(ft), 0, 0, 0, 0}
+		for _, p := range payload {
+			b = append(b, p...)
+		}
+		bin.PutUint32(b[1:5], uint32(len(b)-frameHeaderLen))
+		return b
+	}
+	k := key.NewNode().Public().AppendTo(nil)
+	f.Add(false, frame(frameSendPacket, k, []byte("hello")))
+	f.Add(false, frame(frameSendPacketZstd, k, []byte("not zstd")))
+	f.Add(false, frame(framePing, []byte("12345678")))
+	f.Add(false, frame(framePong, []byte("12345678")))
+	f.Add(false, frame(frameNotePreferred, []byte{1}))
+	f.Add(false, frame(0xFE, []byte("from the future")))
+	f.Add(false, []byte{byte(frameSendPacket), 0xff, 0xff, 0xff, 0xff})
+	f.Add(true, frame(frameForwardPacket, k, k, []byte("hello")))
+	f.Add(true, frame(frameWatchConns))
+	f.Add(true, frame(frameWatchConns, []byte{1, 0xab}))
+	f.Add(true, frame(frameGossipSubscribe))
+	f.Add(true, frame(frameClosePeer, k))
+
+	s := NewServer(key.NewNode(), logger.Discard)
+	s.SetMeshKey("mesh-key")
+	f.Cleanup(func() { s.Close() })
+
+	f.Fuzz(func(t *testing.T, mesh bool, frames []byte) {
+		sc, cc := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			brw := bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc))
+			s.Accept(context.Background(), sc, brw, "127.0.0.1:1234")
+		}()
+		var opts []ClientOpt
+		if mesh {
+			opts = append(opts, MeshKey("mesh-key"))
+		}
+		brw := bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc))
+		if _, err := NewClient(key.NewNode(), cc, brw, logger.Discard, opts...); err != nil {
+			t.Fatal(err)
+		}
+		// Discard what the server sends, so it doesn't block.
+		go io.Copy(io.Discard, cc)
+		cc.Write(frames) // fails if the server hangs up first
+		cc.Close()
+		<-done
+	})
 }
@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// SetUpgradeAuthorizer requires clients to be authorized by f to
+// connect, for private DERP servers that gate access with tokens, such
+// as behind a standard authenticating proxy. f is passed each HTTP
+// request to connect, whether with DERP's upgrade or over a WebSocket,
+// and returns a non-nil error to refuse it, such as when its
+// Authorization header lacks a valid bearer token. Mesh peers must be
+// authorized too, such as by sending the same headers.
+//
+// Connections that don't begin with an HTTP request, such as with the
+// ALPN protocol or plain TCP, can't be authorized this way, and are
+// refused.
+//
+// It must be called before serving begins.
+func (s *Server) SetUpgradeAuthorizer(f func(*http.Request) error) {
+	s.upgradeAuth = f
+}
+
+// errNotAuthorizable is returned by AuthorizeUpgrade when connections
+// must be authorized, but there's no HTTP request to authorize.
+var errNotAuthorizable = errors.New("connection must be authorized with an HTTP request")
+
+// AuthorizeUpgrade returns an error if the client making r, an HTTP
+// request to connect, or a connection made without an HTTP request if
+// r is nil, isn't authorized to. See SetUpgradeAuthorizer.
+func (s *Server) AuthorizeUpgrade(r *http.Request) error {
+	if s.upgradeAuth == nil {
+		return nil
+	}
+	if r == nil {
+		return errNotAuthorizable
+	}
+	return s.upgradeAuth(r)
+}
@@ -0,0 +1,29 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derph2 registers the HTTP/2 client that derphttp clients
+// need to tunnel DERP through HTTP/2 CONNECT (see
+// derphttp.Client.H2Connect). Programs that use it must import this
+// package.
+package derph2
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"tailscale.com/derp/derphttp"
+)
+
+func init() {
+	derphttp.RegisterH2Connect(roundTrip)
+}
+
+// roundTrip sends req on a new HTTP/2 client connection over tlsConn.
+func roundTrip(tlsConn *tls.Conn, req *http.Request) (*http.Response, error) {
+	cc, err := new(http2.Transport).NewClientConn(tlsConn)
+	if err != nil {
+		return nil, err
+	}
+	return cc.RoundTrip(req)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// defaultRetryInterval is how long RunWatchConnectionLoop and
+// RunGossipLoop wait to try again after a failure, unless the Client
+// has a ReconnectBackoff.
+const defaultRetryInterval = 5 * time.Second
+
+// BackoffPolicy is how a Client backs off from reconnecting to its
+// server after failing to connect, or after a connection ends soon
+// after being made, such as to tune recovery over flaky links.
+type BackoffPolicy struct {
+	// Initial is the delay after the first failure. Each further
+	// consecutive failure doubles it, up to Max. Zero, the default,
+	// disables backing off: the Client reconnects whenever it's next
+	// used, and RunWatchConnectionLoop and RunGossipLoop wait 5
+	// seconds between attempts.
+	Initial time.Duration
+
+	// Max is the longest delay. Zero means one minute.
+	Max time.Duration
+
+	// Jitter is the fraction of each delay, from 0 to 1, by which
+	// it's randomly shortened, so that clients that failed together
+	// don't all retry together.
+	Jitter float64
+
+	// ResetAfter is how long a connection must last for its ending
+	// not to count as a failure, which resets the delay. Zero means
+	// that any successful connection resets it.
+	ResetAfter time.Duration
+}
+
+// delay returns how long to wait after the given number of
+// consecutive failures.
+func (p BackoffPolicy) delay(failures int) time.Duration {
+	max := p.Max
+	if max <= 0 {
+		max = time.Minute
+	}
+	d := p.Initial
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if j := p.Jitter; j > 0 {
+		if j > 1 {
+			j = 1
+		}
+		d -= time.Duration(float64(d) * j * rand.Float64())
+	}
+	return d
+}
+
+// ConnectStats are counts of a Client's attempts to connect to its
+// server, as returned by Client.ConnectStats.
+type ConnectStats struct {
+	Attempts  int64 // attempts to connect, including the first
+	Failures  int64 // attempts that failed
+	BackedOff int64 // calls that failed without attempting, to back off
+}
+
+// ConnectStats returns counts of c's attempts to connect.
+func (c *Client) ConnectStats() ConnectStats {
+	return ConnectStats{
+		Attempts:  c.conns.attempts.Load(),
+		Failures:  c.conns.failures.Load(),
+		BackedOff: c.conns.backedOff.Load(),
+	}
+}
+
+// checkBackoffLocked returns an error if c is backing off from
+// reconnecting.
+//
+// c.mu must be held.
+func (c *Client) checkBackoffLocked() error {
+	if c.ReconnectBackoff.Initial <= 0 || c.retryAt.IsZero() {
+		return nil
+	}
+	wait := c.retryAt.Sub(c.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	c.conns.backedOff.Add(1)
+	msg := fmt.Sprintf("backing off reconnecting for %v after %d failures", wait.Round(time.Millisecond), c.connectFailures)
+	if c.lastConnectErr != nil {
+		return fmt.Errorf("%s: %w", msg, c.lastConnectErr)
+	}
+	return errors.New(msg)
+}
+
+// noteConnectFailureLocked records a failure to connect, or a
+// connection that didn't last ReconnectBackoff.ResetAfter, with the
+// error that caused it, if any.
+//
+// c.mu must be held.
+func (c *Client) noteConnectFailureLocked(err error) {
+	c.connectFailures++
+	c.lastConnectErr = err
+	if p := c.ReconnectBackoff; p.Initial > 0 {
+		c.retryAt = c.clock.Now().Add(p.delay(c.connectFailures))
+	}
+}
+
+// resetBackoffLocked forgets past failures to connect.
+//
+// c.mu must be held.
+func (c *Client) resetBackoffLocked() {
+	c.connectFailures = 0
+	c.lastConnectErr = nil
+	c.retryAt = time.Time{}
+}
+
+// retryDelay returns how long RunWatchConnectionLoop and RunGossipLoop
+// wait to try again after a failure.
+func (c *Client) retryDelay() time.Duration {
+	if c.ReconnectBackoff.Initial <= 0 {
+		return defaultRetryInterval
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retryAt.IsZero() {
+		return 0
+	}
+	if d := c.retryAt.Sub(c.clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
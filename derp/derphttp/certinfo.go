@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// ServerCert describes a certificate in the chain a DERP server
+// presented over TLS, for auditing which relays a node talks to.
+type ServerCert struct {
+	// SPKIHash is the hex SHA-256 hash of the certificate's
+	// SubjectPublicKeyInfo, as used for certificate pinning.
+	SPKIHash string
+
+	Subject   string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ServerCertInfo describes the TLS certificates a DERP server
+// presented on a connection.
+type ServerCertInfo struct {
+	// Chain is the chain of certificates the server presented,
+	// leaf first. It doesn't include the DERP "meta cert" that
+	// carries the server's DERP key.
+	Chain []ServerCert
+
+	// SCTs is the number of certificate transparency signed
+	// certificate timestamps stapled to the TLS handshake. SCTs
+	// embedded in the certificates aren't counted.
+	SCTs int
+
+	// Connected is when the connection was made.
+	Connected time.Time
+}
+
+// newServerCertInfo returns the description of the certificates in cs.
+func newServerCertInfo(cs *tls.ConnectionState, now time.Time) *ServerCertInfo {
+	info := &ServerCertInfo{
+		SCTs:      len(cs.SignedCertificateTimestamps),
+		Connected: now,
+	}
+	for _, cert := range cs.PeerCertificates {
+		if strings.HasPrefix(cert.Subject.CommonName, "derpkey") {
+			continue // see parseMetaCert
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		info.Chain = append(info.Chain, ServerCert{
+			SPKIHash:  hex.EncodeToString(sum[:]),
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return info
+}
+
+// leafSPKIHash returns the SPKIHash of the leaf certificate in info,
+// or the empty string if there's none.
+func (info *ServerCertInfo) leafSPKIHash() string {
+	if info == nil || len(info.Chain) == 0 {
+		return ""
+	}
+	return info.Chain[0].SPKIHash
+}
+
+// certPins returns the SPKI hashes that the certificate of node, which
+// is nil for a Client made with NewClient, is pinned to.
+func (c *Client) certPins(node *tailcfg.DERPNode) []string {
+	if node == nil || node.CertPin == "" {
+		return c.CertPins
+	}
+	return append(c.CertPins[:len(c.CertPins):len(c.CertPins)], node.CertPin)
+}
+
+// verifyCertPins returns a tls.Config.VerifyConnection func that
+// accepts only a leaf certificate whose SPKI hash is one of pins.
+func verifyCertPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certs presented")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		got := hex.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if strings.EqualFold(pin, got) {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate public key %s doesn't match a pinned key", got)
+	}
+}
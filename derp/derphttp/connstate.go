@@ -0,0 +1,122 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"errors"
+	"fmt"
+
+	"tailscale.com/derp"
+)
+
+// ConnState is the state of a Client's connection to its server, as
+// reported to Client.OnConnectionStateChange.
+type ConnState int
+
+const (
+	// StateConnecting means the client is connecting to the server
+	// for the first time.
+	StateConnecting ConnState = iota + 1
+
+	// StateConnected means the client is connected.
+	StateConnected
+
+	// StateDegraded means the client is connected, but the server
+	// has reported a problem with the connection, such as another
+	// client having connected with the same key. It's reported with
+	// the problem as the error.
+	StateDegraded
+
+	// StateReconnecting means the connection was lost, or an
+	// attempt to reconnect failed, and the client reconnects the
+	// next time it's used. It's reported with ErrLinkChanged when
+	// the connection was closed by Client.ReconnectForLinkChange.
+	StateReconnecting
+
+	// StateClosed means Close was called.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDegraded:
+		return "degraded"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// stateChange is a pending call to OnConnectionStateChange.
+type stateChange struct {
+	state ConnState
+	err   error
+}
+
+// setState records that c's connection is in state st, because of err
+// if non-nil. If that's a change of state, or err is non-nil, it
+// queues a call to OnConnectionStateChange.
+//
+// It may be called with c.mu held.
+func (c *Client) setState(st ConnState, err error) {
+	if c.OnConnectionStateChange == nil {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state == StateClosed || (st == c.state && err == nil) {
+		return
+	}
+	c.state = st
+	c.stateChanges = append(c.stateChanges, stateChange{st, err})
+	if !c.notifyingState {
+		c.notifyingState = true
+		go c.notifyStateChanges()
+	}
+}
+
+// notifyStateChanges calls OnConnectionStateChange with the queued
+// state changes, in order, until there are none left.
+func (c *Client) notifyStateChanges() {
+	for {
+		c.stateMu.Lock()
+		changes := c.stateChanges
+		c.stateChanges = nil
+		if len(changes) == 0 {
+			c.notifyingState = false
+			c.stateMu.Unlock()
+			return
+		}
+		c.stateMu.Unlock()
+		for _, sc := range changes {
+			c.OnConnectionStateChange(sc.state, sc.err)
+		}
+	}
+}
+
+// noteHealth records the health of the connection to the server made
+// by client, per a derp.HealthMessage with the given problem.
+func (c *Client) noteHealth(client *derp.Client, problem string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != client {
+		return
+	}
+	if problem != "" {
+		c.setState(StateDegraded, errors.New(problem))
+		return
+	}
+	c.stateMu.Lock()
+	degraded := c.state == StateDegraded
+	c.stateMu.Unlock()
+	if degraded {
+		c.setState(StateConnected, nil)
+	}
+}
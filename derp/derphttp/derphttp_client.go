@@ -25,9 +25,11 @@
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go4.org/mem"
+	"golang.org/x/net/proxy"
 	"tailscale.com/derp"
 	"tailscale.com/envknob"
 	"tailscale.com/net/dnscache"
@@ -40,6 +42,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
 	"tailscale.com/types/key"
+	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/cmpx"
 )
@@ -56,6 +59,102 @@ type Client struct {
 	MeshKey   string             // optional; for trusted clients
 	IsProber  bool               // optional; for probers to optional declare themselves as such
 
+	// MeshKeySecondary, if non-empty, is a mesh key to try instead
+	// of MeshKey after the server rejects MeshKey, such as while the
+	// mesh key is being rotated. The client alternates between the
+	// two on each rejection.
+	//
+	// To change MeshKey or MeshKeySecondary after the client is in
+	// use, call SetMeshKeys instead.
+	MeshKeySecondary string
+
+	// UserAgent, if non-empty, is sent as the User-Agent of the HTTP
+	// request that upgrades to DERP, so that embedders can identify
+	// themselves and their version to relay operators. Metadata, if
+	// non-empty, is sent with it in the ClientMetadataHeader, such
+	// as build information. Neither is authenticated.
+	UserAgent string
+	Metadata  string
+
+	// Header, if non-nil, holds extra headers to send with the HTTP
+	// request that upgrades to DERP, or opens the WebSocket, such as
+	// an Authorization header for a private relay that requires a
+	// token (see derp.Server.SetUpgradeAuthorizer). It must be set
+	// before the client is used.
+	Header http.Header
+
+	// Proxy, if non-nil, is the proxy through which to dial the
+	// DERP server, instead of any configured in the environment.
+	// Its scheme is "http" or "https" for an HTTP CONNECT proxy, or
+	// "socks5" for a SOCKS5 proxy, and it may carry a username and
+	// password to authenticate with. It's used even for a Client
+	// made with NewClient, which otherwise dials directly.
+	Proxy *url.URL
+
+	// NoWebSocketFallback, if true, disables retrying a connection
+	// over WebSocket when the server's DERP upgrade response is
+	// missing or isn't HTTP, as when a middlebox blocks the upgrade.
+	// The fallback is only available on platforms that support
+	// WebSocket clients.
+	NoWebSocketFallback bool
+
+	// CertPins, if non-empty, pins the server's TLS certificate to
+	// the given public keys: the leaf certificate it presents must
+	// have a SubjectPublicKeyInfo whose hex SHA-256 hash, as reported
+	// in ServerCert.SPKIHash, is one of them. The certificate is then
+	// verified by its pin alone, rather than by a chain to a trusted
+	// root, so private relays can use self-issued certificates. A
+	// DERPNode's CertPin is used in addition. Pinned connections
+	// don't fall back to WebSocket.
+	CertPins []string
+
+	// ReconnectBackoff is how the client backs off from reconnecting
+	// after failures. The zero value doesn't back off. It must be
+	// set before the client is used.
+	ReconnectBackoff BackoffPolicy
+
+	// OnConnectionStateChange, if non-nil, is called when the state
+	// of the connection to the server changes, and when an attempt
+	// to connect fails, with the error that caused it, if any, so
+	// that embedders can show the relay's health. It's called from a
+	// goroutine of its own, in the order that the changes happened.
+	// It must be set before the client is used.
+	OnConnectionStateChange func(state ConnState, err error)
+
+	// KeepAliveIdle, if non-zero, is how long the connection may go
+	// without anything being received from the server before the
+	// client pings it, to notice a dead connection sooner than TCP
+	// would, such as after a silent change of network path. The
+	// client pings again every KeepAliveIdle while nothing arrives,
+	// and after KeepAliveMissed pings in a row go unanswered (zero
+	// means 3), it closes the connection so that the next use
+	// reconnects. As for Ping, another goroutine must be calling Recv
+	// for replies to be noticed. Both must be set before the client
+	// is used.
+	KeepAliveIdle   time.Duration
+	KeepAliveMissed int
+
+	// DialTimeout, TLSHandshakeTimeout and HandshakeTimeout limit the
+	// phases of connecting to the server: resolving and dialing it,
+	// including through any proxy; the TLS handshake; and the HTTP
+	// upgrade and DERP handshake. Zero means 5 seconds each. A phase
+	// that runs out of time fails with a *ConnectTimeoutError naming
+	// it, which tells a captive portal or middlebox that stalls TLS
+	// or the upgrade apart from an unreachable server. The context
+	// passed to Connect and the like may limit connecting further.
+	// They must be set before the client is used.
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	HandshakeTimeout    time.Duration
+
+	// H2Connect, if true, makes the client tunnel DERP through an
+	// HTTP/2 CONNECT request rather than upgrading an HTTP/1.1
+	// request, for servers that share their port with an HTTP/2
+	// frontend that forwards CONNECT requests but not upgrades. It
+	// requires TLS and the derp/derph2 package, and there's no
+	// WebSocket fallback. It must be set before the client is used.
+	H2Connect bool
+
 	// BaseContext, if non-nil, returns the base context to use for dialing a
 	// new derp server. If nil, context.Background is used.
 	// In either case, additional timeouts may be added to the base context.
@@ -79,17 +178,88 @@ type Client struct {
 	// Client.conn holds mu.
 	addrFamSelAtomic syncs.AtomicValue[AddressFamilySelector]
 
-	mu           sync.Mutex
-	preferred    bool
-	canAckPings  bool
-	closed       bool
-	netConn      io.Closer
-	client       *derp.Client
-	connGen      int // incremented once per new connection; valid values are >0
-	serverPubKey key.NodePublic
-	tlsState     *tls.ConnectionState
-	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
-	clock        tstime.Clock
+	// receiving is the number of RecvDetail calls in progress.
+	// Prime uses it to tell whether a pong would be read, and so
+	// whether it can wait for one.
+	receiving atomic.Int32
+
+	// recvBusy is whether a Recv, RecvDetail or RecvCtx call is in
+	// progress, to reject concurrent ones. It's guarded by recvMu.
+	recvMu   sync.Mutex
+	recvBusy bool
+
+	// The following are owned by the caller that set recvBusy.
+	//
+	// recvLoop receives a message for RecvCtx each time it's asked
+	// to on recvStart, and delivers the result on recvResults.
+	// recvPending is whether it's been asked to and the result hasn't
+	// been taken yet, because RecvCtx stopped waiting for it.
+	recvLoopOnce sync.Once
+	recvStart    chan struct{}
+	recvResults  chan recvResult
+	recvPending  bool
+
+	// watching is whether RunWatchConnectionLoop has subscribed to
+	// connection changes on the current connection. See IsWatching.
+	watching atomic.Bool
+
+	// stateMu guards the connection state last reported to
+	// OnConnectionStateChange, and the changes yet to be reported.
+	stateMu        sync.Mutex
+	state          ConnState
+	stateChanges   []stateChange
+	notifyingState bool // whether a notifyStateChanges goroutine is running
+
+	// tlsSessions caches the TLS sessions of c's connections, so that
+	// reconnecting resumes them, saving a round trip, unless
+	// TLSConfig has a ClientSessionCache of its own.
+	tlsSessions lazy.SyncValue[tls.ClientSessionCache]
+
+	// conns are the counts of connection attempts, for ConnectStats.
+	conns struct {
+		attempts, failures, backedOff atomic.Int64
+	}
+
+	// lastRecv is when something was last received from the
+	// server, in Unix nanoseconds, if KeepAliveIdle is set.
+	lastRecv atomic.Int64
+
+	// met are the rest of the counts for Metrics.
+	met clientMetrics
+
+	// fwd are the counts of forwarded packets, for ForwardStats.
+	fwd struct {
+		packetsSent, bytesSent   atomic.Uint64
+		packetsAcked, bytesAcked atomic.Uint64
+		packetsDropped           atomic.Uint64
+	}
+
+	mu            sync.Mutex
+	preferred     bool
+	canAckPings   bool
+	canZstd       bool
+	canDropNotify bool
+	canForwardAck bool
+	maxPacketSize int
+	closed        bool
+	netConn       io.Closer
+	client        *derp.Client
+	connGen       int // incremented once per new connection; valid values are >0
+	serverPubKey  key.NodePublic
+	wantServer    key.NodePublic // if non-zero, the server key required by ExpectServerKey
+	watchBatch    bool           // whether to advertise derp.CanPeerPresentBatch and derp.CanPeerSnapshot; set by RunWatchConnectionLoop
+	useSecondary  bool           // whether to present MeshKeySecondary rather than MeshKey
+	tlsState      *tls.ConnectionState
+	certInfo      *ServerCertInfo                  // of the current connection, or nil if not using TLS
+	transport     string                           // of the current connection; see Transport
+	connectedAt   time.Time                        // when the current or last connection was made
+	pingOut       map[derp.PingMessage]chan<- bool // chan to send to on pong
+	clock         tstime.Clock
+
+	// Backoff state; see ReconnectBackoff.
+	connectFailures int       // consecutive failures to connect, or short-lived connections
+	lastConnectErr  error     // the error of the last such failure, if any
+	retryAt         time.Time // if non-zero, when reconnecting may next be attempted
 }
 
 func (c *Client) String() string {
@@ -149,6 +319,59 @@ func (c *Client) Connect(ctx context.Context) error {
 	return err
 }
 
+// Prime readies c to send with as little delay as possible, for
+// callers that expect to send soon, such as when the user has just
+// asked to connect. It doesn't send any packets.
+//
+// If c isn't connected, Prime connects and completes the DERP
+// handshake, hiding the dial latency from the first Send. If c is
+// already connected, Prime instead checks the connection, replacing it
+// with a new one if the check fails.
+//
+// How thorough the check is depends on whether another goroutine is
+// calling Recv. If one is, Prime pings the server and waits up to
+// primePingTimeout for the pong, which verifies the whole round trip.
+// If not, nothing would read the pong, and Prime can't read it itself
+// without consuming packets meant for the caller's next Recv. It then
+// only writes a ping, which checks that the socket is still writable:
+// that catches a connection already closed or reset, but not one whose
+// server silently went away, since the write just lands in the local
+// send buffer.
+func (c *Client) Prime(ctx context.Context) error {
+	c.mu.Lock()
+	closed, client := c.closed, c.client
+	c.mu.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if client != nil {
+		var err error
+		if c.receiving.Load() > 0 {
+			pctx, cancel := context.WithTimeout(ctx, primePingTimeout)
+			err = c.Ping(pctx)
+			cancel()
+		} else {
+			var data derp.PingMessage
+			rand.Read(data[:])
+			err = client.SendPing(data)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.logf("derphttp.Client.Prime: connection check failed, reconnecting: %v", err)
+		c.closeForReconnect(client, err)
+	}
+	_, _, err := c.connect(ctx, "derphttp.Client.Prime")
+	return err
+}
+
+// primePingTimeout is how long Prime waits for the server to answer
+// a ping before deciding the connection is broken.
+const primePingTimeout = 2 * time.Second
+
 // newContext returns a new context for setting up a new DERP connection.
 // It uses either c.BaseContext or returns context.Background.
 func (c *Client) newContext() context.Context {
@@ -173,6 +396,35 @@ func (c *Client) TLSConnectionState() (_ *tls.ConnectionState, ok bool) {
 	return c.tlsState, c.tlsState != nil
 }
 
+// ServerCertInfo returns the TLS certificates the server presented on
+// the current connection, if it's using TLS. Security tooling can use
+// it to audit the relays a node actually talks to.
+//
+// The returned value must not be modified.
+func (c *Client) ServerCertInfo() (_ *ServerCertInfo, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.client == nil {
+		return nil, false
+	}
+	return c.certInfo, c.certInfo != nil
+}
+
+// Transport returns how the current connection reaches the server,
+// for diagnostics: derp.TransportTLS or derp.TransportHTTP for an HTTP
+// upgrade with or without TLS, derp.TransportH2Connect for an HTTP/2
+// CONNECT tunnel, or derp.TransportWebSocket, including after falling
+// back to it because the upgrade was blocked. It returns
+// the empty string if the client isn't connected.
+func (c *Client) Transport() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.client == nil {
+		return ""
+	}
+	return c.transport
+}
+
 // ServerPublicKey returns the server's public key.
 //
 // It only returns a non-zero value once a connection has succeeded
@@ -183,6 +435,38 @@ func (c *Client) ServerPublicKey() key.NodePublic {
 	return c.serverPubKey
 }
 
+// ExpectServerKey sets the public key that the DERP server is expected
+// to have, such as from the DERP map. Subsequent connections fail with
+// a *ServerKeyMismatchError if the server presents a different key,
+// detecting misrouted or spoofed servers before any packets are sent.
+//
+// The zero value, the default, accepts any server key.
+func (c *Client) ExpectServerKey(k key.NodePublic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wantServer = k
+}
+
+// ServerKeyMismatchError is returned when connecting to a DERP server
+// whose public key isn't the one set by Client.ExpectServerKey.
+type ServerKeyMismatchError struct {
+	Want key.NodePublic // key set by ExpectServerKey
+	Got  key.NodePublic // key presented by the server
+}
+
+func (e *ServerKeyMismatchError) Error() string {
+	return fmt.Sprintf("DERP server key %v does not match expected key %v", e.Got.ShortString(), e.Want.ShortString())
+}
+
+// checkServerKeyLocked returns a *ServerKeyMismatchError if got isn't
+// the key required by ExpectServerKey. c.mu must be held.
+func (c *Client) checkServerKeyLocked(got key.NodePublic) error {
+	if c.wantServer.IsZero() || got == c.wantServer {
+		return nil
+	}
+	return &ServerKeyMismatchError{Want: c.wantServer, Got: got}
+}
+
 // SelfPublicKey returns our own public key.
 func (c *Client) SelfPublicKey() key.NodePublic {
 	return c.privateKey.Public()
@@ -269,7 +553,8 @@ func (c *Client) preferIPv6() bool {
 }
 
 // dialWebsocketFunc is non-nil (set by websocket.go's init) when compiled in.
-var dialWebsocketFunc func(ctx context.Context, urlStr string) (net.Conn, error)
+// If hc is nil, http.DefaultClient is used.
+var dialWebsocketFunc func(ctx context.Context, urlStr string, header http.Header, hc *http.Client) (net.Conn, error)
 
 func useWebsockets() bool {
 	if runtime.GOOS == "js" {
@@ -281,6 +566,26 @@ func useWebsockets() bool {
 	return false
 }
 
+// agentHeader adds the client's Header, UserAgent and Metadata, if
+// any, to h, which may be nil, and returns it.
+func (c *Client) agentHeader(h http.Header) http.Header {
+	if h == nil {
+		h = make(http.Header)
+	}
+	for k, vv := range c.Header {
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	if c.UserAgent != "" {
+		h.Set("User-Agent", c.UserAgent)
+	}
+	if c.Metadata != "" {
+		h.Set(ClientMetadataHeader, c.Metadata)
+	}
+	return h
+}
+
 func (c *Client) connect(ctx context.Context, caller string) (client *derp.Client, connGen int, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -290,11 +595,43 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if c.client != nil {
 		return c.client, c.connGen, nil
 	}
+	if err := c.checkBackoffLocked(); err != nil {
+		return nil, 0, err
+	}
+
+	connecting := StateConnecting
+	if c.connGen > 0 {
+		connecting = StateReconnecting
+	}
+	c.setState(connecting, nil)
+	c.conns.attempts.Add(1)
+	failStage := ConnectFailOther // updated as connecting progresses
+	defer func() {
+		if err != nil {
+			c.conns.failures.Add(1)
+			c.met.noteConnectFailure(failStage)
+			c.noteConnectFailureLocked(err)
+			c.setState(connecting, err)
+		} else {
+			c.connectedAt = c.clock.Now()
+			if c.connGen > 1 {
+				c.met.reconnects.Add(1)
+			}
+			if c.KeepAliveIdle > 0 {
+				c.noteRecv()
+				go c.keepAlive(c.client)
+			}
+			if c.ReconnectBackoff.ResetAfter <= 0 {
+				c.resetBackoffLocked()
+			}
+			c.setState(StateConnected, nil)
+		}
+	}()
 
 	// timeout is the fallback maximum time (if ctx doesn't limit
 	// it further) to do all of: DNS + TCP + TLS + HTTP Upgrade +
-	// DERP upgrade.
-	const timeout = 10 * time.Second
+	// DERP upgrade. Each phase is limited further below.
+	timeout := c.dialTimeout() + c.tlsHandshakeTimeout() + c.handshakeTimeout()
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	go func() {
 		select {
@@ -320,12 +657,23 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 
 	var tcpConn net.Conn
 
+	// The current phase's deadline, if any, to tell a phase timing
+	// out from ctx being done. The dial phase's is in dialCtx; later
+	// phases' are deadlines on tcpConn.
+	var (
+		phaseTimeout time.Duration
+		dialCtx      context.Context
+	)
+
 	defer func() {
 		if err != nil {
+			if phaseTimeout > 0 && phaseTimedOut(ctx, dialCtx, err) {
+				err = &ConnectTimeoutError{Stage: failStage, Timeout: phaseTimeout, Err: err}
+			}
 			if ctx.Err() != nil {
-				err = fmt.Errorf("%v: %v", ctx.Err(), err)
+				err = fmt.Errorf("%v: %w", ctx.Err(), err)
 			}
-			err = fmt.Errorf("%s connect to %v: %v", caller, c.targetString(reg), err)
+			err = fmt.Errorf("%s connect to %v: %w", caller, c.targetString(reg), err)
 			if tcpConn != nil {
 				go tcpConn.Close()
 			}
@@ -341,42 +689,29 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		} else {
 			urlStr = c.urlString(reg.Nodes[0])
 		}
-		c.logf("%s: connecting websocket to %v", caller, urlStr)
-		conn, err := dialWebsocketFunc(ctx, urlStr)
-		if err != nil {
-			c.logf("%s: websocket to %v error: %v", caller, urlStr, err)
-			return nil, 0, err
-		}
-		brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-		derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
-			derp.MeshKey(c.MeshKey),
-			derp.CanAckPings(c.canAckPings),
-			derp.IsProber(c.IsProber),
-		)
-		if err != nil {
-			return nil, 0, err
-		}
-		if c.preferred {
-			if err := derpClient.NotePreferred(true); err != nil {
-				go conn.Close()
-				return nil, 0, err
-			}
-		}
-		c.serverPubKey = derpClient.ServerPublicKey()
-		c.client = derpClient
-		c.netConn = conn
-		c.connGen++
-		return c.client, c.connGen, nil
+		failStage = ConnectFailWebSocket
+		return c.connectWebsocketLocked(ctx, caller, urlStr, nil)
 	case c.url != nil:
 		c.logf("%s: connecting to %v", caller, c.url)
-		tcpConn, err = c.dialURL(ctx)
+		failStage = ConnectFailDial
+		phaseTimeout = c.dialTimeout()
+		var dialCancel context.CancelFunc
+		dialCtx, dialCancel = context.WithTimeout(ctx, phaseTimeout)
+		tcpConn, err = c.dialURL(dialCtx)
+		dialCancel()
 	default:
 		c.logf("%s: connecting to derp-%d (%v)", caller, reg.RegionID, reg.RegionCode)
-		tcpConn, node, err = c.dialRegion(ctx, reg)
+		failStage = ConnectFailDial
+		phaseTimeout = c.dialTimeout()
+		var dialCancel context.CancelFunc
+		dialCtx, dialCancel = context.WithTimeout(ctx, phaseTimeout)
+		tcpConn, node, err = c.dialRegion(dialCtx, reg)
+		dialCancel()
 	}
 	if err != nil {
 		return nil, 0, err
 	}
+	dialCtx = nil
 
 	// Now that we have a TCP connection, force close it if the
 	// TLS handshake + DERP setup takes too long.
@@ -407,6 +742,9 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	var serverProtoVersion int
 	var tlsState *tls.ConnectionState
 	if c.useHTTPS() {
+		failStage = ConnectFailTLS
+		phaseTimeout = c.tlsHandshakeTimeout()
+		tcpConn.SetDeadline(time.Now().Add(phaseTimeout))
 		tlsConn := c.tlsClient(tcpConn, node)
 		httpConn = tlsConn
 
@@ -437,6 +775,25 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		httpConn = tcpConn
 	}
 
+	if !serverPub.IsZero() {
+		// The TLS meta cert told us the server's key, so we can
+		// reject a mismatch before even speaking HTTP.
+		failStage = ConnectFailHandshake
+		if err := c.checkServerKeyLocked(serverPub); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// The HTTP upgrade and DERP handshake share one deadline.
+	phaseTimeout = c.handshakeTimeout()
+	tcpConn.SetDeadline(time.Now().Add(phaseTimeout))
+
+	failStage = ConnectFailUpgrade
+	if c.H2Connect {
+		if httpConn, err = c.h2Connect(httpConn, node); err != nil {
+			return nil, 0, err
+		}
+	}
 	brw := bufio.NewReadWriter(bufio.NewReader(httpConn), bufio.NewWriter(httpConn))
 	var derpClient *derp.Client
 
@@ -444,10 +801,14 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if err != nil {
 		return nil, 0, err
 	}
+	req.Header = c.agentHeader(req.Header)
 	req.Header.Set("Upgrade", "DERP")
 	req.Header.Set("Connection", "Upgrade")
 
-	if !serverPub.IsZero() && serverProtoVersion != 0 {
+	switch {
+	case c.H2Connect:
+		// The tunnel is open, so DERP can begin.
+	case !serverPub.IsZero() && serverProtoVersion != 0:
 		// parseMetaCert found the server's public key (no TLS
 		// middlebox was in the way), so skip the HTTP upgrade
 		// exchange.  See https://github.com/tailscale/tailscale/issues/693
@@ -461,7 +822,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		}
 		// No need to flush the HTTP request. the derp.Client's initial
 		// client auth frame will flush it.
-	} else {
+	default:
 		if err := req.Write(brw); err != nil {
 			return nil, 0, err
 		}
@@ -471,7 +832,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 
 		resp, err := http.ReadResponse(brw.Reader, req)
 		if err != nil {
-			return nil, 0, err
+			return c.webSocketFallbackLocked(ctx, caller, node, tcpConn, err)
 		}
 		if resp.StatusCode != http.StatusSwitchingProtocols {
 			b, _ := io.ReadAll(resp.Body)
@@ -479,30 +840,166 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 			return nil, 0, fmt.Errorf("GET failed: %v: %s", err, b)
 		}
 	}
+	failStage = ConnectFailHandshake
 	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf,
-		derp.MeshKey(c.MeshKey),
+		derp.MeshKey(c.meshKeyLocked()),
 		derp.ServerPublicKey(serverPub),
 		derp.CanAckPings(c.canAckPings),
 		derp.IsProber(c.IsProber),
+		derp.CanPeerPresentBatch(c.watchBatch),
+		derp.CanPeerSnapshot(c.watchBatch),
+		derp.CanZstd(c.canZstd),
+		derp.CanDropNotify(c.canDropNotify),
+		derp.CanForwardAck(c.canForwardAck),
+		derp.JumboPacketSize(c.maxPacketSize),
 	)
 	if err != nil {
 		return nil, 0, err
 	}
+	if err := c.checkServerKeyLocked(derpClient.ServerPublicKey()); err != nil {
+		return nil, 0, err
+	}
 	if c.preferred {
 		if err := derpClient.NotePreferred(true); err != nil {
 			go httpConn.Close()
 			return nil, 0, err
 		}
 	}
+	if err := tcpConn.SetDeadline(time.Time{}); err != nil {
+		go httpConn.Close()
+		return nil, 0, err
+	}
+
+	var certInfo *ServerCertInfo
+	if tlsState != nil {
+		certInfo = newServerCertInfo(tlsState, c.clock.Now())
+		if spki := certInfo.leafSPKIHash(); spki != "" && spki != c.certInfo.leafSPKIHash() {
+			leaf := certInfo.Chain[0]
+			c.logf("%s: server cert spki=%s subject=%q issuer=%q notAfter=%v scts=%d",
+				caller, spki, leaf.Subject, leaf.Issuer, leaf.NotAfter.Format(time.RFC3339), certInfo.SCTs)
+		}
+	}
 
 	c.serverPubKey = derpClient.ServerPublicKey()
 	c.client = derpClient
 	c.netConn = tcpConn
 	c.tlsState = tlsState
+	c.certInfo = certInfo
+	c.transport = derp.TransportHTTP
+	if c.H2Connect {
+		c.transport = derp.TransportH2Connect
+	} else if tlsState != nil {
+		c.transport = derp.TransportTLS
+	}
+	c.connGen++
+	return c.client, c.connGen, nil
+}
+
+// connectWebsocketLocked connects to the server over a WebSocket to
+// urlStr, using hc, or http.DefaultClient if it's nil.
+//
+// c.mu must be held.
+func (c *Client) connectWebsocketLocked(ctx context.Context, caller, urlStr string, hc *http.Client) (*derp.Client, int, error) {
+	c.logf("%s: connecting websocket to %v", caller, urlStr)
+	conn, err := dialWebsocketFunc(ctx, urlStr, c.agentHeader(nil), hc)
+	if err != nil {
+		c.logf("%s: websocket to %v error: %v", caller, urlStr, err)
+		return nil, 0, err
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
+		derp.MeshKey(c.meshKeyLocked()),
+		derp.CanAckPings(c.canAckPings),
+		derp.IsProber(c.IsProber),
+		derp.CanPeerPresentBatch(c.watchBatch),
+		derp.CanPeerSnapshot(c.watchBatch),
+		derp.CanZstd(c.canZstd),
+		derp.CanDropNotify(c.canDropNotify),
+		derp.CanForwardAck(c.canForwardAck),
+		derp.JumboPacketSize(c.maxPacketSize),
+	)
+	if err != nil {
+		go conn.Close()
+		return nil, 0, err
+	}
+	if err := c.checkServerKeyLocked(derpClient.ServerPublicKey()); err != nil {
+		go conn.Close()
+		return nil, 0, err
+	}
+	if c.preferred {
+		if err := derpClient.NotePreferred(true); err != nil {
+			go conn.Close()
+			return nil, 0, err
+		}
+	}
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = conn
+	c.tlsState = nil
+	c.certInfo = nil
+	c.transport = derp.TransportWebSocket
 	c.connGen++
 	return c.client, c.connGen, nil
 }
 
+// webSocketFallbackLocked is called when the server's response to the
+// DERP upgrade request over conn was missing or wasn't HTTP, with
+// upgradeErr saying why. Middleboxes that block the upgrade often let
+// WebSockets through, so unless that's disabled or unavailable, it
+// closes conn and retries over a WebSocket to the same URL, dialed and
+// secured the same way as conn was. Otherwise, it returns upgradeErr.
+//
+// A response that is HTTP, such as a 403 from a server that refuses
+// the client, is the server's answer, so isn't retried.
+//
+// c.mu must be held.
+func (c *Client) webSocketFallbackLocked(ctx context.Context, caller string, node *tailcfg.DERPNode, conn net.Conn, upgradeErr error) (*derp.Client, int, error) {
+	if dialWebsocketFunc == nil || c.NoWebSocketFallback || ctx.Err() != nil {
+		return nil, 0, upgradeErr
+	}
+	go conn.Close()
+	c.logf("%s: DERP upgrade failed (%v); falling back to websocket", caller, upgradeErr)
+	hc := c.webSocketHTTPClient(node)
+	defer hc.CloseIdleConnections()
+	client, connGen, err := c.connectWebsocketLocked(ctx, caller, c.urlString(node), hc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w; websocket fallback: %v", upgradeErr, err)
+	}
+	return client, connGen, nil
+}
+
+// webSocketHTTPClient returns an HTTP client for dialing a WebSocket
+// to node, or to c.url if node is nil, that connects the same way as
+// the DERP upgrade does: with c's dialer, proxy and netns settings,
+// and c's TLS config.
+func (c *Client) webSocketHTTPClient(node *tailcfg.DERPNode) *http.Client {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if node == nil {
+			return c.dialURL(ctx)
+		}
+		return c.dialNode(ctx, node)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx)
+			},
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				nc, err := dial(ctx)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := c.tlsClient(nc, node)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					nc.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+	}
+}
+
 // SetURLDialer sets the dialer to use for dialing URLs.
 // This dialer is only use for clients created with NewClient, not NewRegionClient.
 // If unset or nil, the default dialer is used.
@@ -515,6 +1012,9 @@ func (c *Client) SetURLDialer(dialer func(ctx context.Context, network, addr str
 
 func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 	host := c.url.Hostname()
+	if c.Proxy != nil {
+		return c.dialUsingProxy(ctx, c.Proxy, net.JoinHostPort(host, urlPort(c.url)))
+	}
 	if c.dialer != nil {
 		return c.dialer(ctx, "tcp", net.JoinHostPort(host, urlPort(c.url)))
 	}
@@ -522,9 +1022,20 @@ func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 	dialer := netns.NewDialer(c.logf, c.netMon)
 
 	if c.DNSCache != nil {
-		ip, _, _, err := c.DNSCache.LookupIP(ctx, host)
+		ip, ip6, _, err := c.DNSCache.LookupIP(ctx, host)
 		if err == nil {
 			hostOrIP = ip.String()
+			if ip.Is4() && ip6.IsValid() && !netns.IsSOCKSDialer(dialer) {
+				// Dual-stack: race the two families so that a
+				// broken or slow path for one doesn't hold up
+				// connecting over the other.
+				ips := happyEyeballsOrder(ip, ip6, c.preferIPv6())
+				tcpConn, err := c.dialHappyEyeballs(ctx, dialer.DialContext, ips, urlPort(c.url))
+				if err != nil {
+					return nil, fmt.Errorf("dial of %v: %v", host, err)
+				}
+				return tcpConn, nil
+			}
 		}
 		if err != nil && netns.IsSOCKSDialer(dialer) {
 			// Return an error if we're not using a dial
@@ -577,6 +1088,19 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
 		}
 	}
+	if c.H2Connect {
+		tlsConf.NextProtos = []string{"h2"}
+	}
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = c.tlsSessions.Get(func() tls.ClientSessionCache {
+			return tls.NewLRUClientSessionCache(8)
+		})
+	}
+	if pins := c.certPins(node); len(pins) > 0 {
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = nil
+		tlsConf.VerifyConnection = verifyCertPins(pins)
+	}
 	return tls.Client(nc, tlsConf)
 }
 
@@ -647,8 +1171,11 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 			Path:   "/", // unused
 		},
 	}
+	if c.Proxy != nil {
+		return c.dialUsingProxy(ctx, c.Proxy, net.JoinHostPort(n.HostName, "443"))
+	}
 	if proxyURL, err := tshttpproxy.ProxyFromEnvironment(proxyReq); err == nil && proxyURL != nil {
-		return c.dialNodeUsingProxy(ctx, n, proxyURL)
+		return c.dialUsingProxy(ctx, proxyURL, net.JoinHostPort(n.HostName, "443"))
 	}
 
 	type res struct {
@@ -729,9 +1256,14 @@ func firstStr(a, b string) string {
 	return b
 }
 
-// dialNodeUsingProxy connects to n using a CONNECT to the HTTP(s) proxy in proxyURL.
-func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, proxyURL *url.URL) (_ net.Conn, err error) {
+// dialUsingProxy connects to target, a host:port, through the proxy in
+// proxyURL: with SOCKS5 if its scheme is "socks5" or "socks5h", and
+// otherwise with a CONNECT to it as an HTTP(S) proxy.
+func (c *Client) dialUsingProxy(ctx context.Context, proxyURL *url.URL, target string) (_ net.Conn, err error) {
 	pu := proxyURL
+	if pu.Scheme == "socks5" || pu.Scheme == "socks5h" {
+		return c.dialUsingSOCKS5(ctx, pu, target)
+	}
 	var proxyConn net.Conn
 	if pu.Scheme == "https" {
 		var d tls.Dialer
@@ -762,8 +1294,6 @@ func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, pr
 		}
 	}()
 
-	target := net.JoinHostPort(n.HostName, "443")
-
 	var authHeader string
 	if v, err := tshttpproxy.GetAuthHeader(pu); err != nil {
 		c.logf("derphttp: error getting proxy auth header for %v: %v", proxyURL, err)
@@ -794,24 +1324,139 @@ func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, pr
 	return proxyConn, nil
 }
 
+// dialUsingSOCKS5 connects to target, a host:port, through the SOCKS5
+// proxy in pu, authenticating with its username and password, if any.
+// The proxy resolves target's hostname.
+func (c *Client) dialUsingSOCKS5(ctx context.Context, pu *url.URL, target string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if pu.User != nil {
+		pass, _ := pu.User.Password()
+		auth = &proxy.Auth{User: pu.User.Username(), Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", net.JoinHostPort(pu.Hostname(), firstStr(pu.Port(), "1080")), auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+	if err != nil {
+		c.logf("derphttp: SOCKS5 dial to %s via %s: %v", target, pu.Host, err)
+		return nil, err
+	}
+	return nc, nil
+}
+
+// Send sends a packet to the Tailscale node identified by dstKey,
+// connecting first if needed.
+//
+// Like derp.Client.Send, it is safe for concurrent use, and packets
+// from ordered Send calls (such as from one goroutine) to a given
+// destination are written in order. If the write fails, the connection
+// is closed and the next call reconnects.
 func (c *Client) Send(dstKey key.NodePublic, b []byte) error {
 	client, _, err := c.connect(c.newContext(), "derphttp.Client.Send")
 	if err != nil {
 		return err
 	}
-	if err := client.Send(dstKey, b); err != nil {
-		c.closeForReconnect(client)
+	err = client.Send(dstKey, b)
+	c.met.noteSent(len(b), err)
+	if err != nil {
+		c.closeForReconnect(client, err)
 	}
 	return err
 }
 
-func (c *Client) registerPing(m derp.PingMessage, ch chan<- bool) {
+// TrySend is like Send, but returns an error matching
+// derp.ErrSendWouldBlock rather than wait, whether to connect to the
+// server or for other writes to the connection to finish, such as
+// for latency-sensitive packets that are better sent another way than
+// late. See derp.Client.TrySend.
+func (c *Client) TrySend(dstKey key.NodePublic, b []byte) error {
+	if !c.mu.TryLock() {
+		return derp.ErrSendWouldBlock // connecting
+	}
+	client, closed := c.client, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if client == nil {
+		// Connecting would block; start it for next time.
+		go c.connect(c.newContext(), "derphttp.Client.TrySend")
+		return derp.ErrSendWouldBlock
+	}
+	err := client.TrySend(dstKey, b)
+	if errors.Is(err, derp.ErrSendWouldBlock) {
+		return err
+	}
+	c.met.noteSent(len(b), err)
+	if err != nil {
+		c.closeForReconnect(client, err)
+	}
+	return err
+}
+
+// SendQueueDepth returns the number of sends waiting to write their
+// packet to the current connection, or writing it, or zero if not
+// connected. See derp.Client.SendQueueDepth.
+func (c *Client) SendQueueDepth() int {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return 0
+	}
+	return client.SendQueueDepth()
+}
+
+// SendCompressible is like Send, but compressible says whether to
+// compress b when the server accepts compressed packets, regardless of
+// SetCanZstd. See derp.Client.SendCompressible.
+func (c *Client) SendCompressible(dstKey key.NodePublic, b []byte, compressible bool) error {
+	client, _, err := c.connect(c.newContext(), "derphttp.Client.SendCompressible")
+	if err != nil {
+		return err
+	}
+	err = client.SendCompressible(dstKey, b, compressible)
+	c.met.noteSent(len(b), err)
+	if err != nil {
+		c.closeForReconnect(client, err)
+	}
+	return err
+}
+
+// SendCtx is like Send, but if it needs to connect to the server
+// first, it gives up when ctx is done. Once the packet is being
+// written, it's written in full regardless of ctx.
+func (c *Client) SendCtx(ctx context.Context, dstKey key.NodePublic, b []byte) error {
+	client, _, err := c.connect(ctx, "derphttp.Client.SendCtx")
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err = client.Send(dstKey, b)
+	c.met.noteSent(len(b), err)
+	if err != nil {
+		c.closeForReconnect(client, err)
+	}
+	return err
+}
+
+// registerPing registers ch to be sent to when the pong for ping m is
+// received, reporting whether it did so: it doesn't if a ping with the
+// same data is already registered.
+func (c *Client) registerPing(m derp.PingMessage, ch chan<- bool) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if _, dup := c.pingOut[m]; dup {
+		return false
+	}
 	if c.pingOut == nil {
 		c.pingOut = map[derp.PingMessage]chan<- bool{}
 	}
 	c.pingOut[m] = ch
+	return true
 }
 
 func (c *Client) unregisterPing(m derp.PingMessage) {
@@ -840,25 +1485,38 @@ func (c *Client) handledPong(m derp.PongMessage) bool {
 // Another goroutine must be in a loop calling Recv or
 // RecvDetail or ping responses won't be handled.
 func (c *Client) Ping(ctx context.Context) error {
+	var data derp.PingMessage
+	rand.Read(data[:])
+	_, err := c.PingPayload(ctx, data)
+	return err
+}
+
+// PingPayload is like Ping, but sends payload as the ping's data,
+// which the server echoes in its reply, and returns the round-trip
+// time. Pings in flight at the same time must have different payloads,
+// so that their replies can be told apart; it's an error to ping with
+// the payload of a ping still awaiting its reply.
+func (c *Client) PingPayload(ctx context.Context, payload derp.PingMessage) (rtt time.Duration, err error) {
 	maxDL := time.Now().Add(5 * time.Second)
 	if dl, ok := ctx.Deadline(); !ok || dl.After(maxDL) {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, maxDL)
 		defer cancel()
 	}
-	var data derp.PingMessage
-	rand.Read(data[:])
 	gotPing := make(chan bool, 1)
-	c.registerPing(data, gotPing)
-	defer c.unregisterPing(data)
-	if err := c.SendPing(data); err != nil {
-		return err
+	if !c.registerPing(payload, gotPing) {
+		return 0, errors.New("ping with the same payload already in flight")
+	}
+	defer c.unregisterPing(payload)
+	start := c.clock.Now()
+	if err := c.SendPing(payload); err != nil {
+		return 0, err
 	}
 	select {
 	case <-gotPing:
-		return nil
+		return c.clock.Since(start), nil
 	case <-ctx.Done():
-		return ctx.Err()
+		return 0, ctx.Err()
 	}
 }
 
@@ -900,9 +1558,14 @@ func (c *Client) ForwardPacket(from, to key.NodePublic, b []byte) error {
 		return err
 	}
 	if err := client.ForwardPacket(from, to, b); err != nil {
-		c.closeForReconnect(client)
+		c.met.forwardErrors.Add(1)
+		c.closeForReconnect(client, err)
+		return err
 	}
-	return err
+	c.met.noteSent(len(b), nil)
+	c.fwd.packetsSent.Add(1)
+	c.fwd.bytesSent.Add(uint64(len(b)))
+	return nil
 }
 
 // SendPong sends a reply to a ping, with the ping's provided
@@ -937,6 +1600,77 @@ func (c *Client) SetCanAckPings(v bool) {
 	c.canAckPings = v
 }
 
+// SetCanZstd sets whether this client will send and receive
+// zstd-compressed packets, if the server supports it. See derp.CanZstd.
+//
+// This only affects future connections.
+func (c *Client) SetCanZstd(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canZstd = v
+}
+
+// SetCanDropNotify sets whether this client asks the server to report
+// packets it drops, as derp.PacketDroppedMessage from Recv. See
+// derp.CanDropNotify.
+//
+// This only affects future connections.
+func (c *Client) SetCanDropNotify(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canDropNotify = v
+}
+
+// SetCanForwardAck sets whether this client, a mesh client, asks the
+// server to acknowledge the packets it forwards with ForwardPacket, so
+// that ForwardStats can report how many were received. See
+// derp.CanForwardAck.
+//
+// This only affects future connections.
+func (c *Client) SetCanForwardAck(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canForwardAck = v
+}
+
+// SetMaxPacketSize sets the largest packet this client supports
+// sending and receiving, if the server supports it too. See
+// derp.JumboPacketSize. Zero means derp.MaxPacketSize.
+//
+// This only affects future connections.
+func (c *Client) SetMaxPacketSize(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxPacketSize = n
+}
+
+// ForwardStats are the counts of packets a mesh client forwarded, over
+// all its connections, and those the server acknowledged.
+//
+// The difference between the sent and acknowledged counts is the
+// packets lost, such as with a connection that broke, plus those sent
+// since the last acknowledgement.
+type ForwardStats struct {
+	PacketsSent    uint64
+	BytesSent      uint64
+	PacketsAcked   uint64 // received by the server
+	BytesAcked     uint64
+	PacketsDropped uint64 // acknowledged, but dropped on arrival by the server
+}
+
+// ForwardStats returns the counts of packets c forwarded and that the
+// server acknowledged. The acknowledgements are only counted with
+// SetCanForwardAck, as they're received by RecvDetail.
+func (c *Client) ForwardStats() ForwardStats {
+	return ForwardStats{
+		PacketsSent:    c.fwd.packetsSent.Load(),
+		BytesSent:      c.fwd.bytesSent.Load(),
+		PacketsAcked:   c.fwd.packetsAcked.Load(),
+		BytesAcked:     c.fwd.bytesAcked.Load(),
+		PacketsDropped: c.fwd.packetsDropped.Load(),
+	}
+}
+
 // NotePreferred notes whether this Client is the caller's preferred
 // (home) DERP node. It's only used for stats.
 func (c *Client) NotePreferred(v bool) {
@@ -951,7 +1685,7 @@ func (c *Client) NotePreferred(v bool) {
 
 	if client != nil {
 		if err := client.NotePreferred(v); err != nil {
-			c.closeForReconnect(client)
+			c.closeForReconnect(client, err)
 		}
 	}
 }
@@ -967,7 +1701,38 @@ func (c *Client) WatchConnectionChanges() error {
 	}
 	err = client.WatchConnectionChanges()
 	if err != nil {
-		c.closeForReconnect(client)
+		c.closeForReconnect(client, err)
+	}
+	return err
+}
+
+// SubscribeGossip subscribes to the peer maps of a server in gossip
+// mode. See derp.Client.SubscribeGossip.
+func (c *Client) SubscribeGossip() error {
+	client, _, err := c.connect(c.newContext(), "derphttp.Client.SubscribeGossip")
+	if err != nil {
+		return err
+	}
+	err = client.SubscribeGossip()
+	if err != nil {
+		c.closeForReconnect(client, err)
+	}
+	return err
+}
+
+// WatchConnectionChangesFiltered is like WatchConnectionChanges, but
+// subscribes only to changes for the peers matching f.
+// See derp.Client.WatchConnectionChangesFiltered.
+//
+// Only trusted connections (using MeshKey) are allowed to use this.
+func (c *Client) WatchConnectionChangesFiltered(f derp.WatchFilter) error {
+	client, _, err := c.connect(c.newContext(), "derphttp.Client.WatchConnectionChangesFiltered")
+	if err != nil {
+		return err
+	}
+	err = client.WatchConnectionChangesFiltered(f)
+	if err != nil {
+		c.closeForReconnect(client, err)
 	}
 	return err
 }
@@ -982,35 +1747,147 @@ func (c *Client) ClosePeer(target key.NodePublic) error {
 	}
 	err = client.ClosePeer(target)
 	if err != nil {
-		c.closeForReconnect(client)
+		c.closeForReconnect(client, err)
 	}
 	return err
 }
 
 // Recv reads a message from c. The returned message may alias memory from Client.
 // The message should only be used until the next Client call.
+//
+// Only one goroutine may receive from c at a time, with Recv,
+// RecvDetail or RecvCtx. While one is, the others return
+// errConcurrentRecv.
 func (c *Client) Recv() (derp.ReceivedMessage, error) {
 	m, _, err := c.RecvDetail()
 	return m, err
 }
 
+// errConcurrentRecv is returned by receives from a Client that another
+// receive is already in progress for.
+var errConcurrentRecv = errors.New("derphttp: concurrent receives from Client")
+
+// recvResult is the result of a receive started by RecvCtx.
+type recvResult struct {
+	m       derp.ReceivedMessage
+	connGen int
+	err     error
+}
+
+// startRecv marks a receive as in progress, or returns
+// errConcurrentRecv if one already is. If it returns nil, the caller
+// must call endRecv when done.
+func (c *Client) startRecv() error {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	if c.recvBusy {
+		return errConcurrentRecv
+	}
+	c.recvBusy = true
+	return nil
+}
+
+func (c *Client) endRecv() {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	c.recvBusy = false
+}
+
+// RecvCtx is like Recv, but returns ctx.Err() if ctx is done before a
+// message arrives, without closing the connection, so that callers can
+// stop waiting without a separate goroutine or closing the client.
+// The receive carries on in the background, and the next call to
+// Recv, RecvDetail or RecvCtx returns its result, so no message is
+// lost.
+func (c *Client) RecvCtx(ctx context.Context) (derp.ReceivedMessage, error) {
+	if ctx.Done() == nil {
+		return c.Recv()
+	}
+	if err := c.startRecv(); err != nil {
+		return nil, err
+	}
+	defer c.endRecv()
+	if !c.recvPending {
+		c.recvLoopOnce.Do(func() {
+			c.recvStart = make(chan struct{}, 1)
+			c.recvResults = make(chan recvResult, 1)
+			go c.recvLoop()
+		})
+		c.recvStart <- struct{}{}
+		c.recvPending = true
+	}
+	select {
+	case r := <-c.recvResults:
+		c.recvPending = false
+		return r.m, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// recvLoop receives a message each time RecvCtx asks it to, until c is
+// closed. It doesn't receive the next one until asked, so that, as with
+// Recv, a message is valid until the next receive.
+func (c *Client) recvLoop() {
+	for {
+		select {
+		case <-c.recvStart:
+		case <-c.ctx.Done():
+			return
+		}
+		m, connGen, err := c.recvDetail()
+		c.recvResults <- recvResult{m, connGen, err}
+	}
+}
+
 // RecvDetail is like Recv, but additional returns the connection generation on each message.
 // The connGen value is incremented every time the derphttp.Client reconnects to the server.
 func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
+	if err := c.startRecv(); err != nil {
+		return nil, 0, err
+	}
+	defer c.endRecv()
+	if c.recvPending {
+		// A receive that RecvCtx gave up waiting for is still
+		// outstanding; return its result.
+		r := <-c.recvResults
+		c.recvPending = false
+		return r.m, r.connGen, r.err
+	}
+	return c.recvDetail()
+}
+
+func (c *Client) recvDetail() (m derp.ReceivedMessage, connGen int, err error) {
 	client, connGen, err := c.connect(c.newContext(), "derphttp.Client.Recv")
 	if err != nil {
 		return nil, 0, err
 	}
+	c.receiving.Add(1)
+	defer c.receiving.Add(-1)
 	for {
 		m, err = client.Recv()
+		if err == nil {
+			c.met.noteRecv(m)
+			c.noteRecv()
+		}
 		switch m := m.(type) {
 		case derp.PongMessage:
 			if c.handledPong(m) {
 				continue
 			}
+		case derp.ServerInfoMessage:
+			if m.MeshKeyRejected && c.switchMeshKey(client) {
+				return nil, 0, errMeshKeyRejected
+			}
+		case derp.HealthMessage:
+			c.noteHealth(client, m.Problem)
+		case derp.ForwardAckMessage:
+			c.fwd.packetsAcked.Add(m.Packets)
+			c.fwd.bytesAcked.Add(m.Bytes)
+			c.fwd.packetsDropped.Add(m.Dropped)
 		}
 		if err != nil {
-			c.closeForReconnect(client)
+			c.closeForReconnect(client, err)
 			if c.isClosed() {
 				err = ErrClientClosed
 			}
@@ -1041,12 +1918,13 @@ func (c *Client) Close() error {
 	if c.netConn != nil {
 		c.netConn.Close()
 	}
+	c.setState(StateClosed, nil)
 	return nil
 }
 
 // closeForReconnect closes the underlying network connection and
 // zeros out the client field so future calls to Connect will
-// reconnect.
+// reconnect. err, if non-nil, is the error that broke the connection.
 //
 // The provided brokenClient is the client to forget. If current
 // client is not brokenClient, closeForReconnect does nothing. (This
@@ -1054,7 +1932,7 @@ func (c *Client) Close() error {
 // time and both calling closeForReconnect and the caller goroutines
 // forever calling closeForReconnect in lockstep endlessly;
 // https://github.com/tailscale/tailscale/pull/264)
-func (c *Client) closeForReconnect(brokenClient *derp.Client) {
+func (c *Client) closeForReconnect(brokenClient *derp.Client, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.client != brokenClient {
@@ -1065,10 +1943,92 @@ func (c *Client) closeForReconnect(brokenClient *derp.Client) {
 		c.netConn = nil
 	}
 	c.client = nil
+	if c.closed {
+		return
+	}
+	if c.clock.Since(c.connectedAt) < c.ReconnectBackoff.ResetAfter {
+		c.noteConnectFailureLocked(err)
+	} else {
+		c.resetBackoffLocked()
+	}
+	c.setState(StateReconnecting, err)
+}
+
+// ReconnectForLinkChange closes c's current connection, if any,
+// because the network it was made over has changed, such as when the
+// default route moves from Wi-Fi to cellular. c reconnects over the
+// new network the next time it's used, without backing off, and
+// OnConnectionStateChange is called with StateReconnecting and
+// ErrLinkChanged so that embedders can tell the migration from a
+// failure.
+func (c *Client) ReconnectForLinkChange() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.client == nil {
+		return
+	}
+	if c.netConn != nil {
+		c.netConn.Close()
+		c.netConn = nil
+	}
+	c.client = nil
+	c.resetBackoffLocked()
+	c.setState(StateReconnecting, ErrLinkChanged)
 }
 
 var ErrClientClosed = errors.New("derphttp.Client closed")
 
+// ErrLinkChanged is the error reported to OnConnectionStateChange when
+// ReconnectForLinkChange closes the connection.
+var ErrLinkChanged = errors.New("derphttp.Client: network link changed")
+
+var errMeshKeyRejected = errors.New("derphttp.Client: server rejected mesh key")
+
+// meshKeyLocked returns the mesh key to present to the server.
+// c.mu must be held.
+func (c *Client) meshKeyLocked() string {
+	if c.useSecondary && c.MeshKeySecondary != "" {
+		return c.MeshKeySecondary
+	}
+	return c.MeshKey
+}
+
+// SetMeshKeys replaces MeshKey and MeshKeySecondary, such as after
+// the mesh keys are rotated. Unlike setting the fields, it may be
+// called while the client is in use.
+//
+// This only affects future connections.
+func (c *Client) SetMeshKeys(primary, secondary string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MeshKey = primary
+	c.MeshKeySecondary = secondary
+	c.useSecondary = false
+}
+
+// switchMeshKey closes the connection of rejectedClient, whose mesh
+// key the server rejected, so that the next connection presents the
+// other of MeshKey and MeshKeySecondary. It reports false, doing
+// nothing, if there's no MeshKeySecondary to switch to.
+func (c *Client) switchMeshKey(rejectedClient *derp.Client) bool {
+	c.mu.Lock()
+	if c.MeshKeySecondary == "" {
+		c.mu.Unlock()
+		return false
+	}
+	if c.client == rejectedClient {
+		c.useSecondary = !c.useSecondary
+		which := "primary"
+		if c.useSecondary {
+			which = "secondary"
+		}
+		c.logf("derphttp.Client: server rejected mesh key; switching to %s key", which)
+	}
+	c.mu.Unlock()
+	c.closeForReconnect(rejectedClient, errMeshKeyRejected)
+	return true
+}
+
 func parseMetaCert(certs []*x509.Certificate) (serverPub key.NodePublic, serverProtoVersion int) {
 	for _, cert := range certs {
 		// Look for derpkey prefix added by initMetacert() on the server side.
@@ -4,12 +4,24 @@
 package derphttp
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"tailscale.com/derp"
+	"tailscale.com/types/key"
 )
 
 // fastStartHeader is the header (with value "1") that signals to the HTTP
@@ -18,9 +30,86 @@
 // following its HTTP request.
 const fastStartHeader = "Derp-Fast-Start"
 
+// ClientMetadataHeader is the HTTP header in which clients may send
+// metadata about themselves, such as build information, along with
+// their User-Agent. See Client.Metadata.
+const ClientMetadataHeader = "Derp-Client-Metadata"
+
+// ProbeHandler is the endpoint that js/wasm clients hit to measure
+// DERP latency, since they can't do UDP STUN queries, and that
+// RegionFailoverClient uses to health-check nodes it's not connected
+// to. DERP servers serve it at /derp/probe.
+func ProbeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "HEAD", "GET":
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	default:
+		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveWebSocketFunc is non-nil (set by websocket_server.go's init)
+// when compiled in.
+var serveWebSocketFunc func(s *derp.Server, w http.ResponseWriter, r *http.Request)
+
+// isWebSocketRequest reports whether r is a request to speak DERP over
+// WebSockets.
+//
+// Very early versions of Tailscale set "Upgrade: WebSocket" but didn't
+// actually speak WebSockets (they still assumed DERP's binary framing).
+// So to distinguish clients that actually want WebSockets, look for an
+// explicit "derp" subprotocol.
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(r.Header.Get("Sec-Websocket-Protocol"), "derp")
+}
+
+// Handler returns an http.Handler that upgrades requests to DERP
+// connections served by s. Clients may either use DERP's own HTTP
+// upgrade or speak DERP over a WebSocket (RFC 6455) with the "derp"
+// subprotocol, such as from browsers or networks whose middleboxes
+// only permit standard protocols (on Linux only), or tunnel DERP through an HTTP/2
+// CONNECT request (see Client.H2Connect).
+//
+// Requests without an Upgrade header that carry an "Authorization:
+// Bearer <token>" header are instead served by the server's
+// administrative API, where token must be the server's mesh key or
+// admin token (see derp.Server.SetAdminToken). A GET returns a JSON
+// array of the connected clients, or with a "recent" query parameter,
+// of the recently disconnected ones (see derp.Server.RecentClients),
+// or with "recent" and "key" parameters, just the named key's entry
+// in that list, or with a "bans" parameter, of the source IPs that
+// are temporarily banned (see derp.Server.SetBanPolicy), or with a
+// "ping" parameter naming a connected client's key, the round-trip
+// time of a ping to it (see derp.Server.PingClient). A DELETE with
+// a "key" query parameter naming a client's node public key
+// disconnects that client, and one with a "ban" parameter naming an IP
+// lifts its ban.
 func Handler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		up := strings.ToLower(r.Header.Get("Upgrade"))
+		if up == "" && r.Method != http.MethodConnect && r.Header.Get("Authorization") != "" {
+			serveAdmin(s, w, r)
+			return
+		}
+		if retryAfter, banned := s.Banned(r.RemoteAddr); banned {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "temporarily banned for abuse", http.StatusForbidden)
+			return
+		}
+		if err := s.AuthorizeUpgrade(r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if serveWebSocketFunc != nil && isWebSocketRequest(r) {
+			serveWebSocketFunc(s, w, r)
+			return
+		}
+		if isH2ConnectRequest(r) {
+			serveH2Connect(s, w, r)
+			return
+		}
 		if up != "websocket" && up != "derp" {
 			if up != "" {
 				log.Printf("Weird upgrade: %q", up)
@@ -55,6 +144,201 @@ func Handler(s *derp.Server) http.Handler {
 				pubKey.UntypedHexString())
 		}
 
-		s.Accept(r.Context(), netConn, conn, netConn.RemoteAddr().String())
+		s.Accept(acceptContext(r, ""), netConn, conn, netConn.RemoteAddr().String())
 	})
 }
+
+// acceptContext returns the context with which to accept a DERP
+// connection from r, carrying what the client declared about itself
+// (see derp.ContextWithClientAgent), its TLS state for verifying
+// client certificates (see derp.Server.SetClientCAs) and its
+// transport. An empty transport means the HTTP upgrade, with or without
+// TLS.
+func acceptContext(r *http.Request, transport string) context.Context {
+	ctx := derp.ContextWithClientAgent(r.Context(), r.UserAgent(), r.Header.Get(ClientMetadataHeader))
+	if r.TLS != nil {
+		ctx = derp.ContextWithTLSState(ctx, r.TLS)
+	}
+	if transport == "" {
+		transport = derp.TransportHTTP
+		if r.TLS != nil {
+			transport = derp.TransportTLS
+		}
+	}
+	return derp.ContextWithTransport(ctx, transport)
+}
+
+// ALPNProto is the TLS ALPN protocol with which clients may speak DERP
+// immediately after the TLS handshake, without an HTTP upgrade. Unlike
+// the upgrade, it's visible in the clear in the ClientHello, so it's
+// only for clients that know the server supports it.
+const ALPNProto = "derp"
+
+// TLSNextProto returns a function for an http.Server's TLSNextProto
+// map, under the key ALPNProto, that hands TLS connections that
+// negotiated ALPNProto to s. The server's TLSConfig.NextProtos must
+// also list ALPNProto.
+//
+// Connections served this way share s, and so all of its client state,
+// with those upgraded via Handler on the same or other listeners.
+func TLSNextProto(s *derp.Server) func(*http.Server, *tls.Conn, http.Handler) {
+	return func(_ *http.Server, tc *tls.Conn, _ http.Handler) {
+		if err := s.AuthorizeUpgrade(nil); err != nil {
+			tc.Close()
+			return
+		}
+		// Clear the http.Server's handshake deadlines; the DERP
+		// server manages its own.
+		tc.SetDeadline(time.Time{})
+		brw := bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc))
+		s.Accept(derp.ContextWithTransport(context.Background(), derp.TransportALPN), tc, brw, tc.RemoteAddr().String())
+	}
+}
+
+// ServeTCP accepts connections on ln and hands them to s to speak DERP
+// directly, without TLS or HTTP, until ln's Accept fails, returning
+// that error. It's meant for private networks or for use behind a
+// TLS-terminating load balancer.
+func ServeTCP(s *derp.Server, ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if err := s.AuthorizeUpgrade(nil); err != nil {
+			c.Close()
+			continue
+		}
+		go func() {
+			brw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+			s.Accept(derp.ContextWithTransport(context.Background(), derp.TransportTCP), c, brw, c.RemoteAddr().String())
+		}()
+	}
+}
+
+// BearerTokenAuthorizer returns a func for
+// derp.Server.SetUpgradeAuthorizer that authorizes requests with an
+// "Authorization: Bearer <token>" header naming one of tokens.
+func BearerTokenAuthorizer(tokens ...string) func(*http.Request) error {
+	return func(r *http.Request) error {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return errors.New("missing bearer token")
+		}
+		for _, tok := range tokens {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(tok)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid bearer token")
+	}
+}
+
+// HealthzHandler returns an http.Handler for liveness probes, such as
+// a Kubernetes livenessProbe. It reports that the process is alive
+// with a 200 response, even while the server is draining, so that
+// it's not restarted before its clients have moved.
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// ReadyzHandler returns an http.Handler for readiness probes, such as
+// a Kubernetes readinessProbe. It responds with a 200 if s is ready to
+// accept new clients, and otherwise a 503 saying why not, as reported
+// by s.Ready: while it's draining, at its connection capacity, or its
+// mesh connections aren't established yet.
+func ReadyzHandler(s *derp.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Ready(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// serveAdmin serves the administrative API of s.
+func serveAdmin(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !s.IsAdminToken(tok) {
+		s.ReportAbuse(r.RemoteAddr, "bad admin token")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		var v any = s.ConnectedClients()
+		if q.Has("recent") {
+			v = s.RecentClients()
+		}
+		if q.Has("bans") {
+			v = s.Bans()
+		}
+		if q.Has("ping") {
+			var k key.NodePublic
+			if err := k.UnmarshalText([]byte(q.Get("ping"))); err != nil {
+				http.Error(w, "invalid key: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			defer cancel()
+			rtt, err := s.PingClient(ctx, k)
+			if err != nil {
+				http.Error(w, "ping failed: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			v = struct {
+				Key       key.NodePublic
+				RTTMillis float64
+			}{k, float64(rtt) / float64(time.Millisecond)}
+		}
+		if q.Has("recent") && q.Has("key") {
+			var k key.NodePublic
+			if err := k.UnmarshalText([]byte(q.Get("key"))); err != nil {
+				http.Error(w, "invalid key: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rc, ok := s.RecentClient(k)
+			if !ok {
+				http.Error(w, "client not recently disconnected", http.StatusNotFound)
+				return
+			}
+			v = rc
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(v)
+	case "DELETE":
+		if v := r.FormValue("ban"); v != "" {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				http.Error(w, "invalid IP: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !s.Unban(ip) {
+				http.Error(w, "IP not banned", http.StatusNotFound)
+				return
+			}
+			log.Printf("derphttp: admin lifted ban of %v", ip)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var k key.NodePublic
+		if err := k.UnmarshalText([]byte(r.FormValue("key"))); err != nil {
+			http.Error(w, "invalid key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.DisconnectClient(k) {
+			http.Error(w, "client not connected", http.StatusNotFound)
+			return
+		}
+		log.Printf("derphttp: admin disconnected client %v", k)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
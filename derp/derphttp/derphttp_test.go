@@ -4,19 +4,59 @@
 package derphttp
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+	"nhooyr.io/websocket"
 	"tailscale.com/derp"
+	"tailscale.com/net/socks5"
+	"tailscale.com/net/wsconn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
 	"tailscale.com/types/key"
 )
 
+func init() {
+	// The derp/derph2 package imports derphttp, so can't be imported
+	// here. Register the equivalent for tests instead.
+	RegisterH2Connect(func(tlsConn *tls.Conn, req *http.Request) (*http.Response, error) {
+		cc, err := new(http2.Transport).NewClientConn(tlsConn)
+		if err != nil {
+			return nil, err
+		}
+		return cc.RoundTrip(req)
+	})
+}
+
 func TestSendRecv(t *testing.T) {
 	serverPrivateKey := key.NewNode()
 
@@ -32,27 +72,9 @@ func TestSendRecv(t *testing.T) {
 	s := derp.NewServer(serverPrivateKey, t.Logf)
 	defer s.Close()
 
-	httpsrv := &http.Server{
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		Handler:      Handler(s),
-	}
-
-	ln, err := net.Listen("tcp4", "localhost:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	serverURL := "http://" + ln.Addr().String()
+	serverURL := newTestServer(t, s)
 	t.Logf("server URL: %s", serverURL)
 
-	go func() {
-		if err := httpsrv.Serve(ln); err != nil {
-			if err == http.ErrServerClosed {
-				return
-			}
-			panic(err)
-		}
-	}()
-
 	var clients []*Client
 	var recvChs []chan []byte
 	done := make(chan struct{})
@@ -146,6 +168,150 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(1)
 }
 
+func TestRecvCtx(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	newClient := func() *Client {
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+		return c
+	}
+	alice, bob := newClient(), newClient()
+
+	timeoutRecv := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if m, err := bob.RecvCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("RecvCtx = %#v, %v; want %v", m, err, context.DeadlineExceeded)
+		}
+	}
+	wantPacket := func(m derp.ReceivedMessage, err error, want string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); !ok || string(p.Data) != want {
+			t.Fatalf("got %#v; want packet %q", m, want)
+		}
+	}
+
+	timeoutRecv()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := alice.SendCtx(ctx, bob.privateKey.Public(), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := bob.RecvCtx(ctx)
+	wantPacket(m, err, "one")
+
+	// A receive that RecvCtx stopped waiting for is returned by Recv.
+	timeoutRecv()
+	if err := alice.Send(bob.privateKey.Public(), []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	m, err = bob.Recv()
+	wantPacket(m, err, "two")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := alice.SendCtx(canceled, bob.privateKey.Public(), []byte("three")); !errors.Is(err, context.Canceled) {
+		t.Errorf("SendCtx with canceled context = %v; want %v", err, context.Canceled)
+	}
+
+	// Only one receive may be in progress at a time.
+	type result struct {
+		m   derp.ReceivedMessage
+		err error
+	}
+	got := make(chan result, 1)
+	go func() {
+		m, err := bob.Recv()
+		got <- result{m, err}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := bob.RecvCtx(short)
+		cancel()
+		if errors.Is(err, errConcurrentRecv) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("RecvCtx during Recv = %v; want %v", err, errConcurrentRecv)
+		}
+	}
+	if err := alice.Send(bob.privateKey.Public(), []byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	wantPacket(r.m, r.err, "four")
+}
+
+func TestMeasureLatency(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.MeasureLatency(ctx, 0); err == nil {
+		t.Fatal("MeasureLatency(0) succeeded; want error")
+	}
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	st, err := c.MeasureLatency(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Sent != 5 || st.Received != 5 || st.Loss != 0 {
+		t.Fatalf("got %+v; want 5 sent and received, no loss", st)
+	}
+	if st.Min <= 0 || st.Min > st.Avg || st.Avg > st.P95 {
+		t.Fatalf("got %+v; want 0 < Min <= Avg <= P95", st)
+	}
+}
+
+// newTestServer serves s over HTTP on a localhost port until the test
+// ends, returning the URL to reach it.
+func newTestServer(t *testing.T, s *derp.Server) (serverURL string) {
+	t.Helper()
+	httpsrv := &http.Server{
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:      Handler(s),
+	}
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { httpsrv.Close() })
+	go httpsrv.Serve(ln)
+	return "http://" + ln.Addr().String()
+}
+
 func waitConnect(t testing.TB, c *Client) {
 	t.Helper()
 	if m, err := c.Recv(); err != nil {
@@ -155,31 +321,118 @@ func waitConnect(t testing.TB, c *Client) {
 	}
 }
 
-func TestPing(t *testing.T) {
-	serverPrivateKey := key.NewNode()
-	s := derp.NewServer(serverPrivateKey, t.Logf)
+// TestConcurrentSendOrdering sends from many goroutines sharing one
+// Client to several destinations and checks that each destination
+// receives each goroutine's packets in the order they were sent. The
+// server may drop packets for slow readers, so not every packet need
+// arrive. It's most useful with the race detector on.
+func TestConcurrentSendOrdering(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
 	defer s.Close()
+	serverURL := newTestServer(t, s)
 
-	httpsrv := &http.Server{
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		Handler:      Handler(s),
+	newClient := func() *Client {
+		t.Helper()
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatalf("client Connect: %v", err)
+		}
+		waitConnect(t, c)
+		return c
 	}
 
-	ln, err := net.Listen("tcp4", "localhost:0")
-	if err != nil {
-		t.Fatal(err)
+	const (
+		numDsts    = 3
+		numSenders = 8
+		numPkts    = 200 // per sender, per destination
+	)
+
+	sender := newClient()
+	defer sender.Close()
+
+	var received atomic.Int64
+	var wg sync.WaitGroup
+	var dsts []*Client
+	for i := 0; i < numDsts; i++ {
+		dst := newClient()
+		dsts = append(dsts, dst)
+		wg.Add(1)
+		go func(i int, dst *Client) {
+			defer wg.Done()
+			var last [numSenders]int64
+			for j := range last {
+				last[j] = -1
+			}
+			for {
+				m, err := dst.Recv()
+				if err != nil {
+					return
+				}
+				p, ok := m.(derp.ReceivedPacket)
+				if !ok {
+					continue
+				}
+				if len(p.Data) != 5 || int(p.Data[0]) >= numSenders {
+					t.Errorf("dst %d: bogus packet %x", i, p.Data)
+					continue
+				}
+				g, seq := p.Data[0], int64(binary.BigEndian.Uint32(p.Data[1:]))
+				if seq <= last[g] {
+					t.Errorf("dst %d: from sender %d, got seq %d after %d", i, g, seq, last[g])
+				}
+				last[g] = seq
+				received.Add(1)
+			}
+		}(i, dst)
 	}
-	serverURL := "http://" + ln.Addr().String()
-	t.Logf("server URL: %s", serverURL)
 
-	go func() {
-		if err := httpsrv.Serve(ln); err != nil {
-			if err == http.ErrServerClosed {
-				return
+	var sendWG sync.WaitGroup
+	for g := 0; g < numSenders; g++ {
+		sendWG.Add(1)
+		go func(g int) {
+			defer sendWG.Done()
+			pkt := make([]byte, 5)
+			pkt[0] = byte(g)
+			for seq := 0; seq < numPkts; seq++ {
+				binary.BigEndian.PutUint32(pkt[1:], uint32(seq))
+				for _, dst := range dsts {
+					if err := sender.Send(dst.SelfPublicKey(), pkt); err != nil {
+						t.Errorf("sender %d: %v", g, err)
+						return
+					}
+				}
 			}
-			panic(err)
-		}
-	}()
+		}(g)
+	}
+	sendWG.Wait()
+
+	// Wait until everything arrived or nothing more is arriving.
+	const total = numDsts * numSenders * numPkts
+	for prev, n := int64(-1), received.Load(); n != prev && n < total; prev, n = n, received.Load() {
+		time.Sleep(500 * time.Millisecond)
+	}
+	for _, dst := range dsts {
+		dst.Close()
+	}
+	wg.Wait()
+
+	n := received.Load()
+	t.Logf("received %d of %d packets", n, total)
+	if n == 0 {
+		t.Fatal("received no packets")
+	}
+}
+
+func TestPing(t *testing.T) {
+	serverPrivateKey := key.NewNode()
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	serverURL := newTestServer(t, s)
+	t.Logf("server URL: %s", serverURL)
 
 	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
 	if err != nil {
@@ -206,3 +459,1781 @@ func TestPing(t *testing.T) {
 		t.Fatalf("Ping: %v", err)
 	}
 }
+
+func TestPrime(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connGen := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.connGen
+	}
+
+	ctx := context.Background()
+	if err := c.Prime(ctx); err != nil {
+		t.Fatalf("Prime: %v", err)
+	}
+	if _, err := c.LocalAddr(); err != nil {
+		t.Fatalf("not connected after Prime: %v", err)
+	}
+	if got := connGen(); got != 1 {
+		t.Fatalf("connGen = %d; want 1", got)
+	}
+
+	// With nobody calling Recv, Prime can only check that the socket
+	// is writable: priming a working connection returns promptly
+	// without waiting for a pong, and keeps the connection.
+	pctx, cancel := context.WithTimeout(ctx, primePingTimeout/2)
+	defer cancel()
+	if err := c.Prime(pctx); err != nil {
+		t.Fatalf("Prime without Recv: %v", err)
+	}
+	if got := connGen(); got != 1 {
+		t.Fatalf("connGen after Prime without Recv = %d; want 1", got)
+	}
+
+	// Priming a broken connection with nobody calling Recv makes a
+	// new one.
+	c.mu.Lock()
+	c.netConn.Close()
+	c.mu.Unlock()
+	if err := c.Prime(ctx); err != nil {
+		t.Fatalf("Prime after break without Recv: %v", err)
+	}
+	if got := connGen(); got != 2 {
+		t.Fatalf("connGen after broken Prime without Recv = %d; want 2", got)
+	}
+
+	go func() {
+		for {
+			if _, err := c.Recv(); err == ErrClientClosed {
+				return
+			}
+		}
+	}()
+
+	// Priming a working connection keeps it.
+	if err := c.Prime(ctx); err != nil {
+		t.Fatalf("Prime with Recv: %v", err)
+	}
+	if got := connGen(); got != 2 {
+		t.Fatalf("connGen after Prime with Recv = %d; want 2", got)
+	}
+
+	// Priming after the connection breaks makes a new one.
+	c.mu.Lock()
+	c.netConn.Close()
+	c.mu.Unlock()
+	if err := c.Prime(ctx); err != nil {
+		t.Fatalf("Prime after break: %v", err)
+	}
+	if got := connGen(); got != 3 {
+		t.Fatalf("connGen after broken Prime = %d; want 3", got)
+	}
+}
+
+func TestAdminListClients(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetAdminToken("sekrit")
+
+	serverURL := newTestServer(t, s)
+
+	priv := key.NewNode()
+	c, err := NewClient(priv, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+
+	get := func(tok string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", serverURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := get("wrong")
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("wrong token: got status %v; want 403", res.Status)
+	}
+
+	res = get("sekrit")
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v; want 200", res.Status)
+	}
+	var got []derp.ConnectedClient
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Key != priv.Public() || got[0].IsMesh || got[0].IsWatcher {
+		t.Fatalf("got clients %+v; want just non-mesh %v", got, priv.Public())
+	}
+}
+
+func TestHealthzReadyz(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetConnCapacity(1)
+	var readyErr error
+	s.SetReadyCheck(func() error { return readyErr })
+
+	check := func(h http.Handler, wantCode int, wantBody string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != wantCode || !strings.Contains(rec.Body.String(), wantBody) {
+			t.Errorf("got %d %q; want %d containing %q", rec.Code, rec.Body, wantCode, wantBody)
+		}
+	}
+	healthz, readyz := HealthzHandler(), ReadyzHandler(s)
+
+	check(healthz, http.StatusOK, "ok")
+	check(readyz, http.StatusOK, "ok")
+
+	readyErr = errors.New("mesh not yet established")
+	check(readyz, http.StatusServiceUnavailable, "mesh not yet established")
+	readyErr = nil
+
+	c, err := NewClient(key.NewNode(), newTestServer(t, s), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+	check(readyz, http.StatusServiceUnavailable, "at capacity")
+
+	s.Close()
+	check(readyz, http.StatusServiceUnavailable, "server closed")
+	check(healthz, http.StatusOK, "ok")
+}
+
+func TestClientAgent(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	c, err := NewClient(key.NewNode(), newTestServer(t, s), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.UserAgent = "exampleapp/1.2.3"
+	c.Metadata = "build=abc123"
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+
+	cc := s.ConnectedClients()
+	if len(cc) != 1 {
+		t.Fatalf("got %d connected clients; want 1", len(cc))
+	}
+	if cc[0].UserAgent != c.UserAgent || cc[0].Metadata != c.Metadata {
+		t.Errorf("got UserAgent %q, Metadata %q; want %q, %q", cc[0].UserAgent, cc[0].Metadata, c.UserAgent, c.Metadata)
+	}
+}
+
+func TestClientFamilyAndTransport(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	c, err := NewClient(key.NewNode(), newTestServer(t, s), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+
+	cc := s.ConnectedClients()
+	if len(cc) != 1 {
+		t.Fatalf("got %d connected clients; want 1", len(cc))
+	}
+	if cc[0].Family != "ipv4" || cc[0].Transport != derp.TransportHTTP {
+		t.Errorf("got Family %q, Transport %q; want ipv4, %q", cc[0].Family, cc[0].Transport, derp.TransportHTTP)
+	}
+	vars := s.ExpVar().String()
+	for _, want := range []string{`"gauge_current_connections_by_family": {"ipv4": 1}`, `"gauge_current_connections_by_transport": {"http": 1}`} {
+		if !strings.Contains(vars, want) {
+			t.Errorf("expvars missing %s: %s", want, vars)
+		}
+	}
+}
+
+// serveConnectProxy serves an HTTP CONNECT proxy on ln that requires
+// the given Proxy-Authorization, counting the tunnels it makes.
+func serveConnectProxy(ln net.Listener, wantAuth string, tunnels *atomic.Int32) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer nc.Close()
+			req, err := http.ReadRequest(bufio.NewReader(nc))
+			if err != nil {
+				return
+			}
+			if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != wantAuth {
+				io.WriteString(nc, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			up, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(nc, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer up.Close()
+			tunnels.Add(1)
+			io.WriteString(nc, "HTTP/1.1 200 OK\r\n\r\n")
+			go io.Copy(up, nc)
+			io.Copy(nc, up)
+		}()
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	connect := func(t *testing.T, proxyURL string) error {
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.Proxy, err = url.Parse(proxyURL); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Connect(ctx); err != nil {
+			return err
+		}
+		waitConnect(t, c)
+		return nil
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		ln, err := net.Listen("tcp4", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		var tunnels atomic.Int32
+		go serveConnectProxy(ln, "Basic dXNlcjpwYXNz", &tunnels) // user:pass
+
+		if err := connect(t, "http://user:pass@"+ln.Addr().String()); err != nil {
+			t.Fatalf("Connect via proxy: %v", err)
+		}
+		if got := tunnels.Load(); got != 1 {
+			t.Errorf("proxy made %d tunnels; want 1", got)
+		}
+		if err := connect(t, "http://user:wrong@"+ln.Addr().String()); err == nil {
+			t.Error("Connect with wrong proxy password succeeded")
+		}
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		ln, err := net.Listen("tcp4", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		var dials atomic.Int32
+		srv := &socks5.Server{
+			Logf:     t.Logf,
+			Username: "user",
+			Password: "pass",
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		go srv.Serve(ln)
+
+		if err := connect(t, "socks5://user:pass@"+ln.Addr().String()); err != nil {
+			t.Fatalf("Connect via proxy: %v", err)
+		}
+		if got := dials.Load(); got != 1 {
+			t.Errorf("proxy made %d dials; want 1", got)
+		}
+		if err := connect(t, "socks5://user:wrong@"+ln.Addr().String()); err == nil {
+			t.Error("Connect with wrong proxy password succeeded")
+		}
+	})
+}
+
+func TestAdminRecentClients(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetAdminToken("sekrit")
+
+	serverURL := newTestServer(t, s)
+
+	priv := key.NewNode()
+	c, err := NewClient(priv, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+
+	get := func(query string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", serverURL+"/?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer sekrit")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	keyQuery := "recent=1&key=" + priv.Public().String()
+
+	// While connected, it isn't a recent client.
+	res := get(keyQuery)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("connected client: got status %v; want 404", res.Status)
+	}
+
+	if !s.DisconnectClient(priv.Public()) {
+		t.Fatal("DisconnectClient failed")
+	}
+	for i := 0; ; i++ {
+		if _, ok := s.RecentClient(priv.Public()); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("client never became recent")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	res = get(keyQuery)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v; want 200", res.Status)
+	}
+	var got derp.RecentClient
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != priv.Public() || got.LastSeen.IsZero() || got.Reason != "connection closed by DERP server administrator" {
+		t.Fatalf("got recent client %+v; want %v disconnected by administrator", got, priv.Public())
+	}
+}
+
+func TestConnHooks(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	events := make(chan derp.ConnEvent, 2)
+	s.SetConnHooks(derp.ConnHooks{
+		OnConnect:    func(e derp.ConnEvent) { events <- e },
+		OnDisconnect: func(e derp.ConnEvent) { events <- e },
+	})
+
+	serverURL := newTestServer(t, s)
+
+	priv := key.NewNode()
+	c, err := NewClient(priv, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() derp.ConnEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for hook")
+			panic("unreachable")
+		}
+	}
+	e := next()
+	if e.Key != priv.Public() || e.RemoteAddr == "" || e.ConnectedAt.IsZero() || e.Reason != "" || e.IsMesh {
+		t.Errorf("OnConnect got %+v", e)
+	}
+
+	if !s.DisconnectClient(priv.Public()) {
+		t.Fatal("DisconnectClient failed")
+	}
+	e = next()
+	if e.Key != priv.Public() || e.Reason != "connection closed by DERP server administrator" {
+		t.Errorf("OnDisconnect got %+v", e)
+	}
+}
+
+func TestExpectServerKey(t *testing.T) {
+	serverPrivateKey := key.NewNode()
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	wrong := key.NewNode().Public()
+	c.ExpectServerKey(wrong)
+	err = c.Connect(context.Background())
+	var mismatch *ServerKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Connect with wrong expected key: got %v; want ServerKeyMismatchError", err)
+	}
+	if mismatch.Want != wrong || mismatch.Got != serverPrivateKey.Public() {
+		t.Errorf("got %+v; want Want=%v, Got=%v", mismatch, wrong, serverPrivateKey.Public())
+	}
+
+	c.ExpectServerKey(serverPrivateKey.Public())
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect with right expected key: %v", err)
+	}
+}
+
+func TestMeshKeySecondary(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("new-key")
+
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.MeshKey = "old-key"
+	c.MeshKeySecondary = "new-key"
+
+	if _, err := c.Recv(); !errors.Is(err, errMeshKeyRejected) {
+		t.Fatalf("first Recv: got %v; want %v", err, errMeshKeyRejected)
+	}
+
+	// The reconnect presents the secondary key, which is accepted.
+	if err := c.WatchConnectionChanges(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si, ok := m.(derp.ServerInfoMessage); !ok || si.MeshKeyRejected {
+		t.Fatalf("second Recv = %#v; want accepted ServerInfoMessage", m)
+	}
+	m, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(derp.PeerPresentMessage); !ok {
+		t.Fatalf("third Recv = %T; want PeerPresentMessage from watching", m)
+	}
+}
+
+func TestSetMeshKeys(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("new-key")
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.MeshKey = "old-key"
+
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si, ok := m.(derp.ServerInfoMessage); !ok || !si.MeshKeyRejected {
+		t.Fatalf("first Recv = %#v; want rejected ServerInfoMessage", m)
+	}
+
+	// The next connection presents the new key.
+	c.SetMeshKeys("new-key", "")
+	c.mu.Lock()
+	dc := c.client
+	c.mu.Unlock()
+	c.closeForReconnect(dc, nil)
+	m, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si, ok := m.(derp.ServerInfoMessage); !ok || si.MeshKeyRejected {
+		t.Fatalf("Recv after SetMeshKeys = %#v; want accepted ServerInfoMessage", m)
+	}
+}
+
+func TestConnectionStateChange(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	priv := key.NewNode()
+	c, err := NewClient(priv, newTestServer(t, s), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	changes := make(chan stateChange, 16)
+	c.OnConnectionStateChange = func(state ConnState, err error) {
+		changes <- stateChange{state, err}
+	}
+	want := func(state ConnState, wantErr bool) {
+		t.Helper()
+		select {
+		case sc := <-changes:
+			if sc.state != state || (sc.err != nil) != wantErr {
+				t.Fatalf("got state %v, err %v; want %v, error %v", sc.state, sc.err, state, wantErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no state change; want %v", state)
+		}
+	}
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want(StateConnecting, false)
+	want(StateConnected, false)
+	waitConnect(t, c)
+
+	// The server says why it's disconnecting before hanging up.
+	s.DisconnectClient(priv.Public())
+	if m, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	} else if hm, ok := m.(derp.HealthMessage); !ok || hm.Problem == "" {
+		t.Fatalf("Recv = %#v; want HealthMessage with a problem", m)
+	}
+	want(StateDegraded, true)
+	if _, err := c.Recv(); err == nil {
+		t.Fatal("Recv after disconnect succeeded")
+	}
+	want(StateReconnecting, true)
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want(StateConnected, false)
+
+	c.Close()
+	want(StateClosed, false)
+	select {
+	case sc := <-changes:
+		t.Fatalf("unexpected state change after Close: %v, %v", sc.state, sc.err)
+	default:
+	}
+}
+
+func TestReconnectForLinkChange(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	n := newTestNode(t, s, "1a")
+
+	c := NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return nodeRegion(n) })
+	defer c.Close()
+	c.ReconnectBackoff = BackoffPolicy{Initial: time.Hour, Max: time.Hour, ResetAfter: time.Hour}
+	changes := make(chan stateChange, 16)
+	c.OnConnectionStateChange = func(state ConnState, err error) {
+		changes <- stateChange{state, err}
+	}
+	want := func(state ConnState, wantErr error) {
+		t.Helper()
+		select {
+		case sc := <-changes:
+			if sc.state != state || sc.err != wantErr {
+				t.Fatalf("got state %v, err %v; want %v, err %v", sc.state, sc.err, state, wantErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no state change; want %v", state)
+		}
+	}
+
+	// The reconnect after a link change resumes the TLS session, and
+	// isn't held back by ReconnectBackoff despite following a short
+	// connection.
+	for _, wantResume := range []bool{false, true} {
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+		cs, ok := c.TLSConnectionState()
+		if !ok {
+			t.Fatal("no TLS connection state")
+		}
+		if cs.DidResume != wantResume {
+			t.Errorf("DidResume = %v; want %v", cs.DidResume, wantResume)
+		}
+		c.ReconnectForLinkChange()
+	}
+	want(StateConnecting, nil)
+	want(StateConnected, nil)
+	want(StateReconnecting, ErrLinkChanged)
+	want(StateConnected, nil)
+	want(StateReconnecting, ErrLinkChanged)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL := "http://" + ln.Addr().String()
+	ln.Close() // so connecting fails
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	c.clock = clock
+	c.ReconnectBackoff = BackoffPolicy{Initial: time.Minute, Max: 3 * time.Minute}
+
+	wantStats := func(want ConnectStats) {
+		t.Helper()
+		if got := c.ConnectStats(); got != want {
+			t.Fatalf("ConnectStats = %+v; want %+v", got, want)
+		}
+	}
+	ctx := context.Background()
+	if err := c.Connect(ctx); err == nil {
+		t.Fatal("Connect succeeded")
+	}
+	wantStats(ConnectStats{Attempts: 1, Failures: 1})
+	if d := c.retryDelay(); d != time.Minute {
+		t.Errorf("retryDelay = %v; want 1m", d)
+	}
+
+	// Until the delay is up, it doesn't try again.
+	if err := c.Connect(ctx); err == nil || !strings.Contains(err.Error(), "backing off") {
+		t.Fatalf("Connect while backing off = %v; want backing off error", err)
+	}
+	wantStats(ConnectStats{Attempts: 1, Failures: 1, BackedOff: 1})
+
+	// Each failure doubles the delay, up to Max.
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		clock.Advance(c.retryDelay())
+		if err := c.Connect(ctx); err == nil {
+			t.Fatal("Connect succeeded")
+		}
+		if d := c.retryDelay(); d != want {
+			t.Errorf("retryDelay = %v; want %v", d, want)
+		}
+	}
+	wantStats(ConnectStats{Attempts: 4, Failures: 4, BackedOff: 1})
+}
+
+func TestBackoffPolicyJitter(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := p.delay(3); d <= 2*time.Second || d > 4*time.Second {
+			t.Fatalf("delay(3) with jitter = %v; want in (2s, 4s]", d)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	if serveWebSocketFunc == nil {
+		t.Skip("WebSocket server not compiled in")
+	}
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	addr := strings.TrimPrefix(newTestServer(t, s), "http://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wc, _, err := websocket.Dial(ctx, "ws://"+addr, &websocket.DialOptions{
+		Subprotocols: []string{"derp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := wsconn.NetConn(ctx, wc, websocket.MessageBinary, addr)
+	defer nc.Close()
+
+	priv := key.NewNode()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	c, err := derp.NewClient(priv, nc, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(derp.ServerInfoMessage); !ok {
+		t.Fatalf("first message = %T; want ServerInfoMessage", m)
+	}
+	if got := s.ConnectedClients(); len(got) != 1 || got[0].Key != priv.Public() {
+		t.Fatalf("connected clients = %+v; want just %v", got, priv.Public())
+	}
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	if serveWebSocketFunc == nil || dialWebsocketFunc == nil {
+		t.Skip("WebSockets not compiled in")
+	}
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	// serve serves DERP behind a "middlebox" that handles DERP
+	// upgrades with blockUpgrade but lets WebSockets through.
+	serve := func(blockUpgrade http.HandlerFunc) string {
+		h := Handler(s)
+		httpsrv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.EqualFold(r.Header.Get("Upgrade"), "DERP") {
+					blockUpgrade(w, r)
+					return
+				}
+				h.ServeHTTP(w, r)
+			}),
+		}
+		ln, err := net.Listen("tcp4", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { httpsrv.Close() })
+		go httpsrv.Serve(ln)
+		return "http://" + ln.Addr().String()
+	}
+	// A middlebox that drops the connection gives no response.
+	dropURL := serve(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	// A server that refuses the client answers in HTTP.
+	refuseURL := serve(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+
+	var dials atomic.Int32
+	connect := func(t *testing.T, serverURL string, noFallback bool) (*Client, error) {
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.NoWebSocketFallback = noFallback
+		var d net.Dialer
+		c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return d.DialContext(ctx, network, addr)
+		})
+		dials.Store(0)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return c, c.Connect(ctx)
+	}
+
+	c, err := connect(t, dropURL, false)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	waitConnect(t, c)
+	if got := c.Transport(); got != derp.TransportWebSocket {
+		t.Errorf("Transport = %q; want %q", got, derp.TransportWebSocket)
+	}
+	// Both the upgrade and the WebSocket were dialed with the URL dialer.
+	if got := dials.Load(); got != 2 {
+		t.Errorf("URL dialer used %d times; want 2", got)
+	}
+
+	if _, err := connect(t, dropURL, true); err == nil {
+		t.Error("Connect with NoWebSocketFallback succeeded")
+	}
+
+	// A refusal isn't retried over a WebSocket.
+	if _, err := connect(t, refuseURL, false); err == nil {
+		t.Error("Connect to refusing server succeeded")
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("refused client dialed %d times; want 1", got)
+	}
+
+	// Without a middlebox, the upgrade is used.
+	c, err = connect(t, newTestServer(t, s), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Transport(); got != derp.TransportHTTP {
+		t.Errorf("Transport without middlebox = %q; want %q", got, derp.TransportHTTP)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	v4Header := func(src netip.AddrPort) []byte {
+		b := append([]byte(nil), proxyProtoSig...)
+		b = append(b, 0x21, 0x11, 0, 12) // v2 PROXY, TCP over IPv4, 12 bytes
+		a := src.Addr().As4()
+		b = append(b, a[:]...)
+		b = append(b, 127, 0, 0, 1)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		return binary.BigEndian.AppendUint16(b, 443)
+	}
+	src := netip.MustParseAddrPort("192.0.2.7:5678")
+
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		send       []byte
+		wantRemote string // or empty for the real peer address
+		wantData   []byte
+	}{
+		{
+			name:       "trusted_with_header",
+			trusted:    []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			send:       append(v4Header(src), "hello"...),
+			wantRemote: src.String(),
+			wantData:   []byte("hello"),
+		},
+		{
+			name:     "trusted_without_header",
+			trusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			send:     []byte("GET / HTTP/1.1\r\n"),
+			wantData: []byte("GET / HTTP/1.1\r\n"),
+		},
+		{
+			name:     "untrusted_with_header",
+			trusted:  []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			send:     append(v4Header(src), "hello"...),
+			wantData: append(v4Header(src), "hello"...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pln := NewProxyProtocolListener(ln, tt.trusted)
+			cc, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cc.Close()
+			if _, err := cc.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+			sc, err := pln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sc.Close()
+
+			want := tt.wantRemote
+			if want == "" {
+				want = cc.LocalAddr().String()
+			}
+			if got := sc.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr = %q; want %q", got, want)
+			}
+			got := make([]byte, len(tt.wantData))
+			if _, err := io.ReadFull(sc, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.wantData) {
+				t.Errorf("read %q; want %q", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestServeALPNAndTCP(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	hs := httptest.NewUnstartedServer(Handler(s))
+	hs.TLS = &tls.Config{NextProtos: []string{"http/1.1", ALPNProto}}
+	hs.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		ALPNProto: TLSNextProto(s),
+	}
+	hs.StartTLS()
+	defer hs.Close()
+
+	tcpLn, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	go ServeTCP(s, tcpLn)
+
+	// connect speaks DERP over nc as priv, checks it gets the
+	// server's info, and returns the client.
+	connect := func(priv key.NodePrivate, nc net.Conn) *derp.Client {
+		t.Helper()
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := derp.NewClient(priv, nc, brw, t.Logf)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		m, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if _, ok := m.(derp.ServerInfoMessage); !ok {
+			t.Fatalf("first Recv was unexpected type %T", m)
+		}
+		return c
+	}
+
+	tc, err := tls.Dial("tcp", hs.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ALPNProto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	if got := tc.ConnectionState().NegotiatedProtocol; got != ALPNProto {
+		t.Fatalf("negotiated protocol %q; want %q", got, ALPNProto)
+	}
+	tlsClient := connect(key.NewNode(), tc)
+
+	nc, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	tcpPriv := key.NewNode()
+	tcpClient := connect(tcpPriv, nc)
+
+	// Both listeners share one server, so clients of one can reach
+	// clients of the other.
+	msg := []byte("hello over tcp")
+	if err := tlsClient.Send(tcpPriv.Public(), msg); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := tcpClient.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if !bytes.Equal(p.Data, msg) {
+				t.Errorf("got %q; want %q", p.Data, msg)
+			}
+			break
+		}
+	}
+}
+
+func TestSourceIPLimitListener(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewSourceIPLimitListener(nil, SourceIPLimits{
+		MaxConns:       2,
+		ConnsPerSecond: 1,
+		ConnBurst:      3,
+		BlockFor:       time.Minute,
+		Exempt:         []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	l.now = func() time.Time { return now }
+
+	ip := netip.MustParseAddr("1.2.3.4")
+	other := netip.MustParseAddr("5.6.7.8")
+	check := func(what string, ip netip.Addr, want bool) {
+		t.Helper()
+		if got := l.admit(ip); got != want {
+			t.Errorf("%s: admit(%v) = %v; want %v", what, ip, got, want)
+		}
+	}
+
+	check("first", ip, true)
+	check("second", ip, true)
+	check("over max conns", ip, false)
+	l.release(ip)
+	check("over rate", ip, false)
+	check("other IP", other, true)
+
+	now = now.Add(30 * time.Second)
+	check("blocked", ip, false)
+	now = now.Add(31 * time.Second)
+	check("after block", ip, true)
+	check("back at max conns", ip, false)
+	if !l.isExempt(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("10.1.2.3 not exempt")
+	}
+
+	if got := l.numRejectsConns.Value(); got != 2 {
+		t.Errorf("max conns rejects = %d; want 2", got)
+	}
+	if got := l.numRejectsRate.Value(); got != 1 {
+		t.Errorf("rate rejects = %d; want 1", got)
+	}
+	if got := l.numRejectsBlocked.Value(); got != 1 {
+		t.Errorf("blocked rejects = %d; want 1", got)
+	}
+
+	// Once idle, IPs are forgotten.
+	l.release(ip)
+	l.release(ip)
+	l.release(other)
+	now = now.Add(2 * ipLimitIdle)
+	check("after idle", other, true)
+	if got := len(l.ips); got != 1 {
+		t.Errorf("tracking %d IPs; want 1", got)
+	}
+}
+
+func TestSourceIPLimitHandshakes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewSourceIPLimitListener(nil, SourceIPLimits{
+		HandshakesPerMinute: 2,
+		Exempt:              []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	l.now = func() time.Time { return now }
+	h := l.LimitHandshakes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(remoteAddr string, upgrade bool) int {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/derp", nil)
+		req.RemoteAddr = remoteAddr
+		if upgrade {
+			req.Header.Set("Upgrade", "DERP")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := do("1.2.3.4:1", true); code != http.StatusOK {
+			t.Fatalf("handshake %d: code = %d; want 200", i, code)
+		}
+	}
+	if code := do("1.2.3.4:1", true); code != http.StatusTooManyRequests {
+		t.Errorf("handshake over limit: code = %d; want 429", code)
+	}
+	if code := do("1.2.3.4:1", false); code != http.StatusOK {
+		t.Errorf("non-upgrade request: code = %d; want 200", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := do("10.1.2.3:1", true); code != http.StatusOK {
+			t.Errorf("exempt handshake %d: code = %d; want 200", i, code)
+		}
+	}
+	now = now.Add(time.Minute)
+	if code := do("1.2.3.4:1", true); code != http.StatusOK {
+		t.Errorf("handshake a minute later: code = %d; want 200", code)
+	}
+}
+
+func TestNewServerCertInfo(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "derp.example.com"},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := x509.ParseCertificate(derp.NewServer(key.NewNode(), t.Logf).MetaCert())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	info := newServerCertInfo(&tls.ConnectionState{
+		PeerCertificates:            []*x509.Certificate{leaf, meta},
+		SignedCertificateTimestamps: [][]byte{{1}, {2}},
+	}, now)
+	if len(info.Chain) != 1 {
+		t.Fatalf("chain has %d certs; want 1 without the meta cert", len(info.Chain))
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	want := ServerCert{
+		SPKIHash:  hex.EncodeToString(sum[:]),
+		Subject:   "CN=derp.example.com",
+		Issuer:    "CN=derp.example.com",
+		NotBefore: tmpl.NotBefore,
+		NotAfter:  notAfter,
+	}
+	if got := info.Chain[0]; got != want {
+		t.Errorf("cert = %+v; want %+v", got, want)
+	}
+	if info.SCTs != 2 || !info.Connected.Equal(now) {
+		t.Errorf("SCTs, Connected = %d, %v; want 2, %v", info.SCTs, info.Connected, now)
+	}
+}
+
+func TestCertPins(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ts := httptest.NewUnstartedServer(Handler(s))
+	ts.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	ts.StartTLS()
+	defer ts.Close()
+	sum := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"unpinned self-signed", nil, true},
+		{"pinned", []string{pin}, false},
+		{"pinned upper case", []string{strings.ToUpper(pin)}, false},
+		{"one of several pins", []string{strings.Repeat("0", 64), pin}, false},
+		{"wrong pin", []string{strings.Repeat("0", 64)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(key.NewNode(), ts.URL, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.CertPins = tt.pins
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = c.Connect(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Connect = %v; want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if info, ok := c.ServerCertInfo(); !ok || info.leafSPKIHash() != pin {
+					t.Errorf("ServerCertInfo = %+v, %v; want leaf %s", info, ok, pin)
+				}
+			}
+		})
+	}
+
+	// A DERPNode's pin adds to the Client's.
+	c := &Client{CertPins: []string{"a"}}
+	if got := c.certPins(&tailcfg.DERPNode{CertPin: "b"}); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("certPins = %q; want [a b]", got)
+	}
+	if got := c.CertPins; !slices.Equal(got, []string{"a"}) {
+		t.Errorf("CertPins modified to %q", got)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+
+	if got, want := happyEyeballsOrder(v4, v6, false), []netip.Addr{v4, v6}; !slices.Equal(got, want) {
+		t.Errorf("order without IPv6 preference = %v; want %v", got, want)
+	}
+	if got, want := happyEyeballsOrder(v4, v6, true), []netip.Addr{v6, v4}; !slices.Equal(got, want) {
+		t.Errorf("order with IPv6 preference = %v; want %v", got, want)
+	}
+	if got, want := happyEyeballsOrder(v4, netip.Addr{}, true), []netip.Addr{v4}; !slices.Equal(got, want) {
+		t.Errorf("order without IPv6 = %v; want %v", got, want)
+	}
+
+	c := &Client{clock: tstime.StdClock{}}
+	dialer := func(hang, fail string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			switch addr {
+			case hang:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case fail:
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		}
+	}
+	ips := []netip.Addr{v6, v4}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A hanging first attempt is overtaken by the second.
+	nc, err := c.dialHappyEyeballs(ctx, dialer("[2001:db8::1]:443", ""), ips, "443")
+	if err != nil {
+		t.Fatalf("with hanging IPv6: %v", err)
+	}
+	nc.Close()
+
+	// A failing first attempt starts the second straight away, without
+	// waiting for the (here, stopped) clock.
+	c.clock = tstest.NewClock(tstest.ClockOpts{})
+	nc, err = c.dialHappyEyeballs(ctx, dialer("", "[2001:db8::1]:443"), ips, "443")
+	if err != nil {
+		t.Fatalf("with failing IPv6: %v", err)
+	}
+	nc.Close()
+
+	// If everything fails, the first error is returned.
+	failAll := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("fail " + addr)
+	}
+	if _, err := c.dialHappyEyeballs(ctx, failAll, ips, "443"); err == nil || err.Error() != "fail [2001:db8::1]:443" {
+		t.Errorf("with everything failing, err = %v; want first error", err)
+	}
+}
+
+func TestFetchDERPMap(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "one", Nodes: []*tailcfg.DERPNode{{Name: "1a", RegionID: 1, HostName: "derp1.example.com"}}},
+			2: {RegionID: 2, RegionCode: "two", Nodes: []*tailcfg.DERPNode{{Name: "2a", RegionID: 2, HostName: "derp2.example.com"}}},
+		},
+	}
+	expires := time.Now().Add(time.Hour)
+	sign := func(serial int64, expires time.Time) []byte {
+		t.Helper()
+		b, err := SignDERPMap(dm, serial, expires, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	signed := sign(5, expires)
+	expired := sign(6, time.Now().Add(-time.Minute))
+	noExpiry := sign(6, time.Time{})
+	var sm SignedDERPMap
+	if err := json.Unmarshal(signed, &sm); err != nil {
+		t.Fatal(err)
+	}
+	sm.Payload = bytes.Replace(sm.Payload, []byte("derp1.example.com"), []byte("evil1.example.com"), 1)
+	tampered, err := json.Marshal(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed":
+			w.Write(signed)
+		case "/tampered":
+			w.Write(tampered)
+		case "/expired":
+			w.Write(expired)
+		case "/noexpiry":
+			w.Write(noExpiry)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+
+	p, err := FetchDERPMap(ctx, ts.Client(), ts.URL+"/signed", pub, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := p.DERPMap
+	if !reflect.DeepEqual(got, dm) {
+		t.Errorf("got %+v; want %+v", got, dm)
+	}
+	if p.Serial != 5 || !p.Expires.Equal(expires) {
+		t.Errorf("got serial %d, expiry %v; want 5, %v", p.Serial, p.Expires, expires)
+	}
+	for _, tt := range []struct {
+		name      string
+		path      string
+		pub       ed25519.PublicKey
+		minSerial int64
+	}{
+		{"tampered", "/tampered", pub, 0},
+		{"wrong key", "/signed", otherPub, 0},
+		{"not found", "/missing", pub, 0},
+		{"expired", "/expired", pub, 0},
+		{"no expiry", "/noexpiry", pub, 0},
+		{"older serial", "/signed", pub, 6},
+	} {
+		if _, err := FetchDERPMap(ctx, ts.Client(), ts.URL+tt.path, tt.pub, tt.minSerial); err == nil {
+			t.Errorf("%s: FetchDERPMap succeeded; want error", tt.name)
+		}
+	}
+
+	clients := NewRegionClients(key.NewNode(), t.Logf, nil, got)
+	if len(clients) != 2 {
+		t.Fatalf("got %d clients; want 2", len(clients))
+	}
+	for id, c := range clients {
+		if reg := c.getRegion(); reg.RegionID != id {
+			t.Errorf("client %d is for region %d", id, reg.RegionID)
+		}
+		c.Close()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	newClient := func(url string) *Client {
+		c, err := NewClient(key.NewNode(), url, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	alice, bob := newClient(serverURL), newClient(serverURL)
+	ctx := context.Background()
+	for _, c := range []*Client{alice, bob} {
+		if err := c.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+	}
+	if err := alice.Send(bob.privateKey.Public(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := bob.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(derp.ReceivedPacket); ok {
+			break
+		}
+	}
+
+	am, bm := alice.Metrics(), bob.Metrics()
+	if am.FramesSent != 1 || am.BytesSent != 5 || am.SendErrors != 0 {
+		t.Errorf("alice sent %d frames of %d bytes, %d errors; want 1, 5, 0", am.FramesSent, am.BytesSent, am.SendErrors)
+	}
+	if bm.FramesRecv < 2 || bm.BytesRecv != 5 {
+		t.Errorf("bob received %d frames of %d bytes; want at least 2 (with the server info), 5", bm.FramesRecv, bm.BytesRecv)
+	}
+	if am.Connect.Attempts != 1 || am.Reconnects != 0 || len(am.ConnectFailures) != 0 {
+		t.Errorf("alice connect metrics = %+v", am)
+	}
+
+	// Reconnecting counts as such.
+	alice.closeForReconnect(alice.client, nil)
+	if err := alice.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := alice.Metrics().Reconnects; got != 1 {
+		t.Errorf("Reconnects = %d; want 1", got)
+	}
+
+	// Failures are counted by stage.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "http://" + ln.Addr().String()
+	ln.Close()
+	dead := newClient(deadURL)
+	if err := dead.Connect(ctx); err == nil {
+		t.Fatal("Connect to closed port succeeded")
+	}
+	if got := dead.Metrics().ConnectFailures; !reflect.DeepEqual(got, map[string]int64{ConnectFailDial: 1}) {
+		t.Errorf("ConnectFailures = %v; want 1 dial failure", got)
+	}
+}
+
+// newTestNode returns a DERP node served by s over TLS with a
+// self-signed certificate, along with its /derp/probe endpoint.
+func newTestNode(t *testing.T, s *derp.Server, name string) *tailcfg.DERPNode {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/derp", Handler(s))
+	mux.HandleFunc("/derp/probe", ProbeHandler)
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	ap := netip.MustParseAddrPort(ts.Listener.Addr().String())
+	return &tailcfg.DERPNode{
+		Name:             name,
+		RegionID:         1,
+		HostName:         "localhost",
+		IPv4:             ap.Addr().String(),
+		IPv6:             "none",
+		DERPPort:         int(ap.Port()),
+		InsecureForTests: true,
+	}
+}
+
+func TestRegionFailoverClient(t *testing.T) {
+	s1 := derp.NewServer(key.NewNode(), t.Logf)
+	defer s1.Close()
+	s2 := derp.NewServer(key.NewNode(), t.Logf)
+	defer s2.Close()
+	n1, n2 := newTestNode(t, s1, "1a"), newTestNode(t, s2, "1b")
+	reg := &tailcfg.DERPRegion{RegionID: 1, Nodes: []*tailcfg.DERPNode{n1, n2}}
+
+	bobKey := key.NewNode()
+	rc, err := NewRegionFailoverClient(bobKey, t.Logf, nil, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rc.HealthCheckInterval = 20 * time.Millisecond
+	changes := make(chan string, 10)
+	rc.OnActiveNodeChange = func(n *tailcfg.DERPNode) { changes <- n.Name }
+	if got := rc.ActiveNode().Name; got != "1a" {
+		t.Fatalf("active node = %s; want 1a", got)
+	}
+
+	packets := make(chan string, 10)
+	go func() {
+		for {
+			m, err := rc.Recv()
+			if errors.Is(err, ErrClientClosed) {
+				return
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				packets <- string(p.Data)
+			}
+		}
+	}()
+
+	// sendUntilReceived sends msg to bob through node n until bob
+	// receives it, as bob may not have connected yet.
+	sendUntilReceived := func(n *tailcfg.DERPNode, msg string) {
+		t.Helper()
+		alice := NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return nodeRegion(n) })
+		defer alice.Close()
+		timeout := time.After(10 * time.Second)
+		for {
+			if err := alice.Send(bobKey.Public(), []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-packets:
+				if got != msg {
+					t.Fatalf("got packet %q; want %q", got, msg)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			case <-timeout:
+				t.Fatalf("%q not received", msg)
+			}
+		}
+	}
+	sendUntilReceived(n1, "via 1a")
+
+	// Health checks of the inactive node don't connect to it as a
+	// DERP client.
+	time.Sleep(100 * time.Millisecond)
+	if got := s2.ConnectedClients(); len(got) != 0 {
+		t.Fatalf("inactive node has %d clients connected; want 0", len(got))
+	}
+
+	// Losing the active node fails over to the other.
+	s1.Close()
+	select {
+	case got := <-changes:
+		if got != "1b" {
+			t.Fatalf("failed over to %s; want 1b", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no failover")
+	}
+	sendUntilReceived(n2, "via 1b")
+
+	// With no healthy node left, sends fail.
+	s2.Close()
+	for rc.Send(key.NewNode().Public(), []byte("x")) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	newClient := func() (*Client, chan error) {
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.KeepAliveIdle = 20 * time.Millisecond
+		c.KeepAliveMissed = 2
+		lost := make(chan error, 10)
+		c.OnConnectionStateChange = func(st ConnState, err error) {
+			if st == StateReconnecting && err != nil {
+				lost <- err
+			}
+		}
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return c, lost
+	}
+
+	// While pongs are received, the connection is kept.
+	alive, aliveLost := newClient()
+	go func() {
+		for {
+			if _, err := alive.Recv(); errors.Is(err, ErrClientClosed) {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-aliveLost:
+		t.Fatalf("connection with keepalive replies lost: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Without anything received, such as when nothing reads replies
+	// here, the connection is closed.
+	_, deadLost := newClient()
+	select {
+	case err := <-deadLost:
+		if !errors.Is(err, errKeepAliveTimeout) {
+			t.Fatalf("connection lost with %v; want %v", err, errKeepAliveTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection without keepalive replies not closed")
+	}
+}
+
+func TestPingPayload(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	serverURL := newTestServer(t, s)
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	payload := derp.PingMessage{1, 2, 3, 4, 5, 6, 7, 8}
+	rtt, err := c.PingPayload(ctx, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Errorf("rtt = %v; want positive", rtt)
+	}
+
+	// A payload already awaiting a reply can't be reused.
+	if !c.registerPing(payload, make(chan bool, 1)) {
+		t.Fatal("registerPing of finished ping's payload failed")
+	}
+	if _, err := c.PingPayload(ctx, payload); err == nil {
+		t.Error("PingPayload with in-flight payload succeeded")
+	}
+	c.unregisterPing(payload)
+	if _, err := c.PingPayload(ctx, payload); err != nil {
+		t.Errorf("PingPayload after reply: %v", err)
+	}
+}
+
+func TestUpgradeAuthorizer(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetUpgradeAuthorizer(BearerTokenAuthorizer("secret"))
+	serverURL := newTestServer(t, s)
+
+	connect := func(h http.Header) error {
+		c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Header = h
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return c.Connect(ctx)
+	}
+	if err := connect(nil); err == nil {
+		t.Error("Connect without token succeeded")
+	}
+	if err := connect(http.Header{"Authorization": {"Bearer wrong"}}); err == nil {
+		t.Error("Connect with wrong token succeeded")
+	}
+	if err := connect(http.Header{"Authorization": {"Bearer secret"}}); err != nil {
+		t.Errorf("Connect with token: %v", err)
+	}
+}
+
+func TestConnectTimeouts(t *testing.T) {
+	// A listener that accepts connections but never says anything,
+	// like a broken middlebox.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tests := []struct {
+		name      string
+		url       string
+		stallDial bool
+		wantStage string
+	}{
+		{"dial", "http://" + ln.Addr().String(), true, ConnectFailDial},
+		{"tls", "https://" + ln.Addr().String(), false, ConnectFailTLS},
+		{"upgrade", "http://" + ln.Addr().String(), false, ConnectFailUpgrade},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(key.NewNode(), tt.url, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.DialTimeout = 100 * time.Millisecond
+			c.TLSHandshakeTimeout = 100 * time.Millisecond
+			c.HandshakeTimeout = 100 * time.Millisecond
+			c.NoWebSocketFallback = true
+			if tt.stallDial {
+				c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = c.Connect(ctx)
+			var te *ConnectTimeoutError
+			if !errors.As(err, &te) {
+				t.Fatalf("Connect error = %v; want a ConnectTimeoutError", err)
+			}
+			if te.Stage != tt.wantStage || te.Timeout != 100*time.Millisecond {
+				t.Errorf("timed out at %q after %v; want %q after 100ms", te.Stage, te.Timeout, tt.wantStage)
+			}
+			if got := c.Metrics().ConnectFailures[tt.wantStage]; got != 1 {
+				t.Errorf("ConnectFailures[%q] = %d; want 1", tt.wantStage, got)
+			}
+		})
+	}
+}
+
+func TestH2Connect(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ts := httptest.NewUnstartedServer(Handler(s))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	ap := netip.MustParseAddrPort(ts.Listener.Addr().String())
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         1,
+		HostName:         "localhost",
+		IPv4:             ap.Addr().String(),
+		IPv6:             "none",
+		DERPPort:         int(ap.Port()),
+		InsecureForTests: true,
+	}
+	reg := nodeRegion(node)
+
+	newClient := func() *Client {
+		c := NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return reg })
+		c.H2Connect = true
+		t.Cleanup(func() { c.Close() })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Transport(); got != derp.TransportH2Connect {
+			t.Errorf("Transport = %q; want %q", got, derp.TransportH2Connect)
+		}
+		return c
+	}
+	a, b := newClient(), newClient()
+	waitConnect(t, a)
+	waitConnect(t, b)
+
+	msg := []byte("hello over h2")
+	if err := a.Send(b.SelfPublicKey(), msg); err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.(derp.ReceivedPacket); !ok || !bytes.Equal(p.Data, msg) || p.Source != a.SelfPublicKey() {
+		t.Fatalf("b received %#v; want packet %q from a", m, msg)
+	}
+}
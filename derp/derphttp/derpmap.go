@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// A DERP map can be fetched from a URL, such as to bootstrap nodes
+// that don't use a control server to learn their relays. It's served
+// as a SignedDERPMap, so that it needn't be trusted merely because of
+// where it came from. The signature covers the map's serial number and
+// expiry too, so that a map can't be replayed once it's expired or been
+// superseded.
+
+// maxSignedDERPMapSize is the largest SignedDERPMap that FetchDERPMap
+// reads.
+const maxSignedDERPMapSize = 4 << 20
+
+// SignedDERPMap is a DERP map signed by its publisher, in the form
+// served to FetchDERPMap.
+type SignedDERPMap struct {
+	// Payload is the JSON encoding of a DERPMapPayload, exactly as
+	// signed.
+	Payload json.RawMessage
+
+	// Signature is the ed25519 signature of Payload.
+	Signature []byte
+}
+
+// DERPMapPayload is the signed contents of a SignedDERPMap.
+type DERPMapPayload struct {
+	DERPMap *tailcfg.DERPMap
+
+	// Serial is the map's serial number, which the publisher
+	// increases with each map it signs, so that clients can reject
+	// maps older than one they already have.
+	Serial int64
+
+	// Expires is when the map stops being valid. Maps without an
+	// expiry are rejected.
+	Expires time.Time
+}
+
+// SignDERPMap returns the JSON encoding of the SignedDERPMap of dm,
+// with the given serial number and expiry, signed with priv, for
+// serving to FetchDERPMap.
+func SignDERPMap(dm *tailcfg.DERPMap, serial int64, expires time.Time, priv ed25519.PrivateKey) ([]byte, error) {
+	b, err := json.Marshal(DERPMapPayload{
+		DERPMap: dm,
+		Serial:  serial,
+		Expires: expires,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(SignedDERPMap{
+		Payload:   b,
+		Signature: ed25519.Sign(priv, b),
+	})
+}
+
+// FetchDERPMap fetches the SignedDERPMap at url, normally an HTTPS
+// URL, and returns its payload if it's signed by pub, hasn't expired,
+// and its serial number is at least minSerial. Callers that keep the
+// map should pass the serial of the last one they accepted. If hc is
+// nil, an HTTP client that verifies TLS certificates as for DERP
+// servers is used.
+func FetchDERPMap(ctx context.Context, hc *http.Client, url string, pub ed25519.PublicKey, minSerial int64) (*DERPMapPayload, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid DERP map public key")
+	}
+	if hc == nil {
+		hc = &http.Client{Transport: tlsdial.NewTransport()}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching DERP map: %v", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxSignedDERPMapSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching DERP map: %w", err)
+	}
+	if len(b) > maxSignedDERPMapSize {
+		return nil, errors.New("DERP map too large")
+	}
+	return ParseSignedDERPMap(b, pub, time.Now(), minSerial)
+}
+
+// ParseSignedDERPMap returns the payload of the JSON encoding of the
+// SignedDERPMap b, if it's signed by pub, hasn't expired as of now,
+// and its serial number is at least minSerial.
+func ParseSignedDERPMap(b []byte, pub ed25519.PublicKey, now time.Time, minSerial int64) (*DERPMapPayload, error) {
+	var sm SignedDERPMap
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return nil, fmt.Errorf("parsing signed DERP map: %w", err)
+	}
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, sm.Payload, sm.Signature) {
+		return nil, errors.New("DERP map signature invalid")
+	}
+	p := new(DERPMapPayload)
+	if err := json.Unmarshal(sm.Payload, p); err != nil {
+		return nil, fmt.Errorf("parsing DERP map: %w", err)
+	}
+	if p.Expires.IsZero() {
+		return nil, errors.New("DERP map has no expiry")
+	}
+	if !now.Before(p.Expires) {
+		return nil, fmt.Errorf("DERP map expired at %v", p.Expires)
+	}
+	if p.Serial < minSerial {
+		return nil, fmt.Errorf("DERP map serial %d older than %d", p.Serial, minSerial)
+	}
+	if p.DERPMap == nil {
+		return nil, errors.New("DERP map missing")
+	}
+	for id, reg := range p.DERPMap.Regions {
+		if reg == nil || reg.RegionID != id {
+			return nil, fmt.Errorf("DERP map region %d invalid", id)
+		}
+	}
+	return p, nil
+}
+
+// NewRegionClients returns a Client, made with NewRegionClient, for
+// each region of dm, keyed by region ID.
+func NewRegionClients(privateKey key.NodePrivate, logf logger.Logf, netMon *netmon.Monitor, dm *tailcfg.DERPMap) map[int]*Client {
+	ret := make(map[int]*Client, len(dm.Regions))
+	for id, reg := range dm.Regions {
+		reg := reg
+		ret[id] = NewRegionClient(privateKey, logf, netMon, func() *tailcfg.DERPRegion { return reg })
+	}
+	return ret
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
+)
+
+var counterH2ConnectAccepts = expvar.NewInt("derp_h2connect_accepts")
+
+// h2RoundTrip, if non-nil, sends req on a new HTTP/2 client connection
+// over tlsConn and returns the response. See RegisterH2Connect.
+var h2RoundTrip func(tlsConn *tls.Conn, req *http.Request) (*http.Response, error)
+
+// RegisterH2Connect lets the conditionally linked derp/derph2 package
+// register its HTTP/2 client, which Client.H2Connect requires, so that
+// programs that don't use it, such as the CLI, don't link one.
+func RegisterH2Connect(roundTrip func(tlsConn *tls.Conn, req *http.Request) (*http.Response, error)) {
+	h2RoundTrip = roundTrip
+}
+
+// isH2ConnectRequest reports whether r is a request to tunnel DERP
+// through HTTP/2 CONNECT. See Client.H2Connect.
+func isH2ConnectRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor == 2
+}
+
+// serveH2Connect accepts the HTTP/2 CONNECT request r and serves DERP
+// over its tunnel: the request body carries the client's side of the
+// DERP byte stream and the response body the server's.
+func serveH2Connect(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// Like Hijack does for the HTTP upgrade, clear the http.Server's
+	// deadlines for the stream; the DERP server manages its own.
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		http.Error(w, "HTTP/2 CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Derp-Version", fmt.Sprint(derp.ProtocolVersion))
+	w.Header().Set("Derp-Public-Key", s.PublicKey().UntypedHexString())
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	counterH2ConnectAccepts.Add(1)
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	ap, _ := netip.ParseAddrPort(r.RemoteAddr)
+	conn := &h2TunnelConn{
+		r:                r.Body,
+		w:                w,
+		flush:            rc.Flush,
+		closeFn:          r.Body.Close,
+		setReadDeadline:  rc.SetReadDeadline,
+		setWriteDeadline: rc.SetWriteDeadline,
+		local:            local,
+		remote:           net.TCPAddrFromAddrPort(ap),
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	s.Accept(acceptContext(r, derp.TransportH2Connect), conn, brw, r.RemoteAddr)
+}
+
+// h2Connect opens a tunnel for DERP to the server with an HTTP/2
+// CONNECT request over conn, a TLS connection to it that must have
+// negotiated HTTP/2, and returns the tunnel.
+//
+// The request isn't bound to a context, as the tunnel outlives the
+// connecting, so the caller must bound it with a deadline on conn.
+func (c *Client) h2Connect(conn net.Conn, node *tailcfg.DERPNode) (net.Conn, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("HTTP/2 CONNECT requires TLS")
+	}
+	if h2RoundTrip == nil {
+		return nil, errors.New("HTTP/2 CONNECT requires the derp/derph2 package")
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		return nil, fmt.Errorf("server didn't negotiate HTTP/2 (ALPN %q)", p)
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("CONNECT", c.urlString(node), pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.agentHeader(req.Header)
+	resp, err := h2RoundTrip(tlsConn, req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("CONNECT failed: %v: %s", resp.Status, b)
+	}
+	return &h2TunnelConn{
+		r: resp.Body,
+		w: pw,
+		closeFn: func() error {
+			pw.Close()
+			resp.Body.Close()
+			return tlsConn.Close()
+		},
+		// Only the one stream uses the connection, so its deadlines
+		// can stand in for the stream's.
+		setReadDeadline:  tlsConn.SetReadDeadline,
+		setWriteDeadline: tlsConn.SetWriteDeadline,
+		local:            tlsConn.LocalAddr(),
+		remote:           tlsConn.RemoteAddr(),
+	}, nil
+}
+
+// h2TunnelConn is a net.Conn over an HTTP/2 CONNECT tunnel, reading
+// from the peer's stream and writing to ours.
+type h2TunnelConn struct {
+	r     io.ReadCloser
+	w     io.Writer
+	flush func() error // if non-nil, called after each write
+
+	closeFn                           func() error
+	setReadDeadline, setWriteDeadline func(time.Time) error
+	local, remote                     net.Addr
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    atomic.Bool
+}
+
+func (c *h2TunnelConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *h2TunnelConn) Write(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(p)
+	if err == nil && c.flush != nil {
+		err = c.flush()
+	}
+	return n, err
+}
+
+func (c *h2TunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		c.closeErr = c.closeFn()
+	})
+	return c.closeErr
+}
+
+func (c *h2TunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *h2TunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2TunnelConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.setReadDeadline(t), c.setWriteDeadline(t))
+}
+
+func (c *h2TunnelConn) SetReadDeadline(t time.Time) error  { return c.setReadDeadline(t) }
+func (c *h2TunnelConn) SetWriteDeadline(t time.Time) error { return c.setWriteDeadline(t) }
@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// happyEyeballsDelay is how long dialHappyEyeballs waits for a
+// connection attempt before starting the next one, per RFC 8305's
+// recommended Connection Attempt Delay.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialHappyEyeballs connects to port on one of ips, in the manner of
+// RFC 8305: it dials them in order, starting each attempt
+// happyEyeballsDelay after the previous one, or as soon as it fails,
+// and returns the first connection made, closing any others. If all
+// attempts fail, it returns the first error.
+func (c *Client) dialHappyEyeballs(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), ips []netip.Addr, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("no IPs to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		c   net.Conn
+		err error
+	}
+	resc := make(chan res) // must be unbuffered
+	start := func(ip netip.Addr) {
+		go func() {
+			c, err := dial(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			select {
+			case resc <- res{c, err}:
+			case <-ctx.Done():
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+
+	start(ips[0])
+	next, nwait := 1, 1
+	t, timerC := c.clock.NewTimer(happyEyeballsDelay)
+	defer func() { t.Stop() }()
+	var firstErr error
+	for {
+		select {
+		case r := <-resc:
+			nwait--
+			if r.err == nil {
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if nwait == 0 && next == len(ips) {
+				return nil, firstErr
+			}
+		case <-timerC:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if next == len(ips) {
+			timerC = nil // nothing left to start
+			continue
+		}
+		start(ips[next])
+		next++
+		nwait++
+		t.Stop()
+		t, timerC = c.clock.NewTimer(happyEyeballsDelay)
+	}
+}
+
+// happyEyeballsOrder returns the IPv4 address ip4 and IPv6 address ip6,
+// whichever are valid, in the order to dial them: IPv6 first if it's
+// preferred, and otherwise IPv4 first.
+func happyEyeballsOrder(ip4, ip6 netip.Addr, preferIPv6 bool) []netip.Addr {
+	var ips []netip.Addr
+	if preferIPv6 && ip6.IsValid() {
+		ips = append(ips, ip6)
+	}
+	if ip4.IsValid() {
+		ips = append(ips, ip4)
+	}
+	if !preferIPv6 && ip6.IsValid() {
+		ips = append(ips, ip6)
+	}
+	return ips
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/metrics"
+)
+
+// ipLimitIdle is how long a source IP with no open connections is
+// remembered, so that its connection rate limit carries over between
+// short-lived connections.
+const ipLimitIdle = time.Minute
+
+// SourceIPLimits are the limits a listener from
+// NewSourceIPLimitListener applies to each source IP. Zero values
+// mean no limit.
+type SourceIPLimits struct {
+	// MaxConns is the most connections from one IP that may be open
+	// at once.
+	MaxConns int
+
+	// ConnsPerSecond and ConnBurst limit how fast new connections
+	// (and so TLS and DERP handshakes) from one IP are accepted.
+	ConnsPerSecond float64
+	ConnBurst      int
+
+	// BlockFor is how long all connections from an IP are refused
+	// after it exceeds ConnsPerSecond, such as in a SYN burst. If
+	// zero, only the excess connections are refused.
+	BlockFor time.Duration
+
+	// HandshakesPerMinute is how many DERP connections one IP may
+	// start per minute over HTTP, in bursts of up to that many. It's
+	// enforced by the handler from LimitHandshakes rather than by
+	// the listener, as one connection may carry many requests.
+	HandshakesPerMinute int
+
+	// Exempt are addresses to which no limits apply, such as load
+	// balancers or mesh peers.
+	Exempt []netip.Prefix
+}
+
+// SourceIPLimitListener is a net.Listener that enforces
+// SourceIPLimits. Connections over the limits are closed as soon as
+// they're accepted, rather than left pending, so they don't pile up in
+// the kernel and their clients find out promptly.
+type SourceIPLimitListener struct {
+	// These are at the start of the struct to ensure 64-bit
+	// alignment on 32-bit architectures.
+	numAccepts        expvar.Int
+	numRejectsConns   expvar.Int // over MaxConns
+	numRejectsRate    expvar.Int // over ConnsPerSecond
+	numRejectsBlocked expvar.Int // from a blocked IP
+	numBlocks         expvar.Int // times an IP was blocked
+	numRejectsShakes  expvar.Int // DERP upgrades over HandshakesPerMinute
+
+	net.Listener
+	lim SourceIPLimits
+	now func() time.Time // or nil for time.Now
+
+	mu        sync.Mutex
+	ips       map[netip.Addr]*ipLimitState
+	lastSweep time.Time
+}
+
+type ipLimitState struct {
+	conns        int
+	rate         *rate.Limiter // or nil
+	handshakes   *rate.Limiter // or nil
+	blockedUntil time.Time
+	lastActive   time.Time
+}
+
+// NewSourceIPLimitListener returns a listener that accepts connections
+// from ln, subject to lim per source IP.
+func NewSourceIPLimitListener(ln net.Listener, lim SourceIPLimits) *SourceIPLimitListener {
+	return &SourceIPLimitListener{
+		Listener: ln,
+		lim:      lim,
+		ips:      map[netip.Addr]*ipLimitState{},
+	}
+}
+
+// ExpVar returns the listener's metrics.
+func (l *SourceIPLimitListener) ExpVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("counter_accepted_connections", &l.numAccepts)
+	m.Set("counter_rejected_connections_max_conns", &l.numRejectsConns)
+	m.Set("counter_rejected_connections_rate", &l.numRejectsRate)
+	m.Set("counter_rejected_connections_blocked", &l.numRejectsBlocked)
+	m.Set("counter_blocked_ips", &l.numBlocks)
+	m.Set("counter_rejected_handshakes", &l.numRejectsShakes)
+	m.Set("gauge_tracked_ips", expvar.Func(func() any {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.ips)
+	}))
+	return m
+}
+
+func (l *SourceIPLimitListener) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Accept waits for and returns the next connection within the limits,
+// closing any over them.
+func (l *SourceIPLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ap, err := netip.ParseAddrPort(c.RemoteAddr().String())
+		if err != nil {
+			l.numAccepts.Add(1)
+			return c, nil
+		}
+		ip := ap.Addr().Unmap()
+		if l.isExempt(ip) {
+			l.numAccepts.Add(1)
+			return c, nil
+		}
+		if !l.admit(ip) {
+			c.Close()
+			continue
+		}
+		l.numAccepts.Add(1)
+		return &ipLimitConn{Conn: c, l: l, ip: ip}, nil
+	}
+}
+
+func (l *SourceIPLimitListener) isExempt(ip netip.Addr) bool {
+	for _, p := range l.lim.Exempt {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit reports whether a new connection from ip is within the limits,
+// counting it if so.
+func (l *SourceIPLimitListener) admit(ip netip.Addr) bool {
+	now := l.timeNow()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweepLocked(now)
+
+	st := l.stateLocked(ip)
+	st.lastActive = now
+	if now.Before(st.blockedUntil) {
+		l.numRejectsBlocked.Add(1)
+		return false
+	}
+	if st.rate != nil && !st.rate.AllowN(now, 1) {
+		l.numRejectsRate.Add(1)
+		if l.lim.BlockFor > 0 {
+			st.blockedUntil = now.Add(l.lim.BlockFor)
+			l.numBlocks.Add(1)
+		}
+		return false
+	}
+	if l.lim.MaxConns > 0 && st.conns >= l.lim.MaxConns {
+		l.numRejectsConns.Add(1)
+		return false
+	}
+	st.conns++
+	return true
+}
+
+// stateLocked returns ip's state, tracking it if it's not already.
+// l.mu must be held.
+func (l *SourceIPLimitListener) stateLocked(ip netip.Addr) *ipLimitState {
+	if st, ok := l.ips[ip]; ok {
+		return st
+	}
+	st := &ipLimitState{}
+	if l.lim.ConnsPerSecond > 0 {
+		burst := l.lim.ConnBurst
+		if burst < 1 {
+			burst = 1
+		}
+		st.rate = rate.NewLimiter(rate.Limit(l.lim.ConnsPerSecond), burst)
+	}
+	if n := l.lim.HandshakesPerMinute; n > 0 {
+		st.handshakes = rate.NewLimiter(rate.Limit(float64(n)/60), n)
+	}
+	l.ips[ip] = st
+	return st
+}
+
+// LimitHandshakes returns a handler that serves requests with h,
+// except that it refuses DERP connection upgrades and HTTP/2 CONNECT
+// requests from source IPs over l's HandshakesPerMinute with status
+// 429 (Too Many Requests). Requests' source IPs are those of their
+// RemoteAddr, so are those of the clients behind any trusted proxy.
+func (l *SourceIPLimitListener) LimitHandshakes(h http.Handler) http.Handler {
+	if l.lim.HandshakesPerMinute <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Header.Get("Upgrade") != "" || r.Method == http.MethodConnect) && !l.allowHandshake(r.RemoteAddr) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, fmt.Sprintf("too many connections started to this DERP server from your IP; limit %d per minute", l.lim.HandshakesPerMinute), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowHandshake reports whether a DERP connection from remoteAddr's
+// IP is within HandshakesPerMinute, counting it if so.
+func (l *SourceIPLimitListener) allowHandshake(remoteAddr string) bool {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return true
+	}
+	ip := ap.Addr().Unmap()
+	if l.isExempt(ip) {
+		return true
+	}
+	now := l.timeNow()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweepLocked(now)
+	st := l.stateLocked(ip)
+	st.lastActive = now
+	if !st.handshakes.AllowN(now, 1) {
+		l.numRejectsShakes.Add(1)
+		return false
+	}
+	return true
+}
+
+// sweepLocked forgets source IPs with no open connections that haven't
+// been active or blocked recently. l.mu must be held.
+func (l *SourceIPLimitListener) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < ipLimitIdle {
+		return
+	}
+	l.lastSweep = now
+	for ip, st := range l.ips {
+		if st.conns == 0 && now.Sub(st.lastActive) > ipLimitIdle && now.After(st.blockedUntil) {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+func (l *SourceIPLimitListener) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.ips[ip]; ok {
+		st.conns--
+		st.lastActive = l.timeNow()
+	}
+}
+
+// ipLimitConn is a connection counted against its source IP's
+// MaxConns until it's closed.
+type ipLimitConn struct {
+	net.Conn
+	l         *SourceIPLimitListener
+	ip        netip.Addr
+	closeOnce sync.Once
+}
+
+func (c *ipLimitConn) Close() error {
+	c.closeOnce.Do(func() { c.l.release(c.ip) })
+	return c.Conn.Close()
+}
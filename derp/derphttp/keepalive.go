@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/util/cmpx"
+)
+
+var errKeepAliveTimeout = errors.New("derphttp.Client: server didn't reply to keepalive pings")
+
+// noteRecv records that something was received from the server, for
+// keepalives.
+func (c *Client) noteRecv() {
+	if c.KeepAliveIdle > 0 {
+		c.lastRecv.Store(c.clock.Now().UnixNano())
+	}
+}
+
+// keepAlive pings the server over client's connection whenever it's
+// been KeepAliveIdle since anything was received, and closes the
+// connection after KeepAliveMissed pings in a row go unanswered. It
+// returns when the connection is replaced or closed.
+func (c *Client) keepAlive(client *derp.Client) {
+	idle := c.KeepAliveIdle
+	maxMissed := cmpx.Or(c.KeepAliveMissed, 3)
+	t, tc := c.clock.NewTicker(idle)
+	defer t.Stop()
+
+	var (
+		missed   int
+		lastPing time.Time
+		data     derp.PingMessage // of the last ping, if any
+	)
+	defer func() {
+		if missed > 0 {
+			c.unregisterPing(data)
+		}
+	}()
+	for {
+		select {
+		case <-tc:
+		case <-c.ctx.Done():
+			return
+		}
+		c.mu.Lock()
+		current := c.client == client
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+
+		now := c.clock.Now()
+		lastRecv := time.Unix(0, c.lastRecv.Load())
+		if missed > 0 && lastRecv.After(lastPing) {
+			c.unregisterPing(data)
+			missed = 0
+		}
+		if now.Sub(lastRecv) < idle {
+			continue
+		}
+		if missed >= maxMissed {
+			c.logf("derphttp: no reply to %d keepalive pings; closing connection", missed)
+			c.closeForReconnect(client, errKeepAliveTimeout)
+			return
+		}
+		if missed > 0 {
+			c.unregisterPing(data)
+		}
+		rand.Read(data[:])
+		// Register the ping so that its pong, which noteRecv counts,
+		// isn't returned by Recv.
+		c.registerPing(data, make(chan bool, 1))
+		if err := client.SendPing(data); err != nil {
+			c.closeForReconnect(client, err)
+			return
+		}
+		lastPing = now
+		missed++
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sort"
+	"time"
+
+	"tailscale.com/derp"
+)
+
+// LatencyStats are the round-trip times of pings to a DERP server, as
+// reported by Client.MeasureLatency.
+type LatencyStats struct {
+	Sent     int // pings sent
+	Received int // pongs received
+
+	// Min, Avg and P95 are the minimum, mean and 95th percentile
+	// round-trip times of the pings that were answered, or zero if
+	// none were.
+	Min, Avg, P95 time.Duration
+
+	// Loss is the fraction of pings that went unanswered, from 0 to 1.
+	Loss float64
+}
+
+// MeasureLatency connects to the server, if not already connected, and
+// sends it n pings, one after another, reporting their round-trip
+// times and how many went unanswered within 5 seconds, such as to rank
+// relays. It returns an error if a ping can't be sent or ctx is done
+// first.
+//
+// Like Ping, another goroutine must be in a loop calling Recv or
+// RecvDetail or ping responses won't be handled.
+func (c *Client) MeasureLatency(ctx context.Context, n int) (LatencyStats, error) {
+	var st LatencyStats
+	if n <= 0 {
+		return st, errors.New("MeasureLatency: no pings to send")
+	}
+	if _, _, err := c.connect(ctx, "derphttp.Client.MeasureLatency"); err != nil {
+		return st, err
+	}
+	rtts := make([]time.Duration, 0, n)
+	for i := 0; i < n; i++ {
+		var data derp.PingMessage
+		rand.Read(data[:])
+		rtt, err := c.PingPayload(ctx, data)
+		st.Sent++
+		if err != nil {
+			if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+				return st, err
+			}
+			continue // lost
+		}
+		rtts = append(rtts, rtt)
+	}
+	st.Received = len(rtts)
+	st.Loss = float64(st.Sent-st.Received) / float64(st.Sent)
+	if len(rtts) == 0 {
+		return st, nil
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	var sum time.Duration
+	for _, d := range rtts {
+		sum += d
+	}
+	st.Min = rtts[0]
+	st.Avg = sum / time.Duration(len(rtts))
+	st.P95 = rtts[(len(rtts)*95+99)/100-1]
+	return st, nil
+}
@@ -20,6 +20,9 @@
 // If the server's public key is ignoreServerKey, RunWatchConnectionLoop returns.
 //
 // Otherwise, the add and remove funcs are called as clients come & go.
+// If the server sends periodic snapshots of its clients (see
+// derp.Server.SetWatcherSnapshotInterval), they're also called for any
+// clients whose coming or going was missed.
 //
 // infoLogf, if non-nil, is the logger to write periodic status
 // updates about how many peers are on the server. Error log output is
@@ -32,7 +35,13 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 		infoLogf = logger.Discard
 	}
 	logf := c.logf
-	const retryInterval = 5 * time.Second
+
+	// Ask for the initial set of connected peers in batches, and
+	// for periodic snapshots, on connections made from here on.
+	c.mu.Lock()
+	c.watchBatch = true
+	c.mu.Unlock()
+
 	const statusInterval = 10 * time.Second
 	var (
 		mu              sync.Mutex
@@ -91,6 +100,37 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 		}
 	}
 
+	// resync corrects present to match peers, a complete snapshot.
+	resync := func(peers []derp.PeerPresentMessage) {
+		inSnapshot := make(map[key.NodePublic]bool, len(peers))
+		var added []derp.PeerPresentMessage
+		var gone []key.NodePublic
+		mu.Lock()
+		for _, p := range peers {
+			inSnapshot[p.Key] = true
+			if !present[p.Key] {
+				added = append(added, p)
+			}
+		}
+		for k := range present {
+			if !inSnapshot[k] {
+				gone = append(gone, k)
+			}
+		}
+		mu.Unlock()
+		if len(added) > 0 || len(gone) > 0 {
+			logf("resync: %d peers missed as present, %d as gone", len(added), len(gone))
+		}
+		for _, p := range added {
+			updatePeer(p.Key, p.IPPort, true)
+		}
+		for _, k := range gone {
+			updatePeer(k, netip.AddrPort{}, false)
+		}
+	}
+	var snapshot []derp.PeerPresentMessage // parts of a snapshot received so far
+	snapshotNext := 0                      // next part of snapshot expected
+
 	sleep := func(d time.Duration) {
 		t, tChannel := c.clock.NewTimer(d)
 		select {
@@ -103,12 +143,16 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 	for ctx.Err() == nil {
 		err := c.WatchConnectionChanges()
 		if err != nil {
+			c.watching.Store(false)
 			clear()
 			logf("WatchConnectionChanges: %v", err)
-			sleep(retryInterval)
+			sleep(c.retryDelay())
 			continue
 		}
 
+		// Meshing with ourselves counts as established too, as
+		// there's nothing more to do.
+		c.watching.Store(true)
 		if c.ServerPublicKey() == ignoreServerKey {
 			logf("detected self-connect; ignoring host")
 			return
@@ -116,18 +160,24 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 		for {
 			m, connGen, err := c.RecvDetail()
 			if err != nil {
+				c.watching.Store(false)
 				clear()
 				logf("Recv: %v", err)
-				sleep(retryInterval)
+				sleep(c.retryDelay())
 				break
 			}
 			if connGen != lastConnGen {
 				lastConnGen = connGen
 				clear()
+				snapshot, snapshotNext = nil, 0
 			}
 			switch m := m.(type) {
 			case derp.PeerPresentMessage:
 				updatePeer(m.Key, m.IPPort, true)
+			case derp.PeerPresentBatchMessage:
+				for _, p := range m {
+					updatePeer(p.Key, p.IPPort, true)
+				}
 			case derp.PeerGoneMessage:
 				switch m.Reason {
 				case derp.PeerGoneReasonDisconnected:
@@ -140,6 +190,21 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 						key.NodePublic(m.Peer).ShortString(), c.ServerPublicKey().ShortString(), m.Reason)
 				}
 				updatePeer(key.NodePublic(m.Peer), netip.AddrPort{}, false)
+			case derp.PeerSnapshotMessage:
+				if m.Part == 0 {
+					snapshot = snapshot[:0]
+				} else if m.Part != snapshotNext {
+					// Missed a part; wait for the next snapshot.
+					snapshot, snapshotNext = nil, 0
+					continue
+				}
+				snapshot = append(snapshot, m.Peers...)
+				snapshotNext = m.Part + 1
+				if snapshotNext < m.Parts {
+					continue
+				}
+				resync(snapshot)
+				snapshot, snapshotNext = snapshot[:0], 0
 			default:
 				continue
 			}
@@ -150,3 +215,83 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 		}
 	}
 }
+
+// IsWatching reports whether RunWatchConnectionLoop is subscribed to
+// the server's connection changes, or found that the server is its own.
+// It's false until the first subscription and while reconnecting.
+func (c *Client) IsWatching() bool {
+	return c.watching.Load()
+}
+
+// RunGossipLoop loops until ctx is done, subscribing to the peer maps
+// of a server in gossip mode (see derp.Server.SetGossip) and calling
+// update with each complete map received, whether the server's own or
+// one it relays.
+//
+// If the server's public key is ignoreServerKey, RunGossipLoop returns.
+//
+// To force RunGossipLoop to return quickly, its ctx needs to be
+// closed, and c itself needs to be closed.
+func (c *Client) RunGossipLoop(ctx context.Context, ignoreServerKey key.NodePublic, update func(derp.PeerMap)) {
+	logf := c.logf
+
+	sleep := func(d time.Duration) {
+		t, tChannel := c.clock.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+		case <-tChannel:
+		}
+	}
+
+	// partial are the maps whose parts are still arriving, by origin.
+	partial := map[key.NodePublic]*derp.PeerMap{}
+	partsLeft := map[key.NodePublic]int{}
+
+	for ctx.Err() == nil {
+		if err := c.SubscribeGossip(); err != nil {
+			logf("SubscribeGossip: %v", err)
+			sleep(c.retryDelay())
+			continue
+		}
+		if c.ServerPublicKey() == ignoreServerKey {
+			logf("detected self-connect; ignoring host")
+			return
+		}
+		clear(partial)
+		clear(partsLeft)
+		for {
+			m, err := c.Recv()
+			if err != nil {
+				logf("Recv: %v", err)
+				sleep(c.retryDelay())
+				break
+			}
+			pm, ok := m.(derp.PeerMapMessage)
+			if !ok {
+				continue
+			}
+			if pm.Parts == 1 {
+				update(pm.PeerMap)
+				continue
+			}
+			cur := partial[pm.Origin]
+			if cur == nil || cur.Seq != pm.Seq {
+				// Parts of a map are sent together, so a new
+				// one means any earlier one is abandoned.
+				m := pm.PeerMap
+				m.Keys = nil
+				cur = &m
+				partial[pm.Origin] = cur
+				partsLeft[pm.Origin] = pm.Parts
+			}
+			cur.Keys = append(cur.Keys, pm.Keys...)
+			partsLeft[pm.Origin]--
+			if partsLeft[pm.Origin] == 0 {
+				delete(partial, pm.Origin)
+				delete(partsLeft, pm.Origin)
+				update(*cur)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"tailscale.com/derp"
+	"tailscale.com/util/mak"
+)
+
+// Stages of connecting to the server at which an attempt can fail, as
+// counted in Metrics.ConnectFailures.
+const (
+	ConnectFailOther     = "other"     // before dialing, such as no region being available
+	ConnectFailDial      = "dial"      // resolving or dialing the server, or a proxy
+	ConnectFailTLS       = "tls"       // the TLS handshake, including verifying the certificate
+	ConnectFailUpgrade   = "upgrade"   // the HTTP upgrade to DERP, including any WebSocket fallback
+	ConnectFailWebSocket = "websocket" // connecting over WebSocket, where that's all that's supported
+	ConnectFailHandshake = "handshake" // the DERP handshake, including checking the server's key
+)
+
+// Metrics are counts of a Client's activity, as returned by
+// Client.Metrics, for embedders to export to their telemetry.
+type Metrics struct {
+	Connect ConnectStats
+	Forward ForwardStats
+
+	// Reconnects is the number of connections made after the
+	// first.
+	Reconnects int64
+
+	// ConnectFailures are the failed attempts to connect, by the
+	// ConnectFail stage at which they failed.
+	ConnectFailures map[string]int64
+
+	// FramesSent and BytesSent are the packets sent, including
+	// forwarded ones, and their size. FramesRecv is the messages
+	// received, of which BytesRecv is the size of the packets.
+	FramesSent int64
+	BytesSent  int64
+	FramesRecv int64
+	BytesRecv  int64
+
+	// SendErrors and ForwardErrors are the sends and forwards that
+	// failed, closing the connection.
+	SendErrors    int64
+	ForwardErrors int64
+}
+
+// clientMetrics are the counts for Metrics not kept elsewhere.
+type clientMetrics struct {
+	reconnects    atomic.Int64
+	framesSent    atomic.Int64
+	bytesSent     atomic.Int64
+	framesRecv    atomic.Int64
+	bytesRecv     atomic.Int64
+	sendErrors    atomic.Int64
+	forwardErrors atomic.Int64
+
+	mu       sync.Mutex
+	failures map[string]int64 // by ConnectFail stage
+}
+
+// Metrics returns counts of c's activity since it was made.
+func (c *Client) Metrics() Metrics {
+	m := Metrics{
+		Connect:       c.ConnectStats(),
+		Forward:       c.ForwardStats(),
+		Reconnects:    c.met.reconnects.Load(),
+		FramesSent:    c.met.framesSent.Load(),
+		BytesSent:     c.met.bytesSent.Load(),
+		FramesRecv:    c.met.framesRecv.Load(),
+		BytesRecv:     c.met.bytesRecv.Load(),
+		SendErrors:    c.met.sendErrors.Load(),
+		ForwardErrors: c.met.forwardErrors.Load(),
+	}
+	c.met.mu.Lock()
+	defer c.met.mu.Unlock()
+	for stage, n := range c.met.failures {
+		mak.Set(&m.ConnectFailures, stage, n)
+	}
+	return m
+}
+
+// noteConnectFailure counts a failure to connect at the given
+// ConnectFail stage.
+func (m *clientMetrics) noteConnectFailure(stage string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mak.Set(&m.failures, stage, m.failures[stage]+1)
+}
+
+// noteSent counts the sending of a packet of n bytes, which failed
+// with err if non-nil.
+func (m *clientMetrics) noteSent(n int, err error) {
+	if err != nil {
+		m.sendErrors.Add(1)
+		return
+	}
+	m.framesSent.Add(1)
+	m.bytesSent.Add(int64(n))
+}
+
+// noteRecv counts the receipt of msg.
+func (m *clientMetrics) noteRecv(msg derp.ReceivedMessage) {
+	m.framesRecv.Add(1)
+	if p, ok := msg.(derp.ReceivedPacket); ok {
+		m.bytesRecv.Add(int64(len(p.Data)))
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// proxyProtoSig is the signature that starts a PROXY protocol version
+// 2 header.
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoHeaderTimeout is how long a connection from a trusted
+// proxy may take to send its PROXY protocol header.
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+// NewProxyProtocolListener returns a listener that accepts connections
+// from ln, recognizing an optional PROXY protocol version 2 header at
+// the start of those from the addresses in trusted, such as L4 load
+// balancers. For a connection with such a header, RemoteAddr returns
+// the original client address the header carries, so Handler and
+// derp.Server see and enforce policy on the real client rather than
+// the load balancer.
+//
+// Connections from other addresses are passed through untouched; a
+// PROXY header from them isn't trusted, and fails the connection's
+// TLS or HTTP handshake.
+//
+// The header is read on the connection's first call to RemoteAddr or
+// Read, not in Accept, so a slow or broken proxy can't block other
+// connections from being accepted.
+func NewProxyProtocolListener(ln net.Listener, trusted []netip.Prefix) net.Listener {
+	return &proxyProtoListener{Listener: ln, trusted: trusted}
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ap, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil || !l.isTrusted(ap.Addr().Unmap()) {
+		return c, nil
+	}
+	return &proxyProtoConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+func (l *proxyProtoListener) isTrusted(ip netip.Addr) bool {
+	for _, p := range l.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn is a connection from a trusted proxy that may start
+// with a PROXY protocol version 2 header.
+type proxyProtoConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr // from the header, or nil to use Conn's
+	err    error    // from reading the header
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.remote, c.err = readProxyProtoHeader(c.br)
+	})
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// readProxyProtoHeader reads a PROXY protocol version 2 header from
+// br, if it starts with one, and returns the source address it
+// carries. It returns a nil address if br doesn't start with a header,
+// or if the header doesn't carry a TCP source address (such as for the
+// proxy's own health checks).
+func readProxyProtoHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyProtoSig))
+	if err != nil && !(errors.Is(err, io.EOF) && len(sig) > 0) {
+		return nil, err
+	}
+	if !bytes.Equal(sig, proxyProtoSig) {
+		return nil, nil
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", verCmd&0xf)
+	}
+	var ip netip.Addr
+	var port uint16
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol IPv4 address block")
+		}
+		ip = netip.AddrFrom4([4]byte(body[:4]))
+		port = binary.BigEndian.Uint16(body[8:])
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol IPv6 address block")
+		}
+		ip = netip.AddrFrom16([16]byte(body[:16]))
+		port = binary.BigEndian.Uint16(body[32:])
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
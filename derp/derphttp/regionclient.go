@@ -0,0 +1,324 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// defaultHealthCheckInterval is how often a RegionFailoverClient checks the
+// health of its region's nodes, unless HealthCheckInterval is set.
+const defaultHealthCheckInterval = 10 * time.Second
+
+// RegionFailoverClient is a DERP client for a region of several nodes.
+// It sends and receives through one node at a time, the active node,
+// and fails over to another healthy node when the active one degrades:
+// when a send or receive fails, the server reports a problem with the
+// connection, or a health check of the node fails.
+//
+// Only the active node is connected to, so that the region's mesh
+// doesn't see the client connected twice. It's health-checked by
+// pinging it over that connection, so, as with Client.Ping, a
+// goroutine must be calling Recv. The other nodes are health-checked
+// with a GET of their /derp/probe endpoint (see ProbeHandler), which
+// doesn't make a DERP connection to them.
+type RegionFailoverClient struct {
+	// OnActiveNodeChange, if non-nil, is called with the new active
+	// node when the client fails over to it. It must be set before
+	// the client is used.
+	OnActiveNodeChange func(*tailcfg.DERPNode)
+
+	// HealthCheckInterval is how often the region's nodes are
+	// health-checked. Zero means 10 seconds. It must be set before
+	// the client is used.
+	HealthCheckInterval time.Duration
+
+	privateKey key.NodePrivate
+	logf       logger.Logf
+	netMon     *netmon.Monitor
+	nodes      []*tailcfg.DERPNode // the region's non-STUNOnly nodes
+
+	ctx       context.Context // canceled by Close
+	cancelCtx context.CancelFunc
+	startOnce sync.Once
+
+	mu      sync.Mutex
+	closed  bool
+	active  int       // index into nodes of the active node
+	clients []*Client // by index into nodes; made lazily
+	healthy []bool    // by index into nodes
+}
+
+// NewRegionFailoverClient returns a RegionFailoverClient for the nodes of reg.
+// Like Client, it connects lazily. The netMon parameter is optional.
+func NewRegionFailoverClient(privateKey key.NodePrivate, logf logger.Logf, netMon *netmon.Monitor, reg *tailcfg.DERPRegion) (*RegionFailoverClient, error) {
+	var nodes []*tailcfg.DERPNode
+	for _, n := range reg.Nodes {
+		if !n.STUNOnly {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("derphttp: no DERP nodes in region")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &RegionFailoverClient{
+		privateKey: privateKey,
+		logf:       logf,
+		netMon:     netMon,
+		nodes:      nodes,
+		ctx:        ctx,
+		cancelCtx:  cancel,
+		clients:    make([]*Client, len(nodes)),
+		healthy:    make([]bool, len(nodes)),
+	}
+	for i := range rc.healthy {
+		rc.healthy[i] = true
+	}
+	return rc, nil
+}
+
+// nodeRegion returns a region of only node n, for a Client of n.
+func nodeRegion(n *tailcfg.DERPNode) *tailcfg.DERPRegion {
+	return &tailcfg.DERPRegion{RegionID: n.RegionID, Nodes: []*tailcfg.DERPNode{n}}
+}
+
+// ActiveNode returns the node that rc sends and receives through.
+func (rc *RegionFailoverClient) ActiveNode() *tailcfg.DERPNode {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.nodes[rc.active]
+}
+
+// current returns the active node's index and Client, making the
+// Client if needed.
+func (rc *RegionFailoverClient) current() (int, *Client, error) {
+	rc.startOnce.Do(func() { go rc.healthCheckLoop() })
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return 0, nil, ErrClientClosed
+	}
+	i := rc.active
+	if rc.clients[i] == nil {
+		reg := nodeRegion(rc.nodes[i])
+		c := NewRegionClient(rc.privateKey, rc.logf, rc.netMon, func() *tailcfg.DERPRegion { return reg })
+		c.OnConnectionStateChange = func(st ConnState, err error) {
+			if st == StateDegraded {
+				rc.failover(i, c, err)
+			}
+		}
+		rc.clients[i] = c
+	}
+	return i, rc.clients[i], nil
+}
+
+// failover makes the next healthy node after node i the active node, if
+// i is still active with Client c, because of err. It reports whether
+// the active node is no longer i, so that the caller should retry.
+func (rc *RegionFailoverClient) failover(i int, c *Client, err error) bool {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return false
+	}
+	if rc.active != i || rc.clients[i] != c {
+		// Someone else failed over already.
+		rc.mu.Unlock()
+		return true
+	}
+	rc.healthy[i] = false
+	next := -1
+	for j := 1; j < len(rc.nodes); j++ {
+		if k := (i + j) % len(rc.nodes); rc.healthy[k] {
+			next = k
+			break
+		}
+	}
+	if next < 0 {
+		rc.mu.Unlock()
+		return false
+	}
+	rc.active = next
+	rc.clients[i] = nil // start afresh if failed back to
+	node := rc.nodes[next]
+	rc.mu.Unlock()
+
+	rc.logf("derphttp: failing over from DERP node %s to %s: %v", rc.nodes[i].Name, node.Name, err)
+	c.Close()
+	if f := rc.OnActiveNodeChange; f != nil {
+		f(node)
+	}
+	return true
+}
+
+// Send sends a packet to the Tailscale node identified by dstKey
+// through the active node, failing over to another node and retrying
+// if that fails.
+func (rc *RegionFailoverClient) Send(dstKey key.NodePublic, b []byte) error {
+	for {
+		i, c, err := rc.current()
+		if err != nil {
+			return err
+		}
+		err = c.Send(dstKey, b)
+		if err == nil || !rc.failover(i, c, err) {
+			return err
+		}
+	}
+}
+
+// Recv reads a message from the active node, failing over to another
+// node and reading from it if that fails. As with Client.Recv, the
+// messages include the server info of each new connection.
+func (rc *RegionFailoverClient) Recv() (derp.ReceivedMessage, error) {
+	for {
+		i, c, err := rc.current()
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.Recv()
+		if err == nil || !rc.failover(i, c, err) {
+			return m, err
+		}
+	}
+}
+
+// Close closes rc's connections and stops its health checks.
+func (rc *RegionFailoverClient) Close() error {
+	rc.cancelCtx()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return ErrClientClosed
+	}
+	rc.closed = true
+	for _, c := range rc.clients {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// healthCheckLoop checks the health of the region's nodes every
+// HealthCheckInterval until rc is closed.
+func (rc *RegionFailoverClient) healthCheckLoop() {
+	d := rc.HealthCheckInterval
+	if d <= 0 {
+		d = defaultHealthCheckInterval
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-rc.ctx.Done():
+			return
+		}
+		rc.checkHealth()
+	}
+}
+
+// healthCheckTimeout is how long a health check of a node may take.
+const healthCheckTimeout = 5 * time.Second
+
+// checkHealth pings the active node and probes the others, recording
+// whether that succeeded, and fails over if the active node is
+// unhealthy.
+func (rc *RegionFailoverClient) checkHealth() {
+	rc.mu.Lock()
+	active, activeClient := rc.active, rc.clients[rc.active]
+	rc.mu.Unlock()
+
+	results := make([]error, len(rc.nodes))
+	var wg sync.WaitGroup
+	for i, n := range rc.nodes {
+		wg.Add(1)
+		go func(i int, n *tailcfg.DERPNode) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(rc.ctx, healthCheckTimeout)
+			defer cancel()
+			if i == active {
+				results[i] = pingIfConnected(ctx, activeClient)
+			} else {
+				results[i] = rc.probeNode(ctx, n)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	if rc.ctx.Err() != nil {
+		return
+	}
+
+	rc.mu.Lock()
+	for i, err := range results {
+		rc.healthy[i] = err == nil
+	}
+	stillActive := rc.active == active && rc.clients[active] == activeClient
+	rc.mu.Unlock()
+	if err := results[active]; err != nil && stillActive && activeClient != nil {
+		rc.failover(active, activeClient, err)
+	}
+}
+
+// pingIfConnected pings the server c is connected to, if c is non-nil
+// and connected. Otherwise there's nothing to check yet: a failure to
+// connect is seen by Send or Recv instead.
+func pingIfConnected(ctx context.Context, c *Client) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	connected := c.client != nil
+	c.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	return c.Ping(ctx)
+}
+
+// probeNode makes an HTTP GET request of node n's /derp/probe
+// endpoint, returning an error unless it succeeds.
+func (rc *RegionFailoverClient) probeNode(ctx context.Context, n *tailcfg.DERPNode) error {
+	reg := nodeRegion(n)
+	c := NewRegionClient(rc.privateKey, logger.Discard, rc.netMon, func() *tailcfg.DERPRegion { return reg })
+	defer c.Close()
+	tlsConn, connClose, _, err := c.DialRegionTLS(ctx, reg)
+	if err != nil {
+		return err
+	}
+	defer connClose.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(dl)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+n.HostName+"/derp/probe", nil)
+	if err != nil {
+		return err
+	}
+	if err := req.Write(tlsConn); err != nil {
+		return err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("derphttp: probe of %s: %s", n.Name, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"tailscale.com/util/cmpx"
+)
+
+// Default timeouts for the phases of connecting, if the Client's
+// corresponding fields are zero.
+const (
+	defaultDialTimeout         = 5 * time.Second
+	defaultTLSHandshakeTimeout = 5 * time.Second
+	defaultHandshakeTimeout    = 5 * time.Second
+)
+
+// ConnectTimeoutError is the error, wrapped, of an attempt to connect
+// that failed because one of its phases didn't complete in time. See
+// Client.DialTimeout.
+type ConnectTimeoutError struct {
+	// Stage is the ConnectFail stage that timed out:
+	// ConnectFailDial, ConnectFailTLS, ConnectFailUpgrade or
+	// ConnectFailHandshake.
+	Stage   string
+	Timeout time.Duration // the phase's timeout
+	Err     error         // the underlying error
+}
+
+func (e *ConnectTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v: %v", e.Stage, e.Timeout, e.Err)
+}
+
+func (e *ConnectTimeoutError) Unwrap() error { return e.Err }
+
+func (c *Client) dialTimeout() time.Duration {
+	return cmpx.Or(c.DialTimeout, defaultDialTimeout)
+}
+
+func (c *Client) tlsHandshakeTimeout() time.Duration {
+	return cmpx.Or(c.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+}
+
+func (c *Client) handshakeTimeout() time.Duration {
+	return cmpx.Or(c.HandshakeTimeout, defaultHandshakeTimeout)
+}
+
+// phaseTimedOut reports whether err, from a phase of connecting given
+// its own deadline within ctx, is because that deadline passed, rather
+// than ctx being done.
+func phaseTimedOut(ctx, phaseCtx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if phaseCtx != nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		return true
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -9,6 +9,7 @@
 	"context"
 	"log"
 	"net"
+	"net/http"
 
 	"nhooyr.io/websocket"
 	"tailscale.com/net/wsconn"
@@ -18,9 +19,11 @@ func init() {
 	dialWebsocketFunc = dialWebsocket
 }
 
-func dialWebsocket(ctx context.Context, urlStr string) (net.Conn, error) {
+func dialWebsocket(ctx context.Context, urlStr string, header http.Header, hc *http.Client) (net.Conn, error) {
 	c, res, err := websocket.Dial(ctx, urlStr, &websocket.DialOptions{
+		HTTPClient:   hc,
 		Subprotocols: []string{"derp"},
+		HTTPHeader:   header,
 	})
 	if err != nil {
 		log.Printf("websocket Dial: %v, %+v", err, res)
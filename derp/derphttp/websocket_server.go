@@ -0,0 +1,54 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package derphttp
+
+import (
+	"bufio"
+	"expvar"
+	"log"
+	"net/http"
+
+	"nhooyr.io/websocket"
+	"tailscale.com/derp"
+	"tailscale.com/net/wsconn"
+)
+
+var counterWebSocketAccepts = expvar.NewInt("derp_websocket_accepts")
+
+// The WebSocket server is only compiled in on Linux, where DERP servers
+// run, so that clients on other platforms don't link it. On Linux, the
+// WebSocket client (see websocket.go) links the same packages anyway.
+func init() {
+	serveWebSocketFunc = serveWebSocket
+}
+
+// serveWebSocket accepts a WebSocket connection from r and serves DERP
+// over it, with each DERP frame carried in binary WebSocket messages.
+func serveWebSocket(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:   []string{"derp"},
+		OriginPatterns: []string{"*"},
+		// Disable compression because we transmit WireGuard messages that
+		// are not compressible.
+		// Additionally, Safari has a broken implementation of compression
+		// (see https://github.com/nhooyr/websocket/issues/218) that makes
+		// enabling it actively harmful.
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	if err != nil {
+		log.Printf("websocket.Accept: %v", err)
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "closing")
+	if c.Subprotocol() != "derp" {
+		c.Close(websocket.StatusPolicyViolation, "client must speak the derp subprotocol")
+		return
+	}
+	counterWebSocketAccepts.Add(1)
+	wc := wsconn.NetConn(r.Context(), c, websocket.MessageBinary, r.RemoteAddr)
+	brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+	s.Accept(acceptContext(r, derp.TransportWebSocket), wc, brw, r.RemoteAddr)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derpzstd registers zstd compression of DERP packets with the
+// derp package (see derp.CanZstd and derp.Server.SetZstdThreshold).
+// Programs that use it must import this package.
+package derpzstd
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/derp"
+	"tailscale.com/smallzstd"
+)
+
+func init() {
+	derp.RegisterZstd(codec{})
+}
+
+// encoder and decoder are shared by all clients and servers, and only
+// made once first used. Each packet is compressed independently with
+// EncodeAll, which the encoder allows GOMAXPROCS callers to do
+// concurrently.
+var (
+	encoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, err := smallzstd.NewEncoder(nil,
+			zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)),
+			zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			panic(err)
+		}
+		return enc
+	})
+	decoder = sync.OnceValue(func() *zstd.Decoder {
+		// Unlike for smallzstd's generic users, the max decoded
+		// size is known here, so limit it.
+		dec, err := smallzstd.NewDecoder(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(derp.MaxJumboPacketSize))
+		if err != nil {
+			panic(err)
+		}
+		return dec
+	})
+)
+
+// codec is the derp.ZstdCodec that uses encoder and decoder.
+type codec struct{}
+
+func (codec) EncodeAll(src, dst []byte) []byte {
+	return encoder().EncodeAll(src, dst)
+}
+
+func (codec) DecodeAll(src, dst []byte) ([]byte, error) {
+	return decoder().DecodeAll(src, dst)
+}
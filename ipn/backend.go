@@ -171,6 +171,16 @@ type PartialFile struct {
 	DeclaredSize int64     // or -1 if unknown
 	Received     int64     // bytes copied thus far
 
+	// BytesPerSecond is the recent rate of receiving, smoothed over
+	// several seconds, or zero if it's not yet known or the transfer
+	// isn't in progress.
+	BytesPerSecond float64 `json:",omitempty"`
+
+	// ETA is when the transfer is estimated to complete at
+	// BytesPerSecond, or nil if that's unknown, such as when
+	// DeclaredSize is.
+	ETA *time.Time `json:",omitempty"`
+
 	// PartialPath is set non-empty in "direct" file mode to the
 	// in-progress '*.partial' file's path when the peerapi isn't
 	// being used; see LocalBackend.SetDirectFileRoot.
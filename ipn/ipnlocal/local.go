@@ -255,7 +255,8 @@ type LocalBackend struct {
 	// but in that case DoFinalRename is also set true, which moves the
 	// *.partial file to its final name on completion.
 	directFileRoot          string
-	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
+	directFileDoFinalRename bool           // false on macOS, true on several NAS platforms
+	taildropStore           taildrop.Store // if non-nil, where to stage received files instead of on disk
 	componentLogUntil       map[string]componentLogState
 	// c2nUpdateStatus is the status of c2n-triggered client update.
 	c2nUpdateStatus updateStatus
@@ -518,6 +519,19 @@ func (b *LocalBackend) SetDirectFileDoFinalRename(v bool) {
 	b.directFileDoFinalRename = v
 }
 
+// SetTaildropStore sets a storage backend, such as an object storage
+// bucket, in which to stage received Taildrop files instead of the
+// daemon-owned directory on local disk.
+//
+// It has no effect if SetDirectFileRoot is used.
+//
+// This must be called before the LocalBackend starts being used.
+func (b *LocalBackend) SetTaildropStore(st taildrop.Store) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.taildropStore = st
+}
+
 // pauseOrResumeControlClientLocked pauses b.cc if there is no network available
 // or if the LocalBackend is in Stopped state with a valid NetMap. In all other
 // cases, it unpauses it. It is a no-op if b.cc is nil.
@@ -3558,6 +3572,9 @@ func (b *LocalBackend) initPeerAPIListener() {
 			AvoidFinalRename: !b.directFileDoFinalRename,
 		},
 	}
+	if b.directFileRoot == "" {
+		ps.taildrop.Store = b.taildropStore
+	}
 	if dm, ok := b.sys.DNSManager.GetOK(); ok {
 		ps.resolver = dm.Resolver()
 	}
@@ -132,6 +132,14 @@ type DERPNode struct {
 	// not present) + TLS ClientHello.
 	CertName string `json:",omitempty"`
 
+	// CertPin optionally pins the node's TLS certificate to the given
+	// public key: the hex SHA-256 hash of the SubjectPublicKeyInfo of
+	// the leaf certificate it must present. If non-empty, the
+	// certificate is verified by the pin alone, rather than by a
+	// chain to a trusted root, so private relays can use self-issued
+	// certificates.
+	CertPin string `json:",omitempty"`
+
 	// IPv4 optionally forces an IPv4 address to use, instead of using DNS.
 	// If empty, A record(s) from DNS lookups of HostName are used.
 	// If the string is not an IPv4 address, IPv4 is not used; the
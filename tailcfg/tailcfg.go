@@ -1269,8 +1269,28 @@ type PortRange struct {
 }
 
 // Contains reports whether port is in pr.
+//
+// The packet filter calls it for every packet, so it's written to
+// compile to comparisons without conditional branches, whose
+// mispredictions are costly on low-end routers.
 func (pr PortRange) Contains(port uint16) bool {
-	return port >= pr.First && port <= pr.Last
+	return b2u8(port >= pr.First)&b2u8(port <= pr.Last) != 0
+}
+
+// Overlaps reports whether pr and o have any port in common. Like
+// Contains, it's branch-free.
+func (pr PortRange) Overlaps(o PortRange) bool {
+	return b2u8(pr.First <= o.Last)&b2u8(o.First <= pr.Last)&
+		b2u8(pr.First <= pr.Last)&b2u8(o.First <= o.Last) != 0
+}
+
+// b2u8 returns 1 if b is true, else 0. The compiler emits it as a
+// conditional set, not a branch.
+func b2u8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 var PortRangeAny = PortRange{0, 65535}
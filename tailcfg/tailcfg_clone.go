@@ -449,6 +449,7 @@ func (src *DERPNode) Clone() *DERPNode {
 	RegionID         int
 	HostName         string
 	CertName         string
+	CertPin          string
 	IPv4             string
 	IPv6             string
 	STUNPort         int
@@ -6,6 +6,7 @@
 import (
 	"encoding"
 	"encoding/json"
+	"fmt"
 	"net/netip"
 	"os"
 	"reflect"
@@ -855,3 +856,66 @@ type rule struct {
 		})
 	}
 }
+
+var testPortRanges = []PortRange{
+	{First: 0, Last: 0},
+	{First: 22, Last: 22},
+	{First: 80, Last: 443},
+	{First: 1000, Last: 999}, // empty
+	{First: 65535, Last: 65535},
+	PortRangeAny,
+}
+
+func TestPortRangeContains(t *testing.T) {
+	for _, pr := range testPortRanges {
+		for p := 0; p <= 65535; p++ {
+			port := uint16(p)
+			want := port >= pr.First && port <= pr.Last
+			if got := pr.Contains(port); got != want {
+				t.Fatalf("%+v.Contains(%d) = %v; want %v", pr, port, got, want)
+			}
+		}
+	}
+}
+
+func TestPortRangeOverlaps(t *testing.T) {
+	for _, a := range testPortRanges {
+		for _, b := range testPortRanges {
+			want := false
+			for p := 0; p <= 65535; p++ {
+				if a.Contains(uint16(p)) && b.Contains(uint16(p)) {
+					want = true
+					break
+				}
+			}
+			if got := a.Overlaps(b); got != want {
+				t.Errorf("%+v.Overlaps(%+v) = %v; want %v", a, b, got, want)
+			}
+		}
+	}
+}
+
+// sinkBool keeps benchmarked results alive.
+var sinkBool bool
+
+func BenchmarkPortRangeContains(b *testing.B) {
+	for _, pr := range testPortRanges {
+		b.Run(fmt.Sprintf("%d-%d", pr.First, pr.Last), func(b *testing.B) {
+			var v bool
+			for i := 0; i < b.N; i++ {
+				v = v != pr.Contains(uint16(i))
+			}
+			sinkBool = v
+		})
+	}
+}
+
+func BenchmarkPortRangeOverlaps(b *testing.B) {
+	pr := PortRange{First: 80, Last: 443}
+	var v bool
+	for i := 0; i < b.N; i++ {
+		p := uint16(i)
+		v = v != pr.Overlaps(PortRange{First: p, Last: p + 100})
+	}
+	sinkBool = v
+}
@@ -1038,6 +1038,7 @@ func (v DERPNodeView) Name() string           { return v.ж.Name }
 func (v DERPNodeView) RegionID() int          { return v.ж.RegionID }
 func (v DERPNodeView) HostName() string       { return v.ж.HostName }
 func (v DERPNodeView) CertName() string       { return v.ж.CertName }
+func (v DERPNodeView) CertPin() string        { return v.ж.CertPin }
 func (v DERPNodeView) IPv4() string           { return v.ж.IPv4 }
 func (v DERPNodeView) IPv6() string           { return v.ж.IPv6 }
 func (v DERPNodeView) STUNPort() int          { return v.ж.STUNPort }
@@ -1053,6 +1054,7 @@ func (v DERPNodeView) CanPort80() bool        { return v.ж.CanPort80 }
 	RegionID         int
 	HostName         string
 	CertName         string
+	CertPin          string
 	IPv4             string
 	IPv6             string
 	STUNPort         int
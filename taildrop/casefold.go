@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirCaseInsensitive reports whether h.Dir is on a case-insensitive
+// file system, as is usual on macOS and Windows, where "Report.PDF"
+// and "report.pdf" are the same file. It's detected the first time
+// it's needed.
+func (h *Handler) dirCaseInsensitive() bool {
+	h.caseOnce.Do(func() {
+		detect := h.isCaseInsensitive
+		if detect == nil {
+			detect = isCaseInsensitiveDir
+		}
+		h.caseInsensitive = detect(h.Dir)
+	})
+	return h.caseInsensitive
+}
+
+// isCaseInsensitiveDir reports whether dir is on a case-insensitive
+// file system, by creating a file in it and looking it up by its name
+// in upper case.
+func isCaseInsensitiveDir(dir string) bool {
+	f, err := os.CreateTemp(dir, ".taildrop-case-*")
+	if err != nil {
+		return false
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	_, err = os.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(name))))
+	return err == nil
+}
+
+// caseConflict reports whether receiving the file baseName into h.Dir
+// would collide with a file already there, or with another transfer
+// into it, whose name differs only in case. They're the same file on a
+// case-insensitive file system, so the later one would silently
+// overwrite the other. On case-sensitive file systems there's no
+// conflict.
+func (h *Handler) caseConflict(baseName string) bool {
+	if !h.dirCaseInsensitive() {
+		return false
+	}
+	des, err := os.ReadDir(h.Dir)
+	if err != nil {
+		return false
+	}
+	for _, de := range des {
+		name, _ := strings.CutSuffix(de.Name(), partialSuffix)
+		if name != baseName && strings.EqualFold(name, baseName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// GroupHeader is the header of a PUT to HandlePut that names the
+// transfer group, chosen by the sender, that the file belongs to, and
+// GroupSizeHeader is the header giving the number of files in the
+// group. See HandlePut.
+const (
+	GroupHeader     = "Taildrop-Group"
+	GroupSizeHeader = "Taildrop-Group-Size"
+)
+
+// maxGroupSize is the most files a transfer group may have.
+const maxGroupSize = 10000
+
+// groupDir is the subdirectory of Handler.Dir in which the received
+// files of incomplete transfer groups are staged, in a subdirectory
+// per group. Like progressDir, it can't be confused with a received
+// file, so its files aren't reported as waiting.
+//
+// A group that isn't added to for abandonedAge is deleted, along
+// with its staged files.
+const groupDir = ".taildrop-groups"
+
+// errGroupMemberExists is returned by stageGroupMember when a file of
+// the same name is already staged in the group.
+var errGroupMemberExists = errors.New("file exists")
+
+// transferGroup is the transfer group of a file being received.
+type transferGroup struct {
+	id   string
+	size int // number of files in the group
+
+	// dir is the name of the group's staging directory in groupDir.
+	// Group IDs are chosen by senders, so it's derived from both the
+	// ID and the sender, keeping different senders' groups apart.
+	dir string
+}
+
+// parseGroup returns the transfer group that r's file belongs to, if
+// any. The sender is identified by the IP address r came from.
+func parseGroup(r *http.Request) (g transferGroup, ok bool, err error) {
+	id := r.Header.Get(GroupHeader)
+	if id == "" {
+		return g, false, nil
+	}
+	if len(id) > 64 {
+		return g, false, errors.New("bad transfer group")
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return g, false, errors.New("bad transfer group")
+		}
+	}
+	size, err := strconv.Atoi(r.Header.Get(GroupSizeHeader))
+	if err != nil || size < 1 || size > maxGroupSize {
+		return g, false, errors.New("bad transfer group size")
+	}
+	sender := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(sender); err == nil {
+		sender = host
+	}
+	sum := sha256.Sum256([]byte(sender + "/" + id))
+	return transferGroup{id: id, size: size, dir: hex.EncodeToString(sum[:16])}, true, nil
+}
+
+// groupPath returns the path at which baseName, received as part of
+// group g, is staged.
+func (h *Handler) groupPath(g transferGroup, baseName string) string {
+	return filepath.Join(h.Dir, groupDir, g.dir, baseName)
+}
+
+// removeStaleGroupsLocked deletes the staging directories of groups that
+// haven't been added to for abandonedAge, other than keep's.
+// h.groupMu must be held.
+func (h *Handler) removeStaleGroupsLocked(keep string) {
+	parent := filepath.Join(h.Dir, groupDir)
+	des, err := os.ReadDir(parent)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		if !de.IsDir() || de.Name() == keep {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil || h.Clock.Since(fi.ModTime()) <= abandonedAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(parent, de.Name())); err != nil {
+			h.Logf("removing abandoned transfer group: %v", redactErr(err))
+		}
+	}
+}
+
+// stageGroupMember moves partialFile, the completely received file
+// baseName of group g, to the group's staging directory. If that
+// completes the group, it moves all its files to Dir together. Files
+// that can't be moved are logged and left staged.
+//
+// It returns errGroupMemberExists if baseName is already staged in g.
+func (h *Handler) stageGroupMember(g transferGroup, partialFile, baseName string) error {
+	h.groupMu.Lock()
+	defer h.groupMu.Unlock()
+
+	parent := filepath.Join(h.Dir, groupDir)
+	if fi, err := os.Lstat(parent); err == nil && !fi.IsDir() {
+		// Don't follow a symlink, or clobber a file, that's in
+		// the way.
+		return errNotRegular
+	}
+	h.removeStaleGroupsLocked(g.dir)
+	dir := filepath.Join(parent, g.dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return redactErr(err)
+	}
+	staged := h.groupPath(g, baseName)
+	if _, err := os.Lstat(staged); err == nil {
+		return errGroupMemberExists
+	}
+	if err := os.Rename(partialFile, staged); err != nil {
+		return redactErr(err)
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return redactErr(err)
+	}
+	if len(des) < g.size {
+		return nil
+	}
+	var failed int
+	for _, de := range des {
+		dstFile, ok := h.diskPath(de.Name())
+		if !ok {
+			failed++
+			continue
+		}
+		if _, err := os.Lstat(dstFile); err == nil {
+			// Something of the same name arrived meanwhile;
+			// leave this one staged rather than overwrite it.
+			failed++
+			continue
+		}
+		if err := os.Rename(h.groupPath(g, de.Name()), dstFile); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		h.Logf("put: %d of %d files of transfer group not published", failed, len(des))
+		return nil
+	}
+	os.Remove(dir)
+	return nil
+}
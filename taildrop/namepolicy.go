@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FileNamePolicy transforms the base names of received files before
+// they're stored, such as to archive them by date.
+//
+// The names it's given have already been validated as safe base
+// filenames, and the names it returns are validated again; a put
+// fails if a policy returns an invalid name. Policies that depend on
+// the time should use the now argument rather than the wall clock.
+type FileNamePolicy interface {
+	// FileName returns the name to store the file received as base
+	// under, at time now.
+	FileName(base string, now time.Time) string
+}
+
+// FileNamePolicyFunc is an adapter to allow the use of ordinary
+// functions as a FileNamePolicy.
+type FileNamePolicyFunc func(base string, now time.Time) string
+
+// FileName implements FileNamePolicy.
+func (f FileNamePolicyFunc) FileName(base string, now time.Time) string { return f(base, now) }
+
+// ChainFileNamePolicies returns a FileNamePolicy that applies each of
+// policies in order.
+func ChainFileNamePolicies(policies ...FileNamePolicy) FileNamePolicy {
+	return FileNamePolicyFunc(func(base string, now time.Time) string {
+		for _, p := range policies {
+			base = p.FileName(base, now)
+		}
+		return base
+	})
+}
+
+// DatePrefixPolicy is a FileNamePolicy that prefixes names with the
+// local date they were received, as in "2006-01-02 foo.jpg".
+var DatePrefixPolicy FileNamePolicy = FileNamePolicyFunc(func(base string, now time.Time) string {
+	return now.Format("2006-01-02") + " " + base
+})
+
+// SlugifyPolicy is a FileNamePolicy that lowercases names and replaces
+// each run of characters other than ASCII letters and digits in them
+// with a single hyphen, keeping the extension's dot, so that
+// "My Photo (1).JPG" becomes "my-photo-1.jpg".
+var SlugifyPolicy FileNamePolicy = FileNamePolicyFunc(func(base string, _ time.Time) string {
+	ext := filepath.Ext(base)
+	stem := slugify(strings.TrimSuffix(base, ext))
+	ext = slugify(ext)
+	if stem == "" {
+		stem = "file"
+	}
+	if ext == "" {
+		return stem
+	}
+	return stem + "." + ext
+})
+
+// slugify lowercases s and replaces each run of characters other
+// than ASCII letters and digits with a hyphen, trimming any leading or
+// trailing hyphen.
+func slugify(s string) string {
+	var sb strings.Builder
+	hyphen := false
+	for _, r := range s {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if hyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			hyphen = false
+			sb.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		hyphen = true
+	}
+	return sb.String()
+}
@@ -0,0 +1,11 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package taildrop
+
+// openSafeFlags are added to the flags of every file opened in
+// Handler.Dir. There's no O_NOFOLLOW here, so we rely on the Lstat and
+// Stat checks in openRegular alone.
+const openSafeFlags = 0
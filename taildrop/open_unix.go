@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package taildrop
+
+import "syscall"
+
+// openSafeFlags are added to the flags of every file opened in
+// Handler.Dir. O_NOFOLLOW fails the open if the final path element is
+// a symlink, and O_NONBLOCK keeps a FIFO swapped in after our Lstat
+// check from blocking the open until something connects to it.
+const openSafeFlags = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+)
+
+// progressDir is the subdirectory of Handler.Dir that holds the
+// progress of incoming transfers, so that transfers interrupted by
+// the process exiting are still reported after a restart. Being a
+// directory, it can't be confused with a received file, and a file of
+// the same name can't be received.
+//
+// It's not used in DirectFileMode, where Dir is a directory the user
+// sees, such as their Downloads folder.
+const progressDir = ".taildrop-progress"
+
+// abandonedAge is how long after its progress was last saved an
+// interrupted transfer is deleted, along with its partial file.
+// Nothing resumes such transfers, so it only bounds how long
+// IncomingFiles reports them and their partial files take up space.
+const abandonedAge = 24 * time.Hour
+
+// transferProgress is the persisted progress of an incoming transfer
+// to the local disk.
+type transferProgress struct {
+	Name         string
+	Started      time.Time
+	DeclaredSize int64 // or -1 if unknown
+	Received     int64
+}
+
+// progressPath returns the path of the progress file for baseName.
+// It's named by a hash so it stays short however long baseName is.
+func (h *Handler) progressPath(baseName string) string {
+	sum := sha256.Sum256([]byte(baseName))
+	return filepath.Join(h.Dir, progressDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// saveProgress persists p, creating progressDir if needed.
+func (h *Handler) saveProgress(p transferProgress) error {
+	dir := filepath.Join(h.Dir, progressDir)
+	if fi, err := os.Lstat(dir); err == nil && !fi.IsDir() {
+		// Don't follow a symlink, or clobber a file, that's
+		// in the way.
+		return errNotRegular
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return redactErr(err)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return redactErr(atomicfile.WriteFile(h.progressPath(p.Name), b, 0600))
+}
+
+// removeProgress removes the persisted progress for baseName and
+// forgets it as an interrupted transfer.
+func (h *Handler) removeProgress(baseName string) {
+	h.loadInterrupted()
+	h.interrupted.Delete(baseName)
+	os.Remove(h.progressPath(baseName))
+}
+
+// interruptedTransfer is a transfer that was in progress when a
+// previous process exited.
+type interruptedTransfer struct {
+	pf    ipn.PartialFile
+	saved time.Time // when its progress was last saved
+}
+
+// loadInterrupted loads, once, the transfers that were in progress when
+// a previous process exited, as listed in progressDir. Those whose
+// partial file is gone are forgotten, and those abandoned are deleted,
+// as are abandoned transfer groups.
+func (h *Handler) loadInterrupted() {
+	h.interruptedOnce.Do(func() {
+		if h.Dir == "" || h.Store != nil {
+			return
+		}
+		h.groupMu.Lock()
+		h.removeStaleGroupsLocked("")
+		h.groupMu.Unlock()
+		if h.DirectFileMode {
+			return
+		}
+		des, err := os.ReadDir(filepath.Join(h.Dir, progressDir))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				h.Logf("reading transfer progress: %v", redactErr(err))
+			}
+			return
+		}
+		for _, de := range des {
+			if !strings.HasSuffix(de.Name(), ".json") {
+				continue
+			}
+			info, err := de.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(h.Dir, progressDir, de.Name())
+			b, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			var p transferProgress
+			if err := json.Unmarshal(b, &p); err != nil || h.progressPath(p.Name) != path {
+				os.Remove(path)
+				continue
+			}
+			dstFile, ok := h.diskPath(p.Name)
+			if !ok {
+				os.Remove(path)
+				continue
+			}
+			partialFile := dstFile + partialSuffix
+			fi, err := os.Lstat(partialFile)
+			if err != nil || !fi.Mode().IsRegular() {
+				os.Remove(path)
+				continue
+			}
+			if h.Clock.Since(info.ModTime()) > abandonedAge {
+				os.Remove(partialFile)
+				os.Remove(path)
+				continue
+			}
+			pf := ipn.PartialFile{
+				Name:         p.Name,
+				Started:      p.Started,
+				DeclaredSize: p.DeclaredSize,
+				// The partial file's size is what was actually
+				// written, which may be a little beyond the
+				// last progress saved.
+				Received: fi.Size(),
+			}
+			h.interrupted.Store(p.Name, interruptedTransfer{pf: pf, saved: info.ModTime()})
+		}
+	})
+}
+
+// removeAbandoned deletes the interrupted transfer name, along with
+// its partial file and progress.
+func (h *Handler) removeAbandoned(name string) {
+	if dstFile, ok := h.diskPath(name); ok {
+		os.Remove(dstFile + partialSuffix)
+	}
+	h.removeProgress(name)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import "time"
+
+// rateSampleInterval is the shortest period over which transferRate
+// measures the rate of a transfer.
+const rateSampleInterval = time.Second
+
+// rateSmoothing is the weight that transferRate gives the newest
+// sample's rate in its moving average, from 0 to 1. Lower values give
+// a steadier rate that's slower to follow changes.
+const rateSmoothing = 0.3
+
+// transferRate estimates the rate of a transfer, as an exponentially
+// weighted moving average of its rate over successive samples of at
+// least rateSampleInterval, so that every client reports the same
+// smoothed rate and estimated completion time.
+type transferRate struct {
+	rate        float64   // bytes per second; zero until the first sample
+	sampleStart time.Time // when the current sample began
+	sampleBytes int64     // bytes transferred in the current sample
+}
+
+// add records that n bytes were transferred at now.
+func (r *transferRate) add(now time.Time, n int64) {
+	if r.sampleStart.IsZero() {
+		r.sampleStart = now
+	}
+	r.sampleBytes += n
+	d := now.Sub(r.sampleStart)
+	if d < rateSampleInterval {
+		return
+	}
+	sample := float64(r.sampleBytes) / d.Seconds()
+	if r.rate == 0 {
+		r.rate = sample
+	} else {
+		r.rate += rateSmoothing * (sample - r.rate)
+	}
+	r.sampleStart = now
+	r.sampleBytes = 0
+}
+
+// bytesPerSecond returns the estimated rate at now. A transfer that has
+// stalled is counted as a sample of nothing transferred every
+// rateSampleInterval, so its rate falls off.
+func (r *transferRate) bytesPerSecond(now time.Time) float64 {
+	r.add(now, 0)
+	return r.rate
+}
+
+// eta returns when a transfer of size bytes, of which copied have been
+// transferred, is estimated to complete at rate bytes per second, or
+// the zero time if that's unknown.
+func eta(now time.Time, size, copied int64, rate float64) time.Time {
+	if size < 0 || rate <= 0 {
+		return time.Time{}
+	}
+	remaining := size - copied
+	if remaining <= 0 {
+		return now
+	}
+	return now.Add(time.Duration(float64(remaining) / rate * float64(time.Second)))
+}
@@ -22,7 +22,7 @@
 // HasFilesWaiting reports whether any files are buffered in [Handler.Dir].
 // This always returns false when [Handler.DirectFileMode] is false.
 func (s *Handler) HasFilesWaiting() bool {
-	if s == nil || s.Dir == "" || s.DirectFileMode {
+	if s == nil || !s.hasStorage() || s.DirectFileMode {
 		return false
 	}
 	if s.knownEmpty.Load() {
@@ -33,6 +33,9 @@ func (s *Handler) HasFilesWaiting() bool {
 		// keep this negative cache.
 		return false
 	}
+	if s.Store != nil {
+		return s.storeHasFilesWaiting()
+	}
 	f, err := os.Open(s.Dir)
 	if err != nil {
 		return false
@@ -75,6 +78,40 @@ func (s *Handler) HasFilesWaiting() bool {
 	return false
 }
 
+const (
+	// storeListTimeout bounds how long HasFilesWaiting waits on
+	// Store.List, as it's called from status polling paths.
+	storeListTimeout = 5 * time.Second
+
+	// storeHasFilesTTL is how long a non-empty Store.List result is
+	// reused by HasFilesWaiting. Unlike on disk, files in a Store
+	// only go away via DeleteFile (which resets the cache) or by
+	// someone else emptying the store, so a short TTL is enough.
+	storeHasFilesTTL = 10 * time.Second
+)
+
+// storeHasFilesWaiting is the part of HasFilesWaiting that checks
+// s.Store rather than the local disk.
+func (s *Handler) storeHasFilesWaiting() bool {
+	now := s.Clock.Now()
+	if until := s.storeHasFilesUntil.Load(); until != 0 && now.UnixNano() < until {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeListTimeout)
+	defer cancel()
+	files, err := s.Store.List(ctx)
+	if err != nil {
+		return false
+	}
+	if len(files) == 0 {
+		s.storeHasFilesUntil.Store(0)
+		s.knownEmpty.Store(true)
+		return false
+	}
+	s.storeHasFilesUntil.Store(now.Add(storeHasFilesTTL).UnixNano())
+	return true
+}
+
 // WaitingFiles returns the list of files that have been sent by a
 // peer that are waiting in [Handler.Dir].
 // This always returns nil when [Handler.DirectFileMode] is false.
@@ -82,12 +119,20 @@ func (s *Handler) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 	if s == nil {
 		return nil, errNilHandler
 	}
-	if s.Dir == "" {
+	if !s.hasStorage() {
 		return nil, errNoTaildrop
 	}
 	if s.DirectFileMode {
 		return nil, nil
 	}
+	if s.Store != nil {
+		ret, err := s.Store.List(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+		return ret, nil
+	}
 	f, err := os.Open(s.Dir)
 	if err != nil {
 		return nil, err
@@ -167,7 +212,7 @@ func (s *Handler) DeleteFile(baseName string) error {
 	if s == nil {
 		return errNilHandler
 	}
-	if s.Dir == "" {
+	if !s.hasStorage() {
 		return errNoTaildrop
 	}
 	if s.DirectFileMode {
@@ -177,6 +222,15 @@ func (s *Handler) DeleteFile(baseName string) error {
 	if !ok {
 		return errors.New("bad filename")
 	}
+	if s.Store != nil {
+		if err := s.Store.Delete(context.Background(), baseName); err != nil {
+			err = redactNameErr(err, baseName)
+			s.Logf("peerapi: failed to DeleteFile: %v", err)
+			return err
+		}
+		s.storeHasFilesUntil.Store(0)
+		return nil
+	}
 	var bo *backoff.Backoff
 	logf := s.Logf
 	t0 := s.Clock.Now()
@@ -214,9 +268,9 @@ func (s *Handler) DeleteFile(baseName string) error {
 }
 
 func touchFile(path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	f, err := openRegular(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return redactErr(err)
+		return err
 	}
 	return f.Close()
 }
@@ -227,7 +281,7 @@ func (s *Handler) OpenFile(baseName string) (rc io.ReadCloser, size int64, err e
 	if s == nil {
 		return nil, 0, errNilHandler
 	}
-	if s.Dir == "" {
+	if !s.hasStorage() {
 		return nil, 0, errNoTaildrop
 	}
 	if s.DirectFileMode {
@@ -237,13 +291,17 @@ func (s *Handler) OpenFile(baseName string) (rc io.ReadCloser, size int64, err e
 	if !ok {
 		return nil, 0, errors.New("bad filename")
 	}
+	if s.Store != nil {
+		rc, size, err = s.Store.Open(context.Background(), baseName)
+		return rc, size, redactNameErr(err, baseName)
+	}
 	if fi, err := os.Stat(path + deletedSuffix); err == nil && fi.Mode().IsRegular() {
 		tryDeleteAgain(path)
 		return nil, 0, &fs.PathError{Op: "open", Path: redacted, Err: fs.ErrNotExist}
 	}
-	f, err := os.Open(path)
+	f, err := openRegular(path, os.O_RDONLY, 0)
 	if err != nil {
-		return nil, 0, redactErr(err)
+		return nil, 0, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
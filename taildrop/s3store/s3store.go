@@ -0,0 +1,296 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package s3store contains a taildrop.Store implementation using an
+// S3-compatible object storage bucket.
+//
+// Completed files are stored as objects named by the configured key
+// prefix plus the file name. Files still being received are S3
+// multipart uploads to that same key.
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/taildrop"
+)
+
+// partSize is the size of each uploaded part of a multipart upload
+// other than the last. It's the minimum that S3 permits.
+const partSize = 5 << 20
+
+// s3Client is the subset of the S3 API used by Store, to allow
+// mocking it in tests.
+type s3Client interface {
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// Store is a taildrop.Store that stages files in an S3 bucket.
+type Store struct {
+	client s3Client
+	bucket string
+	prefix string
+}
+
+var _ taildrop.Store = (*Store)(nil)
+
+// New returns a new Store that keeps files in bucket, with object
+// keys prefixed by prefix (which may be empty).
+//
+// The AWS configuration (credentials, region) is loaded from the
+// environment. optFns can be used to customize the S3 client, such
+// as to use path-style addressing or a custom endpoint for other
+// S3-compatible services.
+func New(ctx context.Context, bucket, prefix string, optFns ...func(*s3.Options)) (*Store, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(s3.NewFromConfig(cfg, optFns...), bucket, prefix)
+}
+
+// newStore is New, but for tests.
+func newStore(client s3Client, bucket, prefix string) (*Store, error) {
+	if bucket == "" {
+		return nil, errors.New("s3store: empty bucket name")
+	}
+	return &Store{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *Store) String() string {
+	return fmt.Sprintf("s3store(%q)", "s3://"+s.bucket+"/"+s.prefix)
+}
+
+func (s *Store) key(name string) *string { return aws.String(s.prefix + name) }
+
+// isNotFound reports whether err is an S3 error for a missing object.
+func isNotFound(err error) bool {
+	var nf *s3Types.NotFound
+	var nsk *s3Types.NoSuchKey
+	return errors.As(err, &nf) || errors.As(err, &nsk)
+}
+
+// Stat implements taildrop.Store.
+func (s *Store) Stat(ctx context.Context, name string) (size int64, err error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return 0, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return 0, err
+	}
+	return out.ContentLength, nil
+}
+
+// List implements taildrop.Store.
+func (s *Store) List(ctx context.Context) ([]apitype.WaitingFile, error) {
+	var ret []apitype.WaitingFile
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range out.Contents {
+			name := strings.TrimPrefix(aws.ToString(o.Key), s.prefix)
+			if name == "" || strings.Contains(name, "/") {
+				// Not something we put there.
+				continue
+			}
+			ret = append(ret, apitype.WaitingFile{Name: name, Size: o.Size})
+		}
+	}
+	return ret, nil
+}
+
+// Open implements taildrop.Store.
+func (s *Store) Open(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, 0, err
+	}
+	return out.Body, out.ContentLength, nil
+}
+
+// Delete implements taildrop.Store.
+func (s *Store) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(name),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// OpenPartial implements taildrop.Store.
+//
+// Any multipart uploads for name left by earlier attempts are
+// aborted. A new multipart upload is created when the first part is
+// uploaded.
+func (s *Store) OpenPartial(ctx context.Context, name string) (taildrop.PartialFile, error) {
+	uploadIDs, err := s.findUploads(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range uploadIDs {
+		_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      s.key(name),
+			UploadId: aws.String(id),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &partialFile{s: s, ctx: ctx, key: s.key(name)}, nil
+}
+
+// findUploads returns the IDs of the multipart uploads in progress
+// for name.
+func (s *Store) findUploads(ctx context.Context, name string) ([]string, error) {
+	key := aws.ToString(s.key(name))
+	in := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(key),
+	}
+	var ids []string
+	for {
+		out, err := s.client.ListMultipartUploads(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range out.Uploads {
+			if aws.ToString(u.Key) == key {
+				ids = append(ids, aws.ToString(u.UploadId))
+			}
+		}
+		if !out.IsTruncated {
+			break
+		}
+		in.KeyMarker = out.NextKeyMarker
+		in.UploadIdMarker = out.NextUploadIdMarker
+	}
+	return ids, nil
+}
+
+// partialFile is a taildrop.PartialFile backed by an S3 multipart
+// upload. Each part but the last is partSize bytes.
+type partialFile struct {
+	s        *Store
+	ctx      context.Context // for Write, which has no context of its own
+	key      *string
+	uploadID *string // nil until the first part is uploaded
+
+	parts []s3Types.CompletedPart // uploaded so far, in order
+	buf   bytes.Buffer            // pending data for the next part
+}
+
+func (f *partialFile) Write(p []byte) (n int, err error) {
+	n, _ = f.buf.Write(p)
+	for f.buf.Len() >= partSize {
+		if err := f.uploadPart(f.ctx, f.buf.Next(partSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// uploadPart uploads b as the next part, starting the multipart
+// upload first if needed.
+func (f *partialFile) uploadPart(ctx context.Context, b []byte) error {
+	if f.uploadID == nil {
+		out, err := f.s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(f.s.bucket),
+			Key:    f.key,
+		})
+		if err != nil {
+			return err
+		}
+		f.uploadID = out.UploadId
+	}
+	num := int32(len(f.parts) + 1)
+	out, err := f.s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(f.s.bucket),
+		Key:        f.key,
+		UploadId:   f.uploadID,
+		PartNumber: num,
+		Body:       bytes.NewReader(b),
+	})
+	if err != nil {
+		return err
+	}
+	f.parts = append(f.parts, s3Types.CompletedPart{ETag: out.ETag, PartNumber: num})
+	return nil
+}
+
+func (f *partialFile) Commit(ctx context.Context) error {
+	if f.uploadID == nil {
+		// Small enough to never have needed a multipart upload.
+		_, err := f.s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(f.s.bucket),
+			Key:    f.key,
+			Body:   bytes.NewReader(f.buf.Bytes()),
+		})
+		return err
+	}
+	if f.buf.Len() > 0 || len(f.parts) == 0 {
+		if err := f.uploadPart(ctx, f.buf.Bytes()); err != nil {
+			return err
+		}
+		f.buf.Reset()
+	}
+	_, err := f.s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(f.s.bucket),
+		Key:             f.key,
+		UploadId:        f.uploadID,
+		MultipartUpload: &s3Types.CompletedMultipartUpload{Parts: f.parts},
+	})
+	return err
+}
+
+func (f *partialFile) Abort(ctx context.Context) error {
+	f.buf.Reset()
+	if f.uploadID == nil {
+		return nil
+	}
+	_, err := f.s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(f.s.bucket),
+		Key:      f.key,
+		UploadId: f.uploadID,
+	})
+	return err
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// mockedS3Client is an in-memory fake of the parts of S3 that Store
+// uses. It ignores the bucket name.
+type mockedS3Client struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*mockedUpload // by upload ID
+	nextID  int
+}
+
+type mockedUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int32][]byte
+}
+
+func newMockedS3Client() *mockedS3Client {
+	return &mockedS3Client{
+		objects: map[string][]byte{},
+		uploads: map[string]*mockedUpload{},
+	}
+}
+
+func (m *mockedS3Client) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[*in.Key]
+	if !ok {
+		return nil, &s3Types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: int64(len(b))}, nil
+}
+
+func (m *mockedS3Client) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[*in.Key]
+	if !ok {
+		return nil, &s3Types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}, nil
+}
+
+func (m *mockedS3Client) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[*in.Key] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockedS3Client) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockedS3Client) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &s3.ListObjectsV2Output{}
+	for k, b := range m.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			out.Contents = append(out.Contents, s3Types.Object{Key: aws.String(k), Size: int64(len(b))})
+		}
+	}
+	sort.Slice(out.Contents, func(i, j int) bool {
+		return *out.Contents[i].Key < *out.Contents[j].Key
+	})
+	return out, nil
+}
+
+func (m *mockedS3Client) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	id := fmt.Sprint(m.nextID)
+	m.uploads[id] = &mockedUpload{
+		key:       *in.Key,
+		initiated: time.Unix(int64(m.nextID), 0),
+		parts:     map[int32][]byte{},
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (m *mockedS3Client) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[*in.UploadId]
+	if !ok {
+		return nil, &s3Types.NoSuchUpload{}
+	}
+	u.parts[in.PartNumber] = b
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", in.PartNumber))}, nil
+}
+
+func (m *mockedS3Client) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[*in.UploadId]
+	if !ok {
+		return nil, &s3Types.NoSuchUpload{}
+	}
+	var b []byte
+	for _, p := range in.MultipartUpload.Parts {
+		b = append(b, u.parts[p.PartNumber]...)
+	}
+	m.objects[u.key] = b
+	delete(m.uploads, *in.UploadId)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockedS3Client) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockedS3Client) ListMultipartUploads(_ context.Context, in *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &s3.ListMultipartUploadsOutput{}
+	for id, u := range m.uploads {
+		if strings.HasPrefix(u.key, aws.ToString(in.Prefix)) {
+			out.Uploads = append(out.Uploads, s3Types.MultipartUpload{
+				Key:       aws.String(u.key),
+				UploadId:  aws.String(id),
+				Initiated: aws.Time(u.initiated),
+			})
+		}
+	}
+	return out, nil
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	mc := newMockedS3Client()
+	s, err := newStore(mc, "bucket", "files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat(ctx, "foo.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of missing file: got %v; want ErrNotExist", err)
+	}
+
+	put := func(name string, data []byte) {
+		t.Helper()
+		pf, err := s.OpenPartial(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := pf.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	small := []byte("hello")
+	big := bytes.Repeat([]byte("x"), partSize*2+123)
+	put("small.txt", small)
+	put("big.bin", big)
+	if len(mc.uploads) != 0 {
+		t.Errorf("%d multipart uploads left behind", len(mc.uploads))
+	}
+
+	files, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "big.bin" || files[0].Size != int64(len(big)) || files[1].Name != "small.txt" {
+		t.Fatalf("List = %+v", files)
+	}
+
+	rc, size, err := s.Open(ctx, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(big)) || !bytes.Equal(got, big) {
+		t.Fatalf("Open returned %d bytes (size %d); want %d", len(got), size, len(big))
+	}
+
+	if err := s.Delete(ctx, "small.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "small.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat after Delete: got %v; want ErrNotExist", err)
+	}
+}
+
+func TestStoreOpenPartialDiscardsLeftovers(t *testing.T) {
+	ctx := context.Background()
+	mc := newMockedS3Client()
+	s, err := newStore(mc, "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), partSize/5)
+
+	// Write a part and a bit, then get interrupted without aborting,
+	// as when the process exits.
+	pf, err := s.OpenPartial(ctx, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.Write(data[:partSize+10]); err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.uploads) != 1 {
+		t.Fatalf("%d multipart uploads after interruption; want 1", len(mc.uploads))
+	}
+
+	// Starting over aborts the leftover upload.
+	pf, err = s.OpenPartial(ctx, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left after reopening", len(mc.uploads))
+	}
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mc.objects["f"], data) {
+		t.Fatalf("object is %d bytes, not equal to the %d bytes written", len(mc.objects["f"]), len(data))
+	}
+
+	// Aborting discards everything.
+	pf, err = s.OpenPartial(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.uploads) != 0 {
+		t.Errorf("%d multipart uploads left after Abort", len(mc.uploads))
+	}
+}
@@ -4,7 +4,10 @@
 package taildrop
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
@@ -22,15 +25,21 @@ type incomingFile struct {
 
 	name           string // "foo.jpg"
 	started        time.Time
-	size           int64     // or -1 if unknown; never 0
+	size           int64     // or -1 if unknown; 0 for an empty file
 	w              io.Writer // underlying writer
 	sendFileNotify func()    // called when done
 	partialPath    string    // non-empty in direct mode
 
+	// saveKick, if non-nil, is signaled whenever sendFileNotify is
+	// called, to have the goroutine started by startSavingProgress
+	// persist the bytes copied so far.
+	saveKick chan struct{}
+
 	mu         sync.Mutex
 	copied     int64
 	done       bool
 	lastNotify time.Time
+	rate       transferRate
 }
 
 func (f *incomingFile) markAndNotifyDone() {
@@ -46,6 +55,12 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 	var needNotify bool
 	defer func() {
 		if needNotify {
+			if f.saveKick != nil {
+				select {
+				case f.saveKick <- struct{}{}:
+				default:
+				}
+			}
 			f.sendFileNotify()
 		}
 	}()
@@ -54,6 +69,7 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 		defer f.mu.Unlock()
 		f.copied += int64(n)
 		now := f.clock.Now()
+		f.rate.add(now, int64(n))
 		if f.lastNotify.IsZero() || now.Sub(f.lastNotify) > time.Second {
 			f.lastNotify = now
 			needNotify = true
@@ -62,10 +78,64 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// startSavingProgress starts a goroutine that calls save with the
+// bytes copied so far whenever Write signals f.saveKick, so that
+// persisting progress doesn't hold up the copy. The returned func
+// stops the goroutine and waits for it to exit.
+func (f *incomingFile) startSavingProgress(save func(copied int64)) (stop func()) {
+	f.saveKick = make(chan struct{}, 1)
+	stopc := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-f.saveKick:
+				f.mu.Lock()
+				copied := f.copied
+				f.mu.Unlock()
+				save(copied)
+			case <-stopc:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-done
+	}
+}
+
 // HandlePut receives a file.
 // It handles an HTTP PUT request to the "/v0/put/{filename}" endpoint,
 // where {filename} is a base filename.
 // It returns the number of bytes received and whether it was received successfully.
+//
+// Unless in DirectFileMode, the progress of transfers to Dir is kept in
+// a state file until they finish, so that if the receiving process
+// exits midway, IncomingFiles still reports them after it restarts.
+// See loadInterrupted.
+//
+// Empty files, sent with a Content-Length of zero, are received like
+// any other: they're reported by IncomingFiles until done, including
+// as Done in direct mode, and finalized even though nothing was
+// written to them.
+//
+// A file may be sent as one of a transfer group, with the group's name
+// (letters, digits, '-' and '_', chosen by the sender) in the
+// GroupHeader and the number of files in it in the GroupSizeHeader.
+// The group's files are staged out of sight as they're received, and
+// only moved to Dir together once all have been, so that consumers
+// don't act on half a dataset. A member that fails can be resent like
+// any other file, and one already staged is refused like an existing
+// file. Groups are kept apart per sender, and one that isn't added to
+// for a day is deleted. Groups aren't supported with Store, or
+// in DirectFileMode with AvoidFinalRename.
+//
+// A file that already exists is refused with status 409 (Conflict).
+// If Dir is on a case-insensitive file system, as is usual on macOS
+// and Windows, so is one whose name differs from an existing file's or
+// another transfer's only in case, rather than overwriting it.
 func (h *Handler) HandlePut(w http.ResponseWriter, r *http.Request) (finalSize int64, success bool) {
 	if !envknob.CanTaildrop() {
 		http.Error(w, "Taildrop disabled on device", http.StatusForbidden)
@@ -75,11 +145,11 @@ func (h *Handler) HandlePut(w http.ResponseWriter, r *http.Request) (finalSize i
 		http.Error(w, "expected method PUT", http.StatusMethodNotAllowed)
 		return finalSize, success
 	}
-	if h == nil || h.Dir == "" {
+	if h == nil || !h.hasStorage() {
 		http.Error(w, errNoTaildrop.Error(), http.StatusInternalServerError)
 		return finalSize, success
 	}
-	if distro.Get() == distro.Unraid && !h.DirectFileMode {
+	if distro.Get() == distro.Unraid && !h.DirectFileMode && h.Store == nil {
 		http.Error(w, "Taildrop folder not configured or accessible", http.StatusInternalServerError)
 		return finalSize, success
 	}
@@ -107,63 +177,124 @@ func (h *Handler) HandlePut(w http.ResponseWriter, r *http.Request) (finalSize i
 		http.Error(w, "bad filename", http.StatusBadRequest)
 		return finalSize, success
 	}
+	if h.FileNamePolicy != nil {
+		baseName = h.FileNamePolicy.FileName(baseName, h.Clock.Now())
+		if dstFile, ok = h.diskPath(baseName); !ok {
+			h.Logf("put: FileNamePolicy returned a bad filename")
+			http.Error(w, "bad filename from file name policy", http.StatusInternalServerError)
+			return finalSize, success
+		}
+	}
+	group, inGroup, err := parseGroup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return finalSize, success
+	}
+	if inGroup && (h.Store != nil || (h.DirectFileMode && h.AvoidFinalRename)) {
+		http.Error(w, "transfer groups not supported", http.StatusNotImplemented)
+		return finalSize, success
+	}
+	if h.Store != nil {
+		return h.putToStore(w, r, baseName)
+	}
 	// TODO(bradfitz): prevent same filename being sent by two peers at once
 
-	// prevent same filename being sent twice
-	if _, err := os.Stat(dstFile); err == nil {
+	// prevent same filename being sent twice. Use Lstat so that a
+	// symlink, even a dangling one, also counts as existing.
+	if _, err := os.Lstat(dstFile); err == nil {
+		http.Error(w, "file exists", http.StatusConflict)
+		return finalSize, success
+	}
+	if inGroup {
+		if _, err := os.Lstat(h.groupPath(group, baseName)); err == nil {
+			http.Error(w, "file exists", http.StatusConflict)
+			return finalSize, success
+		}
+	}
+	// On case-insensitive file systems, a file whose name differs
+	// only in case is the same file, so also counts as existing.
+	if h.caseConflict(baseName) {
 		http.Error(w, "file exists", http.StatusConflict)
 		return finalSize, success
 	}
 
 	partialFile := dstFile + partialSuffix
-	f, err := os.Create(partialFile)
+	f, err := openRegular(partialFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		h.Logf("put Create error: %v", redactErr(err))
+		h.Logf("put Create error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return finalSize, success
 	}
 	defer func() {
 		if !success {
 			os.Remove(partialFile)
+			h.removeProgress(baseName)
 		}
 	}()
-	var inFile *incomingFile
+	started := h.Clock.Now()
 	sendFileNotify := h.SendFileNotify
 	if sendFileNotify == nil {
 		sendFileNotify = func() {} // avoid nil panics below
 	}
-	if r.ContentLength != 0 {
-		inFile = &incomingFile{
-			clock:          h.Clock,
-			name:           baseName,
-			started:        h.Clock.Now(),
-			size:           r.ContentLength,
-			w:              f,
-			sendFileNotify: sendFileNotify,
-		}
-		if h.DirectFileMode {
-			inFile.partialPath = partialFile
-		}
-		h.incomingFiles.Store(inFile, struct{}{})
-		defer h.incomingFiles.Delete(inFile)
-		n, err := io.Copy(inFile, r.Body)
-		if err != nil {
-			err = redactErr(err)
-			f.Close()
-			h.Logf("put Copy error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return finalSize, success
+	size := r.ContentLength
+	inFile := &incomingFile{
+		clock:          h.Clock,
+		name:           baseName,
+		started:        started,
+		size:           size,
+		w:              f,
+		sendFileNotify: sendFileNotify,
+		rate:           transferRate{sampleStart: h.Clock.Now()},
+	}
+	stopSaving := func() {}
+	if h.DirectFileMode {
+		inFile.partialPath = partialFile
+	} else {
+		save := func(copied int64) {
+			if err := h.saveProgress(transferProgress{
+				Name:         baseName,
+				Started:      started,
+				DeclaredSize: size,
+				Received:     copied,
+			}); err != nil {
+				h.Logf("put saving progress: %v", err)
+			}
 		}
-		finalSize = n
+		h.loadInterrupted()
+		h.interrupted.Delete(baseName)
+		save(0)
+		stopSaving = inFile.startSavingProgress(save)
+	}
+	h.incomingFiles.Store(inFile, struct{}{})
+	defer h.incomingFiles.Delete(inFile)
+	n, err := io.Copy(inFile, r.Body)
+	stopSaving() // before the progress is removed, so it's not saved again
+	if err != nil {
+		err = redactErr(err)
+		f.Close()
+		h.Logf("put Copy error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return finalSize, success
 	}
+	finalSize = n
 	if err := redactErr(f.Close()); err != nil {
 		h.Logf("put Close error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return finalSize, success
 	}
 	if h.DirectFileMode && h.AvoidFinalRename {
-		if inFile != nil { // non-zero length; TODO: notify even for zero length
-			inFile.markAndNotifyDone()
+		inFile.markAndNotifyDone()
+	} else if inGroup {
+		if err := h.stageGroupMember(group, partialFile, baseName); err != nil {
+			if errors.Is(err, errGroupMemberExists) {
+				// Another transfer of the same name finished
+				// staging first.
+				http.Error(w, err.Error(), http.StatusConflict)
+				return finalSize, success
+			}
+			h.Logf("put staging transfer group: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return finalSize, success
 		}
 	} else {
 		if err := os.Rename(partialFile, dstFile); err != nil {
@@ -174,6 +305,8 @@ func (h *Handler) HandlePut(w http.ResponseWriter, r *http.Request) (finalSize i
 		}
 	}
 
+	h.removeProgress(baseName)
+
 	// TODO: set modtime
 	// TODO: some real response
 	success = true
@@ -182,3 +315,82 @@ func (h *Handler) HandlePut(w http.ResponseWriter, r *http.Request) (finalSize i
 	sendFileNotify()
 	return finalSize, success
 }
+
+// putToStore is the part of HandlePut that stages the received file
+// in h.Store rather than on the local disk.
+//
+// If a transfer fails, whatever was already stored for it is aborted,
+// so that nothing is left behind (such as an incomplete multipart
+// upload that's billed until it's cleaned up).
+func (h *Handler) putToStore(w http.ResponseWriter, r *http.Request, baseName string) (finalSize int64, success bool) {
+	ctx := r.Context()
+
+	// prevent same filename being sent twice
+	if _, err := h.Store.Stat(ctx, baseName); err == nil {
+		http.Error(w, "file exists", http.StatusConflict)
+		return finalSize, success
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		err = redactNameErr(err, baseName)
+		h.Logf("put Stat error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return finalSize, success
+	}
+
+	pf, err := h.Store.OpenPartial(ctx, baseName)
+	if err != nil {
+		err = redactNameErr(err, baseName)
+		h.Logf("put OpenPartial error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return finalSize, success
+	}
+	defer func() {
+		if success {
+			return
+		}
+		// The request's context may be what failed the transfer,
+		// so don't use it to clean up.
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		if err := pf.Abort(ctx); err != nil {
+			h.Logf("put Abort error: %v", redactNameErr(err, baseName))
+		}
+	}()
+	sendFileNotify := h.SendFileNotify
+	if sendFileNotify == nil {
+		sendFileNotify = func() {} // avoid nil panics below
+	}
+	inFile := &incomingFile{
+		clock:          h.Clock,
+		name:           baseName,
+		started:        h.Clock.Now(),
+		size:           r.ContentLength,
+		w:              pf,
+		sendFileNotify: sendFileNotify,
+		rate:           transferRate{sampleStart: h.Clock.Now()},
+	}
+	h.incomingFiles.Store(inFile, struct{}{})
+	defer h.incomingFiles.Delete(inFile)
+	finalSize, err = io.Copy(inFile, r.Body)
+	if err != nil {
+		err = redactNameErr(err, baseName)
+		h.Logf("put Copy error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return finalSize, success
+	}
+	if err := pf.Commit(ctx); err != nil {
+		err = redactNameErr(err, baseName)
+		h.Logf("put Commit error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return finalSize, success
+	}
+
+	success = true
+	io.WriteString(w, "{}\n")
+	h.knownEmpty.Store(false)
+	sendFileNotify()
+	return finalSize, success
+}
+
+// abortTimeout is how long putToStore waits for a failed transfer's
+// PartialFile to be aborted.
+const abortTimeout = 30 * time.Second
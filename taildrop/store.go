@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"context"
+	"io"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Store is a storage backend for the staging area of received files.
+// It's an alternative to staging files in [Handler.Dir] on the local
+// disk, such as a bucket in an object storage service, for headless
+// receivers that never need the files locally.
+//
+// Names passed to a Store have already been validated as safe base
+// filenames. Implementations must be safe for concurrent use.
+type Store interface {
+	// Stat returns the size of the completed file name.
+	// It returns an error satisfying errors.Is(err, fs.ErrNotExist)
+	// if no such completed file exists.
+	Stat(ctx context.Context, name string) (size int64, err error)
+
+	// List returns all completed files in the store.
+	List(ctx context.Context) ([]apitype.WaitingFile, error)
+
+	// Open opens the completed file name for reading.
+	Open(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error)
+
+	// Delete deletes the completed file name. Deleting a file that
+	// doesn't exist is not an error.
+	Delete(ctx context.Context, name string) error
+
+	// OpenPartial begins storing the file name, discarding anything
+	// stored for it by an earlier attempt that was neither committed
+	// nor aborted, as when the process exited midway. The file isn't
+	// visible to Stat, List, or Open until the returned PartialFile
+	// is committed.
+	OpenPartial(ctx context.Context, name string) (PartialFile, error)
+}
+
+// PartialFile is a file being written to a Store.
+//
+// Exactly one of Commit or Abort must be called when done writing.
+type PartialFile interface {
+	io.Writer
+
+	// Commit completes the file, making it visible in the store.
+	Commit(ctx context.Context) error
+
+	// Abort discards the file and any data stored for it.
+	Abort(ctx context.Context) error
+}
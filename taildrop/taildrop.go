@@ -12,11 +12,13 @@
 import (
 	"errors"
 	"hash/adler32"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
@@ -56,6 +58,15 @@ type Handler struct {
 	// we should avoid renaming "foo.jpg.partial" to "foo.jpg" after reception.
 	AvoidFinalRename bool
 
+	// Store, if non-nil, is where received files are staged
+	// instead of in Dir on the local disk. Dir is then unused.
+	// It must not be used with DirectFileMode.
+	Store Store
+
+	// FileNamePolicy, if non-nil, transforms the base names of
+	// received files before they're stored.
+	FileNamePolicy FileNamePolicy
+
 	// SendFileNotify is called periodically while a file is actively
 	// receiving the contents for the file. There is a final call
 	// to the function when reception completes.
@@ -64,12 +75,33 @@ type Handler struct {
 
 	knownEmpty atomic.Bool
 
+	// storeHasFilesUntil, if non-zero, is the UnixNano time until
+	// which HasFilesWaiting reports true without listing Store.
+	storeHasFilesUntil atomic.Int64
+
 	incomingFiles syncs.Map[*incomingFile, struct{}]
+
+	// interrupted are the transfers to Dir that a previous process
+	// didn't finish, keyed by name. See loadInterrupted.
+	interruptedOnce sync.Once
+	interrupted     syncs.Map[string, interruptedTransfer]
+
+	// isCaseInsensitive, if non-nil, reports whether a directory is
+	// on a case-insensitive file system, instead of detecting it, for
+	// tests. See dirCaseInsensitive.
+	isCaseInsensitive func(dir string) bool
+	caseOnce          sync.Once
+	caseInsensitive   bool
+
+	// groupMu serializes staging the files of transfer groups, so
+	// that each group is published once. See stageGroupMember.
+	groupMu sync.Mutex
 }
 
 var (
 	errNilHandler = errors.New("handler unavailable; not listening")
 	errNoTaildrop = errors.New("Taildrop disabled; no storage directory")
+	errNotRegular = errors.New("not a regular file")
 )
 
 const (
@@ -136,6 +168,42 @@ func (s *Handler) diskPath(baseName string) (fullPath string, ok bool) {
 	return filepath.Join(s.Dir, baseName), true
 }
 
+// openRegular is like os.OpenFile, but only opens regular files.
+// A symlink, FIFO, device node, or other special file at path (such
+// as one planted in Dir by another local user to redirect or stall a
+// transfer) is neither followed nor written to. The returned error is
+// already redacted.
+func openRegular(path string, flag int, perm fs.FileMode) (*os.File, error) {
+	notRegular := &fs.PathError{Op: "open", Path: redacted, Err: errNotRegular}
+	if fi, err := os.Lstat(path); err == nil && !fi.Mode().IsRegular() {
+		return nil, notRegular
+	}
+	f, err := os.OpenFile(path, flag|openSafeFlags, perm)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	// Check again on the open file, in case path was swapped out
+	// between the Lstat and the open.
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, redactErr(err)
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, notRegular
+	}
+	return f, nil
+}
+
+// hasStorage reports whether s has somewhere to store received files.
+func (s *Handler) hasStorage() bool {
+	return s.Dir != "" || s.Store != nil
+}
+
+// IncomingFiles returns the files being received, including those to
+// Dir whose transfers a previous process didn't finish, until they're
+// abandoned.
 func (s *Handler) IncomingFiles() []ipn.PartialFile {
 	// Make sure we always set n.IncomingFiles non-nil so it gets encoded
 	// in JSON to clients. They distinguish between empty and non-nil
@@ -144,16 +212,37 @@ func (s *Handler) IncomingFiles() []ipn.PartialFile {
 	s.incomingFiles.Range(func(f *incomingFile, _ struct{}) bool {
 		f.mu.Lock()
 		defer f.mu.Unlock()
-		files = append(files, ipn.PartialFile{
+		pf := ipn.PartialFile{
 			Name:         f.name,
 			Started:      f.started,
 			DeclaredSize: f.size,
 			Received:     f.copied,
 			PartialPath:  f.partialPath,
 			Done:         f.done,
-		})
+		}
+		if !f.done {
+			now := f.clock.Now()
+			pf.BytesPerSecond = f.rate.bytesPerSecond(now)
+			if t := eta(now, f.size, f.copied, pf.BytesPerSecond); !t.IsZero() {
+				pf.ETA = &t
+			}
+		}
+		files = append(files, pf)
+		return true
+	})
+	s.loadInterrupted()
+	var abandoned []string
+	s.interrupted.Range(func(name string, it interruptedTransfer) bool {
+		if s.Clock.Since(it.saved) > abandonedAge {
+			abandoned = append(abandoned, name)
+		} else {
+			files = append(files, it.pf)
+		}
 		return true
 	})
+	for _, name := range abandoned {
+		s.removeAbandoned(name)
+	}
 	return files
 }
 
@@ -180,6 +269,19 @@ func redactString(s string) string {
 	return string(b)
 }
 
+// redactNameErr is like redactErr, but for errors from a Store, which
+// might mention the name of the file in any form, it also redacts name.
+func redactNameErr(err error, name string) error {
+	if err == nil {
+		return nil
+	}
+	err = redactErr(err)
+	if s := err.Error(); strings.Contains(s, name) {
+		return &redactedErr{msg: strings.ReplaceAll(s, name, redactString(name)), inner: err}
+	}
+	return err
+}
+
 func redactErr(root error) error {
 	// redactStrings is a list of sensitive strings that were redacted.
 	// It is not sufficient to just snub out sensitive fields in Go errors
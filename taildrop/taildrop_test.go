@@ -4,13 +4,31 @@
 package taildrop
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+	"tailscale.com/util/mak"
 )
 
 // Tests "foo.jpg.deleted" marks (for Windows).
@@ -90,6 +108,81 @@ func TestDeletedMarkers(t *testing.T) {
 	}
 }
 
+// putFile calls h.HandlePut to receive a file named base containing
+// contents, returning the HTTP status code.
+func putFile(h *Handler, base, contents string) int {
+	req := httptest.NewRequest("PUT", "/v0/put/"+base, strings.NewReader(contents))
+	rec := httptest.NewRecorder()
+	h.HandlePut(rec, req)
+	return rec.Code
+}
+
+func TestSymlinksNotFollowed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	dir := t.TempDir()
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Dir: dir}
+
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(victim, []byte("precious"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	wantVictimIntact := func() {
+		t.Helper()
+		if b, err := os.ReadFile(victim); err != nil || string(b) != "precious" {
+			t.Fatalf("victim = %q, %v; want unmodified", b, err)
+		}
+	}
+	symlink := func(base string) {
+		t.Helper()
+		if err := os.Symlink(victim, filepath.Join(dir, base)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A symlink where the partial file goes must not be written through.
+	symlink("a.txt" + partialSuffix)
+	if code := putFile(h, "a.txt", "evil"); code != http.StatusInternalServerError {
+		t.Errorf("put via partial symlink: code = %d; want %d", code, http.StatusInternalServerError)
+	}
+	wantVictimIntact()
+
+	// A symlink at the final name, even a dangling one, counts as existing.
+	symlink("b.txt")
+	if code := putFile(h, "b.txt", "evil"); code != http.StatusConflict {
+		t.Errorf("put over symlink: code = %d; want %d", code, http.StatusConflict)
+	}
+	if err := os.Symlink(filepath.Join(dir, "nonexistent"), filepath.Join(dir, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if code := putFile(h, "c.txt", "evil"); code != http.StatusConflict {
+		t.Errorf("put over dangling symlink: code = %d; want %d", code, http.StatusConflict)
+	}
+	wantVictimIntact()
+
+	// Nor can a symlink be used to read files outside Dir.
+	if rc, _, err := h.OpenFile("b.txt"); err == nil {
+		rc.Close()
+		t.Fatal("OpenFile followed symlink")
+	} else if !errors.Is(err, errNotRegular) {
+		t.Errorf("OpenFile error = %v; want %v", err, errNotRegular)
+	}
+
+	// Regular files still work.
+	if code := putFile(h, "d.txt", "hello"); code != http.StatusOK {
+		t.Fatalf("put regular file: code = %d; want %d", code, http.StatusOK)
+	}
+	rc, size, err := h.OpenFile("d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if size != 5 {
+		t.Errorf("size = %d; want 5", size)
+	}
+}
+
 func TestRedactErr(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -153,3 +246,563 @@ func TestRedactErr(t *testing.T) {
 		})
 	}
 }
+
+// memStore is an in-memory Store for tests.
+type memStore struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	partials map[string][]byte
+	lists    int // number of List calls
+}
+
+func (s *memStore) Stat(ctx context.Context, name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[name]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+func (s *memStore) List(ctx context.Context) (ret []apitype.WaitingFile, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	for name, b := range s.files {
+		ret = append(ret, apitype.WaitingFile{Name: name, Size: int64(len(b))})
+	}
+	return ret, nil
+}
+
+func (s *memStore) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[name]
+	if !ok {
+		return nil, 0, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (s *memStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memStore) OpenPartial(ctx context.Context, name string) (PartialFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.partials, name)
+	return &memPartial{s: s, name: name}, nil
+}
+
+type memPartial struct {
+	s    *memStore
+	name string
+}
+
+func (p *memPartial) Write(b []byte) (int, error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	mak.Set(&p.s.partials, p.name, append(p.s.partials[p.name], b...))
+	return len(b), nil
+}
+
+func (p *memPartial) Commit(ctx context.Context) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	mak.Set(&p.s.files, p.name, p.s.partials[p.name])
+	delete(p.s.partials, p.name)
+	return nil
+}
+
+func (p *memPartial) Abort(ctx context.Context) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	delete(p.s.partials, p.name)
+	return nil
+}
+
+func TestPutToStoreAbort(t *testing.T) {
+	st := &memStore{}
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Store: st}
+
+	put := func(body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/v0/put/foo.txt", body)
+		rec := httptest.NewRecorder()
+		h.HandlePut(rec, req)
+		return rec
+	}
+	partial := func() (string, bool) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		b, ok := st.partials["foo.txt"]
+		return string(b), ok
+	}
+
+	// A transfer that fails midway leaves nothing behind.
+	rec := put(io.MultiReader(strings.NewReader("hello, "), iotest.ErrReader(errors.New("boom"))))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("interrupted put: code = %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if got, ok := partial(); ok {
+		t.Fatalf("partial after interrupted put = %q; want none", got)
+	}
+
+	// What an earlier attempt left without aborting, as when the
+	// process exited, is discarded.
+	mak.Set(&st.partials, "foo.txt", []byte("stale"))
+	if rec = put(strings.NewReader("fresh")); rec.Code != http.StatusOK {
+		t.Fatalf("fresh put: code = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := string(st.files["foo.txt"]), "fresh"; got != want {
+		t.Fatalf("fresh file = %q; want %q", got, want)
+	}
+}
+
+func TestPutToDirInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Now()})
+	h := &Handler{Logf: t.Logf, Clock: clock, Dir: dir}
+	partialFile := filepath.Join(dir, "foo.txt"+partialSuffix)
+
+	// A transfer that fails leaves nothing behind.
+	req := httptest.NewRequest("PUT", "/v0/put/foo.txt", io.MultiReader(strings.NewReader("hello, "), iotest.ErrReader(errors.New("boom"))))
+	rec := httptest.NewRecorder()
+	h.HandlePut(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failed put: code = %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if files := h.IncomingFiles(); len(files) != 0 {
+		t.Errorf("IncomingFiles after failed put = %+v; want none", files)
+	}
+	if _, err := os.Lstat(partialFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("partial file after failed put: %v; want not exist", err)
+	}
+	if des, _ := os.ReadDir(filepath.Join(dir, progressDir)); len(des) != 0 {
+		t.Errorf("%d progress files left after failed put", len(des))
+	}
+
+	// What a transfer leaves when the process exits midway.
+	started := clock.Now()
+	if err := os.WriteFile(partialFile, []byte("hello, "), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.saveProgress(transferProgress{Name: "foo.txt", Started: started, DeclaredSize: 12, Received: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new Handler, as after a restart, still reports the transfer.
+	h = &Handler{Logf: t.Logf, Clock: clock, Dir: dir}
+	files := h.IncomingFiles()
+	if len(files) != 1 {
+		t.Fatalf("IncomingFiles after restart = %+v; want 1 file", files)
+	}
+	if f := files[0]; f.Name != "foo.txt" || f.Received != 7 || f.DeclaredSize != 12 || !f.Started.Equal(started) {
+		t.Errorf("IncomingFiles after restart = %+v; want foo.txt started with 7 of 12 bytes", f)
+	}
+
+	// Once abandoned, it's deleted.
+	clock.Advance(abandonedAge + time.Hour)
+	if files := h.IncomingFiles(); len(files) != 0 {
+		t.Errorf("IncomingFiles after abandoned = %+v; want none", files)
+	}
+	if _, err := os.Lstat(partialFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("partial file after abandoned: %v; want not exist", err)
+	}
+	if des, _ := os.ReadDir(filepath.Join(dir, progressDir)); len(des) != 0 {
+		t.Errorf("%d progress files left after abandoned", len(des))
+	}
+}
+
+func TestPutEmptyFile(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *Handler
+	}{
+		{"dir", &Handler{Dir: t.TempDir()}},
+		{"direct", &Handler{Dir: t.TempDir(), DirectFileMode: true, AvoidFinalRename: true}},
+		{"store", &Handler{Store: &memStore{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.h
+			h.Logf = t.Logf
+			h.Clock = tstime.StdClock{}
+			var notifies int
+			var done []string
+			h.SendFileNotify = func() {
+				notifies++
+				for _, f := range h.IncomingFiles() {
+					if f.DeclaredSize != 0 || f.Received != 0 {
+						t.Errorf("IncomingFiles = %+v; want 0 bytes declared and received", f)
+					}
+					if f.Done {
+						done = append(done, f.Name)
+					}
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			size, ok := h.HandlePut(rec, httptest.NewRequest("PUT", "/v0/put/empty.txt", strings.NewReader("")))
+			if !ok || size != 0 || rec.Code != http.StatusOK {
+				t.Fatalf("HandlePut = %d, %v, code %d; want 0, true, 200: %s", size, ok, rec.Code, rec.Body)
+			}
+			if notifies == 0 {
+				t.Error("no file notify")
+			}
+
+			if h.AvoidFinalRename {
+				if len(done) == 0 || done[0] != "empty.txt" {
+					t.Errorf("files notified as done = %q; want empty.txt", done)
+				}
+				fi, err := os.Stat(filepath.Join(h.Dir, "empty.txt"+partialSuffix))
+				if err != nil || fi.Size() != 0 {
+					t.Errorf("partial file = %v, %v; want empty file", fi, err)
+				}
+				if _, err := os.Lstat(filepath.Join(h.Dir, progressDir)); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("progress dir in direct mode: %v; want not exist", err)
+				}
+				return
+			}
+			files, err := h.WaitingFiles()
+			if err != nil || len(files) != 1 || files[0].Name != "empty.txt" || files[0].Size != 0 {
+				t.Fatalf("WaitingFiles = %+v, %v; want just empty.txt with 0 bytes", files, err)
+			}
+			rc, n, err := h.OpenFile("empty.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc.Close()
+			if n != 0 {
+				t.Errorf("OpenFile size = %d; want 0", n)
+			}
+			if h.Dir != "" {
+				if des, _ := os.ReadDir(filepath.Join(h.Dir, progressDir)); len(des) != 0 {
+					t.Errorf("%d progress files left after put", len(des))
+				}
+			}
+		})
+	}
+}
+
+func TestHasFilesWaitingStore(t *testing.T) {
+	st := &memStore{}
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Store: st}
+
+	lists := func() int {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.lists
+	}
+
+	if h.HasFilesWaiting() {
+		t.Fatal("files waiting in empty store")
+	}
+	if h.HasFilesWaiting() || lists() != 1 {
+		t.Fatalf("empty store listed %d times; want 1", lists())
+	}
+
+	if code := putFile(h, "foo.txt", "hi"); code != http.StatusOK {
+		t.Fatalf("put: code = %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if !h.HasFilesWaiting() {
+			t.Fatal("no files waiting after put")
+		}
+	}
+	if got := lists(); got != 2 {
+		t.Fatalf("non-empty store listed %d times; want 2", got)
+	}
+
+	if err := h.DeleteFile("foo.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if h.HasFilesWaiting() {
+		t.Fatal("files waiting after delete")
+	}
+	if got := lists(); got != 3 {
+		t.Fatalf("store listed %d times after delete; want 3", got)
+	}
+}
+
+func TestFileNamePolicies(t *testing.T) {
+	now := time.Date(2023, 9, 8, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy FileNamePolicy
+		in     string
+		want   string
+	}{
+		{SlugifyPolicy, "My Photo (1).JPG", "my-photo-1.jpg"},
+		{SlugifyPolicy, "résumé.pdf", "r-sum.pdf"},
+		{SlugifyPolicy, "README", "readme"},
+		{SlugifyPolicy, "!!!.txt", "file.txt"},
+		{SlugifyPolicy, "archive.tar.gz", "archive-tar.gz"},
+		{DatePrefixPolicy, "foo.jpg", "2023-09-08 foo.jpg"},
+		{ChainFileNamePolicies(SlugifyPolicy, DatePrefixPolicy), "Foo Bar.JPG", "2023-09-08 foo-bar.jpg"},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.FileName(tt.in, now); got != tt.want {
+			t.Errorf("FileName(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Dir: dir, FileNamePolicy: SlugifyPolicy}
+	if code := putFile(h, "Hello%20World.TXT", "hi"); code != http.StatusOK {
+		t.Fatalf("put: code = %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hello-world.txt")); err != nil {
+		t.Fatalf("file not stored under policy name: %v", err)
+	}
+
+	h.FileNamePolicy = FileNamePolicyFunc(func(string, time.Time) string { return "../escape" })
+	if code := putFile(h, "foo.txt", "hi"); code != http.StatusInternalServerError {
+		t.Fatalf("put with bad policy name: code = %d; want %d", code, http.StatusInternalServerError)
+	}
+}
+
+func TestPutCaseInsensitive(t *testing.T) {
+	put := func(h *Handler, name string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.HandlePut(rec, httptest.NewRequest("PUT", "/v0/put/"+name, strings.NewReader("data")))
+		return rec.Code
+	}
+	for _, insensitive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("insensitive=%v", insensitive), func(t *testing.T) {
+			h := &Handler{
+				Logf:              t.Logf,
+				Clock:             tstime.StdClock{},
+				Dir:               t.TempDir(),
+				isCaseInsensitive: func(string) bool { return insensitive },
+			}
+			if code := put(h, "Report.PDF"); code != http.StatusOK {
+				t.Fatalf("put Report.PDF = %d; want 200", code)
+			}
+			// A transfer of a name in another case that was
+			// interrupted, still partial.
+			if err := os.WriteFile(filepath.Join(h.Dir, "Notes.txt"+partialSuffix), []byte("da"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			want := http.StatusOK
+			if insensitive {
+				want = http.StatusConflict
+			}
+			for _, name := range []string{"report.pdf", "notes.TXT"} {
+				if code := put(h, name); code != want {
+					t.Errorf("put %s = %d; want %d", name, code, want)
+				}
+			}
+			if code := put(h, "Report.PDF"); code != http.StatusConflict {
+				t.Errorf("put Report.PDF again = %d; want 409", code)
+			}
+		})
+	}
+}
+
+func TestPutGroup(t *testing.T) {
+	h := &Handler{
+		Logf:  t.Logf,
+		Clock: tstime.StdClock{},
+		Dir:   t.TempDir(),
+	}
+	putFrom := func(remoteAddr, name, group, size string) int {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/v0/put/"+name, strings.NewReader("data "+name))
+		req.RemoteAddr = remoteAddr
+		if group != "" {
+			req.Header.Set(GroupHeader, group)
+			req.Header.Set(GroupSizeHeader, size)
+		}
+		rec := httptest.NewRecorder()
+		h.HandlePut(rec, req)
+		return rec.Code
+	}
+	put := func(name, group, size string) int {
+		t.Helper()
+		return putFrom("192.0.2.1:1234", name, group, size)
+	}
+	waiting := func() []string {
+		t.Helper()
+		files, err := h.WaitingFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, bad := range [][2]string{{"../x", "2"}, {"g", "0"}, {"g", "x"}} {
+		if code := put("bad.txt", bad[0], bad[1]); code != http.StatusBadRequest {
+			t.Errorf("put with group %q size %q = %d; want 400", bad[0], bad[1], code)
+		}
+	}
+
+	if code := put("a.txt", "set1", "2"); code != http.StatusOK {
+		t.Fatalf("put a.txt = %d; want 200", code)
+	}
+	if got := waiting(); len(got) != 0 {
+		t.Fatalf("waiting files after first of group = %q; want none", got)
+	}
+	if code := put("a.txt", "set1", "2"); code != http.StatusConflict {
+		t.Errorf("put a.txt again = %d; want 409", code)
+	}
+	if code := put("lone.txt", "", ""); code != http.StatusOK {
+		t.Fatalf("put lone.txt = %d; want 200", code)
+	}
+	if got, want := waiting(), []string{"lone.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("waiting files = %q; want %q", got, want)
+	}
+	if code := put("b.txt", "set1", "2"); code != http.StatusOK {
+		t.Fatalf("put b.txt = %d; want 200", code)
+	}
+	if got, want := waiting(), []string{"a.txt", "b.txt", "lone.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("waiting files after group complete = %q; want %q", got, want)
+	}
+	if b, err := os.ReadFile(filepath.Join(h.Dir, "a.txt")); err != nil || string(b) != "data a.txt" {
+		t.Errorf("a.txt = %q, %v; want %q", b, err, "data a.txt")
+	}
+	if des, _ := os.ReadDir(filepath.Join(h.Dir, groupDir)); len(des) != 0 {
+		t.Errorf("%d group staging dirs left after group complete", len(des))
+	}
+
+	// Groups of the same ID from different senders are kept apart.
+	if code := putFrom("192.0.2.1:1234", "c.txt", "set2", "2"); code != http.StatusOK {
+		t.Fatalf("put c.txt = %d; want 200", code)
+	}
+	if code := putFrom("192.0.2.2:1234", "d.txt", "set2", "2"); code != http.StatusOK {
+		t.Fatalf("put d.txt from other sender = %d; want 200", code)
+	}
+	if got, want := waiting(), []string{"a.txt", "b.txt", "lone.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("waiting files after two senders' halves of set2 = %q; want %q", got, want)
+	}
+
+	// A group that's not added to for abandonedAge is deleted.
+	des, err := os.ReadDir(filepath.Join(h.Dir, groupDir))
+	if err != nil || len(des) != 2 {
+		t.Fatalf("group staging dirs = %v, %v; want 2", des, err)
+	}
+	old := time.Now().Add(-abandonedAge - time.Hour)
+	for _, de := range des {
+		if err := os.Chtimes(filepath.Join(h.Dir, groupDir, de.Name()), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h = &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Dir: h.Dir} // as after a restart
+	h.IncomingFiles()
+	if des, _ := os.ReadDir(filepath.Join(h.Dir, groupDir)); len(des) != 0 {
+		t.Errorf("%d abandoned group staging dirs left", len(des))
+	}
+}
+
+func TestStageGroupMemberExists(t *testing.T) {
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Dir: t.TempDir()}
+	g := transferGroup{id: "g", size: 2, dir: "g"}
+	for i, want := range []error{nil, errGroupMemberExists} {
+		partial := filepath.Join(h.Dir, "a.txt"+partialSuffix)
+		if err := os.WriteFile(partial, []byte(fmt.Sprint(i)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.stageGroupMember(g, partial, "a.txt"); err != want {
+			t.Fatalf("stageGroupMember #%d = %v; want %v", i, err, want)
+		}
+	}
+	if b, err := os.ReadFile(h.groupPath(g, "a.txt")); err != nil || string(b) != "0" {
+		t.Errorf("staged a.txt = %q, %v; want the first one", b, err)
+	}
+}
+
+func TestIsCaseInsensitiveDir(t *testing.T) {
+	dir := t.TempDir()
+	got := isCaseInsensitiveDir(dir)
+	if want := runtime.GOOS == "windows" || runtime.GOOS == "darwin"; got != want {
+		// Either can be configured otherwise, but not in CI.
+		t.Logf("isCaseInsensitiveDir = %v; usual for %s is %v", got, runtime.GOOS, want)
+	}
+	if des, _ := os.ReadDir(dir); len(des) != 0 {
+		t.Errorf("%d files left in dir after detection", len(des))
+	}
+}
+
+func TestTransferRate(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := transferRate{sampleStart: start}
+
+	// Nothing is known until a sample completes.
+	r.add(start.Add(500*time.Millisecond), 500)
+	if got := r.bytesPerSecond(start.Add(500 * time.Millisecond)); got != 0 {
+		t.Fatalf("rate within first sample = %v; want 0", got)
+	}
+	r.add(start.Add(time.Second), 500)
+	if got := r.bytesPerSecond(start.Add(time.Second)); got != 1000 {
+		t.Fatalf("rate after first sample = %v; want 1000", got)
+	}
+
+	// Later samples are smoothed in.
+	r.add(start.Add(2*time.Second), 2000)
+	if got, want := r.bytesPerSecond(start.Add(2*time.Second)), 1000+rateSmoothing*1000; got != want {
+		t.Fatalf("rate after second sample = %v; want %v", got, want)
+	}
+
+	// A stalled transfer's rate falls off.
+	before := r.rate
+	if got := r.bytesPerSecond(start.Add(4 * time.Second)); got >= before {
+		t.Fatalf("rate after stall = %v; want less than %v", got, before)
+	}
+
+	now := start.Add(10 * time.Second)
+	if got, want := eta(now, 3000, 1000, 1000), now.Add(2*time.Second); !got.Equal(want) {
+		t.Errorf("eta = %v; want %v", got, want)
+	}
+	if got := eta(now, -1, 1000, 1000); !got.IsZero() {
+		t.Errorf("eta of unknown size = %v; want zero", got)
+	}
+	if got := eta(now, 3000, 1000, 0); !got.IsZero() {
+		t.Errorf("eta at unknown rate = %v; want zero", got)
+	}
+}
+
+func TestIncomingFilesRate(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)})
+	h := &Handler{Logf: t.Logf, Clock: clock}
+	f := &incomingFile{
+		clock: h.Clock,
+		name:  "foo.bin",
+		size:  10000,
+		w:     io.Discard,
+		rate:  transferRate{sampleStart: clock.Now()},
+	}
+	f.sendFileNotify = func() {}
+	h.incomingFiles.Store(f, struct{}{})
+
+	clock.Advance(time.Second)
+	f.Write(make([]byte, 2000))
+	files := h.IncomingFiles()
+	if len(files) != 1 {
+		t.Fatalf("IncomingFiles = %+v; want 1 file", files)
+	}
+	pf := files[0]
+	if pf.BytesPerSecond != 2000 {
+		t.Errorf("BytesPerSecond = %v; want 2000", pf.BytesPerSecond)
+	}
+	if want := clock.Now().Add(4 * time.Second); pf.ETA == nil || !pf.ETA.Equal(want) {
+		t.Errorf("ETA = %v; want %v", pf.ETA, want)
+	}
+	j, err := json.Marshal(ipn.PartialFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "ETA") || strings.Contains(string(j), "BytesPerSecond") {
+		t.Errorf("unknown rate and ETA aren't omitted: %s", j)
+	}
+}
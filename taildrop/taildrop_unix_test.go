@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package taildrop
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+func TestFIFOsRefused(t *testing.T) {
+	dir := t.TempDir()
+	h := &Handler{Logf: t.Logf, Clock: tstime.StdClock{}, Dir: dir}
+	for _, base := range []string{"a.txt", "b.txt" + partialSuffix} {
+		if err := syscall.Mkfifo(filepath.Join(dir, base), 0666); err != nil {
+			t.Skipf("Mkfifo: %v", err)
+		}
+	}
+
+	// Neither of these may block waiting for the other end of the FIFO.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if rc, _, err := h.OpenFile("a.txt"); err == nil {
+			rc.Close()
+			t.Error("OpenFile opened FIFO")
+		} else if !errors.Is(err, errNotRegular) {
+			t.Errorf("OpenFile error = %v; want %v", err, errNotRegular)
+		}
+		if code := putFile(h, "b.txt", "data"); code != http.StatusInternalServerError {
+			t.Errorf("put via partial FIFO: code = %d; want %d", code, http.StatusInternalServerError)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("blocked opening FIFO")
+	}
+
+	if wf, err := h.WaitingFiles(); err != nil {
+		t.Fatal(err)
+	} else if len(wf) != 0 {
+		t.Errorf("WaitingFiles = %+v; want none", wf)
+	}
+}
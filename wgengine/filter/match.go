@@ -32,9 +32,10 @@ func (pr PortRange) String() string {
 	}
 }
 
-// contains returns whether port is in pr.
+// contains returns whether port is in pr. It's tailcfg.PortRange's
+// Contains, which avoids branching on the per-packet path.
 func (pr PortRange) contains(port uint16) bool {
-	return port >= pr.First && port <= pr.Last
+	return tailcfg.PortRange(pr).Contains(port)
 }
 
 // NetPortRange combines an IP address prefix and PortRange.
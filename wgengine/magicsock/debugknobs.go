@@ -6,6 +6,7 @@
 package magicsock
 
 import (
+	_ "tailscale.com/derp/derpzstd" // for debugDERPZstd
 	"tailscale.com/envknob"
 )
 
@@ -56,6 +57,11 @@
 	debugEnablePMTUD = envknob.RegisterOptBool("TS_DEBUG_ENABLE_PMTUD")
 	// debugPMTUD prints extra debugging about peer MTU path discovery.
 	debugPMTUD = envknob.RegisterBool("TS_DEBUG_PMTUD")
+	// debugDERPZstd advertises to DERP servers that we accept
+	// zstd-compressed packets, and compresses those we send if the
+	// server accepts them. It's off by default as WireGuard packets
+	// are encrypted and so rarely compress.
+	debugDERPZstd = envknob.RegisterBool("TS_DEBUG_DERP_ZSTD")
 	// Hey you! Adding a new debugknob? Make sure to stub it out in the
 	// debugknobs_stubs.go file too.
 )